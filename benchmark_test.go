@@ -1,9 +1,11 @@
 package vt
 
 import (
+	"fmt"
 	"testing"
 
 	"github.com/QoraNet/qoraDB/go/common"
+	"github.com/QoraNet/qoraDB/go/database/vt/memory/trie"
 	"github.com/ethereum/go-ethereum/trie/utils"
 	"github.com/ethereum/go-verkle"
 )
@@ -110,6 +112,36 @@ func Benchmark_VerkleTrie_Commit_To_LeafNode_Update_Single_Value(b *testing.B) {
 	}
 }
 
+func Benchmark_MemoryTrie_Commit_Many_Stems_Updated(b *testing.B) {
+	const numStems = 4096
+	for _, parallelism := range []int{1, 2, 4, 8} {
+		b.Run(fmt.Sprintf("parallelism=%d", parallelism), func(b *testing.B) {
+			root := &trie.Trie{}
+			root.SetParallelism(parallelism)
+			for i := 0; i < numStems; i++ {
+				key := trie.Key{byte(i), byte(i >> 8), 0x1}
+				root.Set(key, trie.Value{byte(i)})
+			}
+
+			// start with a tree with all commitments computed
+			root.Commit()
+
+			var counter int
+			for i := 0; i < b.N; i++ {
+				// update one value in every stem
+				for j := 0; j < numStems; j++ {
+					key := trie.Key{byte(j), byte(j >> 8), 0x1}
+					value := trie.Value{byte(counter), byte(counter >> 8), byte(counter >> 16), byte(counter >> 24), 0x1}
+					counter++
+					root.Set(key, value)
+				}
+
+				root.Commit() // measurement time
+			}
+		})
+	}
+}
+
 var pointHashSink []byte
 
 func Benchmark_VerkleTrie_Hash_Key_No_Cache(b *testing.B) {
@@ -1,6 +1,8 @@
 package commit
 
 import (
+	"fmt"
+
 	"github.com/QoraNet/qoraDB/go/common"
 	"github.com/crate-crypto/go-ipa/banderwagon"
 	"github.com/crate-crypto/go-ipa/ipa"
@@ -35,6 +37,25 @@ func Commit(values [VectorSize]Value) Commitment {
 	return Commitment{point: ipaConfig.Commit(elements)}
 }
 
+// CommitPrefix creates a new commitment to a vector in which the leading
+// positions hold the given values and all remaining positions are zero. The
+// result is the same as for Commit, but it is computed using precomputed
+// tables of the involved generator points instead of a multi-scalar
+// multiplication over all positions. This makes it considerably faster for
+// short inputs, like the five values hashed to derive Verkle trie keys. At
+// most VectorSize values may be provided.
+func CommitPrefix(values ...Value) Commitment {
+	res := Identity()
+	for i, value := range values {
+		if value.scalar.IsZero() {
+			continue
+		}
+		product := getPositionTable(byte(i)).mul(value)
+		res.point.Add(&res.point, &product)
+	}
+	return res
+}
+
 // IsValid checks if the commitment is valid, i.e., if it is a point on the
 // curve. Not all possible instances of Commitment are valid. If instances are
 // fetched from an untrusted source, they should be checked for validity.
@@ -72,23 +93,59 @@ func (p Commitment) Compress() [32]byte {
 	return p.point.Bytes()
 }
 
+// NewCommitmentFromCompressedBytes parses a commitment from its compressed
+// form as produced by Compress. Data not describing a valid point in the
+// Banderwagon subgroup is rejected, such that the result can be used safely
+// even if the data was received from an untrusted source.
+func NewCommitmentFromCompressedBytes(data [32]byte) (Commitment, error) {
+	var res Commitment
+	if err := res.point.SetBytes(data[:]); err != nil {
+		return Commitment{}, fmt.Errorf("invalid compressed commitment: %w", err)
+	}
+	return res, nil
+}
+
+// UncompressedBytes returns the uncompressed representation of the commitment,
+// which contains both coordinates of the curve point. It is larger than the
+// compressed form, but cheaper to decode.
+func (p Commitment) UncompressedBytes() [64]byte {
+	return p.point.BytesUncompressedTrusted()
+}
+
+// NewCommitmentFromUncompressedBytes parses a commitment from its uncompressed
+// form as produced by UncompressedBytes. Points not on the curve or outside of
+// the Banderwagon subgroup are rejected.
+func NewCommitmentFromUncompressedBytes(data [64]byte) (Commitment, error) {
+	var res Commitment
+	if err := res.point.SetBytesUncompressed(data[:], false); err != nil {
+		return Commitment{}, fmt.Errorf("invalid uncompressed commitment: %w", err)
+	}
+	if !res.IsValid() {
+		return Commitment{}, fmt.Errorf("invalid uncompressed commitment: point not on curve")
+	}
+	return res, nil
+}
+
 // Update creates a new commitment that is the same as the original, except
 // that the value at the given position is updated from old to new.
 func (c Commitment) Update(position byte, old, new Value) Commitment {
-	// This is a very inefficient way to update a commitment.
-	// Creates a new commitment of a 256-element vector containing the
-	// difference between the old and the new vector -- which is zero
-	// everywhere, except at the position of the change.
-	//
-	// It then uses the additive homomorphism property of the Pedersen commit:
+	// Using the additive homomorphism property of the Pedersen commit:
 	//   Commit(A+B) = Commit(A) + Commit(B)
-	// for vectors A and B, where + is the point addition.
-	values := [VectorSize]Value{}
-	values[position].scalar.Sub(&new.scalar, &old.scalar)
-	diff := Commit(values)
+	// for vectors A and B, where + is the point addition, the update is
+	// computed by adding the commitment of the difference between the old
+	// and the new vector. This difference is zero everywhere except at the
+	// given position, so its commitment is (new-old) * G, where G is the
+	// generator point of the position. This product is computed using a
+	// table of precomputed multiples of G.
+	var delta Value
+	delta.scalar.Sub(&new.scalar, &old.scalar)
+	if delta.scalar.IsZero() {
+		return c
+	}
+	diff := getPositionTable(position).mul(delta)
 
 	var res Commitment
-	res.point.Add(&c.point, &diff.point)
+	res.point.Add(&c.point, &diff)
 	return res
 }
 
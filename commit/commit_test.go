@@ -69,3 +69,75 @@ func TestCommitment_UpdateChangesIndividualElements(t *testing.T) {
 	require.True(modified.IsValid())
 	require.True(modified.Equal(recomputed))
 }
+
+func TestCommitment_CompressedBytes_CanBeParsed(t *testing.T) {
+	require := require.New(t)
+	for _, commitment := range []Commitment{Identity(), Commit([VectorSize]Value{NewValue(12)})} {
+		restored, err := NewCommitmentFromCompressedBytes(commitment.Compress())
+		require.NoError(err)
+		require.True(restored.Equal(commitment))
+	}
+}
+
+func TestCommitment_UncompressedBytes_CanBeParsed(t *testing.T) {
+	require := require.New(t)
+	for _, commitment := range []Commitment{Identity(), Commit([VectorSize]Value{NewValue(12)})} {
+		restored, err := NewCommitmentFromUncompressedBytes(commitment.UncompressedBytes())
+		require.NoError(err)
+		require.True(restored.Equal(commitment))
+	}
+}
+
+func TestCommitment_NewCommitmentFromCompressedBytes_RejectsInvalidPoints(t *testing.T) {
+	data := [32]byte{}
+	for i := range data {
+		data[i] = 0xff
+	}
+	_, err := NewCommitmentFromCompressedBytes(data)
+	require.Error(t, err)
+}
+
+func TestCommitment_NewCommitmentFromUncompressedBytes_RejectsInvalidPoints(t *testing.T) {
+	data := Commit([VectorSize]Value{NewValue(12)}).UncompressedBytes()
+	data[40] ^= 0x01 // modify the y coordinate
+	_, err := NewCommitmentFromUncompressedBytes(data)
+	require.Error(t, err)
+}
+
+func TestCommitment_UpdateMatchesRecomputationForAllPositions(t *testing.T) {
+	require := require.New(t)
+
+	values := [VectorSize]Value{}
+	for i := range uint64(VectorSize) {
+		values[i] = NewValue(i * i)
+	}
+	commitment := Commit(values)
+
+	for i := range VectorSize {
+		old := values[i]
+		values[i] = NewValueFromLittleEndianBytes([]byte{byte(i), 0xff, 0xfe, 31: 0x0f})
+		commitment = commitment.Update(byte(i), old, values[i])
+	}
+	require.True(commitment.Equal(Commit(values)))
+}
+
+func TestCommitment_UpdateWithEqualValuesHasNoEffect(t *testing.T) {
+	commitment := Commit([VectorSize]Value{NewValue(12)})
+	updated := commitment.Update(0, NewValue(12), NewValue(12))
+	require.True(t, updated.Equal(commitment))
+}
+
+func TestCommitment_CommitPrefixMatchesCommit(t *testing.T) {
+	require := require.New(t)
+
+	prefixes := [][]Value{
+		{},
+		{NewValue(1)},
+		{NewValue(2 + 256*64), NewValue(0), NewValue(12), NewValueFromLittleEndianBytes([]byte{1, 2, 3, 31: 0xff}), NewValue(42)},
+	}
+	for _, prefix := range prefixes {
+		values := [VectorSize]Value{}
+		copy(values[:], prefix)
+		require.True(CommitPrefix(prefix...).Equal(Commit(values)), "prefix=%v", prefix)
+	}
+}
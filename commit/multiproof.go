@@ -0,0 +1,130 @@
+package commit
+
+import (
+	"fmt"
+
+	multiproof "github.com/crate-crypto/go-ipa"
+	"github.com/crate-crypto/go-ipa/bandersnatch/fr"
+	"github.com/crate-crypto/go-ipa/banderwagon"
+	"github.com/crate-crypto/go-ipa/common"
+)
+
+// Claim states that a commitment has a given value at a given position. It is
+// the statement proven by an Opening or, aggregated with other claims, by a
+// MultiOpening.
+type Claim struct {
+	Commitment Commitment
+	Position   byte
+	Value      Value
+}
+
+// Query requests a position of a committed vector to be covered by a
+// MultiOpening. In addition to the commitment and the position, the full
+// vector committed to is required to create the proof.
+type Query struct {
+	Commitment Commitment
+	Values     [VectorSize]Value
+	Position   byte
+}
+
+// MultiOpening is a single, constant-size proof for an arbitrary number of
+// claims, each stating that a commitment has a specific value at a specific
+// position. It aggregates the claims into a single polynomial evaluation,
+// which is then proven using an Inner Product Argument (IPA).
+// Details: https://dankradfeist.de/ethereum/2021/06/18/pcs-multiproofs.html
+type MultiOpening struct {
+	proof multiproof.MultiProof
+}
+
+// OpenMulti creates a single opening covering all the given queries. At least
+// one query is required.
+func OpenMulti(queries ...Query) (MultiOpening, error) {
+	if len(queries) == 0 {
+		return MultiOpening{}, fmt.Errorf("no queries to open")
+	}
+
+	commitments := make([]*banderwagon.Element, len(queries))
+	vectors := make([][]fr.Element, len(queries))
+	positions := make([]uint8, len(queries))
+	for i := range queries {
+		query := &queries[i]
+		commitments[i] = &query.Commitment.point
+		vectors[i] = make([]fr.Element, VectorSize)
+		for j, value := range query.Values {
+			vectors[i][j] = value.scalar
+		}
+		positions[i] = query.Position
+	}
+
+	transcript := common.NewTranscript("vt")
+	proof, err := multiproof.CreateMultiProof(
+		transcript,
+		ipaConfig,
+		commitments,
+		vectors,
+		positions,
+	)
+	if err != nil {
+		return MultiOpening{}, err
+	}
+	return MultiOpening{proof: *proof}, nil
+}
+
+// Verify checks if the opening proves all of the given claims. The claims must
+// be provided in the same order as the queries the opening was created for.
+// It returns true if the opening is valid, false otherwise.
+func (o MultiOpening) Verify(claims ...Claim) (bool, error) {
+	if len(claims) == 0 {
+		return false, nil
+	}
+
+	commitments := make([]*banderwagon.Element, len(claims))
+	values := make([]*fr.Element, len(claims))
+	positions := make([]uint8, len(claims))
+	for i := range claims {
+		claim := &claims[i]
+		commitments[i] = &claim.Commitment.point
+		values[i] = &claim.Value.scalar
+		positions[i] = claim.Position
+	}
+
+	transcript := common.NewTranscript("vt")
+	return multiproof.CheckMultiProof(
+		transcript,
+		ipaConfig,
+		&o.proof,
+		commitments,
+		values,
+		positions,
+	)
+}
+
+// MultiOpeningSize is the size of the byte encoding of a MultiOpening.
+const MultiOpeningSize = 32 + OpeningSize
+
+// Bytes returns the byte encoding of the multi-opening. It consists of the
+// compressed commitment to the aggregated quotient polynomial followed by the
+// encoding of the IPA proof of its evaluation.
+func (o MultiOpening) Bytes() [MultiOpeningSize]byte {
+	res := [MultiOpeningSize]byte{}
+	d := o.proof.D.Bytes()
+	copy(res[:32], d[:])
+	writeIpaProof(res[32:], &o.proof.IPA)
+	return res
+}
+
+// NewMultiOpeningFromBytes parses a multi-opening from its byte encoding as
+// produced by Bytes. Encodings containing invalid points or scalars are
+// rejected.
+func NewMultiOpeningFromBytes(data [MultiOpeningSize]byte) (MultiOpening, error) {
+	var res MultiOpening
+	if err := res.proof.D.SetBytes(data[:32]); err != nil {
+		return MultiOpening{}, fmt.Errorf("invalid multi-opening point D: %w", err)
+	}
+	proof, err := readIpaProof(data[32:])
+	if err != nil {
+		return MultiOpening{}, err
+	}
+	res.proof.IPA = proof
+	return res, nil
+}
@@ -0,0 +1,113 @@
+package commit
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMultiOpening_CoversClaimsOfMultipleCommitments(t *testing.T) {
+	require := require.New(t)
+
+	vectors := [3][VectorSize]Value{}
+	commitments := [3]Commitment{}
+	for i := range vectors {
+		for j := range uint64(VectorSize) {
+			vectors[i][j] = NewValue(uint64(i)*VectorSize + j + 1)
+		}
+		commitments[i] = Commit(vectors[i])
+	}
+
+	queries := []Query{}
+	claims := []Claim{}
+	for i := range vectors {
+		for _, position := range []byte{0, 7, 255} {
+			queries = append(queries, Query{
+				Commitment: commitments[i],
+				Values:     vectors[i],
+				Position:   position,
+			})
+			claims = append(claims, Claim{
+				Commitment: commitments[i],
+				Position:   position,
+				Value:      vectors[i][position],
+			})
+		}
+	}
+
+	opening, err := OpenMulti(queries...)
+	require.NoError(err, "Opening should not return an error")
+
+	valid, err := opening.Verify(claims...)
+	require.NoError(err, "Verification should not return an error")
+	require.True(valid, "Opening should verify for committed values")
+
+	// Modifying any of the claimed values should invalidate the proof.
+	for i := range claims {
+		modified := append([]Claim{}, claims...)
+		modified[i].Value = NewValue(0)
+		valid, err := opening.Verify(modified...)
+		require.NoError(err, "Verification should not return an error")
+		require.False(valid, "Opening should not verify for different value in claim %d", i)
+	}
+}
+
+func TestMultiOpening_FailsForDifferentPositions(t *testing.T) {
+	require := require.New(t)
+
+	values := [VectorSize]Value{}
+	for i := range uint64(VectorSize) {
+		values[i] = NewValue(42)
+	}
+	commitment := Commit(values)
+
+	opening, err := OpenMulti(Query{Commitment: commitment, Values: values, Position: 1})
+	require.NoError(err)
+
+	valid, err := opening.Verify(Claim{Commitment: commitment, Position: 1, Value: NewValue(42)})
+	require.NoError(err)
+	require.True(valid)
+
+	valid, err = opening.Verify(Claim{Commitment: commitment, Position: 2, Value: NewValue(42)})
+	require.NoError(err)
+	require.False(valid, "Opening should not verify for a different position")
+}
+
+func TestMultiOpening_RequiresAtLeastOneQuery(t *testing.T) {
+	_, err := OpenMulti()
+	require.Error(t, err)
+
+	valid, err := MultiOpening{}.Verify()
+	require.NoError(t, err)
+	require.False(t, valid)
+}
+
+func TestMultiOpening_Bytes_CanBeParsed(t *testing.T) {
+	require := require.New(t)
+	values := [VectorSize]Value{NewValue(1), NewValue(2)}
+	commitment := Commit(values)
+
+	opening, err := OpenMulti(
+		Query{Commitment: commitment, Values: values, Position: 0},
+		Query{Commitment: commitment, Values: values, Position: 1},
+	)
+	require.NoError(err)
+
+	restored, err := NewMultiOpeningFromBytes(opening.Bytes())
+	require.NoError(err)
+	require.Equal(opening.Bytes(), restored.Bytes())
+
+	valid, err := restored.Verify(
+		Claim{Commitment: commitment, Position: 0, Value: NewValue(1)},
+		Claim{Commitment: commitment, Position: 1, Value: NewValue(2)},
+	)
+	require.NoError(err)
+	require.True(valid)
+
+	data := opening.Bytes()
+	for i := range 32 {
+		data[i] = 0xff
+	}
+	_, err = NewMultiOpeningFromBytes(data)
+	require.Error(err)
+}
@@ -0,0 +1,77 @@
+package commit
+
+import (
+	"sync"
+
+	"github.com/crate-crypto/go-ipa/banderwagon"
+)
+
+// windowBits is the number of bits of a scalar covered by a single lookup in
+// a positionTable. Larger windows reduce the number of point additions per
+// multiplication at the expense of exponentially larger tables.
+const windowBits = 4
+
+// numWindows is the number of windows required to cover a full 256-bit
+// scalar.
+const numWindows = 256 / windowBits
+
+// positionTable contains precomputed multiples of the generator point of a
+// single position of the committed vector. The entry [w][k] is the point
+//
+//	k * 2^(w*windowBits) * G
+//
+// where G is the generator point of the position. Using this table, the
+// multiplication of G with an arbitrary scalar requires only numWindows point
+// additions and no point doublings.
+type positionTable [numWindows][1 << windowBits]banderwagon.Element
+
+// positionTables contains the tables for all positions of the committed
+// vector. Tables are computed lazily on first use, since each of them
+// occupies about 100 KB of memory and positions are not uniformly used.
+var positionTables [VectorSize]struct {
+	once  sync.Once
+	table *positionTable
+}
+
+// getPositionTable returns the table of precomputed multiples of the generator
+// point of the given position, computing it if necessary.
+func getPositionTable(position byte) *positionTable {
+	entry := &positionTables[position]
+	entry.once.Do(func() {
+		entry.table = newPositionTable(ipaConfig.SRS[position])
+	})
+	return entry.table
+}
+
+// newPositionTable computes the table of precomputed multiples of the given
+// generator point.
+func newPositionTable(generator banderwagon.Element) *positionTable {
+	res := &positionTable{}
+	base := generator
+	for w := range numWindows {
+		res[w][0] = banderwagon.Identity
+		for k := 1; k < 1<<windowBits; k++ {
+			res[w][k].Add(&res[w][k-1], &base)
+		}
+		// The base of the next window is 2^windowBits times the current base.
+		base.Add(&res[w][(1<<windowBits)-1], &base)
+	}
+	return res
+}
+
+// mul computes the product of the scalar of the given value and the generator
+// point this table has been created for.
+func (t *positionTable) mul(value Value) banderwagon.Element {
+	bytes := value.scalar.Bytes() // big-endian, in regular form
+	res := banderwagon.Identity
+	for w := range numWindows {
+		// Each byte of the scalar covers two windows, starting with the
+		// least significant byte.
+		b := bytes[len(bytes)-1-w/2]
+		k := (b >> ((w % 2) * windowBits)) & ((1 << windowBits) - 1)
+		if k != 0 {
+			res.Add(&res, &t[w][k])
+		}
+	}
+	return res
+}
@@ -1,7 +1,10 @@
 package commit
 
 import (
+	"fmt"
+
 	"github.com/crate-crypto/go-ipa/bandersnatch/fr"
+	"github.com/crate-crypto/go-ipa/banderwagon"
 	"github.com/crate-crypto/go-ipa/common"
 	"github.com/crate-crypto/go-ipa/ipa"
 )
@@ -58,3 +61,73 @@ func (o Opening) Verify(
 		value.scalar,
 	)
 }
+
+// openingRounds is the number of rounds of the IPA proof of an opening, which
+// is the logarithm of the VectorSize. Each round contributes two points to
+// the proof.
+const openingRounds = 8
+
+// OpeningSize is the size of the byte encoding of an Opening.
+const OpeningSize = 2*openingRounds*32 + 32
+
+// Bytes returns the byte encoding of the opening. It consists of the
+// compressed points of the left and right halves of all IPA rounds followed
+// by the final scalar of the proof.
+func (o Opening) Bytes() [OpeningSize]byte {
+	res := [OpeningSize]byte{}
+	writeIpaProof(res[:], &o.proof)
+	return res
+}
+
+// NewOpeningFromBytes parses an opening from its byte encoding as produced by
+// Bytes. Encodings containing invalid points or scalars are rejected, such that
+// openings received from untrusted sources can be verified safely.
+func NewOpeningFromBytes(data [OpeningSize]byte) (Opening, error) {
+	proof, err := readIpaProof(data[:])
+	if err != nil {
+		return Opening{}, err
+	}
+	return Opening{proof: proof}, nil
+}
+
+// writeIpaProof writes the encoding of the given IPA proof into the given
+// buffer, which must be at least OpeningSize bytes long.
+func writeIpaProof(buffer []byte, proof *ipa.IPAProof) {
+	for i := range openingRounds {
+		var l, r [32]byte
+		if i < len(proof.L) {
+			l = proof.L[i].Bytes()
+		}
+		if i < len(proof.R) {
+			r = proof.R[i].Bytes()
+		}
+		copy(buffer[i*32:], l[:])
+		copy(buffer[(openingRounds+i)*32:], r[:])
+	}
+	scalar := proof.A_scalar.BytesLE()
+	copy(buffer[2*openingRounds*32:], scalar[:])
+}
+
+// readIpaProof parses an IPA proof from the given buffer, which must be at
+// least OpeningSize bytes long.
+func readIpaProof(buffer []byte) (ipa.IPAProof, error) {
+	proof := ipa.IPAProof{
+		L: make([]banderwagon.Element, openingRounds),
+		R: make([]banderwagon.Element, openingRounds),
+	}
+	for i := range openingRounds {
+		if err := proof.L[i].SetBytes(buffer[i*32 : (i+1)*32]); err != nil {
+			return ipa.IPAProof{}, fmt.Errorf("invalid opening point L[%d]: %w", i, err)
+		}
+		offset := (openingRounds + i) * 32
+		if err := proof.R[i].SetBytes(buffer[offset : offset+32]); err != nil {
+			return ipa.IPAProof{}, fmt.Errorf("invalid opening point R[%d]: %w", i, err)
+		}
+	}
+	scalar, err := NewValueFromCanonicalBytes([32]byte(buffer[2*openingRounds*32:]))
+	if err != nil {
+		return ipa.IPAProof{}, fmt.Errorf("invalid opening scalar: %w", err)
+	}
+	proof.A_scalar = scalar.scalar
+	return proof, nil
+}
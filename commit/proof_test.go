@@ -37,3 +37,44 @@ func TestCommitment_CommittedValuesCanBeUsedToProofValues(t *testing.T) {
 		})
 	}
 }
+
+func TestOpening_Bytes_CanBeParsed(t *testing.T) {
+	require := require.New(t)
+	values := [VectorSize]Value{}
+	for i := range uint64(VectorSize) {
+		values[i] = NewValue(i + 1)
+	}
+	commitment := Commit(values)
+
+	opening, err := Open(commitment, values, 12)
+	require.NoError(err)
+
+	restored, err := NewOpeningFromBytes(opening.Bytes())
+	require.NoError(err)
+	require.Equal(opening.Bytes(), restored.Bytes())
+
+	valid, err := restored.Verify(commitment, 12, values[12])
+	require.NoError(err)
+	require.True(valid, "Restored opening should verify for committed value")
+}
+
+func TestOpening_NewOpeningFromBytes_RejectsInvalidEncodings(t *testing.T) {
+	values := [VectorSize]Value{NewValue(1)}
+	opening, err := Open(Commit(values), values, 0)
+	require.NoError(t, err)
+
+	tests := map[string]int{
+		"invalid point":  0,
+		"invalid scalar": OpeningSize - 32,
+	}
+	for name, offset := range tests {
+		t.Run(name, func(t *testing.T) {
+			data := opening.Bytes()
+			for i := range 32 {
+				data[offset+i] = 0xff
+			}
+			_, err := NewOpeningFromBytes(data)
+			require.Error(t, err)
+		})
+	}
+}
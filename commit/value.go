@@ -2,6 +2,8 @@
 package commit
 
 import (
+	"fmt"
+
 	"github.com/crate-crypto/go-ipa/banderwagon"
 )
 
@@ -35,6 +37,24 @@ func NewValueFromLittleEndianBytes(data []byte) Value {
 	return Value{scalar: scalar}
 }
 
+// NewValueFromCanonicalBytes parses a value from its 32-byte little-endian
+// encoding as produced by Bytes. Unlike NewValueFromLittleEndianBytes, inputs
+// exceeding the value range are rejected instead of being reduced, such that
+// every value has exactly one valid encoding.
+func NewValueFromCanonicalBytes(data [32]byte) (Value, error) {
+	var scalar banderwagon.Fr
+	scalar.SetBytesLE(data[:])
+	if scalar.BytesLE() != data {
+		return Value{}, fmt.Errorf("invalid value encoding: exceeds scalar field")
+	}
+	return Value{scalar: scalar}, nil
+}
+
+// Bytes returns the canonical 32-byte little-endian encoding of the value.
+func (v Value) Bytes() [32]byte {
+	return v.scalar.BytesLE()
+}
+
 // SetBit128 sets the 128th bit of the value to 1. This is a special bit used
 // in the Verkle trie to indicate that the value is used. Thus, this operation
 // is provided as a convenience method.
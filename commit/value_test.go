@@ -85,3 +85,21 @@ func TestValue_SetBit128(t *testing.T) {
 	require.Equal([32]byte{15: 1, 24: 0xf1, 0xf2, 0xf3, 0xf4, 0xf5, 0xf6, 0xf7, 0xf8},
 		v.scalar.Bytes(), "128th bit should be set without changing other bits")
 }
+
+func TestValue_Bytes_CanBeParsed(t *testing.T) {
+	require := require.New(t)
+	for _, value := range []Value{NewValue(0), NewValue(1), NewValue(math.MaxUint64)} {
+		restored, err := NewValueFromCanonicalBytes(value.Bytes())
+		require.NoError(err)
+		require.Equal(value, restored)
+	}
+}
+
+func TestValue_NewValueFromCanonicalBytes_RejectsValuesOutOfRange(t *testing.T) {
+	data := [32]byte{}
+	for i := range data {
+		data[i] = 0xff
+	}
+	_, err := NewValueFromCanonicalBytes(data)
+	require.Error(t, err)
+}
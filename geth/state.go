@@ -16,7 +16,7 @@ import (
 	"github.com/ethereum/go-ethereum/core/types"
 	"github.com/ethereum/go-ethereum/trie"
 	"github.com/ethereum/go-ethereum/trie/utils"
-	"github.com/ethereum/go-ethereum/triedb/database"
+	"github.com/ethereum/go-verkle"
 
 	ethcommon "github.com/ethereum/go-ethereum/common"
 )
@@ -27,7 +27,9 @@ import (
 // This state is experimental, stores data in-memory only,
 // and not intended for production use.
 func NewState(params state.Parameters) (state.State, error) {
-	return newState(params, nil)
+	// Nodes are only written to the in-memory source when keys are deleted,
+	// see deleteKeys.
+	return newState(params, newMemorySource())
 }
 
 // NewStateWithSource creates a new verkle state where the whole trie
@@ -36,16 +38,15 @@ func NewState(params state.Parameters) (state.State, error) {
 // This state is experimental, stores data in-memory only,
 // and not intended for production use.
 func NewStateWithSource(params state.Parameters, nodeSource NodeSource) (state.State, error) {
-	source := singleNodeReader{source: nodeSource}
-	vs, err := newState(params, source)
+	vs, err := newState(params, nodeSource)
 	if err != nil {
 		return nil, err
 	}
-
-	return &persistentVerkleState{*vs, source}, nil
+	return &persistentVerkleState{*vs}, nil
 }
 
-func newState(_ state.Parameters, source database.NodeDatabase) (*verkleState, error) {
+func newState(_ state.Parameters, nodeSource NodeSource) (*verkleState, error) {
+	source := singleNodeReader{source: nodeSource}
 	pointCache := utils.NewPointCache(4096)
 	vt, err := trie.NewVerkleTrie(ethcommon.Hash{}, source, pointCache)
 	if err != nil {
@@ -54,7 +55,9 @@ func newState(_ state.Parameters, source database.NodeDatabase) (*verkleState, e
 	return &verkleState{
 		pointCache: pointCache,
 		verkle:     vt,
+		source:     source,
 		codes:      make(map[common.Address][]byte),
+		slots:      make(map[common.Address]map[common.Key]struct{}),
 	}, nil
 }
 
@@ -64,11 +67,37 @@ func newState(_ state.Parameters, source database.NodeDatabase) (*verkleState, e
 type verkleState struct {
 	pointCache *utils.PointCache
 	verkle     *trie.VerkleTrie
-	codes      map[common.Address][]byte // current Verkle Trie does not support code retrieval, so we use a map to store codes
+	source     singleNodeReader                           // nodes of the trie written by commitNodes
+	codes      map[common.Address][]byte                  // current Verkle Trie does not support code retrieval, so we use a map to store codes
+	slots      map[common.Address]map[common.Key]struct{} // storage keys written per account, needed to wipe storage on account deletion
 }
 
 func (s *verkleState) DeleteAccount(address common.Address) error {
-	return fmt.Errorf("not supported: verkle trie does not support deleting accounts")
+	// Storage slots outside the account header are located in other stems.
+	// The Geth Verkle Trie can only overwrite them with zeros, which still
+	// contribute to the commitment. Thus, they are removed from the trie
+	// directly, like the memory backend does.
+	if len(s.slots[address]) > 0 {
+		keys := make([][]byte, 0, len(s.slots[address]))
+		for key := range s.slots[address] {
+			keys = append(keys, utils.StorageSlotKeyWithEvaluatedAddress(s.pointCache.Get(address[:]), key[:]))
+		}
+		if err := s.deleteKeys(keys); err != nil {
+			return err
+		}
+	}
+	delete(s.slots, address)
+	delete(s.codes, address)
+
+	account, err := s.verkle.GetAccount(ethcommon.Address(address))
+	if account == nil || err != nil {
+		return err
+	}
+
+	// Removes the account header stem, covering the basic data, the code
+	// hash, the first 64 storage slots and the first 128 code chunks, as
+	// well as all stems holding further code chunks.
+	return s.verkle.RollBackAccount(ethcommon.Address(address))
 }
 
 func (s *verkleState) SetNonce(address common.Address, nonce common.Nonce) error {
@@ -88,7 +117,16 @@ func (s *verkleState) SetNonce(address common.Address, nonce common.Nonce) error
 }
 
 func (s *verkleState) SetStorage(address common.Address, key common.Key, value common.Value) error {
-	return s.verkle.UpdateStorage(ethcommon.Address(address), key[:], value[:])
+	if err := s.verkle.UpdateStorage(ethcommon.Address(address), key[:], value[:]); err != nil {
+		return err
+	}
+
+	// track the key for wiping the storage on account deletion
+	if s.slots[address] == nil {
+		s.slots[address] = make(map[common.Key]struct{})
+	}
+	s.slots[address][key] = struct{}{}
+	return nil
 }
 
 func (s *verkleState) SetCode(address common.Address, code []byte) error {
@@ -282,6 +320,77 @@ func (s *verkleState) Close() error {
 	return nil
 }
 
+// commitNodes writes all nodes modified since the last call to the node
+// source and recreates the verkle trie from there, flushing the in-memory
+// nodes.
+func (s *verkleState) commitNodes() error {
+	rootHash, nodeSet := s.verkle.Commit(false)
+	var errs []error
+	for path, node := range nodeSet.Nodes {
+		errs = append(errs, s.source.getSource().set([]byte(path), node.Blob))
+	}
+	if err := errors.Join(errs...); err != nil {
+		return err
+	}
+	return s.reopen(rootHash)
+}
+
+// reopen recreates the verkle trie with the given root from the node source.
+func (s *verkleState) reopen(rootHash ethcommon.Hash) error {
+	vt, err := trie.NewVerkleTrie(rootHash, s.source, s.pointCache)
+	if err != nil {
+		return err
+	}
+	s.verkle = vt
+	return nil
+}
+
+// deleteKeys removes the given keys from the trie. The Geth Verkle Trie
+// neither supports deleting individual keys nor exposes its root node. Thus,
+// the trie is committed to the node source, from which a root node of our
+// own is loaded. The keys are deleted through this root, whose modified
+// nodes are written back to the source before the trie is recreated from
+// the new root.
+func (s *verkleState) deleteKeys(keys [][]byte) error {
+	if err := s.commitNodes(); err != nil {
+		return err
+	}
+	source := s.source.getSource()
+	blob, err := source.Node(ethcommon.Hash{}, nil, ethcommon.Hash{})
+	if err != nil || len(blob) == 0 {
+		return err // an empty trie contains no keys to delete
+	}
+	node, err := verkle.ParseNode(blob, 0)
+	if err != nil {
+		return err
+	}
+	root, ok := node.(*verkle.InternalNode)
+	if !ok {
+		return fmt.Errorf("unexpected type of root node: %T", node)
+	}
+	resolver := func(path []byte) ([]byte, error) {
+		return source.Node(ethcommon.Hash{}, path, ethcommon.Hash{})
+	}
+	for _, key := range keys {
+		if _, err := root.Delete(key, resolver); err != nil {
+			return err
+		}
+	}
+
+	nodes, err := root.BatchSerialize()
+	if err != nil {
+		return err
+	}
+	var errs []error
+	for _, node := range nodes {
+		errs = append(errs, source.set(node.Path, node.SerializedBytes))
+	}
+	if err := errors.Join(errs...); err != nil {
+		return err
+	}
+	return s.reopen(ethcommon.Hash(root.Commit().Bytes()))
+}
+
 func (s *verkleState) getAccount(address common.Address) (*types.StateAccount, error) {
 	account, err := s.verkle.GetAccount(ethcommon.Address(address))
 	if err != nil {
@@ -299,32 +408,34 @@ func (s *verkleState) getAccount(address common.Address) (*types.StateAccount, e
 // This is a reference implementation to compare with the original Geth.
 type persistentVerkleState struct {
 	verkleState
-	source singleNodeReader
 }
 
 func (s *persistentVerkleState) Apply(block uint64, update common.Update) error {
-	if err := update.ApplyTo(s); err != nil {
-		return err
+	// The storage keys written for accounts are persisted along with the
+	// nodes, such that the storage of accounts written before the state was
+	// reopened is wiped on deletion as well.
+	accounts := getStorageAccounts(update)
+	for _, address := range accounts {
+		if err := s.loadSlots(address); err != nil {
+			return err
+		}
 	}
-
-	rootHash, nodeSet := s.verkle.Commit(false)
-	var errs []error
-	for path, node := range nodeSet.Nodes {
-		errs = append(errs, s.source.getSource().set([]byte(path), node.Blob))
+	written := s.getNewSlots(update)
+	numDeleted := make(map[common.Address]int, len(update.DeletedAccounts))
+	for _, address := range update.DeletedAccounts {
+		numDeleted[address] = len(s.slots[address])
 	}
 
-	if err := errors.Join(errs...); err != nil {
+	if err := update.ApplyTo(s); err != nil {
 		return err
 	}
 
-	// recreate the verkle trie to flush the in-memory nodes
-	vt, err := trie.NewVerkleTrie(rootHash, s.source, s.pointCache)
-	if err != nil {
+	if err := s.storeSlots(numDeleted, written); err != nil {
 		return err
 	}
-	s.verkle = vt
 
-	return nil
+	// write the nodes and recreate the verkle trie to flush the in-memory nodes
+	return s.commitNodes()
 }
 
 func (s *persistentVerkleState) Flush() error {
@@ -337,3 +448,124 @@ func (s *persistentVerkleState) Close() error {
 		s.source.getSource().Close(),
 	)
 }
+
+// slotsPathPrefix is the prefix of the paths under which the storage keys
+// written per account are stored in node sources. For each account, the
+// number of written keys is stored at the prefix followed by the address,
+// and the keys are stored one by one at this path followed by their index.
+// Resulting paths are longer than the paths of any node, so they do not
+// collide with nodes.
+const slotsPathPrefix = "written-slots/"
+
+func getSlotsPath(address common.Address) []byte {
+	return append([]byte(slotsPathPrefix), address[:]...)
+}
+
+func getSlotPath(address common.Address, index int) []byte {
+	return binary.BigEndian.AppendUint64(getSlotsPath(address), uint64(index))
+}
+
+// loadSlots loads the storage keys written for the given account from the
+// node source, unless they are already known.
+func (s *persistentVerkleState) loadSlots(address common.Address) error {
+	if _, found := s.slots[address]; found {
+		return nil
+	}
+	source := s.source.getSource()
+	data, err := source.Node(ethcommon.Hash{}, getSlotsPath(address), ethcommon.Hash{})
+	if err != nil {
+		return err
+	}
+	var numSlots uint64
+	if len(data) != 0 {
+		if len(data) != 8 {
+			return fmt.Errorf("invalid length of number of written slots of account %x: %d", address, len(data))
+		}
+		numSlots = binary.BigEndian.Uint64(data)
+	}
+	slots := make(map[common.Key]struct{}, min(numSlots, 1<<16))
+	for i := range int(numSlots) {
+		data, err := source.Node(ethcommon.Hash{}, getSlotPath(address, i), ethcommon.Hash{})
+		if err != nil {
+			return err
+		}
+		if len(data) != len(common.Key{}) {
+			return fmt.Errorf("invalid length of written slot %d of account %x: %d", i, address, len(data))
+		}
+		slots[common.Key(data)] = struct{}{}
+	}
+	s.slots[address] = slots
+	return nil
+}
+
+// getNewSlots returns the storage keys written by the given update which
+// were not written before, in the order of the update. The storage of deleted
+// accounts is wiped before slots are written, so all their keys are new.
+func (s *persistentVerkleState) getNewSlots(update common.Update) map[common.Address][]common.Key {
+	deleted := make(map[common.Address]struct{}, len(update.DeletedAccounts))
+	for _, address := range update.DeletedAccounts {
+		deleted[address] = struct{}{}
+	}
+	seen := make(map[common.Address]map[common.Key]struct{})
+	res := make(map[common.Address][]common.Key)
+	for _, slot := range update.Slots {
+		if _, found := deleted[slot.Account]; !found {
+			if _, found := s.slots[slot.Account][slot.Key]; found {
+				continue
+			}
+		}
+		if seen[slot.Account] == nil {
+			seen[slot.Account] = make(map[common.Key]struct{})
+		}
+		if _, found := seen[slot.Account][slot.Key]; found {
+			continue
+		}
+		seen[slot.Account][slot.Key] = struct{}{}
+		res[slot.Account] = append(res[slot.Account], slot.Key)
+	}
+	return res
+}
+
+// storeSlots updates the storage keys persisted in the node source. The
+// entries of deleted accounts, whose number is given, are removed and the
+// newly written keys are appended to the entries of their accounts.
+func (s *persistentVerkleState) storeSlots(numDeleted map[common.Address]int, written map[common.Address][]common.Key) error {
+	source := s.source.getSource()
+	var errs []error
+	for address, count := range numDeleted {
+		for i := range count {
+			errs = append(errs, source.set(getSlotPath(address, i), nil))
+		}
+		if _, found := written[address]; !found {
+			errs = append(errs, source.set(getSlotsPath(address), nil))
+		}
+	}
+	for address, keys := range written {
+		numSlots := len(s.slots[address])
+		for i, key := range keys {
+			errs = append(errs, source.set(getSlotPath(address, numSlots-len(keys)+i), key[:]))
+		}
+		errs = append(errs, source.set(getSlotsPath(address), binary.BigEndian.AppendUint64(nil, uint64(numSlots))))
+	}
+	return errors.Join(errs...)
+}
+
+// getStorageAccounts returns the accounts whose storage is modified or wiped
+// by the given update.
+func getStorageAccounts(update common.Update) []common.Address {
+	seen := make(map[common.Address]struct{})
+	var res []common.Address
+	add := func(address common.Address) {
+		if _, found := seen[address]; !found {
+			seen[address] = struct{}{}
+			res = append(res, address)
+		}
+	}
+	for _, address := range update.DeletedAccounts {
+		add(address)
+	}
+	for _, slot := range update.Slots {
+		add(slot.Account)
+	}
+	return res
+}
@@ -2,15 +2,18 @@ package geth
 
 import (
 	"bytes"
+	"encoding/binary"
 	"fmt"
 	"testing"
 
 	"github.com/QoraNet/qoraDB/go/backend"
 	"github.com/QoraNet/qoraDB/go/common"
 	"github.com/QoraNet/qoraDB/go/common/amount"
+	"github.com/QoraNet/qoraDB/go/database/vt/memory"
 	"github.com/QoraNet/qoraDB/go/state"
 	ethcommon "github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/trie/utils"
 	"github.com/stretchr/testify/require"
 )
 
@@ -240,14 +243,267 @@ func TestState_GetArchiveBlockHeight_ReturnsNoArchiveError(t *testing.T) {
 	}
 }
 
-func TestState_DeletedAccount_Unsupported(t *testing.T) {
+func TestState_DeletedAccount_IsWiped(t *testing.T) {
+	for name, stateInit := range initTestedState() {
+		t.Run(name, func(t *testing.T) {
+			st := stateInit(state.Parameters{}, t)
+			addr := common.Address{1}
+			key := common.Key{31: 1}
+			require.NoError(t, st.Apply(0, common.Update{
+				CreatedAccounts: []common.Address{addr},
+				Balances:        []common.BalanceUpdate{{Account: addr, Balance: amount.New(12)}},
+				Nonces:          []common.NonceUpdate{{Account: addr, Nonce: common.ToNonce(1)}},
+				Codes:           []common.CodeUpdate{{Account: addr, Code: make([]byte, 10_000)}},
+				Slots:           []common.SlotUpdate{{Account: addr, Key: key, Value: common.Value{1}}},
+			}), "failed to apply update")
+
+			require.NoError(t, st.Apply(1, common.Update{
+				DeletedAccounts: []common.Address{addr},
+			}), "failed to delete account")
+
+			exists, err := st.Exists(addr)
+			require.NoError(t, err, "failed to check existence")
+			require.False(t, exists, "deleted account should not exist")
+			code, err := st.GetCode(addr)
+			require.NoError(t, err, "failed to get code")
+			require.Empty(t, code, "deleted account should have no code")
+			value, err := st.GetStorage(addr, key)
+			require.NoError(t, err, "failed to get storage")
+			require.Equal(t, common.Value{}, value, "deleted account should have empty storage")
+		})
+	}
+}
+
+func TestState_DeletedAccount_HashMatchesMemoryBackend(t *testing.T) {
+	// The accounts cover storage slots in the account header as well as in
+	// the main storage, and code exceeding the account header.
+	createAccount := func(address common.Address) common.Update {
+		return common.Update{
+			CreatedAccounts: []common.Address{address},
+			Balances:        []common.BalanceUpdate{{Account: address, Balance: amount.New(1)}},
+			Nonces:          []common.NonceUpdate{{Account: address, Nonce: common.ToNonce(2)}},
+			Codes:           []common.CodeUpdate{{Account: address, Code: []byte{3 * 256 * 32: 1}}},
+			Slots: []common.SlotUpdate{
+				{Account: address, Key: common.Key{31: 3}, Value: common.Value{4}},
+				{Account: address, Key: common.Key{5}, Value: common.Value{6}},
+			},
+		}
+	}
+	updates := []common.Update{
+		createAccount(common.Address{1}),
+		createAccount(common.Address{2}),
+		{DeletedAccounts: []common.Address{{1}}},
+		createAccount(common.Address{1}),
+		{DeletedAccounts: []common.Address{{1}, {2}}},
+	}
+
+	for name, stateInit := range initTestedState() {
+		t.Run(name, func(t *testing.T) {
+			st := stateInit(state.Parameters{}, t)
+			reference, err := memory.NewState(state.Parameters{})
+			require.NoError(t, err, "failed to create memory state")
+			defer reference.Close()
+
+			for i, update := range updates {
+				require.NoError(t, st.Apply(uint64(i), update), "failed to apply block %d", i)
+				require.NoError(t, reference.Apply(uint64(i), update), "failed to apply block %d", i)
+
+				want, err := reference.GetHash()
+				require.NoError(t, err, "failed to get hash")
+				got, err := st.GetHash()
+				require.NoError(t, err, "failed to get hash")
+				require.Equal(t, want, got, "hash mismatch after block %d", i)
+			}
+		})
+	}
+}
+
+func TestState_DeletedAccount_StemsSharingPrefixes_HashMatchesMemoryBackend(t *testing.T) {
+	// Each account gets many storage stems, such that stems of both accounts
+	// share prefixes and thus the inner nodes along their paths.
+	const numSlots = 1024
+	getSlotKey := func(i int) common.Key {
+		return common.Key{1, 29: byte(i >> 8), 30: byte(i)}
+	}
+	createAccount := func(address common.Address) common.Update {
+		update := common.Update{
+			CreatedAccounts: []common.Address{address},
+			Nonces:          []common.NonceUpdate{{Account: address, Nonce: common.ToNonce(1)}},
+			Slots:           []common.SlotUpdate{{Account: address, Key: common.Key{31: 3}, Value: common.Value{1}}},
+		}
+		for i := range numSlots {
+			update.Slots = append(update.Slots, common.SlotUpdate{Account: address, Key: getSlotKey(i), Value: common.Value{2}})
+		}
+		return update
+	}
+
+	// Make sure that some stems of the deleted account share more than the
+	// first byte with the remaining account.
+	pointCache := utils.NewPointCache(16)
+	getStems := func(address common.Address) map[[2]byte]struct{} {
+		point := pointCache.Get(address[:])
+		keys := []common.Key{{31: 3}} // located in the account header
+		for i := range numSlots {
+			keys = append(keys, getSlotKey(i))
+		}
+		stems := map[[2]byte]struct{}{}
+		for _, key := range keys {
+			treeKey := utils.StorageSlotKeyWithEvaluatedAddress(point, key[:])
+			stems[[2]byte(treeKey)] = struct{}{}
+		}
+		return stems
+	}
+	remaining := getStems(common.Address{2})
+	shared := 0
+	for prefix := range getStems(common.Address{1}) {
+		if _, found := remaining[prefix]; found {
+			shared++
+		}
+	}
+	require.NotZero(t, shared, "no stems sharing a two-byte prefix")
+
+	updates := []common.Update{
+		createAccount(common.Address{1}),
+		createAccount(common.Address{2}),
+		{DeletedAccounts: []common.Address{{1}}},
+	}
+
+	for name, stateInit := range initTestedState() {
+		t.Run(name, func(t *testing.T) {
+			st := stateInit(state.Parameters{}, t)
+			reference, err := memory.NewState(state.Parameters{})
+			require.NoError(t, err, "failed to create memory state")
+			defer reference.Close()
+
+			for i, update := range updates {
+				require.NoError(t, st.Apply(uint64(i), update), "failed to apply block %d", i)
+				require.NoError(t, reference.Apply(uint64(i), update), "failed to apply block %d", i)
+
+				want, err := reference.GetHash()
+				require.NoError(t, err, "failed to get hash")
+				got, err := st.GetHash()
+				require.NoError(t, err, "failed to get hash")
+				require.Equal(t, want, got, "hash mismatch after block %d", i)
+			}
+
+			for i := range numSlots {
+				value, err := st.GetStorage(common.Address{2}, getSlotKey(i))
+				require.NoError(t, err, "failed to get storage")
+				require.Equal(t, common.Value{2}, value, "storage of remaining account modified")
+			}
+		})
+	}
+}
+
+func TestState_DeletedAccount_StorageWrittenBeforeReopeningIsWiped(t *testing.T) {
+	source := newMemorySource()
+	st, err := NewStateWithSource(state.Parameters{}, source)
+	require.NoError(t, err, "failed to create state")
+	reference, err := NewState(state.Parameters{})
+	require.NoError(t, err, "failed to create state")
+
+	addr := common.Address{1}
+	update := common.Update{
+		CreatedAccounts: []common.Address{addr},
+		Nonces:          []common.NonceUpdate{{Account: addr, Nonce: common.ToNonce(1)}},
+		Slots:           []common.SlotUpdate{{Account: addr, Key: common.Key{1}, Value: common.Value{1}}},
+	}
+	require.NoError(t, st.Apply(0, update), "failed to apply update")
+	require.NoError(t, reference.Apply(0, update), "failed to apply update")
+
+	// The written keys are only retained by the node source, as it is the
+	// case after reopening the source.
+	st.(*persistentVerkleState).slots = make(map[common.Address]map[common.Key]struct{})
+
+	deletion := common.Update{DeletedAccounts: []common.Address{addr}}
+	require.NoError(t, st.Apply(1, deletion), "failed to delete account")
+	require.NoError(t, reference.Apply(1, deletion), "failed to delete account")
+
+	value, err := st.GetStorage(addr, common.Key{1})
+	require.NoError(t, err, "failed to get storage")
+	require.Equal(t, common.Value{}, value, "deleted account should have empty storage")
+	want, err := reference.GetHash()
+	require.NoError(t, err, "failed to get hash")
+	got, err := st.GetHash()
+	require.NoError(t, err, "failed to get hash")
+	require.Equal(t, want, got, "hash mismatch after deletion")
+}
+
+func TestState_WrittenSlots_AreStoredOncePerSlotAndRemovedOnDeletion(t *testing.T) {
+	require := require.New(t)
+	source := newMemorySource()
+	st, err := NewStateWithSource(state.Parameters{}, source)
+	require.NoError(err, "failed to create state")
+	defer st.Close()
+
+	getEntries := func() map[string][]byte {
+		res := map[string][]byte{}
+		for path, value := range source.(*memorySource).nodes {
+			if bytes.HasPrefix(path.ToBytes(), []byte(slotsPathPrefix)) && len(value.ToBytes()) > 0 {
+				res[string(path.ToBytes())] = value.ToBytes()
+			}
+		}
+		return res
+	}
+	getCount := func(count uint64) []byte {
+		return binary.BigEndian.AppendUint64(nil, count)
+	}
+	getKey := func(i byte) []byte {
+		key := common.Key{i}
+		return key[:]
+	}
+
+	addr := common.Address{1}
+	require.NoError(st.Apply(0, common.Update{
+		CreatedAccounts: []common.Address{addr},
+		Slots: []common.SlotUpdate{
+			{Account: addr, Key: common.Key{1}, Value: common.Value{1}},
+			{Account: addr, Key: common.Key{2}, Value: common.Value{1}},
+			{Account: addr, Key: common.Key{1}, Value: common.Value{2}},
+		},
+	}), "failed to apply update")
+	require.Equal(map[string][]byte{
+		string(getSlotsPath(addr)):   getCount(2),
+		string(getSlotPath(addr, 0)): getKey(1),
+		string(getSlotPath(addr, 1)): getKey(2),
+	}, getEntries())
+
+	// Only keys written for the first time are added.
+	require.NoError(st.Apply(1, common.Update{
+		Slots: []common.SlotUpdate{
+			{Account: addr, Key: common.Key{2}, Value: common.Value{3}},
+			{Account: addr, Key: common.Key{3}, Value: common.Value{3}},
+		},
+	}), "failed to apply update")
+	require.Equal(map[string][]byte{
+		string(getSlotsPath(addr)):   getCount(3),
+		string(getSlotPath(addr, 0)): getKey(1),
+		string(getSlotPath(addr, 1)): getKey(2),
+		string(getSlotPath(addr, 2)): getKey(3),
+	}, getEntries())
+
+	// The keys of deleted accounts are removed, unless written again.
+	require.NoError(st.Apply(2, common.Update{
+		DeletedAccounts: []common.Address{addr},
+		CreatedAccounts: []common.Address{addr},
+		Slots:           []common.SlotUpdate{{Account: addr, Key: common.Key{3}, Value: common.Value{4}}},
+	}), "failed to apply update")
+	require.Equal(map[string][]byte{
+		string(getSlotsPath(addr)):   getCount(1),
+		string(getSlotPath(addr, 0)): getKey(3),
+	}, getEntries())
+
+	require.NoError(st.Apply(3, common.Update{DeletedAccounts: []common.Address{addr}}), "failed to apply update")
+	require.Empty(getEntries())
+}
+
+func TestState_DeletedAccount_MissingAccountIsIgnored(t *testing.T) {
 	for name, stateInit := range initTestedState() {
 		t.Run(name, func(t *testing.T) {
 			st := stateInit(state.Parameters{}, t)
 			update := common.Update{}
 			update.DeletedAccounts = append(update.DeletedAccounts, common.Address{})
-			err := st.Apply(0, update)
-			require.Error(t, err, "expected error when applying update with deleted accounts")
+			require.NoError(t, st.Apply(0, update), "deleting a missing account should not fail")
 		})
 	}
 }
@@ -0,0 +1,465 @@
+package memory
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"slices"
+
+	"github.com/QoraNet/qoraDB/go/common"
+	"github.com/QoraNet/qoraDB/go/database/vt/memory/trie"
+)
+
+// ArchivePolicy configures which blocks are retained by the archive of a
+// State. The zero value retains every block without any limits. Only Disabled
+// and MaxBytes are derived from state.Parameters by NewState; the full policy
+// is available through NewStateWithArchivePolicy.
+type ArchivePolicy struct {
+	// Disabled turns off archiving. Archive queries of states without an
+	// archive fail with state.NoArchiveError.
+	Disabled bool
+	// MaxBlocks is the maximum number of blocks kept in memory, 0 for no
+	// limit. If exceeded, the oldest blocks are pruned.
+	MaxBlocks int
+	// MaxBytes is the approximate maximum memory used by the blocks kept in
+	// memory, 0 for no limit. If exceeded, the oldest blocks are pruned. The
+	// most recent block is retained regardless of its size.
+	MaxBytes uint64
+	// Interval is the distance between archived blocks. Only blocks with
+	// numbers divisible by the interval are archived. Values of 0 and 1
+	// archive every block.
+	Interval uint64
+}
+
+// DefaultArchivePolicy is the archive policy used by states unless configured
+// otherwise.
+var DefaultArchivePolicy = ArchivePolicy{MaxBlocks: 1000}
+
+// vtArchive stores the history of the state. For each block, it retains a
+// version of the trie. The set of changes applied by the block is only
+// retained by the disk archive, if the archive is persisted.
+// Trie versions share all nodes not modified in between, so the size of the
+// archive scales with the number of writes rather than with the size of the
+// state.
+//
+// Blocks not changing the root commitment are not stored. Queries for those
+// blocks are resolved to the closest archived block at or before the requested
+// block. Blocks skipped by the archive's policy are resolved the same way,
+// although their state may differ from the resolved block; it is up to the
+// caller to only rely on such blocks where this is intended.
+//
+// Optionally, the archive is backed by a disk archive retaining all blocks
+// beyond the ones kept in memory, including blocks archived before a restart.
+type vtArchive struct {
+	blocks     map[uint64]*archiveEntry // block number -> archived data
+	order      []uint64                 // numbers of the blocks kept in memory, in increasing order
+	maxBlock   uint64                   // highest block number added, including unstored duplicates
+	hasBlocks  bool                     // whether any blocks have been archived
+	latest     [32]byte                 // commitment of the most recent stored block
+	maxSize    int                      // maximum blocks to keep (0 = unlimited)
+	maxBytes   uint64                   // maximum memory of kept blocks (0 = unlimited)
+	interval   uint64                   // distance between archived blocks
+	memorySize uint64                   // estimated memory used by the kept blocks
+	disk       *diskArchive             // persistent copy of all blocks, nil if not persisted
+}
+
+// archiveEntry is the archived data of a single block.
+type archiveEntry struct {
+	commitment [32]byte   // root commitment of the trie after the block
+	trie       *trie.Trie // version of the trie after the block, never modified
+	size       uint64     // estimated memory used by this entry
+
+	// The storage slots dropped from the written-slot tracking of the state
+	// by account deletions in the block, needed for reverting the block.
+	removedSlots map[common.Address]map[common.Key]bool
+}
+
+// slotChanges describes the modifications of the written-slot tracking of a
+// state by a block. If blocks are skipped by the archive, the modifications
+// cover all blocks since the previously archived block.
+type slotChanges struct {
+	added   map[common.Address]map[common.Key]bool // accounts and slots tracked for the first time
+	removed map[common.Address]map[common.Key]bool // accounts dropped by deletions, with their slots
+
+	// The full tracking after the block, used for writing disk checkpoints.
+	// It is only accessed while the block is added to the archive.
+	tracked map[common.Address]map[common.Key]bool
+}
+
+// change records the modification of a single trie key within a block. If
+// blocks are skipped by the archive, changes cover all blocks since the
+// previously archived block.
+type change struct {
+	key    trie.Key
+	before entry // the state of the key before the block
+	after  entry // the state of the key after the block
+}
+
+// entry is the state of a single key in the trie.
+type entry struct {
+	value trie.Value
+	used  bool // false if the key is not present in the trie
+}
+
+// newVtArchive creates an archive retaining blocks according to the given
+// policy. The Disabled flag of the policy is ignored.
+func newVtArchive(policy ArchivePolicy) *vtArchive {
+	return &vtArchive{
+		blocks:    make(map[uint64]*archiveEntry),
+		maxBlock:  0,
+		hasBlocks: false,
+		maxSize:   max(policy.MaxBlocks, 0),
+		maxBytes:  policy.MaxBytes,
+		interval:  max(policy.Interval, 1),
+	}
+}
+
+// newPersistentVtArchive creates an archive keeping blocks in memory according
+// to the given policy, which persists all archived blocks in the given
+// directory. Blocks archived in the directory previously remain accessible.
+func newPersistentVtArchive(policy ArchivePolicy, directory string) (*vtArchive, error) {
+	disk, err := openDiskArchive(directory)
+	if err != nil {
+		return nil, err
+	}
+	res := newVtArchive(policy)
+	res.disk = disk
+	if height, found := disk.getBlockHeight(); found {
+		source, _ := disk.resolve(height)
+		latest, err := disk.getCommitment(source)
+		if err != nil {
+			return nil, errors.Join(err, disk.close())
+		}
+		res.maxBlock = height
+		res.hasBlocks = true
+		res.latest = latest
+	}
+	return res, nil
+}
+
+// isArchived checks whether the given block is to be archived according to
+// the archive's policy.
+func (a *vtArchive) isArchived(block uint64) bool {
+	return block%a.interval == 0
+}
+
+// addBlock stores the trie version of a block with automatic pruning, and
+// writes the changes of the block to the disk archive, if the archive is
+// persisted. The trie must not be modified after being added to the archive.
+// Blocks following the most recent block without changing the root
+// commitment or the written-slot tracking are only recorded as covered by the
+// most recent block.
+func (a *vtArchive) addBlock(
+	block uint64,
+	changes []change,
+	slots slotChanges,
+	version *trie.Trie,
+) error {
+	commitment := version.Commit().Compress()
+	unchanged := commitment == a.latest && len(slots.added) == 0 && len(slots.removed) == 0
+	if a.hasBlocks && block > a.maxBlock && unchanged {
+		if a.disk != nil {
+			if err := a.disk.cover(block); err != nil {
+				return err
+			}
+		}
+		a.maxBlock = block
+		return nil
+	}
+	if a.disk != nil {
+		if err := a.disk.addBlock(block, commitment, changes, slots, version); err != nil {
+			return err
+		}
+	}
+
+	// The trie version only occupies memory for the nodes not shared with
+	// the version of the preceding block.
+	pos, _ := slices.BinarySearch(a.order, block)
+	var predecessor *trie.Trie
+	if pos > 0 {
+		predecessor = a.blocks[a.order[pos-1]].trie
+	}
+	archived := &archiveEntry{
+		commitment:   commitment,
+		trie:         version,
+		size:         getEntrySize(version.CountNodesNotSharedWith(predecessor)),
+		removedSlots: slots.removed,
+	}
+	if previous, found := a.blocks[block]; found {
+		a.memorySize -= previous.size
+	} else {
+		a.order = slices.Insert(a.order, pos, block)
+	}
+	a.blocks[block] = archived
+	a.memorySize += archived.size
+	if block >= a.maxBlock {
+		a.latest = commitment
+	}
+
+	// Update max block
+	if !a.hasBlocks || block > a.maxBlock {
+		a.maxBlock = block
+		a.hasBlocks = true
+	}
+
+	// Prune old blocks if we exceed maxSize or maxBytes
+	if a.maxSize > 0 && len(a.blocks) > a.maxSize {
+		a.pruneOldest()
+	}
+	for a.maxBytes > 0 && a.memorySize > a.maxBytes && len(a.blocks) > 1 {
+		a.pruneOldest()
+	}
+	return nil
+}
+
+// pruneOldest removes the oldest block from the archive. Since blocks are
+// kept in order, the oldest block is found in constant time, even if blocks
+// have been added out of order.
+func (a *vtArchive) pruneOldest() {
+	if len(a.order) == 0 {
+		return
+	}
+	oldest := a.order[0]
+	a.memorySize -= a.blocks[oldest].size
+	delete(a.blocks, oldest)
+	a.order = a.order[1:]
+}
+
+// hasBlock checks whether the state of the given block is archived.
+func (a *vtArchive) hasBlock(block uint64) bool {
+	_, exists := a.blocks[block]
+	return exists || (a.disk != nil && a.disk.hasBlock(block))
+}
+
+// resolve determines the archived block providing the state of the given
+// block, which is the closest archived block at or before the given block.
+// The second result is false if there is no such block or if the given block
+// is beyond the archive's height.
+func (a *vtArchive) resolve(block uint64) (uint64, bool) {
+	if !a.hasBlocks || block > a.maxBlock {
+		return 0, false
+	}
+	pos, exact := slices.BinarySearch(a.order, block)
+	if exact {
+		return block, true
+	}
+	res, found := uint64(0), false
+	if pos > 0 {
+		res, found = a.order[pos-1], true
+	}
+	if a.disk != nil {
+		if onDisk, ok := a.disk.resolve(block); ok && (!found || onDisk > res) {
+			res, found = onDisk, true
+		}
+	}
+	return res, found
+}
+
+// getRemovedSlots returns the storage slots dropped from the written-slot
+// tracking by account deletions in blocks after the given block. Deletions in
+// blocks pruned from memory are obtained from the disk. Without a disk, those
+// blocks can not be resolved anymore, so they are never required.
+func (a *vtArchive) getRemovedSlots(block uint64) ([]map[common.Address]map[common.Key]bool, error) {
+	var res []map[common.Address]map[common.Key]bool
+	if a.disk != nil {
+		oldest := a.maxBlock + 1
+		if len(a.order) > 0 {
+			oldest = a.order[0]
+		}
+		onDisk, err := a.disk.getRemovedSlots(block, oldest)
+		if err != nil {
+			return nil, err
+		}
+		res = onDisk
+	}
+	pos, _ := slices.BinarySearch(a.order, block+1)
+	for _, later := range a.order[pos:] {
+		res = append(res, a.blocks[later].removedSlots)
+	}
+	return res, nil
+}
+
+// getWrittenSlots reconstructs the written-slot tracking of the state after
+// the given block from the disk. This is used for restoring the tracking of
+// a state continuing from a persisted archive.
+func (a *vtArchive) getWrittenSlots(block uint64) (map[common.Address]map[common.Key]bool, error) {
+	if a.disk == nil {
+		return nil, fmt.Errorf("written slots of block %d are not persisted", block)
+	}
+	return a.disk.getWrittenSlots(block)
+}
+
+// getTrie returns a copy of the trie of the given block. For blocks retained
+// in memory, the copy shares all nodes with the archived version and can thus
+// be created in constant time. Other blocks are reconstructed from the disk.
+// Modifications of the copy do not affect the archive.
+func (a *vtArchive) getTrie(block uint64) (*trie.Trie, error) {
+	entry, exists := a.blocks[block]
+	if !exists && a.disk != nil {
+		return a.disk.getTrie(block)
+	}
+	if !exists {
+		return nil, fmt.Errorf("no archived state for block %d", block)
+	}
+	return entry.trie.Clone(), nil
+}
+
+// getValue retrieves the value of the given key after the given block.
+func (a *vtArchive) getValue(block uint64, key trie.Key) (trie.Value, error) {
+	entry, exists := a.blocks[block]
+	if !exists && a.disk != nil {
+		return a.disk.getValue(block, key)
+	}
+	if !exists {
+		return trie.Value{}, fmt.Errorf("no archived state for block %d", block)
+	}
+	return entry.trie.Get(key), nil
+}
+
+// getCommitment returns the root commitment of the trie after the given block.
+func (a *vtArchive) getCommitment(block uint64) ([32]byte, error) {
+	entry, exists := a.blocks[block]
+	if !exists && a.disk != nil {
+		return a.disk.getCommitment(block)
+	}
+	if !exists {
+		return [32]byte{}, fmt.Errorf("no archived state for block %d", block)
+	}
+	return entry.commitment, nil
+}
+
+// revert discards all blocks after the given block, such that the given block
+// becomes the archive's height. It returns the trie of the given block and the
+// storage slots removed from the written-slot tracking by the discarded
+// blocks. Since the latter are only retained in memory, reverting is limited
+// to blocks not preceding the oldest block kept in memory.
+func (a *vtArchive) revert(block uint64) (*trie.Trie, []map[common.Address]map[common.Key]bool, error) {
+	source, found := a.resolve(block)
+	if !found {
+		return nil, nil, fmt.Errorf("no archived state for block %d", block)
+	}
+	if _, inMemory := a.blocks[source]; !inMemory && a.disk != nil {
+		if height, _ := a.disk.getIndexedHeight(); height > source {
+			return nil, nil, fmt.Errorf("block %d is no longer kept in memory and cannot be reverted to", source)
+		}
+	}
+
+	res, err := a.getTrie(source)
+	if err != nil {
+		return nil, nil, err
+	}
+	commitment, err := a.getCommitment(source)
+	if err != nil {
+		return nil, nil, err
+	}
+	if got := res.Commit().Compress(); got != commitment {
+		return nil, nil, fmt.Errorf("state of block %d has commitment %x, expected %x", source, got, commitment)
+	}
+
+	if a.disk != nil {
+		if err := a.disk.truncate(source); err != nil {
+			return nil, nil, err
+		}
+		if block > source {
+			if err := a.disk.cover(block); err != nil {
+				return nil, nil, err
+			}
+		}
+	}
+	pos, _ := slices.BinarySearch(a.order, source+1)
+	removed := make([]map[common.Address]map[common.Key]bool, 0, len(a.order)-pos)
+	for _, discarded := range a.order[pos:] {
+		removed = append(removed, a.blocks[discarded].removedSlots)
+		a.memorySize -= a.blocks[discarded].size
+		delete(a.blocks, discarded)
+	}
+	a.order = a.order[:pos]
+	a.maxBlock = block
+	a.latest = commitment
+	return res, removed, nil
+}
+
+// getBlockHeight returns the highest archived block number
+func (a *vtArchive) getBlockHeight() (uint64, bool) {
+	return a.maxBlock, a.hasBlocks
+}
+
+// flush writes all archived blocks to the disk, if the archive is persisted.
+func (a *vtArchive) flush() error {
+	if a.disk == nil {
+		return nil
+	}
+	return a.disk.flush()
+}
+
+// close releases the resources of the archive.
+func (a *vtArchive) close() error {
+	if a.disk == nil {
+		return nil
+	}
+	return a.disk.close()
+}
+
+// getMemorySize estimates the memory used by the blocks kept in memory.
+func (a *vtArchive) getMemorySize() uint64 {
+	return a.memorySize
+}
+
+// getEntrySize estimates the memory used by an archived block whose trie
+// version retains the given numbers of inner nodes and leaves exclusively.
+// Inner nodes are dominated by the child pointers and the cached values of
+// the children, leaves by their values. Both cache commitments as well.
+func getEntrySize(innerNodes, leafNodes int) uint64 {
+	const innerSize = uint64(256*16 + 256*32 + 256/8 + 96)
+	const leafSize = uint64(256*32 + 256/8 + 3*96)
+	size := uint64(32) // commitment
+	size += uint64(16) // map overhead per entry
+	size += uint64(innerNodes) * innerSize
+	size += uint64(leafNodes) * leafSize
+	return size
+}
+
+// serializeTrie converts the trie state to bytes for snapshotting
+// Format: [numEntries uint32][key1 32 bytes][value1 32 bytes][key2...]...
+//
+// Entries are produced by walking all used leaf slots of the trie in key
+// order. This includes slots explicitly set to zero, since those contribute
+// to the commitment and are required to reproduce the root on restore.
+func serializeTrie(t *trie.Trie) []byte {
+	buf := make([]byte, 4, 4+64*1024)
+	count := uint32(0)
+	t.Visit(func(key trie.Key, value trie.Value) bool {
+		buf = append(buf, key[:]...)
+		buf = append(buf, value[:]...)
+		count++
+		return true
+	})
+	binary.BigEndian.PutUint32(buf[0:4], count)
+	return buf
+}
+
+// deserializeTrie restores a trie from bytes produced by serializeTrie.
+func deserializeTrie(data []byte) (*trie.Trie, error) {
+	if len(data) < 4 {
+		return nil, fmt.Errorf("invalid data: too short")
+	}
+
+	numEntries := binary.BigEndian.Uint32(data[0:4])
+	expectedLen := 4 + int(numEntries)*64
+	if len(data) != expectedLen {
+		return nil, fmt.Errorf("invalid data length: expected %d, got %d", expectedLen, len(data))
+	}
+
+	// Restore all entries
+	res := &trie.Trie{}
+	offset := 4
+	for i := uint32(0); i < numEntries; i++ {
+		var key trie.Key
+		var value trie.Value
+		copy(key[:], data[offset:offset+32])
+		copy(value[:], data[offset+32:offset+64])
+		res.Set(key, value)
+		offset += 64
+	}
+	return res, nil
+}
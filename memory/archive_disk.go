@@ -0,0 +1,878 @@
+package memory
+
+import (
+	"bytes"
+	"cmp"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/QoraNet/qoraDB/go/common"
+	"github.com/QoraNet/qoraDB/go/database/vt/memory/trie"
+)
+
+// defaultDiskCheckpointInterval is the number of blocks between full copies
+// of the trie written by the disk archive.
+const defaultDiskCheckpointInterval = 100
+
+const (
+	diskArchiveBlocksFile     = "blocks.dat"
+	diskArchiveIndexFile      = "index.dat"
+	diskArchiveHeightFile     = "height.dat"
+	diskArchiveCheckpointName = "checkpoint-"
+	diskArchiveTempSuffix     = ".tmp"
+
+	diskIndexEntrySize   = 8 + 8         // block number, offset in the blocks file
+	diskRecordHeaderSize = 8 + 32 + 4    // block number, commitment, number of changes
+	diskChangeSize       = 32 + 2*(1+32) // key, before and after entries
+	diskEntrySize        = 1 + 32        // used flag, value
+)
+
+// diskArchive persists archived blocks in a directory such that the history
+// of a state survives restarts. For each block, the commitment and the
+// changes of the block, including the changes of the written-slot tracking,
+// are appended to a blocks file, and the position of the record is registered
+// in an index file. Additionally, a full copy of the trie and of the tracked
+// slots is written every checkpointInterval blocks. The state of a block is
+// reconstructed by loading the closest checkpoint at or before the block and
+// replaying the changes of the blocks in between.
+//
+// Record:     [block uint64][commitment 32 bytes][numChanges uint32][change1]...[addedLen uint32][added slots][removedLen uint32][removed slots][checksum uint32]
+// Checkpoint: [trie, see serializeTrie][leaf depths][tracked slots][checksum uint32]
+//
+// Leaf depths describe the shape of the trie, as for snapshot parts, and are
+// encoded by appendLeafDepths. Slots are encoded by encodeWrittenSlots. Empty sets of added or removed
+// slots are omitted from records, leaving a length of zero.
+//
+// Blocks following the last archived block without changing the state are
+// not recorded in the blocks file. Instead, the highest such block is stored
+// in a height file, such that the height of the archive survives restarts.
+//
+// Checkpoints and records are protected by checksums. Checkpoints are written
+// atomically by renaming a fully written temporary file. Records are synced to
+// the disk before the block is appended to the index, which is synced before
+// the block is reported as archived, such that a crash never leaves an indexed
+// block whose data is missing.
+//
+// Except for the checkpoint of the first block, checkpoints are written in the
+// background after their block has been indexed, such that adding blocks does
+// not wait for the trie to be serialized. A checkpoint is only used once it is
+// completely written; until then, blocks are reconstructed from the previous
+// checkpoint. Errors of background writes are reported by the next operation
+// modifying the archive, after which the checkpoint is retried.
+//
+// Blocks must be added in increasing order. The archive is not safe for
+// concurrent modification, but may be queried concurrently.
+type diskArchive struct {
+	directory          string
+	blocks             *os.File         // records of all archived blocks
+	index              *os.File         // fixed-size entries locating records in the blocks file
+	entries            []diskIndexEntry // in-memory copy of the index, ordered by block
+	checkpointInterval uint64
+	size               uint64 // size of the blocks file
+	covered            uint64 // highest block covered by the last indexed block, 0 if none
+
+	checkpoints     []uint64   // blocks with a completely written checkpoint, in increasing order
+	checkpointMutex sync.Mutex // protects checkpoints, which are extended by background writes
+
+	pendingCheckpoint uint64     // block of the checkpoint written in the background
+	pendingResult     chan error // result of the background write, nil if none is pending
+}
+
+// diskIndexEntry locates the record of a block in the blocks file.
+type diskIndexEntry struct {
+	block  uint64
+	offset uint64
+}
+
+// openDiskArchive opens the archive stored in the given directory, creating
+// a new, empty archive if the directory does not contain one.
+func openDiskArchive(directory string) (*diskArchive, error) {
+	if err := os.MkdirAll(directory, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create archive directory: %w", err)
+	}
+
+	blocks, err := os.OpenFile(filepath.Join(directory, diskArchiveBlocksFile), os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open blocks file: %w", err)
+	}
+	index, err := os.OpenFile(filepath.Join(directory, diskArchiveIndexFile), os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, errors.Join(fmt.Errorf("failed to open index file: %w", err), blocks.Close())
+	}
+
+	res := &diskArchive{
+		directory:          directory,
+		blocks:             blocks,
+		index:              index,
+		checkpointInterval: defaultDiskCheckpointInterval,
+	}
+	if err := res.load(); err != nil {
+		return nil, errors.Join(err, res.close())
+	}
+	return res, nil
+}
+
+// load reads the index and the list of checkpoints from the directory. Data
+// written after the last complete index entry, which may be left behind by an
+// interrupted write, is discarded.
+func (a *diskArchive) load() error {
+	data, err := io.ReadAll(a.index)
+	if err != nil {
+		return fmt.Errorf("failed to read index: %w", err)
+	}
+	numEntries := len(data) / diskIndexEntrySize
+	a.entries = make([]diskIndexEntry, 0, numEntries)
+	for i := range numEntries {
+		entry := data[i*diskIndexEntrySize:]
+		a.entries = append(a.entries, diskIndexEntry{
+			block:  binary.BigEndian.Uint64(entry[0:8]),
+			offset: binary.BigEndian.Uint64(entry[8:16]),
+		})
+	}
+	if err := a.index.Truncate(int64(numEntries * diskIndexEntrySize)); err != nil {
+		return fmt.Errorf("failed to truncate index: %w", err)
+	}
+
+	// The end of the blocks file is the end of the last indexed record. The
+	// size of the file bounds the records read before.
+	info, err := a.blocks.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to inspect blocks file: %w", err)
+	}
+	a.size = uint64(info.Size())
+	if numEntries > 0 {
+		last := a.entries[numEntries-1]
+		record, err := a.readRecord(last.offset)
+		if err != nil {
+			return fmt.Errorf("failed to read record of block %d: %w", last.block, err)
+		}
+		a.size = last.offset + record.size
+	} else {
+		a.size = 0
+	}
+	if err := a.blocks.Truncate(int64(a.size)); err != nil {
+		return fmt.Errorf("failed to truncate blocks file: %w", err)
+	}
+
+	files, err := os.ReadDir(a.directory)
+	if err != nil {
+		return fmt.Errorf("failed to list archive directory: %w", err)
+	}
+	a.checkpoints = nil
+	for _, file := range files {
+		if strings.HasSuffix(file.Name(), diskArchiveTempSuffix) {
+			// Left behind by an interrupted write.
+			if err := os.Remove(filepath.Join(a.directory, file.Name())); err != nil {
+				return fmt.Errorf("failed to remove incomplete file: %w", err)
+			}
+			continue
+		}
+		suffix, found := strings.CutPrefix(file.Name(), diskArchiveCheckpointName)
+		if !found {
+			continue
+		}
+		block, err := strconv.ParseUint(suffix, 10, 64)
+		if err != nil {
+			continue
+		}
+		if _, found := a.find(block); found {
+			a.checkpoints = append(a.checkpoints, block)
+		}
+	}
+	slices.Sort(a.checkpoints)
+
+	// A covered height not exceeding the last indexed block is outdated, e.g.,
+	// due to an interrupted truncation, and ignored.
+	a.covered = 0
+	data, err = os.ReadFile(filepath.Join(a.directory, diskArchiveHeightFile))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to read height: %w", err)
+	}
+	if err == nil {
+		if len(data) != 8+snapshotChecksumSize || verifySnapshotChecksum(data) != nil {
+			return fmt.Errorf("invalid height file")
+		}
+		if height, found := a.getIndexedHeight(); found && binary.BigEndian.Uint64(data) > height {
+			a.covered = binary.BigEndian.Uint64(data)
+		}
+	}
+	return nil
+}
+
+// diskRecord is the archived data of a single block stored in the blocks file.
+type diskRecord struct {
+	block      uint64
+	commitment [32]byte
+	changes    []change
+	added      []byte // encoded slots added to the tracking, nil if none
+	removed    []byte // encoded slots removed from the tracking, nil if none
+	size       uint64 // size of the record in the blocks file
+}
+
+// addBlock appends the data of the given block to the archive. The trie and
+// the tracked slots are the state after the block and are used for writing
+// checkpoints. Since checkpoints are written in the background, the trie must
+// not be modified after being added.
+func (a *diskArchive) addBlock(block uint64, commitment [32]byte, changes []change, slots slotChanges, version *trie.Trie) error {
+	if height, found := a.getBlockHeight(); found && block <= height {
+		return fmt.Errorf("block %d is not higher than the archive height %d", block, height)
+	}
+
+	// Failed background writes are reported before anything is written, such
+	// that the block can be added again.
+	if err := a.collectCheckpoint(false); err != nil {
+		return err
+	}
+	last, found := a.getLastCheckpoint()
+	checkpoint := !found || block-last >= a.checkpointInterval
+	if checkpoint {
+		if err := a.collectCheckpoint(true); err != nil {
+			return err
+		}
+	}
+
+	// Without any checkpoint, blocks can not be reconstructed. Thus, the first
+	// checkpoint is written before the block is registered in the index. It is
+	// only considered once the block has been indexed, such that a failed
+	// write leaves the archive unchanged. The tracked slots are encoded right
+	// away, since they are modified by the state after the block is added.
+	var encodedSlots []byte
+	if checkpoint {
+		encodedSlots = encodeWrittenSlots(slots.tracked)
+	}
+	if checkpoint && !found {
+		if err := a.writeCheckpoint(block, version, encodedSlots); err != nil {
+			return fmt.Errorf("failed to write checkpoint for block %d: %w", block, err)
+		}
+	}
+
+	record := make([]byte, diskRecordHeaderSize, diskRecordHeaderSize+len(changes)*diskChangeSize)
+	binary.BigEndian.PutUint64(record[0:8], block)
+	copy(record[8:40], commitment[:])
+	binary.BigEndian.PutUint32(record[40:44], uint32(len(changes)))
+	for _, change := range changes {
+		record = append(record, change.key[:]...)
+		record = appendEntry(record, change.before)
+		record = appendEntry(record, change.after)
+	}
+	record = appendSlots(record, slots.added)
+	record = appendSlots(record, slots.removed)
+	record = binary.BigEndian.AppendUint32(record, crc32.Checksum(record, snapshotChecksumTable))
+	if _, err := a.blocks.WriteAt(record, int64(a.size)); err != nil {
+		return fmt.Errorf("failed to write block %d: %w", block, err)
+	}
+	if err := a.blocks.Sync(); err != nil {
+		return fmt.Errorf("failed to sync block %d: %w", block, err)
+	}
+
+	var entry [diskIndexEntrySize]byte
+	binary.BigEndian.PutUint64(entry[0:8], block)
+	binary.BigEndian.PutUint64(entry[8:16], a.size)
+	if _, err := a.index.WriteAt(entry[:], int64(len(a.entries)*diskIndexEntrySize)); err != nil {
+		return fmt.Errorf("failed to index block %d: %w", block, err)
+	}
+	if err := a.index.Sync(); err != nil {
+		return fmt.Errorf("failed to sync index of block %d: %w", block, err)
+	}
+
+	a.entries = append(a.entries, diskIndexEntry{block: block, offset: a.size})
+	a.size += uint64(len(record))
+	if checkpoint && !found {
+		a.addCheckpoint(block)
+	} else if checkpoint {
+		a.startCheckpoint(block, version, encodedSlots)
+	}
+	return nil
+}
+
+// getLastCheckpoint returns the block of the most recent checkpoint, including
+// a checkpoint currently written in the background.
+func (a *diskArchive) getLastCheckpoint() (uint64, bool) {
+	if a.pendingResult != nil {
+		return a.pendingCheckpoint, true
+	}
+	a.checkpointMutex.Lock()
+	defer a.checkpointMutex.Unlock()
+	if len(a.checkpoints) == 0 {
+		return 0, false
+	}
+	return a.checkpoints[len(a.checkpoints)-1], true
+}
+
+// addCheckpoint registers the completely written checkpoint of the given
+// block, which is higher than all blocks with a checkpoint.
+func (a *diskArchive) addCheckpoint(block uint64) {
+	a.checkpointMutex.Lock()
+	defer a.checkpointMutex.Unlock()
+	a.checkpoints = append(a.checkpoints, block)
+}
+
+// startCheckpoint writes the checkpoint of the given block in the background.
+// The trie must not be modified while the checkpoint is written.
+func (a *diskArchive) startCheckpoint(block uint64, version *trie.Trie, slots []byte) {
+	result := make(chan error, 1)
+	a.pendingCheckpoint = block
+	a.pendingResult = result
+	go func() {
+		err := a.writeCheckpoint(block, version, slots)
+		if err == nil {
+			a.addCheckpoint(block)
+		}
+		result <- err
+	}()
+}
+
+// collectCheckpoint collects the result of the checkpoint written in the
+// background, if there is one. Unless wait is set, a checkpoint still being
+// written is left running.
+func (a *diskArchive) collectCheckpoint(wait bool) error {
+	if a.pendingResult == nil {
+		return nil
+	}
+	var err error
+	if wait {
+		err = <-a.pendingResult
+	} else {
+		select {
+		case err = <-a.pendingResult:
+		default:
+			return nil
+		}
+	}
+	a.pendingResult = nil
+	if err != nil {
+		return fmt.Errorf("failed to write checkpoint for block %d: %w", a.pendingCheckpoint, err)
+	}
+	return nil
+}
+
+// cover records that the given block, which is higher than all archived
+// blocks, did not change the state of the last archived block. This way, the
+// block is included in the height of the archive.
+func (a *diskArchive) cover(block uint64) error {
+	height, found := a.getBlockHeight()
+	if !found {
+		return fmt.Errorf("no archived block to cover block %d", block)
+	}
+	if block <= height {
+		return fmt.Errorf("block %d is not higher than the archive height %d", block, height)
+	}
+	data := binary.BigEndian.AppendUint64(nil, block)
+	data = binary.BigEndian.AppendUint32(data, crc32.Checksum(data, snapshotChecksumTable))
+	if err := writeFileAtomically(a.directory, diskArchiveHeightFile, data); err != nil {
+		return fmt.Errorf("failed to write height %d: %w", block, err)
+	}
+	a.covered = block
+	return nil
+}
+
+// truncate removes all blocks after the given block from the archive.
+func (a *diskArchive) truncate(block uint64) error {
+	if err := a.collectCheckpoint(true); err != nil {
+		return err
+	}
+	if a.covered > block {
+		a.covered = 0
+		if err := os.Remove(filepath.Join(a.directory, diskArchiveHeightFile)); err != nil {
+			return fmt.Errorf("failed to reset height: %w", err)
+		}
+	}
+	pos := sort.Search(len(a.entries), func(i int) bool {
+		return a.entries[i].block > block
+	})
+	if pos == len(a.entries) {
+		return nil
+	}
+
+	// The index is truncated first, such that an interrupted truncation leaves
+	// no indexed blocks without data behind.
+	offset := a.entries[pos].offset
+	if err := a.index.Truncate(int64(pos * diskIndexEntrySize)); err != nil {
+		return fmt.Errorf("failed to truncate index: %w", err)
+	}
+	a.entries = a.entries[:pos]
+	if err := a.index.Sync(); err != nil {
+		return fmt.Errorf("failed to sync index: %w", err)
+	}
+	if err := a.blocks.Truncate(int64(offset)); err != nil {
+		return fmt.Errorf("failed to truncate blocks file: %w", err)
+	}
+	a.size = offset
+
+	a.checkpointMutex.Lock()
+	defer a.checkpointMutex.Unlock()
+	for len(a.checkpoints) > 0 && a.checkpoints[len(a.checkpoints)-1] > block {
+		last := a.checkpoints[len(a.checkpoints)-1]
+		if err := os.Remove(a.getCheckpointPath(last)); err != nil {
+			return fmt.Errorf("failed to remove checkpoint of block %d: %w", last, err)
+		}
+		a.checkpoints = a.checkpoints[:len(a.checkpoints)-1]
+	}
+	return nil
+}
+
+// find locates the position of the given block in the index.
+func (a *diskArchive) find(block uint64) (int, bool) {
+	return slices.BinarySearchFunc(a.entries, block, func(entry diskIndexEntry, block uint64) int {
+		return cmp.Compare(entry.block, block)
+	})
+}
+
+// resolve returns the closest archived block at or before the given block.
+func (a *diskArchive) resolve(block uint64) (uint64, bool) {
+	pos := sort.Search(len(a.entries), func(i int) bool {
+		return a.entries[i].block > block
+	})
+	if pos == 0 {
+		return 0, false
+	}
+	return a.entries[pos-1].block, true
+}
+
+// hasBlock checks whether the given block is contained in the archive.
+func (a *diskArchive) hasBlock(block uint64) bool {
+	_, found := a.find(block)
+	return found
+}
+
+// getBlockHeight returns the highest archived block number, including blocks
+// covered by the last archived block.
+func (a *diskArchive) getBlockHeight() (uint64, bool) {
+	height, found := a.getIndexedHeight()
+	return max(height, a.covered), found
+}
+
+// getIndexedHeight returns the highest block number registered in the index.
+func (a *diskArchive) getIndexedHeight() (uint64, bool) {
+	if len(a.entries) == 0 {
+		return 0, false
+	}
+	return a.entries[len(a.entries)-1].block, true
+}
+
+// getCommitment returns the root commitment of the trie after the given block.
+func (a *diskArchive) getCommitment(block uint64) ([32]byte, error) {
+	pos, found := a.find(block)
+	if !found {
+		return [32]byte{}, fmt.Errorf("no archived state for block %d", block)
+	}
+	record, err := a.readRecord(a.entries[pos].offset)
+	if err != nil {
+		return [32]byte{}, err
+	}
+	return record.commitment, nil
+}
+
+// getTrie reconstructs the trie of the given block from the closest checkpoint
+// and the changes recorded since. The commitment of the resulting trie is
+// verified against the archived commitment.
+func (a *diskArchive) getTrie(block uint64) (*trie.Trie, error) {
+	pos, found := a.find(block)
+	if !found {
+		return nil, fmt.Errorf("no archived state for block %d", block)
+	}
+	checkpoint := a.getCheckpointBlock(block)
+	data, err := a.readCheckpoint(checkpoint)
+	if err != nil {
+		return nil, err
+	}
+	data, depths, _, err := splitCheckpoint(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to restore checkpoint of block %d: %w", checkpoint, err)
+	}
+	res, err := deserializeTrie(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to restore checkpoint of block %d: %w", checkpoint, err)
+	}
+	if err := res.SetLeafDepths(depths); err != nil {
+		return nil, fmt.Errorf("failed to restore checkpoint of block %d: %w", checkpoint, err)
+	}
+
+	start, _ := a.find(checkpoint)
+	var record diskRecord
+	for i := start; i <= pos; i++ {
+		record, err = a.readRecord(a.entries[i].offset)
+		if err != nil {
+			return nil, err
+		}
+		if i == start {
+			continue // the changes are included in the checkpoint
+		}
+		for _, change := range record.changes {
+			if change.after.used {
+				res.Set(change.key, change.after.value)
+			} else {
+				res.Delete(change.key)
+			}
+		}
+	}
+
+	if got := res.Commit().Compress(); got != record.commitment {
+		return nil, fmt.Errorf("restored state of block %d has commitment %x, expected %x", block, got, record.commitment)
+	}
+	return res, nil
+}
+
+// getValue retrieves the value of the given key after the given block. The
+// changes of the blocks since the closest checkpoint are searched backwards
+// for the key before resorting to the checkpoint itself.
+func (a *diskArchive) getValue(block uint64, key trie.Key) (trie.Value, error) {
+	pos, found := a.find(block)
+	if !found {
+		return trie.Value{}, fmt.Errorf("no archived state for block %d", block)
+	}
+	checkpoint := a.getCheckpointBlock(block)
+	for i := pos; i >= 0 && a.entries[i].block > checkpoint; i-- {
+		record, err := a.readRecord(a.entries[i].offset)
+		if err != nil {
+			return trie.Value{}, err
+		}
+		if change, found := findChange(record.changes, key); found {
+			return change.after.value, nil
+		}
+	}
+	data, err := a.readCheckpoint(checkpoint)
+	if err != nil {
+		return trie.Value{}, err
+	}
+	data, _, _, err = splitCheckpoint(data)
+	if err != nil {
+		return trie.Value{}, fmt.Errorf("invalid checkpoint of block %d: %w", checkpoint, err)
+	}
+	return lookupCheckpoint(data, key), nil
+}
+
+// getWrittenSlots reconstructs the written-slot tracking after the given block
+// from the closest checkpoint and the changes of the tracking recorded since.
+func (a *diskArchive) getWrittenSlots(block uint64) (map[common.Address]map[common.Key]bool, error) {
+	pos, found := a.find(block)
+	if !found {
+		return nil, fmt.Errorf("no archived state for block %d", block)
+	}
+	checkpoint := a.getCheckpointBlock(block)
+	data, err := a.readCheckpoint(checkpoint)
+	if err != nil {
+		return nil, err
+	}
+	_, _, data, err = splitCheckpoint(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to restore checkpoint of block %d: %w", checkpoint, err)
+	}
+	res, err := decodeWrittenSlots(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to restore written slots of block %d: %w", checkpoint, err)
+	}
+
+	// Slots are only removed from the tracking by deleting their accounts.
+	// Accounts deleted by a block are dropped before the accounts and slots
+	// added by the same block are included, since deletions are applied
+	// first.
+	start, _ := a.find(checkpoint)
+	for i := start + 1; i <= pos; i++ {
+		record, err := a.readRecord(a.entries[i].offset)
+		if err != nil {
+			return nil, err
+		}
+		removed, err := decodeRecordSlots(record.removed)
+		if err != nil {
+			return nil, fmt.Errorf("invalid removed slots of block %d: %w", record.block, err)
+		}
+		for address := range removed {
+			delete(res, address)
+		}
+		added, err := decodeRecordSlots(record.added)
+		if err != nil {
+			return nil, fmt.Errorf("invalid added slots of block %d: %w", record.block, err)
+		}
+		for address, keys := range added {
+			if res[address] == nil {
+				res[address] = make(map[common.Key]bool, len(keys))
+			}
+			maps.Copy(res[address], keys)
+		}
+	}
+	return res, nil
+}
+
+// getRemovedSlots returns the slots removed from the written-slot tracking by
+// the archived blocks after the given block and before the given end.
+func (a *diskArchive) getRemovedSlots(after, before uint64) ([]map[common.Address]map[common.Key]bool, error) {
+	pos := sort.Search(len(a.entries), func(i int) bool {
+		return a.entries[i].block > after
+	})
+	var res []map[common.Address]map[common.Key]bool
+	for _, entry := range a.entries[pos:] {
+		if entry.block >= before {
+			break
+		}
+		record, err := a.readRecord(entry.offset)
+		if err != nil {
+			return nil, err
+		}
+		removed, err := decodeRecordSlots(record.removed)
+		if err != nil {
+			return nil, fmt.Errorf("invalid removed slots of block %d: %w", record.block, err)
+		}
+		if len(removed) > 0 {
+			res = append(res, removed)
+		}
+	}
+	return res, nil
+}
+
+// getCheckpointBlock returns the block of the closest checkpoint at or
+// before the given block. Since the first archived block always has a
+// checkpoint, such a checkpoint exists for every archived block.
+func (a *diskArchive) getCheckpointBlock(block uint64) uint64 {
+	a.checkpointMutex.Lock()
+	defer a.checkpointMutex.Unlock()
+	pos := sort.Search(len(a.checkpoints), func(i int) bool {
+		return a.checkpoints[i] > block
+	})
+	if pos == 0 {
+		return 0
+	}
+	return a.checkpoints[pos-1]
+}
+
+func (a *diskArchive) getCheckpointPath(block uint64) string {
+	return filepath.Join(a.directory, fmt.Sprintf("%s%d", diskArchiveCheckpointName, block))
+}
+
+// writeCheckpoint writes a checksummed copy of the given trie, including its
+// shape, and of the given encoded tracked slots as the checkpoint of the given
+// block.
+func (a *diskArchive) writeCheckpoint(block uint64, version *trie.Trie, slots []byte) error {
+	data := serializeTrie(version)
+	data = appendLeafDepths(data, version.GetLeafDepths())
+	data = append(data, slots...)
+	data = binary.BigEndian.AppendUint32(data, crc32.Checksum(data, snapshotChecksumTable))
+	return writeFileAtomically(a.directory, filepath.Base(a.getCheckpointPath(block)), data)
+}
+
+// writeFileAtomically writes the given data to the named file in the given
+// directory. The data is written to a temporary file, which is synced and
+// renamed, such that the file is either left unchanged or completely
+// replaced, even if the write is interrupted.
+func writeFileAtomically(directory, name string, data []byte) error {
+	path := filepath.Join(directory, name)
+	temp := path + diskArchiveTempSuffix
+	file, err := os.OpenFile(temp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(data); err != nil {
+		return errors.Join(err, file.Close(), os.Remove(temp))
+	}
+	if err := file.Sync(); err != nil {
+		return errors.Join(err, file.Close(), os.Remove(temp))
+	}
+	if err := file.Close(); err != nil {
+		return errors.Join(err, os.Remove(temp))
+	}
+	if err := os.Rename(temp, path); err != nil {
+		return errors.Join(err, os.Remove(temp))
+	}
+	return syncDirectory(directory)
+}
+
+// readCheckpoint reads the checkpoint of the given block and verifies its
+// checksum. The checksum is stripped from the returned data.
+func (a *diskArchive) readCheckpoint(block uint64) ([]byte, error) {
+	data, err := os.ReadFile(a.getCheckpointPath(block))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read checkpoint of block %d: %w", block, err)
+	}
+	if err := verifySnapshotChecksum(data); err != nil {
+		return nil, fmt.Errorf("invalid checkpoint of block %d: %w", block, err)
+	}
+	return data[:len(data)-snapshotChecksumSize], nil
+}
+
+// splitCheckpoint splits the content of a checkpoint into the serialized
+// trie, its decoded leaf depths and the encoded tracked slots.
+func splitCheckpoint(data []byte) ([]byte, []trie.LeafDepth, []byte, error) {
+	if len(data) < 4 {
+		return nil, nil, nil, fmt.Errorf("checkpoint too short")
+	}
+	size := 4 + uint64(binary.BigEndian.Uint32(data[0:4]))*64
+	if uint64(len(data)) < size+4 {
+		return nil, nil, nil, fmt.Errorf("checkpoint too short for %d entries", (size-4)/64)
+	}
+	end := size + 4 + uint64(binary.BigEndian.Uint32(data[size:size+4]))*leafDepthSize
+	if uint64(len(data)) < end {
+		return nil, nil, nil, fmt.Errorf("checkpoint too short for leaf depths")
+	}
+	depths, err := decodeLeafDepths(data[size:end])
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return data[:size], depths, data[end:], nil
+}
+
+// readRecord reads the record starting at the given offset of the blocks file
+// and verifies its checksum. Lengths read from the record are checked against
+// the size of the blocks file before memory is allocated for the data they
+// describe, such that corrupted lengths are rejected.
+func (a *diskArchive) readRecord(offset uint64) (diskRecord, error) {
+	position := offset
+	content := make([]byte, 0, diskRecordHeaderSize)
+	read := func(size uint64) ([]byte, error) {
+		if position > a.size || size > a.size-position {
+			return nil, fmt.Errorf("record at offset %d exceeds the blocks file", offset)
+		}
+		data := make([]byte, size)
+		if _, err := a.blocks.ReadAt(data, int64(position)); err != nil {
+			return nil, err
+		}
+		position += size
+		content = append(content, data...)
+		return data, nil
+	}
+
+	header, err := read(diskRecordHeaderSize)
+	if err != nil {
+		return diskRecord{}, fmt.Errorf("failed to read record header at offset %d: %w", offset, err)
+	}
+	record := diskRecord{
+		block:      binary.BigEndian.Uint64(header[0:8]),
+		commitment: [32]byte(header[8:40]),
+	}
+	numChanges := uint64(binary.BigEndian.Uint32(header[40:44]))
+	data, err := read(numChanges * diskChangeSize)
+	if err != nil {
+		return diskRecord{}, fmt.Errorf("failed to read changes of block %d: %w", record.block, err)
+	}
+	record.changes = make([]change, 0, numChanges)
+	for i := range numChanges {
+		cur := data[i*diskChangeSize:]
+		record.changes = append(record.changes, change{
+			key:    trie.Key(cur[0:32]),
+			before: readEntry(cur[32:]),
+			after:  readEntry(cur[32+diskEntrySize:]),
+		})
+	}
+
+	for _, slots := range []*[]byte{&record.added, &record.removed} {
+		length, err := read(4)
+		if err != nil {
+			return diskRecord{}, fmt.Errorf("failed to read slots of block %d: %w", record.block, err)
+		}
+		if size := binary.BigEndian.Uint32(length); size > 0 {
+			if *slots, err = read(uint64(size)); err != nil {
+				return diskRecord{}, fmt.Errorf("failed to read slots of block %d: %w", record.block, err)
+			}
+		}
+	}
+
+	checksum := crc32.Checksum(content, snapshotChecksumTable)
+	stored, err := read(snapshotChecksumSize)
+	if err != nil {
+		return diskRecord{}, fmt.Errorf("failed to read checksum of block %d: %w", record.block, err)
+	}
+	if binary.BigEndian.Uint32(stored) != checksum {
+		return diskRecord{}, fmt.Errorf("invalid record of block %d: checksum mismatch", record.block)
+	}
+	record.size = position - offset
+	return record, nil
+}
+
+// flush writes all buffered data to the disk, including a checkpoint written
+// in the background.
+func (a *diskArchive) flush() error {
+	return errors.Join(a.collectCheckpoint(true), a.blocks.Sync(), a.index.Sync())
+}
+
+// close flushes and closes the archive files.
+func (a *diskArchive) close() error {
+	return errors.Join(a.flush(), a.blocks.Close(), a.index.Close())
+}
+
+// syncDirectory makes changes to the entries of the given directory, like
+// created or renamed files, durable.
+func syncDirectory(directory string) error {
+	dir, err := os.Open(directory)
+	if err != nil {
+		return err
+	}
+	return errors.Join(dir.Sync(), dir.Close())
+}
+
+// appendSlots appends the length-prefixed encoding of the given slots, which
+// is omitted if there are none.
+func appendSlots(data []byte, slots map[common.Address]map[common.Key]bool) []byte {
+	if len(slots) == 0 {
+		return binary.BigEndian.AppendUint32(data, 0)
+	}
+	encoded := encodeWrittenSlots(slots)
+	data = binary.BigEndian.AppendUint32(data, uint32(len(encoded)))
+	return append(data, encoded...)
+}
+
+// decodeRecordSlots decodes slots appended by appendSlots, which are empty if
+// they have been omitted.
+func decodeRecordSlots(data []byte) (map[common.Address]map[common.Key]bool, error) {
+	if len(data) == 0 {
+		return nil, nil
+	}
+	return decodeWrittenSlots(data)
+}
+
+func appendEntry(data []byte, e entry) []byte {
+	used := byte(0)
+	if e.used {
+		used = 1
+	}
+	data = append(data, used)
+	return append(data, e.value[:]...)
+}
+
+func readEntry(data []byte) entry {
+	return entry{
+		used:  data[0] != 0,
+		value: trie.Value(data[1:diskEntrySize]),
+	}
+}
+
+// findChange locates the change of the given key in a list of changes ordered
+// by key.
+func findChange(changes []change, key trie.Key) (change, bool) {
+	pos, found := slices.BinarySearchFunc(changes, key, func(c change, key trie.Key) int {
+		return bytes.Compare(c.key[:], key[:])
+	})
+	if !found {
+		return change{}, false
+	}
+	return changes[pos], true
+}
+
+// lookupCheckpoint retrieves the value of the given key from a trie serialized
+// by serializeTrie. Since entries are serialized in key order, the key is
+// located using a binary search.
+func lookupCheckpoint(data []byte, key trie.Key) trie.Value {
+	if len(data) < 4 {
+		return trie.Value{}
+	}
+	numEntries := int(binary.BigEndian.Uint32(data[0:4]))
+	getKey := func(i int) []byte {
+		return data[4+i*64 : 4+i*64+32]
+	}
+	pos := sort.Search(numEntries, func(i int) bool {
+		return bytes.Compare(getKey(i), key[:]) >= 0
+	})
+	if pos == numEntries || !bytes.Equal(getKey(pos), key[:]) {
+		return trie.Value{}
+	}
+	return trie.Value(data[4+pos*64+32 : 4+pos*64+64])
+}
@@ -0,0 +1,547 @@
+package memory
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/QoraNet/qoraDB/go/common"
+	"github.com/QoraNet/qoraDB/go/common/amount"
+	"github.com/QoraNet/qoraDB/go/database/vt/memory/trie"
+	"github.com/QoraNet/qoraDB/go/state"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDiskArchive_BlocksCanBeReconstructedAfterReopening(t *testing.T) {
+	require := require.New(t)
+	directory := t.TempDir()
+
+	archive, err := openDiskArchive(directory)
+	require.NoError(err)
+	archive.checkpointInterval = 4
+
+	tree := &trie.Trie{}
+	commitments := map[uint64][32]byte{}
+	for block := range uint64(10) {
+		changes := []change{{
+			key:    trie.Key{1},
+			before: entry{value: tree.Get(trie.Key{1}), used: block > 0},
+			after:  entry{value: trie.Value{byte(block)}, used: true},
+		}}
+		tree.Set(trie.Key{1}, trie.Value{byte(block)})
+		if block%3 == 0 {
+			changes = append(changes, change{key: trie.Key{2, 31: byte(block)}, after: entry{value: trie.Value{1}, used: true}})
+			tree.Set(trie.Key{2, 31: byte(block)}, trie.Value{1})
+		}
+		commitments[block] = tree.Commit().Compress()
+		require.NoError(archive.addBlock(block, commitments[block], changes, slotChanges{}, tree.Clone()))
+	}
+	require.NoError(archive.flush())
+	require.Equal([]uint64{0, 4, 8}, archive.checkpoints)
+	require.NoError(archive.close())
+
+	archive, err = openDiskArchive(directory)
+	require.NoError(err)
+	defer archive.close()
+
+	height, found := archive.getBlockHeight()
+	require.True(found)
+	require.Equal(uint64(9), height)
+	require.Equal([]uint64{0, 4, 8}, archive.checkpoints)
+
+	for block := range uint64(10) {
+		restored, err := archive.getTrie(block)
+		require.NoError(err, "block %d", block)
+		require.Equal(commitments[block], restored.Commit().Compress(), "block %d", block)
+
+		commitment, err := archive.getCommitment(block)
+		require.NoError(err)
+		require.Equal(commitments[block], commitment)
+
+		value, err := archive.getValue(block, trie.Key{1})
+		require.NoError(err)
+		require.Equal(trie.Value{byte(block)}, value, "block %d", block)
+
+		for past := range uint64(10) {
+			value, err := archive.getValue(block, trie.Key{2, 31: byte(past)})
+			require.NoError(err)
+			require.Equal(restored.Get(trie.Key{2, 31: byte(past)}), value, "block %d, key %d", block, past)
+		}
+	}
+
+	_, err = archive.getTrie(10)
+	require.Error(err)
+}
+
+func TestDiskArchive_CheckpointsReproduceShapeOfTrieWithDeletedKeys(t *testing.T) {
+	require := require.New(t)
+
+	archive, err := openDiskArchive(t.TempDir())
+	require.NoError(err)
+	defer archive.close()
+
+	tree := getTrieWithDeletedKeys()
+	require.NotEmpty(tree.GetLeafDepths())
+	commitment := tree.Commit().Compress()
+	require.NoError(archive.addBlock(1, commitment, nil, slotChanges{}, tree))
+
+	restored, err := archive.getTrie(1)
+	require.NoError(err)
+	require.Equal(commitment, restored.Commit().Compress())
+	require.Equal(tree.GetLeafDepths(), restored.GetLeafDepths())
+}
+
+func TestDiskArchive_BlocksMustBeAddedInIncreasingOrder(t *testing.T) {
+	require := require.New(t)
+	archive, err := openDiskArchive(t.TempDir())
+	require.NoError(err)
+	defer archive.close()
+
+	tree := &trie.Trie{}
+	require.NoError(archive.addBlock(5, tree.Commit().Compress(), nil, slotChanges{}, tree))
+	require.Error(archive.addBlock(5, tree.Commit().Compress(), nil, slotChanges{}, tree))
+	require.Error(archive.addBlock(4, tree.Commit().Compress(), nil, slotChanges{}, tree))
+	require.NoError(archive.addBlock(6, tree.Commit().Compress(), nil, slotChanges{}, tree))
+}
+
+func TestDiskArchive_IncompleteTrailingDataIsDiscarded(t *testing.T) {
+	require := require.New(t)
+	directory := t.TempDir()
+
+	archive, err := openDiskArchive(directory)
+	require.NoError(err)
+	tree := &trie.Trie{}
+	tree.Set(trie.Key{1}, trie.Value{1})
+	require.NoError(archive.addBlock(1, tree.Commit().Compress(), nil, slotChanges{}, tree))
+	require.NoError(archive.close())
+
+	// Simulate a write interrupted after parts of the next block were written.
+	for _, name := range []string{diskArchiveBlocksFile, diskArchiveIndexFile} {
+		file, err := os.OpenFile(filepath.Join(directory, name), os.O_APPEND|os.O_WRONLY, 0600)
+		require.NoError(err)
+		_, err = file.Write([]byte{1, 2, 3})
+		require.NoError(err)
+		require.NoError(file.Close())
+	}
+
+	archive, err = openDiskArchive(directory)
+	require.NoError(err)
+	height, found := archive.getBlockHeight()
+	require.True(found)
+	require.Equal(uint64(1), height)
+
+	tree.Set(trie.Key{1}, trie.Value{2})
+	require.NoError(archive.addBlock(2, tree.Commit().Compress(), []change{{
+		key:    trie.Key{1},
+		before: entry{value: trie.Value{1}, used: true},
+		after:  entry{value: trie.Value{2}, used: true},
+	}}, slotChanges{}, tree))
+	restored, err := archive.getTrie(2)
+	require.NoError(err)
+	require.Equal(trie.Value{2}, restored.Get(trie.Key{1}))
+	require.NoError(archive.close())
+}
+
+func TestDiskArchive_CorruptedCheckpointsAreDetected(t *testing.T) {
+	require := require.New(t)
+	directory := t.TempDir()
+
+	archive, err := openDiskArchive(directory)
+	require.NoError(err)
+	tree := &trie.Trie{}
+	tree.Set(trie.Key{1}, trie.Value{1})
+	require.NoError(archive.addBlock(1, tree.Commit().Compress(), nil, slotChanges{}, tree))
+	require.NoError(archive.close())
+
+	path := archive.getCheckpointPath(1)
+	data, err := os.ReadFile(path)
+	require.NoError(err)
+	data[len(data)/2]++
+	require.NoError(os.WriteFile(path, data, 0600))
+
+	archive, err = openDiskArchive(directory)
+	require.NoError(err)
+	defer archive.close()
+
+	_, err = archive.getTrie(1)
+	require.ErrorContains(err, "invalid checkpoint")
+	_, err = archive.getValue(1, trie.Key{1})
+	require.ErrorContains(err, "invalid checkpoint")
+}
+
+func TestDiskArchive_CorruptedRecordsAreDetected(t *testing.T) {
+	tests := map[string]func(data []byte){
+		"modified change": func(data []byte) {
+			data[diskRecordHeaderSize+40]++
+		},
+		"excessive number of changes": func(data []byte) {
+			copy(data[40:44], []byte{0xff, 0xff, 0xff, 0xff})
+		},
+		"excessive length of slots": func(data []byte) {
+			copy(data[diskRecordHeaderSize+diskChangeSize:], []byte{0xff, 0xff, 0xff, 0xff})
+		},
+	}
+	for name, corrupt := range tests {
+		t.Run(name, func(t *testing.T) {
+			require := require.New(t)
+			directory := t.TempDir()
+
+			archive, err := openDiskArchive(directory)
+			require.NoError(err)
+			tree := &trie.Trie{}
+			for block := range uint64(2) {
+				tree.Set(trie.Key{1}, trie.Value{byte(block + 1)})
+				require.NoError(archive.addBlock(block, tree.Commit().Compress(), []change{{
+					key:    trie.Key{1},
+					before: entry{value: trie.Value{byte(block)}, used: block > 0},
+					after:  entry{value: trie.Value{byte(block + 1)}, used: true},
+				}}, slotChanges{}, tree.Clone()))
+			}
+			require.NoError(archive.close())
+
+			// The record of the first block is located at the start of the file.
+			path := filepath.Join(directory, diskArchiveBlocksFile)
+			data, err := os.ReadFile(path)
+			require.NoError(err)
+			corrupt(data)
+			require.NoError(os.WriteFile(path, data, 0600))
+
+			archive, err = openDiskArchive(directory)
+			require.NoError(err)
+			defer archive.close()
+
+			_, err = archive.getCommitment(0)
+			require.ErrorContains(err, "block 0")
+			_, err = archive.getTrie(1)
+			require.ErrorContains(err, "block 0")
+		})
+	}
+}
+
+func TestDiskArchive_IncompleteCheckpointsAreRemoved(t *testing.T) {
+	require := require.New(t)
+	directory := t.TempDir()
+
+	archive, err := openDiskArchive(directory)
+	require.NoError(err)
+	tree := &trie.Trie{}
+	require.NoError(archive.addBlock(1, tree.Commit().Compress(), nil, slotChanges{}, tree))
+	require.NoError(archive.close())
+
+	// Simulate a checkpoint write interrupted before the file was renamed.
+	temp := archive.getCheckpointPath(2) + diskArchiveTempSuffix
+	require.NoError(os.WriteFile(temp, []byte{1, 2, 3}, 0600))
+
+	archive, err = openDiskArchive(directory)
+	require.NoError(err)
+	defer archive.close()
+	require.Equal([]uint64{1}, archive.checkpoints)
+	require.NoFileExists(temp)
+
+	require.NoError(archive.addBlock(2, tree.Commit().Compress(), nil, slotChanges{}, tree))
+	_, err = archive.getTrie(2)
+	require.NoError(err)
+}
+
+func TestDiskArchive_FailedBackgroundCheckpointsAreReportedAndRetried(t *testing.T) {
+	require := require.New(t)
+
+	archive, err := openDiskArchive(t.TempDir())
+	require.NoError(err)
+	defer archive.close()
+	archive.checkpointInterval = 2
+
+	// The checkpoint of block 2 can not be written, since its temporary file
+	// is blocked by a directory.
+	temp := archive.getCheckpointPath(2) + diskArchiveTempSuffix
+	require.NoError(os.Mkdir(temp, 0700))
+
+	tree := &trie.Trie{}
+	addBlock := func(block uint64) error {
+		changes := []change{{
+			key:    trie.Key{1},
+			before: entry{value: tree.Get(trie.Key{1}), used: block > 0},
+			after:  entry{value: trie.Value{byte(block + 1)}, used: true},
+		}}
+		tree.Set(trie.Key{1}, trie.Value{byte(block + 1)})
+		return archive.addBlock(block, tree.Commit().Compress(), changes, slotChanges{}, tree.Clone())
+	}
+	for block := range uint64(3) {
+		require.NoError(addBlock(block))
+	}
+	require.ErrorContains(archive.flush(), "checkpoint for block 2")
+	require.Equal([]uint64{0}, archive.checkpoints)
+
+	// Blocks remain accessible through the previous checkpoint.
+	_, err = archive.getTrie(2)
+	require.NoError(err)
+
+	// The checkpoint is retried with the next block.
+	require.NoError(os.Remove(temp))
+	require.NoError(addBlock(3))
+	require.NoError(archive.flush())
+	require.Equal([]uint64{0, 3}, archive.checkpoints)
+	restored, err := archive.getTrie(3)
+	require.NoError(err)
+	require.Equal(trie.Value{4}, restored.Get(trie.Key{1}))
+}
+
+func TestDiskArchive_CoveredHeightSurvivesReopeningAndTruncation(t *testing.T) {
+	require := require.New(t)
+	directory := t.TempDir()
+
+	archive, err := openDiskArchive(directory)
+	require.NoError(err)
+	tree := &trie.Trie{}
+	require.Error(archive.cover(1))
+	require.NoError(archive.addBlock(1, tree.Commit().Compress(), nil, slotChanges{}, tree))
+	require.NoError(archive.cover(3))
+	require.Error(archive.cover(3))
+	require.Error(archive.addBlock(3, tree.Commit().Compress(), nil, slotChanges{}, tree))
+	require.NoError(archive.close())
+
+	archive, err = openDiskArchive(directory)
+	require.NoError(err)
+	height, found := archive.getBlockHeight()
+	require.True(found)
+	require.Equal(uint64(3), height)
+	source, found := archive.resolve(height)
+	require.True(found)
+	require.Equal(uint64(1), source)
+
+	require.NoError(archive.truncate(1))
+	height, _ = archive.getBlockHeight()
+	require.Equal(uint64(1), height)
+	require.NoError(archive.close())
+
+	archive, err = openDiskArchive(directory)
+	require.NoError(err)
+	defer archive.close()
+	height, _ = archive.getBlockHeight()
+	require.Equal(uint64(1), height)
+}
+
+func TestState_ArchiveIsPersistedInDirectory(t *testing.T) {
+	require := require.New(t)
+	params := state.Parameters{Directory: t.TempDir()}
+
+	st, err := NewStateWithArchivePolicy(params, DefaultArchivePolicy)
+	require.NoError(err)
+
+	address := common.Address{1}
+	hashes := map[uint64]common.Hash{}
+	for block := range uint64(5) {
+		require.NoError(st.Apply(block, common.Update{
+			Balances: []common.BalanceUpdate{{Account: address, Balance: amount.New(block + 1)}},
+		}))
+		hashes[block], err = st.GetHash()
+		require.NoError(err)
+	}
+	require.NoError(st.Flush())
+	require.NoError(st.Close())
+
+	st, err = NewStateWithArchivePolicy(params, DefaultArchivePolicy)
+	require.NoError(err)
+	defer st.Close()
+
+	// The live state continues from the last archived block.
+	hash, err := st.GetHash()
+	require.NoError(err)
+	require.Equal(hashes[4], hash)
+
+	height, empty, err := st.GetArchiveBlockHeight()
+	require.NoError(err)
+	require.False(empty)
+	require.Equal(uint64(4), height)
+
+	for block := range uint64(5) {
+		archived, err := st.GetArchiveState(block)
+		require.NoError(err)
+		hash, err := archived.GetHash()
+		require.NoError(err)
+		require.Equal(hashes[block], hash, "block %d", block)
+		balance, err := archived.GetBalance(address)
+		require.NoError(err)
+		require.Equal(amount.New(block+1), balance, "block %d", block)
+		require.NoError(archived.Close())
+	}
+
+	require.NoError(st.Apply(5, common.Update{
+		Balances: []common.BalanceUpdate{{Account: address, Balance: amount.New(6)}},
+	}))
+	balance, err := st.GetBalance(address)
+	require.NoError(err)
+	require.Equal(amount.New(6), balance)
+}
+
+func TestState_HeightOfBlocksWithoutChangesIsPersisted(t *testing.T) {
+	require := require.New(t)
+	params := state.Parameters{Directory: t.TempDir()}
+
+	st, err := NewStateWithArchivePolicy(params, DefaultArchivePolicy)
+	require.NoError(err)
+	address := common.Address{1}
+	require.NoError(st.Apply(1, common.Update{
+		Balances: []common.BalanceUpdate{{Account: address, Balance: amount.New(1)}},
+	}))
+	want, err := st.GetHash()
+	require.NoError(err)
+	require.NoError(st.Apply(2, common.Update{}))
+	require.NoError(st.Apply(4, common.Update{}))
+	require.NoError(st.Close())
+
+	st, err = NewStateWithArchivePolicy(params, DefaultArchivePolicy)
+	require.NoError(err)
+	defer st.Close()
+
+	height, empty, err := st.GetArchiveBlockHeight()
+	require.NoError(err)
+	require.False(empty)
+	require.Equal(uint64(4), height)
+
+	hash, err := st.GetHash()
+	require.NoError(err)
+	require.Equal(want, hash)
+
+	archived, err := st.GetArchiveState(4)
+	require.NoError(err)
+	hash, err = archived.GetHash()
+	require.NoError(err)
+	require.Equal(want, hash)
+	require.NoError(archived.Close())
+
+	err = st.Apply(4, common.Update{})
+	require.ErrorAs(err, new(*BlockOrderError))
+	require.NoError(st.Apply(5, common.Update{
+		Balances: []common.BalanceUpdate{{Account: address, Balance: amount.New(5)}},
+	}))
+}
+
+func TestState_FailedArchivingDoesNotCommitBlock(t *testing.T) {
+	require := require.New(t)
+	directory := t.TempDir()
+
+	st, err := newStateWithArchivePolicy(state.Parameters{Directory: directory}, DefaultArchivePolicy)
+	require.NoError(err)
+	defer st.Close()
+
+	address := common.Address{1}
+	require.NoError(st.Apply(1, common.Update{
+		Balances: []common.BalanceUpdate{{Account: address, Balance: amount.New(1)}},
+		Slots:    []common.SlotUpdate{{Account: address, Key: common.Key{1}, Value: common.Value{1}}},
+	}))
+	before, err := st.GetHash()
+	require.NoError(err)
+
+	// Writing the block to the disk fails while the blocks file is closed.
+	path := filepath.Join(directory, "archive", diskArchiveBlocksFile)
+	require.NoError(st.archive.disk.blocks.Close())
+	update := common.Update{DeletedAccounts: []common.Address{address}}
+	require.Error(st.Apply(2, update))
+
+	require.Equal(uint64(1), st.lastBlock)
+	require.NotEmpty(st.touched)
+	require.NotEmpty(st.removedSlots)
+	require.Equal([]uint64{1}, st.archive.order)
+	height, _, err := st.GetArchiveBlockHeight()
+	require.NoError(err)
+	require.Equal(uint64(1), height)
+
+	// Once the disk is available again, the block can be applied again.
+	st.archive.disk.blocks, err = os.OpenFile(path, os.O_RDWR, 0600)
+	require.NoError(err)
+	require.NoError(st.Apply(2, update))
+	after, err := st.GetHash()
+	require.NoError(err)
+
+	for block, want := range map[uint64]common.Hash{1: before, 2: after} {
+		archived, err := st.GetArchiveState(block)
+		require.NoError(err)
+		hash, err := archived.GetHash()
+		require.NoError(err)
+		require.Equal(want, hash, "block %d", block)
+	}
+
+	// The slots removed by the block are restored when reverting it.
+	require.NoError(st.RevertTo(1))
+	empty, err := st.HasEmptyStorage(address)
+	require.NoError(err)
+	require.False(empty)
+}
+
+func TestState_WrittenSlotsAreRestoredAfterRestart(t *testing.T) {
+	require := require.New(t)
+	params := state.Parameters{Directory: t.TempDir()}
+
+	a, b, c := common.Address{1}, common.Address{2}, common.Address{3}
+	updates := []common.Update{
+		{
+			Balances: []common.BalanceUpdate{{Account: a, Balance: amount.New(1)}},
+			Slots:    []common.SlotUpdate{{Account: a, Key: common.Key{1}, Value: common.Value{1}}},
+		},
+		{
+			Balances: []common.BalanceUpdate{{Account: c, Balance: amount.New(1)}},
+			Slots: []common.SlotUpdate{
+				{Account: a, Key: common.Key{2}, Value: common.Value{2}},
+				{Account: b, Key: common.Key{3}, Value: common.Value{3}},
+			},
+		},
+		{DeletedAccounts: []common.Address{b}},
+	}
+
+	st, err := newStateWithArchivePolicy(params, DefaultArchivePolicy)
+	require.NoError(err)
+	reference := newState()
+	for i, update := range updates {
+		require.NoError(st.Apply(uint64(i+1), update))
+		require.NoError(reference.Apply(uint64(i+1), update))
+	}
+	require.NoError(st.Close())
+
+	st, err = newStateWithArchivePolicy(params, DefaultArchivePolicy)
+	require.NoError(err)
+	defer st.Close()
+	require.Equal(reference.writtenSlots, st.writtenSlots)
+
+	empty, err := st.HasEmptyStorage(a)
+	require.NoError(err)
+	require.False(empty)
+
+	// Deleting the account wipes the storage written before the restart.
+	update := common.Update{DeletedAccounts: []common.Address{a}}
+	require.NoError(st.Apply(4, update))
+	require.NoError(reference.Apply(4, update))
+	for _, key := range []common.Key{{1}, {2}} {
+		value, err := st.GetStorage(a, key)
+		require.NoError(err)
+		require.Equal(common.Value{}, value)
+	}
+	require.Equal(getHash(t, reference), getHash(t, st))
+}
+
+func TestState_ArchivedStorageIsReportedForBlocksPrunedFromMemory(t *testing.T) {
+	require := require.New(t)
+	params := state.Parameters{Directory: t.TempDir()}
+
+	st, err := newStateWithArchivePolicy(params, ArchivePolicy{MaxBlocks: 1})
+	require.NoError(err)
+	defer st.Close()
+
+	address := common.Address{1}
+	require.NoError(st.Apply(1, common.Update{
+		Slots: []common.SlotUpdate{{Account: address, Key: common.Key{1}, Value: common.Value{1}}},
+	}))
+	require.NoError(st.Apply(2, common.Update{DeletedAccounts: []common.Address{address}}))
+	require.NoError(st.Apply(3, common.Update{
+		Balances: []common.BalanceUpdate{{Account: common.Address{2}, Balance: amount.New(1)}},
+	}))
+	require.Equal([]uint64{3}, st.archive.order)
+
+	// The deletion in block 2 is only known to the disk.
+	archived, err := st.GetArchiveState(1)
+	require.NoError(err)
+	defer archived.Close()
+	empty, err := archived.HasEmptyStorage(address)
+	require.NoError(err)
+	require.False(empty)
+}
@@ -0,0 +1,391 @@
+package memory
+
+import (
+	"testing"
+
+	"github.com/QoraNet/qoraDB/go/common"
+	"github.com/QoraNet/qoraDB/go/common/amount"
+	"github.com/QoraNet/qoraDB/go/database/vt/memory/trie"
+	"github.com/QoraNet/qoraDB/go/state"
+	"github.com/stretchr/testify/require"
+)
+
+func TestArchive_HistoricStatesCanBeReconstructed(t *testing.T) {
+	require := require.New(t)
+
+	state := newStateWithArchive(ArchivePolicy{})
+
+	address := common.Address{1}
+	hashes := map[uint64]common.Hash{}
+	for block := range uint64(10) {
+		update := common.Update{
+			Balances: []common.BalanceUpdate{{Account: address, Balance: amount.New(block + 1)}},
+			Slots:    []common.SlotUpdate{{Account: address, Key: common.Key{byte(block)}, Value: common.Value{1}}},
+		}
+		if block == 6 {
+			update.DeletedAccounts = []common.Address{address}
+		}
+		require.NoError(state.Apply(block, update))
+		hash, err := state.GetHash()
+		require.NoError(err)
+		hashes[block] = hash
+	}
+
+	for block := range uint64(10) {
+		archived, err := state.GetArchiveState(block)
+		require.NoError(err)
+
+		hash, err := archived.GetHash()
+		require.NoError(err)
+		require.Equal(hashes[block], hash, "block %d", block)
+
+		balance, err := archived.GetBalance(address)
+		require.NoError(err)
+		require.Equal(amount.New(block+1), balance, "block %d", block)
+	}
+}
+
+func TestArchive_OnlyChangesAreRecorded(t *testing.T) {
+	require := require.New(t)
+
+	// Changes are only retained by persisted archives.
+	state, err := newStateWithArchivePolicy(state.Parameters{Directory: t.TempDir()}, ArchivePolicy{})
+	require.NoError(err)
+	defer state.Close()
+	address := common.Address{1}
+	require.NoError(state.Apply(0, common.Update{
+		Balances: []common.BalanceUpdate{{Account: address, Balance: amount.New(1)}},
+	}))
+	require.NoError(state.Apply(1, common.Update{
+		Balances: []common.BalanceUpdate{{Account: address, Balance: amount.New(1)}},
+		Slots:    []common.SlotUpdate{{Account: address, Key: common.Key{1}, Value: common.Value{2}}},
+	}))
+
+	key := getStorageKey(address, common.Key{1})
+	require.Equal([]change{{
+		key:    key,
+		before: entry{},
+		after:  entry{value: trie.Value{2}, used: true},
+	}}, getRecordedChanges(t, state, 1))
+}
+
+// getRecordedChanges returns the changes of the given block recorded by the
+// disk archive of the given state.
+func getRecordedChanges(t *testing.T, state *State, block uint64) []change {
+	t.Helper()
+	pos, found := state.archive.disk.find(block)
+	require.True(t, found, "block %d is not archived", block)
+	record, err := state.archive.disk.readRecord(state.archive.disk.entries[pos].offset)
+	require.NoError(t, err)
+	return record.changes
+}
+
+func TestArchive_PruningRemovesOldestBlocks(t *testing.T) {
+	require := require.New(t)
+
+	archive := newVtArchive(ArchivePolicy{MaxBlocks: 3})
+	tree := &trie.Trie{}
+	for block := range uint64(10) {
+		tree.Set(trie.Key{byte(block)}, trie.Value{1})
+		require.NoError(archive.addBlock(block, nil, slotChanges{}, tree.Clone()))
+
+		require.Equal(min(int(block)+1, 3), len(archive.blocks))
+		for past := range block + 1 {
+			require.Equal(past+3 > block, archive.hasBlock(past), "block %d at %d", past, block)
+		}
+	}
+}
+
+func TestArchive_PruningHandlesOutOfOrderInserts(t *testing.T) {
+	require := require.New(t)
+
+	archive := newVtArchive(ArchivePolicy{MaxBlocks: 3})
+	for _, block := range []uint64{5, 1, 7, 3, 9} {
+		tree := &trie.Trie{}
+		tree.Set(trie.Key{byte(block)}, trie.Value{1})
+		require.NoError(archive.addBlock(block, nil, slotChanges{}, tree))
+	}
+	require.Equal([]uint64{5, 7, 9}, archive.order)
+	require.Len(archive.blocks, 3)
+	require.Equal(3*getEntrySize(1, 1), archive.getMemorySize())
+
+	height, found := archive.getBlockHeight()
+	require.True(found)
+	require.Equal(uint64(9), height)
+}
+
+func TestArchive_ArchivedTriesAreNotAffectedByLaterUpdates(t *testing.T) {
+	require := require.New(t)
+
+	archive := newVtArchive(ArchivePolicy{})
+	tree := &trie.Trie{}
+	commitments := map[uint64][32]byte{}
+	for block := range uint64(5) {
+		tree.Set(trie.Key{byte(block)}, trie.Value{byte(block + 1)})
+		tree.Set(trie.Key{31: 1}, trie.Value{byte(block + 1)})
+		commitments[block] = tree.Commit().Compress()
+		require.NoError(archive.addBlock(block, nil, slotChanges{}, tree.Clone()))
+	}
+
+	for block := range uint64(5) {
+		value, err := archive.getValue(block, trie.Key{31: 1})
+		require.NoError(err)
+		require.Equal(trie.Value{byte(block + 1)}, value)
+
+		// Modifications of restored tries must not leak into the archive.
+		restored, err := archive.getTrie(block)
+		require.NoError(err)
+		require.Equal(commitments[block], restored.Commit().Compress())
+		restored.Set(trie.Key{31: 1}, trie.Value{})
+		restored.Set(trie.Key{byte(block + 1)}, trie.Value{1})
+		restored.Commit()
+
+		commitment, err := archive.getCommitment(block)
+		require.NoError(err)
+		require.Equal(commitments[block], commitment)
+		again, err := archive.getTrie(block)
+		require.NoError(err)
+		require.Equal(commitments[block], again.Commit().Compress())
+	}
+}
+
+func TestArchive_MissingBlocksAreReported(t *testing.T) {
+	archive := newVtArchive(ArchivePolicy{})
+	_, err := archive.getTrie(1)
+	require.Error(t, err)
+}
+
+func TestArchiveView_AnswersQueriesWithoutReconstruction(t *testing.T) {
+	require := require.New(t)
+
+	state := newStateWithArchive(ArchivePolicy{})
+
+	address := common.Address{1}
+	for block := range uint64(8) {
+		update := common.Update{
+			Balances: []common.BalanceUpdate{{Account: address, Balance: amount.New(block + 1)}},
+			Nonces:   []common.NonceUpdate{{Account: address, Nonce: common.ToNonce(block)}},
+			Slots:    []common.SlotUpdate{{Account: address, Key: common.Key{byte(block % 2)}, Value: common.Value{byte(block)}}},
+		}
+		if block%4 == 0 {
+			update.Codes = []common.CodeUpdate{{Account: address, Code: []byte{byte(block), 100: 1}}}
+		}
+		require.NoError(state.Apply(block, update))
+	}
+
+	for block := range uint64(8) {
+		view, err := state.GetArchiveView(block)
+		require.NoError(err)
+		archived, err := state.GetArchiveState(block)
+		require.NoError(err)
+
+		wantHash, err := archived.GetHash()
+		require.NoError(err)
+		hash, err := view.GetHash()
+		require.NoError(err)
+		require.Equal(wantHash, hash, "block %d", block)
+
+		wantBalance, _ := archived.GetBalance(address)
+		balance, err := view.GetBalance(address)
+		require.NoError(err)
+		require.Equal(wantBalance, balance, "block %d", block)
+
+		wantNonce, _ := archived.GetNonce(address)
+		nonce, err := view.GetNonce(address)
+		require.NoError(err)
+		require.Equal(wantNonce, nonce, "block %d", block)
+
+		for _, key := range []common.Key{{0}, {1}, {2}} {
+			want, _ := archived.GetStorage(address, key)
+			value, err := view.GetStorage(address, key)
+			require.NoError(err)
+			require.Equal(want, value, "block %d, key %x", block, key)
+		}
+
+		wantCode, _ := archived.GetCode(address)
+		code, err := view.GetCode(address)
+		require.NoError(err)
+		require.Equal(wantCode, code, "block %d", block)
+
+		wantCodeHash, _ := archived.GetCodeHash(address)
+		codeHash, err := view.GetCodeHash(address)
+		require.NoError(err)
+		require.Equal(wantCodeHash, codeHash, "block %d", block)
+	}
+
+	_, err := state.GetArchiveView(8)
+	require.Error(err)
+}
+
+func TestState_NewState_ArchivesByDefault(t *testing.T) {
+	require := require.New(t)
+
+	// The archive cache size does not affect the retention of blocks.
+	for _, params := range []state.Parameters{{}, {ArchiveCache: 1}} {
+		st, err := NewState(params)
+		require.NoError(err)
+		require.Equal(DefaultArchivePolicy.MaxBlocks, st.(*State).archive.maxSize)
+		require.Zero(st.(*State).archive.maxBytes)
+
+		address := common.Address{1}
+		for block := range uint64(3) {
+			require.NoError(st.Apply(block, common.Update{
+				Balances: []common.BalanceUpdate{{Account: address, Balance: amount.New(block + 1)}},
+			}))
+		}
+		for block := range uint64(3) {
+			archived, err := st.GetArchiveState(block)
+			require.NoError(err)
+			balance, err := archived.GetBalance(address)
+			require.NoError(err)
+			require.Equal(amount.New(block+1), balance, "block %d", block)
+		}
+		require.NoError(st.Close())
+	}
+}
+
+func TestState_NewState_ArchiveIsDisabledIfNoArchiveIsSelected(t *testing.T) {
+	require := require.New(t)
+
+	st, err := NewState(state.Parameters{Archive: state.NoArchive})
+	require.NoError(err)
+	require.NoError(st.Apply(0, common.Update{}))
+
+	_, err = st.GetArchiveState(0)
+	require.ErrorIs(err, state.NoArchiveError)
+	_, _, err = st.GetArchiveBlockHeight()
+	require.ErrorIs(err, state.NoArchiveError)
+	_, err = st.(*State).GetArchiveView(0)
+	require.ErrorIs(err, state.NoArchiveError)
+	require.NoError(st.Close())
+}
+
+func TestArchive_MemoryBudgetLimitsRetainedBlocks(t *testing.T) {
+	require := require.New(t)
+
+	// Each block copies the root and the leaf of the account.
+	budget := 3 * getEntrySize(1, 1)
+	state := newStateWithArchive(ArchivePolicy{MaxBytes: budget})
+	for block := range uint64(10) {
+		require.NoError(state.Apply(block, common.Update{
+			Balances: []common.BalanceUpdate{{Account: common.Address{1}, Balance: amount.New(block + 1)}},
+		}))
+		require.LessOrEqual(state.archive.getMemorySize(), budget)
+	}
+	require.Len(state.archive.blocks, 3)
+	for block := range uint64(10) {
+		require.Equal(block >= 7, state.archive.hasBlock(block), "block %d", block)
+	}
+
+	// The most recent block is retained even if it exceeds the budget.
+	state = newStateWithArchive(ArchivePolicy{MaxBytes: 1})
+	require.NoError(state.Apply(0, common.Update{
+		Balances: []common.BalanceUpdate{{Account: common.Address{1}, Balance: amount.New(1)}},
+	}))
+	require.True(state.archive.hasBlock(0))
+}
+
+func TestArchive_OnlyBlocksAtIntervalAreArchived(t *testing.T) {
+	require := require.New(t)
+
+	state, err := newStateWithArchivePolicy(state.Parameters{Directory: t.TempDir()}, ArchivePolicy{Interval: 3})
+	require.NoError(err)
+	defer state.Close()
+	address := common.Address{1}
+	hashes := map[uint64]common.Hash{}
+	for block := range uint64(10) {
+		require.NoError(state.Apply(block, common.Update{
+			Balances: []common.BalanceUpdate{{Account: address, Balance: amount.New(block + 1)}},
+			Slots:    []common.SlotUpdate{{Account: address, Key: common.Key{byte(block)}, Value: common.Value{1}}},
+		}))
+		hashes[block], _ = state.GetHash()
+	}
+
+	for block := range uint64(10) {
+		archived, source, err := state.ResolveArchiveState(block)
+		require.NoError(err, "block %d", block)
+		require.Equal(block-block%3, source, "block %d", block)
+		hash, err := archived.GetHash()
+		require.NoError(err)
+		require.Equal(hashes[source], hash, "block %d", block)
+
+		// The state of skipped blocks differs from the resolved block, so it
+		// is not reported as the state of the skipped block.
+		archived, err = state.GetArchiveState(block)
+		if block%3 != 0 {
+			require.Error(err, "block %d", block)
+			continue
+		}
+		require.NoError(err, "block %d", block)
+		hash, err = archived.GetHash()
+		require.NoError(err)
+		require.Equal(hashes[block], hash, "block %d", block)
+	}
+
+	// Changes of skipped blocks are included in the next archived block.
+	keys := []trie.Key{}
+	for _, change := range getRecordedChanges(t, state, 9) {
+		keys = append(keys, change.key)
+	}
+	for block := range uint64(3) {
+		require.Contains(keys, getStorageKey(address, common.Key{byte(7 + block)}))
+	}
+
+	height, empty, err := state.GetArchiveBlockHeight()
+	require.NoError(err)
+	require.False(empty)
+	require.Equal(uint64(9), height)
+}
+
+func TestArchive_BlocksAreResolvedToClosestArchivedBlock(t *testing.T) {
+	require := require.New(t)
+
+	state := newStateWithArchive(ArchivePolicy{})
+	address := common.Address{1}
+	hashes := map[uint64]common.Hash{}
+	for _, block := range []uint64{2, 5, 6, 10} {
+		require.NoError(state.Apply(block, common.Update{
+			Balances: []common.BalanceUpdate{{Account: address, Balance: amount.New(block)}},
+		}))
+		hashes[block], _ = state.GetHash()
+	}
+
+	// Blocks not changing the state are not stored.
+	require.NoError(state.Apply(11, common.Update{}))
+	require.NoError(state.Apply(12, common.Update{
+		Balances: []common.BalanceUpdate{{Account: address, Balance: amount.New(10)}},
+	}))
+	require.Equal([]uint64{2, 5, 6, 10}, state.archive.order)
+	require.Len(state.archive.blocks, 4)
+
+	height, empty, err := state.GetArchiveBlockHeight()
+	require.NoError(err)
+	require.False(empty)
+	require.Equal(uint64(12), height)
+
+	want := map[uint64]uint64{2: 2, 3: 2, 4: 2, 5: 5, 6: 6, 7: 6, 9: 6, 10: 10, 11: 10, 12: 10}
+	for block, source := range want {
+		archived, got, err := state.ResolveArchiveState(block)
+		require.NoError(err, "block %d", block)
+		require.Equal(source, got, "block %d", block)
+		hash, err := archived.GetHash()
+		require.NoError(err)
+		require.Equal(hashes[source], hash, "block %d", block)
+
+		balance, err := archived.GetBalance(address)
+		require.NoError(err)
+		require.Equal(amount.New(source), balance, "block %d", block)
+		require.Equal(source, archived.(*State).lastBlock, "block %d", block)
+
+		view, err := state.GetArchiveView(block)
+		require.NoError(err, "block %d", block)
+		require.Equal(source, view.GetBlock(), "block %d", block)
+	}
+
+	for _, block := range []uint64{0, 1, 13} {
+		_, err := state.GetArchiveState(block)
+		require.Error(err, "block %d", block)
+		_, err = state.GetArchiveView(block)
+		require.Error(err, "block %d", block)
+	}
+}
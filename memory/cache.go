@@ -0,0 +1,92 @@
+package memory
+
+import (
+	"container/list"
+	"sync"
+
+	"github.com/QoraNet/qoraDB/go/common"
+	"github.com/holiman/uint256"
+)
+
+// stemCacheSize is the number of stems retained by the package-wide stem
+// cache used for deriving trie keys. With about 100 bytes per entry, a full
+// cache occupies roughly 400 KB of memory.
+const stemCacheSize = 4096
+
+// stems is the cache of stems used by getTrieKey. Stems only depend on the
+// address and the tree index, so a single cache can be shared by all states.
+var stems = newStemCache(stemCacheSize)
+
+// stemCache is a bounded cache of stems indexed by address and tree index,
+// evicting the least recently used entry when full. It serves the same
+// purpose as the utils.PointCache used by the geth reference implementation:
+// deriving a stem requires a Pedersen hash, which is expensive compared to
+// the trie operations it is needed for. The cache is safe for concurrent use.
+type stemCache struct {
+	mutex    sync.Mutex
+	capacity int
+	entries  map[stemCacheKey]*list.Element
+	order    *list.List // of *stemCacheEntry, most recently used first
+}
+
+// stemCacheKey is the input a stem is derived from.
+type stemCacheKey struct {
+	address   common.Address
+	treeIndex uint256.Int
+}
+
+type stemCacheEntry struct {
+	key  stemCacheKey
+	stem [31]byte
+}
+
+func newStemCache(capacity int) *stemCache {
+	return &stemCache{
+		capacity: capacity,
+		entries:  make(map[stemCacheKey]*list.Element, capacity),
+		order:    list.New(),
+	}
+}
+
+// get returns the stem for the given address and tree index, computing it
+// with the given function if it is not cached.
+func (c *stemCache) get(
+	address common.Address,
+	treeIndex uint256.Int,
+	compute func() [31]byte,
+) [31]byte {
+	key := stemCacheKey{address: address, treeIndex: treeIndex}
+
+	c.mutex.Lock()
+	if element, found := c.entries[key]; found {
+		c.order.MoveToFront(element)
+		stem := element.Value.(*stemCacheEntry).stem
+		c.mutex.Unlock()
+		return stem
+	}
+	c.mutex.Unlock()
+
+	// The stem is computed without holding the lock, such that concurrent
+	// lookups are not blocked by the hash computation.
+	stem := compute()
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if _, found := c.entries[key]; found {
+		return stem // added by a concurrent lookup in the meantime
+	}
+	c.entries[key] = c.order.PushFront(&stemCacheEntry{key: key, stem: stem})
+	if c.order.Len() > c.capacity {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*stemCacheEntry).key)
+	}
+	return stem
+}
+
+// len returns the number of cached stems.
+func (c *stemCache) len() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.order.Len()
+}
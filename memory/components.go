@@ -0,0 +1,244 @@
+package memory
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/QoraNet/qoraDB/go/backend"
+	"github.com/QoraNet/qoraDB/go/common"
+)
+
+// GetSnapshotableComponents returns the components of the state, which can be
+// snapshotted and verified independently of each other:
+//   - the trie, holding all account data, codes and storage slots, split into
+//     one part per partition and proven by the root commitment, and
+//   - the written-slot index, forming a single part tied to the root
+//     commitment of the trie, which it has to cover when it is restored.
+//
+// Codes are stored in the trie, so there is no separate code component. The
+// components operate on this state, and restoring them replaces the
+// respective data of the state. Restoring the trie drops the written-slot
+// index of the state, which has to be restored afterwards, followed by
+// RunPostRestoreTasks. Restoring the index before the trie it has been taken
+// with fails.
+func (s *State) GetSnapshotableComponents() []backend.Snapshotable {
+	return []backend.Snapshotable{
+		&trieComponent{state: s},
+		&writtenSlotsComponent{state: s},
+	}
+}
+
+// trieComponent exposes the trie of a state as a snapshotable component. Its
+// snapshots are state snapshots without the written-slot index.
+type trieComponent struct {
+	state *State
+}
+
+func (c *trieComponent) GetProof() (backend.Proof, error) {
+	return c.state.GetProof()
+}
+
+func (c *trieComponent) CreateSnapshot() (backend.Snapshot, error) {
+	snapshot := c.state.trie.Clone()
+	return &vtSnapshot{
+		trie:       snapshot,
+		commitment: snapshot.Commit().Compress(),
+	}, nil
+}
+
+func (c *trieComponent) Restore(snapshotData backend.SnapshotData) error {
+	metadata, trieParts, hasSlots, err := getSnapshotMetadata(snapshotData)
+	if err != nil {
+		return err
+	}
+	if hasSlots {
+		return fmt.Errorf("invalid metadata: snapshot is not a trie snapshot")
+	}
+	restored, err := c.state.restoreTrie(snapshotData, metadata, trieParts)
+	if err != nil {
+		return err
+	}
+
+	// The written-slot index of the state does not describe the restored
+	// trie, so it is dropped until the index is restored as well.
+	c.state.trie = restored
+	c.state.setWrittenSlots(make(map[common.Address]map[common.Key]bool))
+	return nil
+}
+
+func (c *trieComponent) GetSnapshotVerifier(metadata []byte) (backend.SnapshotVerifier, error) {
+	verifier, err := c.state.GetSnapshotVerifier(metadata)
+	if err != nil {
+		return nil, err
+	}
+	if verifier.(*vtSnapshotVerifier).hasSlots {
+		return nil, fmt.Errorf("invalid metadata: snapshot is not a trie snapshot")
+	}
+	return verifier, nil
+}
+
+// writtenSlotsComponent exposes the written-slot index of a state as a
+// snapshotable component. Its snapshots consist of a single part holding the
+// encoded index.
+//
+// The index is not covered by the root commitment and, since storage keys are
+// hashed, can not be derived from the trie either, so it can not be proven.
+// Instead, the component is tied to the trie: the metadata of its snapshots
+// lists the root commitment of the trie the index has been taken with, and
+// the proof of the component and of its snapshots is the proof of this root.
+// The index itself is thus left out of proof comparisons, such that states
+// with equal roots have equal proofs regardless of their indexes. Parts have
+// an empty proof and their verification only checks that they are
+// well-formed, since the trie is not available to the verifier. Restore
+// requires the trie of the snapshot to be restored already and rejects
+// indexes not accounting for all of its keys, like the restore of the
+// written-slot part of state snapshots.
+type writtenSlotsComponent struct {
+	state *State
+}
+
+func (c *writtenSlotsComponent) GetProof() (backend.Proof, error) {
+	return c.state.GetProof()
+}
+
+func (c *writtenSlotsComponent) CreateSnapshot() (backend.Snapshot, error) {
+	return &writtenSlotsSnapshot{
+		data: encodeWrittenSlots(c.state.getWrittenSlots()),
+		root: c.state.trie.Commit().Compress(),
+	}, nil
+}
+
+func (c *writtenSlotsComponent) Restore(snapshotData backend.SnapshotData) error {
+	data, err := snapshotData.GetMetaData()
+	if err != nil {
+		return fmt.Errorf("failed to get metadata: %w", err)
+	}
+	metadata, err := decodeWrittenSlotsMetadata(data)
+	if err != nil {
+		return err
+	}
+	if metadata.commitment != c.state.trie.Commit().Compress() {
+		return fmt.Errorf("written slots do not belong to the trie of the state, the trie has to be restored first")
+	}
+	data, err = snapshotData.GetPartData(0)
+	if err != nil {
+		return fmt.Errorf("failed to get written slots: %w", err)
+	}
+	writtenSlots, err := decodeWrittenSlots(data)
+	if err != nil {
+		return fmt.Errorf("failed to deserialize written slots: %w", err)
+	}
+	if err := checkWrittenSlotsCoverageOf(c.state.trie, writtenSlots); err != nil {
+		return fmt.Errorf("invalid written slots: %w", err)
+	}
+	c.state.setWrittenSlots(writtenSlots)
+	return nil
+}
+
+func (c *writtenSlotsComponent) GetSnapshotVerifier(metadata []byte) (backend.SnapshotVerifier, error) {
+	decoded, err := decodeWrittenSlotsMetadata(metadata)
+	if err != nil {
+		return nil, err
+	}
+	return &writtenSlotsVerifier{root: decoded.commitment}, nil
+}
+
+// decodeWrittenSlotsMetadata decodes the metadata of a snapshot of the
+// written-slot index, which has to consist of a single part.
+func decodeWrittenSlotsMetadata(data []byte) (snapshotMetadata, error) {
+	metadata, err := decodeSnapshotMetadata(data)
+	if err != nil {
+		return snapshotMetadata{}, fmt.Errorf("invalid metadata: %w", err)
+	}
+	if metadata.numParts != 1 {
+		return snapshotMetadata{}, fmt.Errorf("invalid metadata: expected a single part, got %d", metadata.numParts)
+	}
+	return metadata, nil
+}
+
+// writtenSlotsSnapshot is a snapshot of the written-slot index of a state.
+type writtenSlotsSnapshot struct {
+	data []byte   // encoded written-slot index
+	root [32]byte // root commitment of the trie the index belongs to
+}
+
+func (s *writtenSlotsSnapshot) GetRootProof() backend.Proof {
+	return &vtProof{commitment: bytes.Clone(s.root[:])}
+}
+
+func (s *writtenSlotsSnapshot) GetNumParts() int {
+	return 1
+}
+
+func (s *writtenSlotsSnapshot) GetProof(partNumber int) (backend.Proof, error) {
+	data, err := s.GetProofData(partNumber)
+	if err != nil {
+		return nil, err
+	}
+	return &vtPartProof{data: data}, nil
+}
+
+func (s *writtenSlotsSnapshot) GetPart(partNumber int) (backend.Part, error) {
+	data, err := s.GetPartData(partNumber)
+	if err != nil {
+		return nil, err
+	}
+	return &vtSnapshotPart{data: data}, nil
+}
+
+func (s *writtenSlotsSnapshot) GetData() backend.SnapshotData {
+	return s
+}
+
+func (s *writtenSlotsSnapshot) GetMetaData() ([]byte, error) {
+	return encodeSnapshotMetadata(s.root, 1), nil
+}
+
+func (s *writtenSlotsSnapshot) GetProofData(partNumber int) ([]byte, error) {
+	if partNumber != 0 {
+		return nil, fmt.Errorf("invalid part number %d, snapshot has 1 part", partNumber)
+	}
+	return []byte{}, nil // the index is not covered by the root
+}
+
+func (s *writtenSlotsSnapshot) GetPartData(partNumber int) ([]byte, error) {
+	if partNumber != 0 {
+		return nil, fmt.Errorf("invalid part number %d, snapshot has 1 part", partNumber)
+	}
+	return s.data, nil
+}
+
+func (s *writtenSlotsSnapshot) Release() error {
+	// In-memory snapshot, nothing to release
+	return nil
+}
+
+// writtenSlotsVerifier verifies that a snapshot of the written-slot index
+// has been taken with a trie of an expected root commitment. The coverage of
+// the trie by the index itself is checked on Restore.
+type writtenSlotsVerifier struct {
+	root [32]byte
+}
+
+func (v *writtenSlotsVerifier) VerifyRootProof(data backend.SnapshotData) (backend.Proof, error) {
+	metadata, err := data.GetMetaData()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get metadata: %w", err)
+	}
+	decoded, err := decodeWrittenSlotsMetadata(metadata)
+	if err != nil {
+		return nil, err
+	}
+	if decoded.commitment != v.root {
+		return nil, fmt.Errorf("root proof verification failed: commitment mismatch")
+	}
+	return &vtProof{commitment: bytes.Clone(v.root[:])}, nil
+}
+
+func (v *writtenSlotsVerifier) VerifyPart(partNumber int, proof, part []byte) error {
+	if partNumber != 0 {
+		return fmt.Errorf("invalid part number %d, snapshot has 1 part", partNumber)
+	}
+	_, err := verifyWrittenSlotsPart(proof, part)
+	return err
+}
@@ -0,0 +1,248 @@
+package memory
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/QoraNet/qoraDB/go/backend"
+	"github.com/QoraNet/qoraDB/go/common"
+	"github.com/QoraNet/qoraDB/go/database/vt/memory/trie"
+	"github.com/stretchr/testify/require"
+)
+
+func TestState_GetSnapshotableComponents_CoverTrieAndWrittenSlots(t *testing.T) {
+	require := require.New(t)
+	state := newState()
+
+	var _ backend.Snapshotable = &trieComponent{}
+	var _ backend.Snapshotable = &writtenSlotsComponent{}
+
+	components := state.GetSnapshotableComponents()
+	require.Len(components, 2)
+	require.IsType(&trieComponent{}, components[0])
+	require.IsType(&writtenSlotsComponent{}, components[1])
+}
+
+func TestState_GetSnapshotableComponents_RestoreReproducesState(t *testing.T) {
+	require := require.New(t)
+
+	original := newState()
+	require.NoError(original.Apply(0, getRandomUpdate(t, 20)))
+	restored := newState()
+
+	sources := original.GetSnapshotableComponents()
+	targets := restored.GetSnapshotableComponents()
+	for i, source := range sources {
+		snapshot, err := source.CreateSnapshot()
+		require.NoError(err)
+		metadata, err := snapshot.GetData().GetMetaData()
+		require.NoError(err)
+
+		// Each part can be verified against the component's root proof.
+		verifier, err := targets[i].GetSnapshotVerifier(metadata)
+		require.NoError(err)
+		root, err := verifier.VerifyRootProof(snapshot.GetData())
+		require.NoError(err)
+		require.True(root.Equal(snapshot.GetRootProof()))
+		for j := range snapshot.GetNumParts() {
+			proof, err := snapshot.GetData().GetProofData(j)
+			require.NoError(err)
+			part, err := snapshot.GetData().GetPartData(j)
+			require.NoError(err)
+			require.NoError(verifier.VerifyPart(j, proof, part), "component %d, part %d", i, j)
+		}
+
+		require.NoError(targets[i].Restore(snapshot.GetData()))
+		require.NoError(snapshot.Release())
+	}
+	require.NoError(restored.RunPostRestoreTasks())
+
+	require.Equal(getHash(t, original), getHash(t, restored))
+	require.Equal(original.writtenSlots, restored.writtenSlots)
+	for i, component := range targets {
+		want, err := sources[i].GetProof()
+		require.NoError(err)
+		got, err := component.GetProof()
+		require.NoError(err)
+		require.True(want.Equal(got), "component %d", i)
+	}
+}
+
+func TestState_GetSnapshotableComponents_ProofsMatchSnapshots(t *testing.T) {
+	require := require.New(t)
+
+	state := newState()
+	require.NoError(state.Apply(0, getRandomUpdate(t, 20)))
+	for i, component := range state.GetSnapshotableComponents() {
+		proof, err := component.GetProof()
+		require.NoError(err)
+		snapshot, err := component.CreateSnapshot()
+		require.NoError(err)
+		require.True(proof.Equal(snapshot.GetRootProof()), "component %d", i)
+	}
+
+	// The proofs of the trie and of the written-slot index are the proof of
+	// the state.
+	want, err := state.GetProof()
+	require.NoError(err)
+	for i, component := range state.GetSnapshotableComponents() {
+		got, err := component.GetProof()
+		require.NoError(err)
+		require.True(want.Equal(got), "component %d", i)
+	}
+}
+
+func TestWrittenSlotsComponent_ProofDoesNotDependOnIndex(t *testing.T) {
+	require := require.New(t)
+
+	update := getRandomUpdate(t, 20)
+	a := newState()
+	require.NoError(a.Apply(0, update))
+	b := newState()
+	require.NoError(b.Apply(0, update))
+	b.writtenSlots[common.Address{42}] = map[common.Key]bool{{1}: true}
+
+	// The index is unauthenticated, so states with equal roots have equal
+	// proofs, even if their indexes differ.
+	want, err := a.GetSnapshotableComponents()[1].GetProof()
+	require.NoError(err)
+	got, err := b.GetSnapshotableComponents()[1].GetProof()
+	require.NoError(err)
+	require.True(want.Equal(got))
+}
+
+func TestTrieComponent_SnapshotConsistsOfPartitions(t *testing.T) {
+	require := require.New(t)
+
+	state := newState()
+	require.NoError(state.Apply(0, getRandomUpdate(t, 20)))
+	snapshot, err := state.GetSnapshotableComponents()[0].CreateSnapshot()
+	require.NoError(err)
+	require.Equal(trie.NumPartitions, snapshot.GetNumParts())
+	_, err = snapshot.GetData().GetPartData(trie.NumPartitions)
+	require.Error(err)
+
+	// State snapshots, which include the written-slot index, are no trie
+	// snapshots.
+	full, err := state.CreateSnapshot()
+	require.NoError(err)
+	metadata, err := full.GetData().GetMetaData()
+	require.NoError(err)
+	component := newState().GetSnapshotableComponents()[0]
+	_, err = component.GetSnapshotVerifier(metadata)
+	require.Error(err)
+	require.Error(component.Restore(full.GetData()))
+}
+
+func TestWrittenSlotsComponent_TamperedSnapshotsAreRejected(t *testing.T) {
+	require := require.New(t)
+
+	state := newState()
+	require.NoError(state.Apply(0, common.Update{
+		Slots: []common.SlotUpdate{{Account: common.Address{1}, Key: common.Key{1}, Value: common.Value{1}}},
+	}))
+	snapshot, err := state.GetSnapshotableComponents()[1].CreateSnapshot()
+	require.NoError(err)
+	require.Equal(1, snapshot.GetNumParts())
+	metadata, err := snapshot.GetData().GetMetaData()
+	require.NoError(err)
+	proof, err := snapshot.GetData().GetProofData(0)
+	require.NoError(err)
+	part, err := snapshot.GetData().GetPartData(0)
+	require.NoError(err)
+
+	target := newState()
+	component := target.GetSnapshotableComponents()[1]
+	verifier, err := component.GetSnapshotVerifier(metadata)
+	require.NoError(err)
+	require.NoError(verifier.VerifyPart(0, proof, part))
+	require.Error(verifier.VerifyPart(1, proof, part))
+
+	corrupted := bytes.Clone(part)
+	corrupted[len(corrupted)-1]++
+	require.ErrorContains(verifier.VerifyPart(0, proof, corrupted), "checksum")
+	require.Error(component.Restore(&tamperedSnapshotData{SnapshotData: snapshot.GetData(), part: 0, data: corrupted}))
+	require.Empty(target.writtenSlots)
+	require.Error(verifier.VerifyPart(0, []byte{1}, part))
+
+	// A snapshot taken with a different trie is not accepted by the verifier.
+	other, err := newState().GetSnapshotableComponents()[1].CreateSnapshot()
+	require.NoError(err)
+	_, err = verifier.VerifyRootProof(other.GetData())
+	require.Error(err)
+
+	// The index itself is not authenticated, so any well-formed part passes.
+	otherProof, err := other.GetData().GetProofData(0)
+	require.NoError(err)
+	otherPart, err := other.GetData().GetPartData(0)
+	require.NoError(err)
+	require.NoError(verifier.VerifyPart(0, otherProof, otherPart))
+}
+
+func TestTrieComponent_RestoreDropsWrittenSlots(t *testing.T) {
+	require := require.New(t)
+
+	original := newState()
+	require.NoError(original.Apply(0, getRandomUpdate(t, 5)))
+	snapshot, err := original.GetSnapshotableComponents()[0].CreateSnapshot()
+	require.NoError(err)
+
+	// Block 1 is skipped by the archive, so its deletion remains recorded.
+	target := newStateWithArchive(ArchivePolicy{Interval: 2})
+	address := common.Address{1}
+	require.NoError(target.Apply(0, common.Update{
+		Slots: []common.SlotUpdate{{Account: address, Key: common.Key{1}, Value: common.Value{1}}},
+	}))
+	require.NoError(target.Apply(1, common.Update{DeletedAccounts: []common.Address{address}}))
+	require.NotEmpty(target.removedSlots)
+	target.writtenSlots[address] = map[common.Key]bool{{1}: true}
+
+	require.NoError(target.GetSnapshotableComponents()[0].Restore(snapshot.GetData()))
+	require.Equal(getHash(t, original), getHash(t, target))
+	require.Empty(target.writtenSlots)
+	require.Empty(target.removedSlots)
+	require.Empty(target.addedSlots)
+}
+
+func TestWrittenSlotsComponent_RestoreRequiresIndexCoveringRestoredTrie(t *testing.T) {
+	require := require.New(t)
+
+	original := newState()
+	require.NoError(original.Apply(0, getRandomUpdate(t, 5)))
+	components := original.GetSnapshotableComponents()
+	trieSnapshot, err := components[0].CreateSnapshot()
+	require.NoError(err)
+	slotsSnapshot, err := components[1].CreateSnapshot()
+	require.NoError(err)
+
+	// The index can not be restored before the trie it belongs to.
+	target := newState()
+	targets := target.GetSnapshotableComponents()
+	require.ErrorContains(targets[1].Restore(slotsSnapshot.GetData()), "restored first")
+	require.Empty(target.writtenSlots)
+	require.NoError(targets[0].Restore(trieSnapshot.GetData()))
+
+	// Indexes missing an account are rejected, even though they pass the
+	// verifier, which can not check them against the trie.
+	var address common.Address
+	for address = range original.writtenSlots {
+		break
+	}
+	incomplete := unionWrittenSlots(original.writtenSlots)
+	delete(incomplete, address)
+	tampered := &tamperedSnapshotData{
+		SnapshotData: slotsSnapshot.GetData(),
+		part:         0,
+		data:         encodeWrittenSlots(incomplete),
+	}
+	metadata, err := slotsSnapshot.GetData().GetMetaData()
+	require.NoError(err)
+	verifier, err := targets[1].GetSnapshotVerifier(metadata)
+	require.NoError(err)
+	require.NoError(verifier.VerifyPart(0, []byte{}, tampered.data))
+	require.ErrorContains(targets[1].Restore(tampered), "invalid written slots")
+	require.Empty(target.writtenSlots)
+
+	require.NoError(targets[1].Restore(slotsSnapshot.GetData()))
+	require.Equal(original.writtenSlots, target.writtenSlots)
+}
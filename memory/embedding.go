@@ -67,37 +67,48 @@ func getStorageKey(address common.Address, key common.Key) trie.Key {
 }
 
 // getTrieKey is a helper function for hashing information to obtain trie keys.
+// Stems are retained in a cache, since the same accounts and tree indices are
+// typically accessed repeatedly.
 func getTrieKey(
 	address common.Address,
 	treeIndex uint256.Int,
 	subIndex byte,
 ) trie.Key {
+	stem := stems.get(address, treeIndex, func() [31]byte {
+		return getStem(address, treeIndex)
+	})
+
+	// Compose the trie key.
+	res := trie.Key{}
+	copy(res[:31], stem[:])
+	res[31] = subIndex
+	return res
+}
+
+// getStem computes the stem of the trie keys of the given address and tree
+// index.
+func getStem(address common.Address, treeIndex uint256.Int) [31]byte {
 	// Inspired by https://github.com/ethereum/go-ethereum/blob/e563918a84b4104e44935ddc6850f11738dcc3f5/trie/utils/verkle.go#L116
 
-	// The key is computed by:
+	// The stem is computed by:
 	//   C = Commit([2+256*64,address_low,address_high,tree_index_low,tree_index_high])
 	//   H = Hash(C)
-	//   K = append(H[:31], subIndex)
+	//   S = H[:31]
 
 	expanded := [32]byte{}
 	copy(expanded[12:], address[:])
 
-	values := [256]commit.Value{}
-	values[0] = commit.NewValue(2 + 256*64)
-	values[1] = commit.NewValueFromLittleEndianBytes(expanded[:16])
-	values[2] = commit.NewValueFromLittleEndianBytes(expanded[16:])
-
 	index := treeIndex.Bytes32() // < produces result in big-endian order
 	slices.Reverse(index[:])     // < reverse to little-endian order
-	values[3] = commit.NewValueFromLittleEndianBytes(index[:16])
-	values[4] = commit.NewValueFromLittleEndianBytes(index[16:])
-
-	// Compute the the Pedersen Hash for the values.
-	hash := commit.Commit(values).Hash()
 
-	// Compose the trie key.
-	res := trie.Key{}
-	copy(res[:31], hash[:31])
-	res[31] = subIndex
-	return res
+	// Compute the the Pedersen Hash for the values. Since only the first
+	// five values are non-zero, the specialized prefix commitment is used.
+	hash := commit.CommitPrefix(
+		commit.NewValue(2+256*64),
+		commit.NewValueFromLittleEndianBytes(expanded[:16]),
+		commit.NewValueFromLittleEndianBytes(expanded[16:]),
+		commit.NewValueFromLittleEndianBytes(index[:16]),
+		commit.NewValueFromLittleEndianBytes(index[16:]),
+	).Hash()
+	return [31]byte(hash[:31])
 }
@@ -118,3 +118,43 @@ func TestGetStorageKey_CompareWithGethResults(t *testing.T) {
 		}
 	}
 }
+
+func TestGetTrieKey_UsesStemCache(t *testing.T) {
+	require := require.New(t)
+
+	address := common.Address{1, 2, 3}
+	treeIndex := *uint256.NewInt(12)
+	key := getTrieKey(address, treeIndex, 7)
+
+	computed := false
+	stem := stems.get(address, treeIndex, func() [31]byte {
+		computed = true
+		return [31]byte{}
+	})
+	require.False(computed, "stem should have been cached")
+	require.Equal(key[:31], stem[:])
+	require.Equal(getStem(address, treeIndex), stem)
+}
+
+func TestStemCache_EvictsLeastRecentlyUsedEntries(t *testing.T) {
+	require := require.New(t)
+
+	cache := newStemCache(2)
+	lookup := func(address byte) bool {
+		computed := false
+		cache.get(common.Address{address}, uint256.Int{}, func() [31]byte {
+			computed = true
+			return [31]byte{address}
+		})
+		return computed
+	}
+
+	require.True(lookup(1))
+	require.True(lookup(2))
+	require.False(lookup(1)) // 1 is now the most recently used entry
+	require.True(lookup(3))  // evicts 2
+	require.Equal(2, cache.len())
+	require.False(lookup(1))
+	require.False(lookup(3))
+	require.True(lookup(2))
+}
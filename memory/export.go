@@ -0,0 +1,148 @@
+package memory
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+
+	"github.com/QoraNet/qoraDB/go/common"
+	"github.com/QoraNet/qoraDB/go/database/vt/memory/trie"
+)
+
+// exportCheckInterval is the number of entries written or read between checks
+// for the cancellation of an export or import.
+const exportCheckInterval = 1024
+
+// maxExportMetadataSize is the maximum size of the metadata accepted by Import.
+const maxExportMetadataSize = 1 << 20
+
+// Export writes the current state to the given output. The output consists
+// of snapshot metadata, a single snapshot part covering all entries and leaf
+// depths of the state, and the written-slot index of the state, each prefixed by its length.
+// Entries are streamed directly from the trie, so the export does not need to
+// be assembled in memory. The export can be canceled through the given
+// context.
+func (s *State) Export(ctx context.Context, out io.Writer) (common.Hash, error) {
+	commitment := s.trie.Commit().Compress()
+
+	// The number of entries is needed up front for the length prefix.
+	count := countEntries(s.trie.Visit)
+	depths := s.trie.GetLeafDepths()
+	partSize := uint64(getSnapshotPartSize(count, len(depths), 0))
+	if partSize > math.MaxUint32 {
+		return common.Hash{}, fmt.Errorf("state with %d entries is too large to be exported", count)
+	}
+
+	writer := bufio.NewWriter(out)
+	metadata := encodeSnapshotMetadata(commitment, 2)
+	header := binary.BigEndian.AppendUint32(nil, uint32(len(metadata)))
+	header = append(header, metadata...)
+	header = binary.BigEndian.AppendUint32(header, uint32(partSize))
+	if _, err := writer.Write(header); err != nil {
+		return common.Hash{}, fmt.Errorf("failed to write metadata: %w", err)
+	}
+	if err := writeSnapshotPart(ctx, writer, s.trie.Visit, count, depths, nil); err != nil {
+		return common.Hash{}, fmt.Errorf("failed to write entries: %w", err)
+	}
+	slots := encodeWrittenSlots(s.getWrittenSlots())
+	if uint64(len(slots)) > math.MaxUint32 {
+		return common.Hash{}, fmt.Errorf("written slots are too large to be exported")
+	}
+	if _, err := writer.Write(binary.BigEndian.AppendUint32(nil, uint32(len(slots)))); err != nil {
+		return common.Hash{}, fmt.Errorf("failed to write written slots: %w", err)
+	}
+	if _, err := writer.Write(slots); err != nil {
+		return common.Hash{}, fmt.Errorf("failed to write written slots: %w", err)
+	}
+	if err := writer.Flush(); err != nil {
+		return common.Hash{}, fmt.Errorf("failed to write entries: %w", err)
+	}
+	return common.Hash(commitment), nil
+}
+
+// Import reconstructs a state from data produced by Export. Entries are read
+// incrementally and are required to be listed in strictly increasing key
+// order. The checksums of the data and the root commitment of the resulting
+// state are verified against the exported metadata. The written-slot index
+// is restored as well and has to account for all keys of the imported trie,
+// so data exported by a version not including the index can only be imported
+// if it holds no entries. The resulting state has no archive. The import can
+// be canceled through the given context.
+func Import(ctx context.Context, in io.Reader) (*State, error) {
+	reader := bufio.NewReader(in)
+
+	var length [4]byte
+	if _, err := io.ReadFull(reader, length[:]); err != nil {
+		return nil, fmt.Errorf("failed to read metadata length: %w", err)
+	}
+	metaLen := binary.BigEndian.Uint32(length[:])
+	if metaLen > maxExportMetadataSize {
+		return nil, fmt.Errorf("invalid metadata length %d", metaLen)
+	}
+	data := make([]byte, metaLen)
+	if _, err := io.ReadFull(reader, data); err != nil {
+		return nil, fmt.Errorf("failed to read metadata: %w", err)
+	}
+	metadata, err := decodeSnapshotMetadata(data)
+	if err != nil {
+		return nil, fmt.Errorf("invalid metadata: %w", err)
+	}
+	trieParts, hasSlots, err := getSnapshotLayout(metadata.numParts)
+	if err != nil {
+		return nil, fmt.Errorf("invalid metadata: %w", err)
+	}
+	if trieParts != 1 {
+		return nil, fmt.Errorf("invalid metadata: expected a single part of entries, got %d", trieParts)
+	}
+
+	if _, err := io.ReadFull(reader, length[:]); err != nil {
+		return nil, fmt.Errorf("failed to read part length: %w", err)
+	}
+	partLen := uint64(binary.BigEndian.Uint32(length[:]))
+
+	// Export does not include node commitments, so parts listing any are
+	// rejected without allocating memory for them.
+	res := newState()
+	depths, _, err := readSnapshotPart(ctx, reader, partLen, 0, func(key trie.Key, value trie.Value) {
+		res.trie.Set(key, value)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read entries: %w", err)
+	}
+	if err := res.trie.SetLeafDepths(depths); err != nil {
+		return nil, fmt.Errorf("invalid leaf depths: %w", err)
+	}
+
+	if hasSlots {
+		if _, err := io.ReadFull(reader, length[:]); err != nil {
+			return nil, fmt.Errorf("failed to read length of written slots: %w", err)
+		}
+		// The data is read incrementally, such that an invalid length does
+		// not cause the allocation of excessive amounts of memory.
+		slotsLen := int64(binary.BigEndian.Uint32(length[:]))
+		data, err := io.ReadAll(io.LimitReader(reader, slotsLen))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read written slots: %w", err)
+		}
+		if int64(len(data)) != slotsLen {
+			return nil, fmt.Errorf("failed to read written slots: %w", io.ErrUnexpectedEOF)
+		}
+		if res.writtenSlots, err = decodeWrittenSlots(data); err != nil {
+			return nil, fmt.Errorf("invalid written slots: %w", err)
+		}
+	}
+
+	if got := res.trie.Commit().Compress(); got != metadata.commitment {
+		return nil, fmt.Errorf("imported state has commitment %x, expected %x", got, metadata.commitment)
+	}
+
+	// The written slots are not covered by the commitment, so they have to
+	// account for all keys of the imported trie.
+	if err := checkWrittenSlotsCoverageOf(res.trie, res.writtenSlots); err != nil {
+		return nil, fmt.Errorf("invalid written slots: %w", err)
+	}
+	return res, nil
+}
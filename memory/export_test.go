@@ -0,0 +1,190 @@
+package memory
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"testing"
+
+	"github.com/QoraNet/qoraDB/go/common"
+	"github.com/QoraNet/qoraDB/go/database/vt/memory/trie"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExport_ImportReproducesExportedState(t *testing.T) {
+	require := require.New(t)
+
+	original := newState()
+	update := getRandomUpdate(t, 20)
+	update.Slots = append(update.Slots, common.SlotUpdate{Account: common.Address{1}, Key: common.Key{1}})
+	require.NoError(original.Apply(0, update))
+
+	var out bytes.Buffer
+	hash, err := original.Export(context.Background(), &out)
+	require.NoError(err)
+
+	restored, err := Import(context.Background(), &out)
+	require.NoError(err)
+	got, err := restored.GetHash()
+	require.NoError(err)
+	require.Equal(hash, got)
+
+	for _, account := range update.CreatedAccounts {
+		want, err := original.GetBalance(account)
+		require.NoError(err)
+		balance, err := restored.GetBalance(account)
+		require.NoError(err)
+		require.Equal(want, balance)
+	}
+}
+
+func TestExport_ImportReproducesShapeOfTrieWithDeletedKeys(t *testing.T) {
+	require := require.New(t)
+
+	original := newState()
+	require.NoError(original.Apply(0, getRandomUpdate(t, 20)))
+	deleteSlotsSharingPrefixes(t, original)
+	require.NotEmpty(original.trie.GetLeafDepths())
+
+	var out bytes.Buffer
+	hash, err := original.Export(context.Background(), &out)
+	require.NoError(err)
+
+	restored, err := Import(context.Background(), &out)
+	require.NoError(err)
+	got, err := restored.GetHash()
+	require.NoError(err)
+	require.Equal(hash, got)
+	require.Equal(original.trie.GetLeafDepths(), restored.trie.GetLeafDepths())
+}
+
+func TestImport_RestoresWrittenSlots(t *testing.T) {
+	require := require.New(t)
+
+	original := newState()
+	address := common.Address{1}
+	require.NoError(original.Apply(0, common.Update{
+		Slots: []common.SlotUpdate{{Account: address, Key: common.Key{1}, Value: common.Value{1}}},
+	}))
+
+	restored, err := Import(context.Background(), exportState(t, original))
+	require.NoError(err)
+	require.Equal(original.writtenSlots, restored.writtenSlots)
+
+	require.NoError(restored.Apply(1, common.Update{
+		DeletedAccounts: []common.Address{address},
+	}))
+	empty, err := restored.HasEmptyStorage(address)
+	require.NoError(err)
+	require.True(empty)
+	value, err := restored.GetStorage(address, common.Key{1})
+	require.NoError(err)
+	require.Equal(common.Value{}, value)
+}
+
+func TestExport_MatchesSnapshotData(t *testing.T) {
+	require := require.New(t)
+
+	state := newState()
+	require.NoError(state.Apply(0, getRandomUpdate(t, 5)))
+
+	var out bytes.Buffer
+	_, err := state.Export(context.Background(), &out)
+	require.NoError(err)
+
+	snapshot, err := state.CreateSnapshot()
+	require.NoError(err)
+	meta, err := snapshot.GetData().GetMetaData()
+	require.NoError(err)
+	want, err := decodeSnapshotMetadata(meta)
+	require.NoError(err)
+
+	// The single exported part lists the entries of all snapshot parts.
+	var entries []byte
+	for i := range trie.NumPartitions {
+		part, err := snapshot.GetData().GetPartData(i)
+		require.NoError(err)
+		count := countEntries(getPartitionEntries(state.trie, byte(i)))
+		entries = append(entries, part[snapshotPartHeaderSize:snapshotPartHeaderSize+64*count]...)
+	}
+
+	data := out.Bytes()
+	metaLen := int(binary.BigEndian.Uint32(data[0:4]))
+	got, err := decodeSnapshotMetadata(data[4 : 4+metaLen])
+	require.NoError(err)
+	require.Equal(want.commitment, got.commitment)
+	require.Equal(uint32(2), got.numParts)
+	partLen := int(binary.BigEndian.Uint32(data[4+metaLen:]))
+	part := data[4+metaLen+4 : 4+metaLen+4+partLen]
+	require.Equal(entries, part[snapshotPartHeaderSize:snapshotPartHeaderSize+len(entries)])
+	require.Len(part, getSnapshotPartSize(len(entries)/64, 0, 0))
+
+	// The exported part is followed by the written-slot index.
+	slots, err := snapshot.GetData().GetPartData(writtenSlotsPart)
+	require.NoError(err)
+	require.Equal(slots, data[4+metaLen+4+partLen+4:])
+}
+
+func TestExport_CanBeCanceled(t *testing.T) {
+	require := require.New(t)
+
+	state := newState()
+	require.NoError(state.Apply(0, getRandomUpdate(t, 5)))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	var out bytes.Buffer
+	_, err := state.Export(ctx, &out)
+	require.ErrorIs(err, context.Canceled)
+
+	out.Reset()
+	_, err = state.Export(context.Background(), &out)
+	require.NoError(err)
+	_, err = Import(ctx, &out)
+	require.ErrorIs(err, context.Canceled)
+}
+
+func TestImport_DetectsCorruptedData(t *testing.T) {
+	require := require.New(t)
+
+	state := newState()
+	require.NoError(state.Apply(0, getRandomUpdate(t, 5)))
+	var out bytes.Buffer
+	_, err := state.Export(context.Background(), &out)
+	require.NoError(err)
+	data := out.Bytes()
+
+	// A modified value is detected by the checksum.
+	const entries = 4 + snapshotMetadataSize + 4 + snapshotPartHeaderSize
+	corrupted := bytes.Clone(data)
+	corrupted[entries+40]++
+	_, err = Import(context.Background(), bytes.NewReader(corrupted))
+	require.ErrorContains(err, "checksum")
+
+	// A modified written-slot index is detected by its checksum.
+	corrupted = bytes.Clone(data)
+	corrupted[len(corrupted)-snapshotChecksumSize-1]++
+	_, err = Import(context.Background(), bytes.NewReader(corrupted))
+	require.ErrorContains(err, "checksum")
+
+	// Entries out of order are rejected.
+	corrupted = bytes.Clone(data)
+	copy(corrupted[entries:entries+64], data[entries+64:entries+128])
+	_, err = Import(context.Background(), bytes.NewReader(corrupted))
+	require.ErrorContains(err, "order")
+
+	// Node commitments are never exported, so any number of them is rejected
+	// before memory is allocated for them.
+	corrupted = bytes.Clone(data)
+	count := int(binary.BigEndian.Uint32(data[entries-4 : entries]))
+	binary.BigEndian.PutUint32(corrupted[entries+count*64:], 1<<31)
+	_, err = Import(context.Background(), bytes.NewReader(corrupted))
+	require.ErrorContains(err, "commitments")
+
+	// Truncated data is rejected.
+	for _, size := range []int{0, 3, 20, entries, len(data) - 1} {
+		_, err = Import(context.Background(), bytes.NewReader(data[:size]))
+		require.Error(err, "size %d", size)
+	}
+}
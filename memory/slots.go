@@ -0,0 +1,198 @@
+package memory
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"maps"
+	"slices"
+
+	"github.com/QoraNet/qoraDB/go/common"
+	"github.com/QoraNet/qoraDB/go/database/vt/memory/trie"
+)
+
+// Storage keys in the trie are derived from account addresses and slot keys
+// through one-way hashes, so the storage slots of an account can not be
+// enumerated from the trie. Instead, states keep an index of the written
+// slots of each account, which is required for answering HasEmptyStorage and
+// for deleting the storage of accounts. The index lists all accounts with
+// data in the trie, including accounts without written slots, and the slots
+// written for each of them. It may list accounts and slots not present in the
+// trie, but has to cover all that are, which can be checked for any given
+// trie through checkWrittenSlotsCoverage.
+//
+// Snapshots and exports carry this index in a dedicated section:
+//
+// Slots: [magic "VTWS"][version uint16][numAccounts uint32][address1 20 bytes][numSlots uint32][key1 32 bytes]...[checksum uint32]
+//
+// Accounts and the slots of each account are listed in strictly increasing
+// order. All integers are encoded in big-endian byte order.
+const (
+	writtenSlotsMagic      = "VTWS"
+	writtenSlotsVersion    = uint16(1)
+	writtenSlotsHeaderSize = 4 + 2 + 4
+)
+
+// encodeWrittenSlots produces the section describing the given written-slot
+// index.
+func encodeWrittenSlots(slots map[common.Address]map[common.Key]bool) []byte {
+	size := writtenSlotsHeaderSize + snapshotChecksumSize
+	addresses := make([]common.Address, 0, len(slots))
+	for address, keys := range slots {
+		size += 20 + 4 + len(keys)*32
+		addresses = append(addresses, address)
+	}
+	slices.SortFunc(addresses, compareAddresses)
+
+	res := make([]byte, 0, size)
+	res = append(res, writtenSlotsMagic...)
+	res = binary.BigEndian.AppendUint16(res, writtenSlotsVersion)
+	res = binary.BigEndian.AppendUint32(res, uint32(len(slots)))
+	for _, address := range addresses {
+		keys := make([]common.Key, 0, len(slots[address]))
+		for key := range slots[address] {
+			keys = append(keys, key)
+		}
+		slices.SortFunc(keys, compareKeys)
+		res = append(res, address[:]...)
+		res = binary.BigEndian.AppendUint32(res, uint32(len(keys)))
+		for _, key := range keys {
+			res = append(res, key[:]...)
+		}
+	}
+	return binary.BigEndian.AppendUint32(res, crc32.Checksum(res, snapshotChecksumTable))
+}
+
+// decodeWrittenSlots restores the written-slot index described by the given
+// section. The checksum of the section is verified before it is decoded.
+func decodeWrittenSlots(data []byte) (map[common.Address]map[common.Key]bool, error) {
+	if !bytes.HasPrefix(data, []byte(writtenSlotsMagic)) {
+		return nil, fmt.Errorf("not a written-slots section")
+	}
+	if len(data) < writtenSlotsHeaderSize+snapshotChecksumSize {
+		return nil, fmt.Errorf("written-slots section too short")
+	}
+	if version := binary.BigEndian.Uint16(data[4:6]); version != writtenSlotsVersion {
+		return nil, fmt.Errorf("unsupported written-slots version %d", version)
+	}
+	if err := verifySnapshotChecksum(data); err != nil {
+		return nil, err
+	}
+
+	numAccounts := binary.BigEndian.Uint32(data[6:10])
+	rest := data[writtenSlotsHeaderSize : len(data)-snapshotChecksumSize]
+	res := make(map[common.Address]map[common.Key]bool, min(numAccounts, uint32(len(rest)/24)))
+	var previous common.Address
+	for i := range numAccounts {
+		if len(rest) < 24 {
+			return nil, fmt.Errorf("missing data of account %d", i)
+		}
+		address := common.Address(rest[0:20])
+		if i > 0 && compareAddresses(previous, address) >= 0 {
+			return nil, fmt.Errorf("account %d is not in increasing order", i)
+		}
+		numSlots := uint64(binary.BigEndian.Uint32(rest[20:24]))
+		rest = rest[24:]
+		if uint64(len(rest)) < numSlots*32 {
+			return nil, fmt.Errorf("missing slots of account %d", i)
+		}
+		keys := make(map[common.Key]bool, numSlots)
+		var last common.Key
+		for j := range numSlots {
+			key := common.Key(rest[j*32 : (j+1)*32])
+			if j > 0 && compareKeys(last, key) >= 0 {
+				return nil, fmt.Errorf("slot %d of account %d is not in increasing order", j, i)
+			}
+			keys[key] = true
+			last = key
+		}
+		rest = rest[numSlots*32:]
+		res[address] = keys
+		previous = address
+	}
+	if len(rest) != 0 {
+		return nil, fmt.Errorf("%d bytes of surplus data", len(rest))
+	}
+	return res, nil
+}
+
+// checkWrittenSlotsCoverage checks that the given written-slot index accounts
+// for all keys of a trie holding the given number of keys, whose use is
+// reported by the given function. Keys are accounted for if they are the basic
+// data, code hash, code chunk or listed storage slot keys of a listed account.
+// Since code chunks are always written starting with the first chunk, the
+// chunks of an account are the keys of consecutive chunks present in the trie.
+func checkWrittenSlotsCoverage(
+	slots map[common.Address]map[common.Key]bool,
+	numKeys int,
+	isUsed func(trie.Key) bool,
+) error {
+	// Keys are collected in a set, since storage keys of some slots coincide
+	// with the keys of other account data.
+	covered := make(map[trie.Key]struct{})
+	add := func(key trie.Key) {
+		if isUsed(key) {
+			covered[key] = struct{}{}
+		}
+	}
+	for address, keys := range slots {
+		add(getBasicDataKey(address))
+		add(getCodeHashKey(address))
+		for i := 0; ; i++ {
+			key := getCodeChunkKey(address, i)
+			if !isUsed(key) {
+				break
+			}
+			covered[key] = struct{}{}
+		}
+		for key := range keys {
+			add(getStorageKey(address, key))
+		}
+	}
+	if len(covered) != numKeys {
+		return fmt.Errorf("written-slot index accounts for %d of %d keys of the trie", len(covered), numKeys)
+	}
+	return nil
+}
+
+// checkWrittenSlotsCoverageOf checks that the given written-slot index
+// accounts for all keys of the given trie, see checkWrittenSlotsCoverage.
+func checkWrittenSlotsCoverageOf(t *trie.Trie, slots map[common.Address]map[common.Key]bool) error {
+	numKeys := 0
+	t.Visit(func(trie.Key, trie.Value) bool {
+		numKeys++
+		return true
+	})
+	return checkWrittenSlotsCoverage(slots, numKeys, func(key trie.Key) bool {
+		_, used := t.Lookup(key)
+		return used
+	})
+}
+
+func compareAddresses(a, b common.Address) int {
+	return bytes.Compare(a[:], b[:])
+}
+
+func compareKeys(a, b common.Key) int {
+	return bytes.Compare(a[:], b[:])
+}
+
+func compareTrieKeys(a, b trie.Key) int {
+	return bytes.Compare(a[:], b[:])
+}
+
+// unionWrittenSlots returns a new written-slot index listing all slots of the
+// given indexes.
+func unionWrittenSlots(indexes ...map[common.Address]map[common.Key]bool) map[common.Address]map[common.Key]bool {
+	res := make(map[common.Address]map[common.Key]bool)
+	for _, slots := range indexes {
+		for address, keys := range slots {
+			if res[address] == nil {
+				res[address] = make(map[common.Key]bool, len(keys))
+			}
+			maps.Copy(res[address], keys)
+		}
+	}
+	return res
+}
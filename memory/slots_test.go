@@ -0,0 +1,143 @@
+package memory
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"testing"
+
+	"github.com/QoraNet/qoraDB/go/common"
+	"github.com/QoraNet/qoraDB/go/common/amount"
+	"github.com/QoraNet/qoraDB/go/database/vt/memory/trie"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWrittenSlots_CanBeEncodedAndDecoded(t *testing.T) {
+	require := require.New(t)
+
+	tests := map[string]map[common.Address]map[common.Key]bool{
+		"empty": {},
+		"single": {
+			{1}: {{1}: true},
+		},
+		"multiple": {
+			{1}: {{1}: true, {2}: true, {31: 3}: true},
+			{2}: {{4}: true},
+			{3}: {{1}: true, {0xff}: true},
+		},
+	}
+	for name, slots := range tests {
+		t.Run(name, func(t *testing.T) {
+			decoded, err := decodeWrittenSlots(encodeWrittenSlots(slots))
+			require.NoError(err)
+			require.Equal(slots, decoded)
+		})
+	}
+}
+
+func TestWrittenSlots_AccountsWithoutSlotsAreRetained(t *testing.T) {
+	require := require.New(t)
+	slots := map[common.Address]map[common.Key]bool{
+		{1}: {{1}: true},
+		{2}: {},
+	}
+	decoded, err := decodeWrittenSlots(encodeWrittenSlots(slots))
+	require.NoError(err)
+	require.Equal(slots, decoded)
+}
+
+func TestWrittenSlots_CorruptedDataIsRejected(t *testing.T) {
+	require := require.New(t)
+	data := encodeWrittenSlots(map[common.Address]map[common.Key]bool{
+		{1}: {{1}: true, {2}: true},
+		{2}: {{3}: true},
+	})
+
+	for i := range data {
+		corrupted := bytes.Clone(data)
+		corrupted[i]++
+		_, err := decodeWrittenSlots(corrupted)
+		require.Error(err, "byte %d", i)
+	}
+	for i := range data {
+		_, err := decodeWrittenSlots(data[:i])
+		require.Error(err, "length %d", i)
+	}
+}
+
+func TestWrittenSlots_UnsortedSlotsAreRejected(t *testing.T) {
+	require := require.New(t)
+	data := encodeWrittenSlots(map[common.Address]map[common.Key]bool{
+		{1}: {{1}: true, {2}: true},
+	})
+
+	// Swap the two slots and fix up the checksum.
+	const first = writtenSlotsHeaderSize + 20 + 4
+	data = data[:len(data)-snapshotChecksumSize]
+	data[first], data[first+32] = data[first+32], data[first]
+	data = binary.BigEndian.AppendUint32(data, crc32.Checksum(data, snapshotChecksumTable))
+	_, err := decodeWrittenSlots(data)
+	require.ErrorContains(err, "order")
+}
+
+func TestWrittenSlots_UnionCoversAllIndexes(t *testing.T) {
+	require := require.New(t)
+	a := map[common.Address]map[common.Key]bool{
+		{1}: {{1}: true},
+		{2}: {{2}: true},
+	}
+	b := map[common.Address]map[common.Key]bool{
+		{1}: {{3}: true},
+	}
+	union := unionWrittenSlots(a, nil, b)
+	require.Equal(map[common.Address]map[common.Key]bool{
+		{1}: {{1}: true, {3}: true},
+		{2}: {{2}: true},
+	}, union)
+
+	// The union does not share maps with its inputs.
+	union[common.Address{2}][common.Key{4}] = true
+	require.Len(a[common.Address{2}], 1)
+}
+
+func TestWrittenSlots_CoverageRequiresAllAccountsAndSlotsOfTrie(t *testing.T) {
+	require := require.New(t)
+
+	state := newState()
+	withSlots, withoutSlots := common.Address{1}, common.Address{2}
+	require.NoError(state.Apply(0, common.Update{
+		Balances: []common.BalanceUpdate{{Account: withoutSlots, Balance: amount.New(1)}},
+		Codes: []common.CodeUpdate{
+			{Account: withSlots, Code: make([]byte, 200*31)},
+			{Account: withoutSlots, Code: []byte{1, 2, 3}},
+		},
+		Slots: []common.SlotUpdate{
+			{Account: withSlots, Key: common.Key{1}, Value: common.Value{1}},
+			{Account: withSlots, Key: common.Key{31: 2}},
+		},
+	}))
+	require.Equal(map[common.Address]map[common.Key]bool{
+		withSlots:    {{1}: true, {31: 2}: true},
+		withoutSlots: {},
+	}, state.writtenSlots)
+	require.NoError(checkWrittenSlotsCoverageOf(state.trie, state.writtenSlots))
+
+	// Indexes may list accounts and slots not present in the trie.
+	extended := unionWrittenSlots(state.writtenSlots, map[common.Address]map[common.Key]bool{
+		withSlots:         {{3}: true},
+		common.Address{3}: {{4}: true},
+	})
+	require.NoError(checkWrittenSlotsCoverageOf(state.trie, extended))
+
+	// Indexes missing slots or accounts are rejected.
+	missingSlot := unionWrittenSlots(state.writtenSlots)
+	delete(missingSlot[withSlots], common.Key{31: 2})
+	require.ErrorContains(checkWrittenSlotsCoverageOf(state.trie, missingSlot), "accounts for")
+	missingAccount := unionWrittenSlots(state.writtenSlots)
+	delete(missingAccount, withoutSlots)
+	require.ErrorContains(checkWrittenSlotsCoverageOf(state.trie, missingAccount), "accounts for")
+	require.Error(checkWrittenSlotsCoverageOf(state.trie, nil))
+
+	// Empty tries are covered by any index.
+	require.NoError(checkWrittenSlotsCoverageOf(&trie.Trie{}, nil))
+}
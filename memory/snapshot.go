@@ -0,0 +1,1100 @@
+package memory
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"math"
+	"math/rand/v2"
+	"slices"
+	"sync"
+
+	"github.com/QoraNet/qoraDB/go/backend"
+	"github.com/QoraNet/qoraDB/go/common"
+	"github.com/QoraNet/qoraDB/go/database/vt/commit"
+	"github.com/QoraNet/qoraDB/go/database/vt/memory/trie"
+)
+
+// Snapshots consist of a metadata section and a list of parts. Both kinds of
+// sections start with magic bytes and a format version and end with a CRC32C
+// checksum of the section, such that snapshots of unsupported formats and
+// corrupted snapshots are detected before any expensive processing.
+//
+// Metadata: [magic "VTSM"][version uint16][commitment 32 bytes][numParts uint32][checksum uint32]
+// Part:     [magic "VTSP"][version uint16][numEntries uint32][key1 32 bytes][value1 32 bytes]...[numLeafDepths uint32][stem1 31 bytes][depth1 uint8]...[numCommitments uint32][commitment1 32 bytes]...[checksum uint32]
+//
+// Entries are listed in strictly increasing key order. All integers are
+// encoded in big-endian byte order.
+//
+// Since deleting keys retains inner nodes left with a single leaf, the shape
+// of a trie can not be derived from its entries alone. The leaf depths
+// section lists the leaves placed deeper than required by their stems, as
+// reported by trie.GetLeafDepths, in strictly increasing stem order. They
+// are applied to the trie rebuilt from the entries to reproduce its shape.
+//
+// The optional commitments section lists the compressed commitments of the
+// trie nodes covering the entries of the part, in the order defined by
+// trie.GetPartitionNodeCommitments. It allows Restore to skip recomputing the
+// commitments of restored nodes. Parts without node commitments have an empty
+// commitments section.
+//
+// Parts of version 2 lack the leaf depths section, and parts of version 1
+// additionally lack the commitments section, but are otherwise identical and
+// still accepted. Their tries are restored with the shape implied by their
+// entries.
+//
+// Snapshots created by CreateSnapshot consist of trie.NumPartitions parts,
+// where part i contains the entries of the trie partition covering all keys
+// starting with the byte i. The proof of a part is the commitment of the
+// partition followed by an opening of the root commitment at position i:
+//
+// Proof:    [partition commitment 32 bytes][opening commit.OpeningSize bytes]
+//
+// Thus, each part can be verified independently of all other parts. Exports
+// and snapshots of older versions consist of a single part containing all
+// entries instead.
+//
+// The trie parts may be followed by a final part holding the written-slot
+// index of the state, as described in slots.go. The index is not covered by
+// the root commitment and, since storage keys are hashed, can not be derived
+// from the trie either. Its proof is thus empty. Instead, the storage, header
+// and code chunk keys of the accounts listed in the index have to account for
+// all keys of the trie. An index lacking slots would cause HasEmptyStorage to
+// miss storage and account deletions to leave storage behind, so snapshots
+// failing this check are rejected by verifiers, once all of their parts have
+// been verified, and by Restore. Snapshots of older versions lack this part,
+// so they can only be restored if their trie is empty.
+//
+// Snapshots of the legacy format predating this encoding, which lacks magic
+// bytes, versions and checksums, are still accepted and treated as version 0.
+const (
+	snapshotMetadataMagic = "VTSM"
+	snapshotPartMagic     = "VTSP"
+	snapshotVersion       = uint16(3)
+	minSnapshotVersion    = uint16(1)
+
+	snapshotMetadataSize       = 4 + 2 + 32 + 4 + 4
+	snapshotPartHeaderSize     = 4 + 2 + 4
+	snapshotChecksumSize       = 4
+	legacySnapshotMetadataSize = 32 + 4
+	snapshotPartProofSize      = 32 + commit.OpeningSize
+	leafDepthSize              = 31 + 1 // stem, depth
+)
+
+var snapshotChecksumTable = crc32.MakeTable(crc32.Castagnoli)
+
+// snapshotMetadata is the decoded metadata section of a snapshot.
+type snapshotMetadata struct {
+	version    uint16
+	commitment [32]byte
+	numParts   uint32
+}
+
+func encodeSnapshotMetadata(commitment [32]byte, numParts uint32) []byte {
+	res := make([]byte, 0, snapshotMetadataSize)
+	res = append(res, snapshotMetadataMagic...)
+	res = binary.BigEndian.AppendUint16(res, snapshotVersion)
+	res = append(res, commitment[:]...)
+	res = binary.BigEndian.AppendUint32(res, numParts)
+	return binary.BigEndian.AppendUint32(res, crc32.Checksum(res, snapshotChecksumTable))
+}
+
+func decodeSnapshotMetadata(data []byte) (snapshotMetadata, error) {
+	if len(data) == legacySnapshotMetadataSize && !bytes.HasPrefix(data, []byte(snapshotMetadataMagic)) {
+		return snapshotMetadata{
+			version:    0,
+			commitment: [32]byte(data[0:32]),
+			numParts:   binary.BigEndian.Uint32(data[32:36]),
+		}, nil
+	}
+	if !bytes.HasPrefix(data, []byte(snapshotMetadataMagic)) {
+		return snapshotMetadata{}, fmt.Errorf("not a snapshot metadata section")
+	}
+	if len(data) < 6 {
+		return snapshotMetadata{}, fmt.Errorf("metadata too short")
+	}
+	version := binary.BigEndian.Uint16(data[4:6])
+	if err := checkSnapshotVersion(version); err != nil {
+		return snapshotMetadata{}, err
+	}
+	if len(data) != snapshotMetadataSize {
+		return snapshotMetadata{}, fmt.Errorf("invalid metadata length: expected %d, got %d", snapshotMetadataSize, len(data))
+	}
+	if err := verifySnapshotChecksum(data); err != nil {
+		return snapshotMetadata{}, err
+	}
+	return snapshotMetadata{
+		version:    version,
+		commitment: [32]byte(data[6:38]),
+		numParts:   binary.BigEndian.Uint32(data[38:42]),
+	}, nil
+}
+
+// checkSnapshotVersion verifies that the given snapshot format version is
+// supported. Version 0, which denotes the legacy format, is handled separately.
+func checkSnapshotVersion(version uint16) error {
+	if version < minSnapshotVersion || version > snapshotVersion {
+		return fmt.Errorf("unsupported snapshot version %d", version)
+	}
+	return nil
+}
+
+// getSnapshotPartSize returns the size of a part of the current version with
+// the given number of entries, leaf depths and node commitments.
+func getSnapshotPartSize(numEntries, numLeafDepths, numCommitments int) int {
+	return snapshotPartHeaderSize + numEntries*64 + 4 + numLeafDepths*leafDepthSize + 4 + numCommitments*32 + snapshotChecksumSize
+}
+
+// entrySource enumerates trie entries in ascending key order, like the Visit
+// method of a trie. The enumeration stops early if the visitor returns false.
+type entrySource func(visitor func(trie.Key, trie.Value) bool)
+
+// getPartitionEntries returns a source of the entries of the given trie
+// partition.
+func getPartitionEntries(t *trie.Trie, partition byte) entrySource {
+	return func(visitor func(trie.Key, trie.Value) bool) {
+		t.VisitPartition(partition, visitor)
+	}
+}
+
+// countEntries returns the number of entries listed by the given source.
+func countEntries(entries entrySource) int {
+	count := 0
+	entries(func(trie.Key, trie.Value) bool {
+		count++
+		return true
+	})
+	return count
+}
+
+// encodeSnapshotPart produces a snapshot part containing all entries listed
+// by the given source, the given leaf depths and the given node commitments.
+// Leaf depths and commitments may be empty.
+func encodeSnapshotPart(entries entrySource, depths []trie.LeafDepth, commitments []commit.Commitment) []byte {
+	count := countEntries(entries)
+	buffer := bytes.NewBuffer(make([]byte, 0, getSnapshotPartSize(count, len(depths), len(commitments))))
+	_ = writeSnapshotPart(context.Background(), buffer, entries, count, depths, commitments) // writing to a buffer can not fail
+	return buffer.Bytes()
+}
+
+// writeSnapshotPart writes a snapshot part containing all entries listed by
+// the given source, the given leaf depths and the given node commitments,
+// which may be empty, to the given output. The number of entries is required
+// for the header of the part. The operation can be canceled through the
+// context.
+func writeSnapshotPart(
+	ctx context.Context,
+	out io.Writer,
+	entries entrySource,
+	count int,
+	depths []trie.LeafDepth,
+	commitments []commit.Commitment,
+) error {
+	checksum := crc32.New(snapshotChecksumTable)
+	writer := io.MultiWriter(out, checksum)
+
+	header := make([]byte, 0, snapshotPartHeaderSize)
+	header = append(header, snapshotPartMagic...)
+	header = binary.BigEndian.AppendUint16(header, snapshotVersion)
+	header = binary.BigEndian.AppendUint32(header, uint32(count))
+	if _, err := writer.Write(header); err != nil {
+		return err
+	}
+
+	var err error
+	written := 0
+	entries(func(key trie.Key, value trie.Value) bool {
+		if written%exportCheckInterval == 0 {
+			if err = ctx.Err(); err != nil {
+				return false
+			}
+		}
+		if _, err = writer.Write(key[:]); err != nil {
+			return false
+		}
+		if _, err = writer.Write(value[:]); err != nil {
+			return false
+		}
+		written++
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	if written != count {
+		return fmt.Errorf("source lists %d entries, expected %d", written, count)
+	}
+
+	if _, err := writer.Write(appendLeafDepths(nil, depths)); err != nil {
+		return err
+	}
+	if _, err := writer.Write(binary.BigEndian.AppendUint32(nil, uint32(len(commitments)))); err != nil {
+		return err
+	}
+	for i, commitment := range commitments {
+		if i%exportCheckInterval == 0 {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+		}
+		compressed := commitment.Compress()
+		if _, err := writer.Write(compressed[:]); err != nil {
+			return err
+		}
+	}
+	_, err = out.Write(binary.BigEndian.AppendUint32(nil, checksum.Sum32()))
+	return err
+}
+
+// decodeSnapshotPart restores the trie contained in the given snapshot part.
+// The checksum of the part is verified before the trie is restored.
+func decodeSnapshotPart(data []byte) (*trie.Trie, error) {
+	res := &trie.Trie{}
+	depths, _, err := consumeSnapshotPart(data, func(key trie.Key, value trie.Value) {
+		res.Set(key, value)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := res.SetLeafDepths(depths); err != nil {
+		return nil, fmt.Errorf("invalid leaf depths: %w", err)
+	}
+	return res, nil
+}
+
+// consumeSnapshotPart reports all entries of the given snapshot part to the
+// given consumer and returns the leaf depths and node commitments listed by
+// the part. The checksum of the part is verified before any entry is
+// reported.
+func consumeSnapshotPart(data []byte, consume func(trie.Key, trie.Value)) ([]trie.LeafDepth, [][32]byte, error) {
+	if bytes.HasPrefix(data, []byte(snapshotPartMagic)) {
+		if len(data) < snapshotPartHeaderSize+snapshotChecksumSize {
+			return nil, nil, fmt.Errorf("part too short")
+		}
+		if err := checkSnapshotVersion(binary.BigEndian.Uint16(data[4:6])); err != nil {
+			return nil, nil, err
+		}
+		if err := verifySnapshotChecksum(data); err != nil {
+			return nil, nil, err
+		}
+	}
+	// The size of the data bounds the number of commitments.
+	return readSnapshotPart(context.Background(), bytes.NewReader(data), uint64(len(data)), math.MaxUint32, consume)
+}
+
+// readSnapshotPart reads a snapshot part of the given size from the given
+// input, reporting all entries to the given consumer, and returns the leaf
+// depths and node commitments listed by the part. Parts listing more than
+// maxCommitments commitments are rejected before memory for them is
+// allocated, and the number of leaf depths is bounded by the number of
+// entries. Parts of the legacy format are accepted as well. Entries are
+// required to be in strictly increasing key order. The operation can be
+// canceled through the context.
+func readSnapshotPart(
+	ctx context.Context,
+	in io.Reader,
+	size uint64,
+	maxCommitments uint64,
+	consume func(trie.Key, trie.Value),
+) ([]trie.LeafDepth, [][32]byte, error) {
+	checksum := crc32.New(snapshotChecksumTable)
+	reader := io.TeeReader(in, checksum)
+
+	var prefix [4]byte
+	if _, err := io.ReadFull(reader, prefix[:]); err != nil {
+		return nil, nil, fmt.Errorf("failed to read part header: %w", err)
+	}
+
+	// Parts of the legacy format start with the number of entries.
+	legacy := string(prefix[:]) != snapshotPartMagic
+	count := uint64(binary.BigEndian.Uint32(prefix[:]))
+	version := uint16(0)
+	if !legacy {
+		var header [snapshotPartHeaderSize - 4]byte
+		if _, err := io.ReadFull(reader, header[:]); err != nil {
+			return nil, nil, fmt.Errorf("failed to read part header: %w", err)
+		}
+		version = binary.BigEndian.Uint16(header[0:2])
+		if err := checkSnapshotVersion(version); err != nil {
+			return nil, nil, err
+		}
+		count = uint64(binary.BigEndian.Uint32(header[2:6]))
+	}
+
+	// The size of parts with leaf depths or commitments sections is checked
+	// once the number of leaf depths and commitments is known.
+	want := uint64(snapshotPartHeaderSize+snapshotChecksumSize) + count*64
+	switch {
+	case legacy:
+		want = 4 + count*64
+	case version >= 3:
+		want += 4 + 4
+	case version >= 2:
+		want += 4
+	}
+	if size < want || (size != want && version < 2) {
+		return nil, nil, fmt.Errorf("invalid part length: expected %d for %d entries, got %d", want, count, size)
+	}
+
+	var previous trie.Key
+	var entry [64]byte
+	for i := range count {
+		if i%exportCheckInterval == 0 {
+			if err := ctx.Err(); err != nil {
+				return nil, nil, err
+			}
+		}
+		if _, err := io.ReadFull(reader, entry[:]); err != nil {
+			return nil, nil, fmt.Errorf("failed to read entry %d: %w", i, err)
+		}
+		key := trie.Key(entry[0:32])
+		if i > 0 && bytes.Compare(previous[:], key[:]) >= 0 {
+			return nil, nil, fmt.Errorf("entry %d is not in increasing key order", i)
+		}
+		consume(key, trie.Value(entry[32:64]))
+		previous = key
+	}
+
+	if legacy {
+		return nil, nil, nil
+	}
+
+	var depths []trie.LeafDepth
+	if version >= 3 {
+		var length [4]byte
+		if _, err := io.ReadFull(reader, length[:]); err != nil {
+			return nil, nil, fmt.Errorf("failed to read number of leaf depths: %w", err)
+		}
+		numDepths := uint64(binary.BigEndian.Uint32(length[:]))
+		if numDepths > count {
+			return nil, nil, fmt.Errorf("part lists %d leaf depths for %d entries", numDepths, count)
+		}
+		want += numDepths * leafDepthSize
+		if size < want {
+			return nil, nil, fmt.Errorf("invalid part length: expected at least %d for %d entries and %d leaf depths, got %d", want, count, numDepths, size)
+		}
+		if numDepths > 0 {
+			depths = make([]trie.LeafDepth, numDepths)
+		}
+		var depth [leafDepthSize]byte
+		for i := range depths {
+			if i%exportCheckInterval == 0 {
+				if err := ctx.Err(); err != nil {
+					return nil, nil, err
+				}
+			}
+			if _, err := io.ReadFull(reader, depth[:]); err != nil {
+				return nil, nil, fmt.Errorf("failed to read leaf depth %d: %w", i, err)
+			}
+			depths[i] = decodeLeafDepth(depth)
+		}
+	}
+
+	var commitments [][32]byte
+	if version >= 2 {
+		var length [4]byte
+		if _, err := io.ReadFull(reader, length[:]); err != nil {
+			return nil, nil, fmt.Errorf("failed to read number of commitments: %w", err)
+		}
+		numCommitments := uint64(binary.BigEndian.Uint32(length[:]))
+		if numCommitments > maxCommitments {
+			return nil, nil, fmt.Errorf("part lists %d commitments, at most %d are accepted", numCommitments, maxCommitments)
+		}
+		if size != want+numCommitments*32 {
+			return nil, nil, fmt.Errorf("invalid part length: expected %d for %d entries and %d commitments, got %d", want+numCommitments*32, count, numCommitments, size)
+		}
+		if numCommitments > 0 {
+			commitments = make([][32]byte, numCommitments)
+		}
+		for i := range commitments {
+			if i%exportCheckInterval == 0 {
+				if err := ctx.Err(); err != nil {
+					return nil, nil, err
+				}
+			}
+			if _, err := io.ReadFull(reader, commitments[i][:]); err != nil {
+				return nil, nil, fmt.Errorf("failed to read commitment %d: %w", i, err)
+			}
+		}
+	}
+
+	want32 := checksum.Sum32()
+	var got [snapshotChecksumSize]byte
+	if _, err := io.ReadFull(in, got[:]); err != nil {
+		return nil, nil, fmt.Errorf("failed to read checksum: %w", err)
+	}
+	if binary.BigEndian.Uint32(got[:]) != want32 {
+		return nil, nil, fmt.Errorf("checksum mismatch")
+	}
+	return depths, commitments, nil
+}
+
+// verifySnapshotChecksum checks the checksum at the end of the given section.
+func verifySnapshotChecksum(data []byte) error {
+	if len(data) < snapshotChecksumSize {
+		return fmt.Errorf("section too short")
+	}
+	content := data[:len(data)-snapshotChecksumSize]
+	got := binary.BigEndian.Uint32(data[len(data)-snapshotChecksumSize:])
+	if crc32.Checksum(content, snapshotChecksumTable) != got {
+		return fmt.Errorf("checksum mismatch")
+	}
+	return nil
+}
+
+// appendLeafDepths appends the number of the given leaf depths, followed by
+// the stem and depth of each of them, to the given buffer.
+func appendLeafDepths(res []byte, depths []trie.LeafDepth) []byte {
+	res = binary.BigEndian.AppendUint32(res, uint32(len(depths)))
+	for _, depth := range depths {
+		res = append(res, depth.Stem[:]...)
+		res = append(res, depth.Depth)
+	}
+	return res
+}
+
+// decodeLeafDepths decodes leaf depths encoded by appendLeafDepths, which
+// have to span the entire given data.
+func decodeLeafDepths(data []byte) ([]trie.LeafDepth, error) {
+	if len(data) < 4 {
+		return nil, fmt.Errorf("leaf depths too short")
+	}
+	count := uint64(binary.BigEndian.Uint32(data[0:4]))
+	if uint64(len(data)) != 4+count*leafDepthSize {
+		return nil, fmt.Errorf("invalid length of leaf depths: expected %d for %d depths, got %d", 4+count*leafDepthSize, count, len(data))
+	}
+	var res []trie.LeafDepth
+	for i := range count {
+		offset := 4 + i*leafDepthSize
+		res = append(res, decodeLeafDepth([leafDepthSize]byte(data[offset:offset+leafDepthSize])))
+	}
+	return res, nil
+}
+
+// decodeLeafDepth decodes a single leaf depth encoded by appendLeafDepths.
+func decodeLeafDepth(data [leafDepthSize]byte) trie.LeafDepth {
+	return trie.LeafDepth{Stem: [31]byte(data[:31]), Depth: data[31]}
+}
+
+// encodePartProof produces the proof of a snapshot part, consisting of the
+// commitment of the part's partition and an opening proving this commitment
+// to be covered by the root commitment.
+func encodePartProof(partition commit.Commitment, opening commit.Opening) []byte {
+	commitment := partition.Compress()
+	encoded := opening.Bytes()
+	res := make([]byte, 0, snapshotPartProofSize)
+	res = append(res, commitment[:]...)
+	return append(res, encoded[:]...)
+}
+
+func decodePartProof(data []byte) (commit.Commitment, commit.Opening, error) {
+	if len(data) != snapshotPartProofSize {
+		return commit.Commitment{}, commit.Opening{}, fmt.Errorf("invalid proof length: expected %d, got %d", snapshotPartProofSize, len(data))
+	}
+	partition, err := commit.NewCommitmentFromCompressedBytes([32]byte(data[:32]))
+	if err != nil {
+		return commit.Commitment{}, commit.Opening{}, fmt.Errorf("invalid partition commitment: %w", err)
+	}
+	opening, err := commit.NewOpeningFromBytes([commit.OpeningSize]byte(data[32:]))
+	if err != nil {
+		return commit.Commitment{}, commit.Opening{}, fmt.Errorf("invalid opening: %w", err)
+	}
+	return partition, opening, nil
+}
+
+// writtenSlotsPart is the number of the part holding the written-slot index
+// in snapshots created by CreateSnapshot.
+const writtenSlotsPart = trie.NumPartitions
+
+// getSnapshotLayout returns the number of trie parts of a snapshot with the
+// given total number of parts, and whether the trie parts are followed by a
+// part holding the written-slot index.
+func getSnapshotLayout(numParts uint32) (trieParts int, hasSlots bool, err error) {
+	switch numParts {
+	case 1, trie.NumPartitions:
+		return int(numParts), false, nil
+	case 2, trie.NumPartitions + 1:
+		return int(numParts) - 1, true, nil
+	}
+	return 0, false, fmt.Errorf("unsupported number of parts: %d", numParts)
+}
+
+// vtSnapshot represents a snapshot of the Verkle Trie state. It retains a
+// clone of the trie at the time the snapshot was created, from which parts
+// and proofs are produced on demand. The clone is never modified, such that
+// parts and proofs may be requested concurrently.
+type vtSnapshot struct {
+	trie       *trie.Trie
+	commitment [32]byte // compressed root commitment of the trie
+	slots      []byte   // encoded written-slot index of the state, nil if not included
+}
+
+// checkPartNumber verifies that the given part number is valid for this
+// snapshot.
+func (s *vtSnapshot) checkPartNumber(partNumber int) error {
+	if partNumber < 0 || partNumber >= s.GetNumParts() {
+		return fmt.Errorf("invalid part number %d, snapshot has %d parts", partNumber, s.GetNumParts())
+	}
+	return nil
+}
+
+func (s *vtSnapshot) GetRootProof() backend.Proof {
+	return &vtProof{commitment: s.commitment[:]}
+}
+
+func (s *vtSnapshot) GetNumParts() int {
+	// Each partition of the trie forms a part, followed by the index
+	if s.slots == nil {
+		return trie.NumPartitions
+	}
+	return writtenSlotsPart + 1
+}
+
+func (s *vtSnapshot) GetProof(partNumber int) (backend.Proof, error) {
+	data, err := s.GetProofData(partNumber)
+	if err != nil {
+		return nil, err
+	}
+	return &vtPartProof{data: data}, nil
+}
+
+func (s *vtSnapshot) GetPart(partNumber int) (backend.Part, error) {
+	data, err := s.GetPartData(partNumber)
+	if err != nil {
+		return nil, err
+	}
+	return &vtSnapshotPart{data: data}, nil
+}
+
+func (s *vtSnapshot) GetData() backend.SnapshotData {
+	return s
+}
+
+func (s *vtSnapshot) GetMetaData() ([]byte, error) {
+	// Metadata contains the commitment and number of parts
+	return encodeSnapshotMetadata(s.commitment, uint32(s.GetNumParts())), nil
+}
+
+func (s *vtSnapshot) GetProofData(partNumber int) ([]byte, error) {
+	if err := s.checkPartNumber(partNumber); err != nil {
+		return nil, err
+	}
+	if partNumber == writtenSlotsPart {
+		return []byte{}, nil // the index is not covered by the root, see above
+	}
+	partition := byte(partNumber)
+	opening, err := s.trie.OpenPartition(partition)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open partition %d: %w", partNumber, err)
+	}
+	return encodePartProof(s.trie.GetPartitionCommitment(partition), opening), nil
+}
+
+func (s *vtSnapshot) GetPartData(partNumber int) ([]byte, error) {
+	if err := s.checkPartNumber(partNumber); err != nil {
+		return nil, err
+	}
+	if partNumber == writtenSlotsPart {
+		return s.slots, nil
+	}
+	// Parts carry the leaf depths of their partition, such that its shape
+	// can be reproduced, and its node commitments, such that they do not
+	// need to be recomputed on restore.
+	partition := byte(partNumber)
+	return encodeSnapshotPart(
+		getPartitionEntries(s.trie, partition),
+		s.trie.GetPartitionLeafDepths(partition),
+		s.trie.GetPartitionNodeCommitments(partition),
+	), nil
+}
+
+func (s *vtSnapshot) Release() error {
+	// In-memory snapshot, nothing to release
+	return nil
+}
+
+// vtSnapshotPart represents a part of the snapshot
+type vtSnapshotPart struct {
+	data []byte
+}
+
+func (p *vtSnapshotPart) ToBytes() []byte {
+	return p.data
+}
+
+// vtProof represents a cryptographic proof of the Verkle Trie state
+type vtProof struct {
+	commitment []byte
+}
+
+func (p *vtProof) Equal(other backend.Proof) bool {
+	if otherVt, ok := other.(*vtProof); ok {
+		return bytes.Equal(p.commitment, otherVt.commitment)
+	}
+	return false
+}
+
+func (p *vtProof) ToBytes() []byte {
+	return p.commitment
+}
+
+// vtPartProof represents the proof of a single snapshot part, consisting of
+// the commitment of the part's partition and its opening against the root
+// commitment.
+type vtPartProof struct {
+	data []byte
+}
+
+func (p *vtPartProof) Equal(other backend.Proof) bool {
+	if otherVt, ok := other.(*vtPartProof); ok {
+		return bytes.Equal(p.data, otherVt.data)
+	}
+	return false
+}
+
+func (p *vtPartProof) ToBytes() []byte {
+	return p.data
+}
+
+// Snapshot & Recovery
+func (s *State) GetProof() (backend.Proof, error) {
+	// Get the current Verkle commitment
+	commitment := s.trie.Commit()
+	commitmentBytes := commitment.Compress()
+	return &vtProof{commitment: commitmentBytes[:]}, nil
+}
+
+func (s *State) CreateSnapshot() (backend.Snapshot, error) {
+	// The snapshot retains a clone of the trie, which shares all nodes with
+	// the live trie until they are modified. Parts and proofs are produced
+	// from this clone when they are requested.
+	snapshot := s.trie.Clone()
+	return &vtSnapshot{
+		trie:       snapshot,
+		commitment: snapshot.Commit().Compress(),
+		slots:      encodeWrittenSlots(s.getWrittenSlots()),
+	}, nil
+}
+
+func (s *State) Restore(snapshotData backend.SnapshotData) error {
+	metadata, trieParts, hasSlots, err := getSnapshotMetadata(snapshotData)
+	if err != nil {
+		return err
+	}
+	restored, err := s.restoreTrie(snapshotData, metadata, trieParts)
+	if err != nil {
+		return err
+	}
+
+	// The written-slot index is restored from the last part, if present. It
+	// is not covered by the root commitment, so it has to account for all keys
+	// of the restored trie. Without an index, only empty tries are accepted.
+	writtenSlots := make(map[common.Address]map[common.Key]bool)
+	if hasSlots {
+		data, err := snapshotData.GetPartData(trieParts)
+		if err != nil {
+			return fmt.Errorf("failed to get written slots: %w", err)
+		}
+		writtenSlots, err = decodeWrittenSlots(data)
+		if err != nil {
+			return fmt.Errorf("failed to deserialize written slots: %w", err)
+		}
+	}
+	if err := checkWrittenSlotsCoverageOf(restored, writtenSlots); err != nil {
+		return fmt.Errorf("invalid written slots: %w", err)
+	}
+
+	s.trie = restored
+	s.setWrittenSlots(writtenSlots)
+	return nil
+}
+
+// getSnapshotMetadata fetches and decodes the metadata of the given snapshot
+// and determines its layout, as described by getSnapshotLayout.
+func getSnapshotMetadata(snapshotData backend.SnapshotData) (snapshotMetadata, int, bool, error) {
+	data, err := snapshotData.GetMetaData()
+	if err != nil {
+		return snapshotMetadata{}, 0, false, fmt.Errorf("failed to get metadata: %w", err)
+	}
+	metadata, err := decodeSnapshotMetadata(data)
+	if err != nil {
+		return snapshotMetadata{}, 0, false, fmt.Errorf("invalid metadata: %w", err)
+	}
+	trieParts, hasSlots, err := getSnapshotLayout(metadata.numParts)
+	if err != nil {
+		return snapshotMetadata{}, 0, false, fmt.Errorf("invalid metadata: %w", err)
+	}
+	return metadata, trieParts, hasSlots, nil
+}
+
+// restoreTrie rebuilds the trie from the given number of leading trie parts
+// of the given snapshot and verifies it against the commitment listed in the
+// snapshot's metadata. The state itself is not modified.
+func (s *State) restoreTrie(
+	snapshotData backend.SnapshotData,
+	metadata snapshotMetadata,
+	trieParts int,
+) (*trie.Trie, error) {
+	// Collect the entries of all trie parts in a new trie. The encoding of
+	// each part is validated before any of its entries are restored. Parts
+	// of partitioned snapshots may only contain keys of their partition.
+	restored := &trie.Trie{}
+	partitioned := trieParts == trie.NumPartitions
+	for i := range trieParts {
+		data, err := snapshotData.GetPartData(i)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get data of part %d: %w", i, err)
+		}
+		var invalid error
+		depths, commitments, err := consumeSnapshotPart(data, func(key trie.Key, value trie.Value) {
+			if partitioned && key[0] != byte(i) && invalid == nil {
+				invalid = fmt.Errorf("key %x does not belong to part %d", key, i)
+			}
+			restored.Set(key, value)
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to deserialize part %d: %w", i, err)
+		}
+		if invalid != nil {
+			return nil, invalid
+		}
+
+		// The shape of the part's subtree is restored before node
+		// commitments are assigned to its nodes.
+		for _, depth := range depths {
+			if partitioned && depth.Stem[0] != byte(i) {
+				return nil, fmt.Errorf("leaf with stem %x does not belong to part %d", depth.Stem, i)
+			}
+		}
+		if err := restored.SetLeafDepths(depths); err != nil {
+			return nil, fmt.Errorf("invalid leaf depths in part %d: %w", i, err)
+		}
+
+		// Node commitments carried by the part are only assigned to the
+		// restored partition if they are to be trusted. Otherwise, all
+		// commitments are recomputed from the restored entries.
+		if len(commitments) == 0 || !s.restoreVerification.TrustCommitments {
+			continue
+		}
+		if !partitioned {
+			return nil, fmt.Errorf("unexpected node commitments in part %d of unpartitioned snapshot", i)
+		}
+		err = restoreNodeCommitments(restored, byte(i), commitments, s.restoreVerification.SampleRate)
+		if err != nil {
+			return nil, fmt.Errorf("failed to restore node commitments of part %d: %w", i, err)
+		}
+	}
+
+	// The root commitment is recomputed from the commitments of the
+	// partitions. If those have been recomputed from the restored entries,
+	// this verifies the entries against the snapshot's commitment. Trusted
+	// node commitments are only covered as far as they have been sampled.
+	restoredCommitment := restored.Commit().Compress()
+	if restoredCommitment != metadata.commitment {
+		return nil, fmt.Errorf("commitment mismatch after restore")
+	}
+	return restored, nil
+}
+
+// RestoreVerification configures how Restore treats the node commitments
+// carried by snapshot parts. The zero value ignores them, such that all
+// commitments are recomputed from the restored entries.
+type RestoreVerification struct {
+	// TrustCommitments enables the use of node commitments carried by
+	// snapshots instead of recomputing them. Restore only verifies that the
+	// carried commitments reproduce the root commitment, not that they match
+	// the restored entries, so this should only be enabled if all parts have
+	// been verified before, e.g. by a snapshot verifier.
+	TrustCommitments bool
+	// SampleRate is the fraction of restored nodes, between 0 and 1, whose
+	// trusted commitments are nevertheless verified by recomputing them.
+	SampleRate float64
+}
+
+// DefaultRestoreVerification is the verification used by Restore unless
+// configured otherwise through SetRestoreVerification. It recomputes all
+// node commitments.
+var DefaultRestoreVerification = RestoreVerification{}
+
+// SetRestoreVerification configures the verification of node commitments
+// carried by snapshots restored by Restore.
+func (s *State) SetRestoreVerification(verification RestoreVerification) {
+	s.restoreVerification = verification
+}
+
+// restoreNodeCommitments assigns the given compressed commitments to the
+// nodes of the given partition of the given trie, recomputing the commitments
+// of a random sample of the nodes with the given rate.
+func restoreNodeCommitments(t *trie.Trie, partition byte, compressed [][32]byte, sampleRate float64) error {
+	commitments := make([]commit.Commitment, len(compressed))
+	for i, data := range compressed {
+		commitment, err := commit.NewCommitmentFromCompressedBytes(data)
+		if err != nil {
+			return fmt.Errorf("invalid commitment %d: %w", i, err)
+		}
+		commitments[i] = commitment
+	}
+	return t.SetPartitionNodeCommitments(partition, commitments, func() bool {
+		return rand.Float64() < sampleRate
+	})
+}
+
+func (s *State) GetSnapshotVerifier(metadata []byte) (backend.SnapshotVerifier, error) {
+	// Parse the commitment from metadata
+	decoded, err := decodeSnapshotMetadata(metadata)
+	if err != nil {
+		return nil, fmt.Errorf("invalid metadata: %w", err)
+	}
+
+	// Besides partitioned snapshots, snapshots of older versions consisting
+	// of a single trie part are supported.
+	_, hasSlots, err := getSnapshotLayout(decoded.numParts)
+	if err != nil {
+		return nil, fmt.Errorf("invalid metadata: %w", err)
+	}
+
+	root, err := commit.NewCommitmentFromCompressedBytes(decoded.commitment)
+	if err != nil {
+		return nil, fmt.Errorf("invalid root commitment: %w", err)
+	}
+
+	return &vtSnapshotVerifier{
+		expectedCommitment: decoded.commitment,
+		root:               root,
+		numParts:           int(decoded.numParts),
+		hasSlots:           hasSlots,
+	}, nil
+}
+
+// RunPostRestoreTasks performs any necessary cleanup after snapshot restoration
+func (s *State) RunPostRestoreTasks() error {
+	// The written-slot index restored from a snapshot has been checked to
+	// cover the restored trie, but may list more than the trie holds. Slots
+	// that have been deleted since they were written, and accounts left
+	// without any data, are dropped. This does not change the answers of
+	// HasEmptyStorage.
+	s.ownWrittenSlots()
+	for address, keys := range s.writtenSlots {
+		for key := range keys {
+			if _, used := s.trie.Lookup(getStorageKey(address, key)); !used {
+				delete(keys, key)
+			}
+		}
+		_, hasBasicData := s.trie.Lookup(getBasicDataKey(address))
+		_, hasCodeHash := s.trie.Lookup(getCodeHashKey(address))
+		if len(keys) == 0 && !hasBasicData && !hasCodeHash {
+			delete(s.writtenSlots, address)
+		}
+	}
+	return nil
+}
+
+// vtSnapshotVerifier verifies that a snapshot matches an expected commitment
+type vtSnapshotVerifier struct {
+	expectedCommitment [32]byte
+	root               commit.Commitment // the expected commitment in decompressed form
+	numParts           int
+	hasSlots           bool // whether the last part holds the written-slot index
+
+	// The keys of verified trie parts and the verified written-slot index
+	// are retained until all parts have been verified, such that the index
+	// can be checked to account for all keys of the trie. Parts may be
+	// verified concurrently.
+	mutex    sync.Mutex
+	partKeys map[int][]trie.Key                     // keys of verified trie parts in ascending order
+	slots    map[common.Address]map[common.Key]bool // the verified index, nil if not verified yet
+}
+
+func (v *vtSnapshotVerifier) VerifyRootProof(data backend.SnapshotData) (backend.Proof, error) {
+	// The root proof is the commitment listed in the metadata
+	metadata, err := data.GetMetaData()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get metadata: %w", err)
+	}
+	decoded, err := decodeSnapshotMetadata(metadata)
+	if err != nil {
+		return nil, fmt.Errorf("invalid metadata: %w", err)
+	}
+
+	// Verify it matches expected commitment
+	if decoded.commitment != v.expectedCommitment {
+		return nil, fmt.Errorf("root proof verification failed: commitment mismatch")
+	}
+
+	return &vtProof{commitment: bytes.Clone(v.expectedCommitment[:])}, nil
+}
+
+func (v *vtSnapshotVerifier) VerifyPart(partNumber int, proof, part []byte) error {
+	if partNumber < 0 || partNumber >= v.numParts {
+		return fmt.Errorf("invalid part number %d, snapshot has %d parts", partNumber, v.numParts)
+	}
+	if v.hasSlots && partNumber == v.numParts-1 {
+		slots, err := verifyWrittenSlotsPart(proof, part)
+		if err != nil {
+			return err
+		}
+		return v.addVerifiedSlots(slots)
+	}
+	if v.numParts == 1 || (v.hasSlots && v.numParts == 2) {
+		keys, err := v.verifySinglePart(proof, part)
+		if err != nil {
+			return err
+		}
+		return v.addVerifiedPart(partNumber, keys)
+	}
+
+	// The proof has to show that the partition commitment is covered by the
+	// expected root commitment.
+	partition := byte(partNumber)
+	commitment, opening, err := decodePartProof(proof)
+	if err != nil {
+		return fmt.Errorf("invalid proof: %w", err)
+	}
+	ok, err := trie.VerifyPartition(v.root, partition, commitment, opening)
+	if err != nil {
+		return fmt.Errorf("proof verification failed: %w", err)
+	}
+	if !ok {
+		return fmt.Errorf("proof verification failed: partition commitment not covered by root commitment")
+	}
+
+	// The entries of the part have to reproduce the partition commitment.
+	// Only the subtree of the partition is rebuilt and committed, such that
+	// the verification time is proportional to the size of the part.
+	restored := trie.NewPartition(partition)
+	var keys []trie.Key
+	var invalid error
+	depths, commitments, err := consumeSnapshotPart(part, func(key trie.Key, value trie.Value) {
+		if err := restored.Set(key, value); err != nil && invalid == nil {
+			invalid = err
+		}
+		keys = append(keys, key)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to deserialize data: %w", err)
+	}
+	if invalid != nil {
+		return fmt.Errorf("data verification failed: %w", invalid)
+	}
+	if err := restored.SetLeafDepths(depths); err != nil {
+		return fmt.Errorf("data verification failed: %w", err)
+	}
+	if !restored.Commit().Equal(commitment) {
+		return fmt.Errorf("data verification failed: commitment mismatch")
+	}
+
+	// Node commitments carried by the part have to match the rebuilt nodes,
+	// such that they can be trusted when restoring the part.
+	if len(commitments) > 0 {
+		want := restored.GetNodeCommitments()
+		if len(want) != len(commitments) {
+			return fmt.Errorf("data verification failed: expected %d node commitments, got %d", len(want), len(commitments))
+		}
+		for i, commitment := range want {
+			if commitment.Compress() != commitments[i] {
+				return fmt.Errorf("data verification failed: node commitment %d mismatch", i)
+			}
+		}
+	}
+
+	return v.addVerifiedPart(partNumber, keys)
+}
+
+// verifySinglePart verifies the only trie part of a snapshot, which contains
+// all entries and is proven by the root commitment itself. The keys of the
+// verified entries are returned.
+func (v *vtSnapshotVerifier) verifySinglePart(proof, part []byte) ([]trie.Key, error) {
+	// Verify the proof matches expected commitment
+	if !bytes.Equal(proof, v.expectedCommitment[:]) {
+		return nil, fmt.Errorf("proof verification failed: commitment mismatch")
+	}
+
+	// Create a temporary trie to deserialize and verify the part data
+	restored, err := decodeSnapshotPart(part)
+	if err != nil {
+		return nil, fmt.Errorf("failed to deserialize data: %w", err)
+	}
+
+	// Verify the commitment matches
+	if restored.Commit().Compress() != v.expectedCommitment {
+		return nil, fmt.Errorf("data verification failed: commitment mismatch")
+	}
+
+	var keys []trie.Key
+	restored.Visit(func(key trie.Key, _ trie.Value) bool {
+		keys = append(keys, key)
+		return true
+	})
+	return keys, nil
+}
+
+// addVerifiedPart records the keys of the given verified trie part and checks
+// the coverage of the trie by the written-slot index once all parts have been
+// verified.
+func (v *vtSnapshotVerifier) addVerifiedPart(partNumber int, keys []trie.Key) error {
+	if !v.hasSlots {
+		return nil // there is no index to be checked
+	}
+	slices.SortFunc(keys, compareTrieKeys)
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	if v.partKeys == nil {
+		v.partKeys = make(map[int][]trie.Key)
+	}
+	v.partKeys[partNumber] = keys
+	return v.checkCoverage()
+}
+
+// addVerifiedSlots records the verified written-slot index and checks the
+// coverage of the trie by the index once all parts have been verified.
+func (v *vtSnapshotVerifier) addVerifiedSlots(slots map[common.Address]map[common.Key]bool) error {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	v.slots = slots
+	return v.checkCoverage()
+}
+
+// checkCoverage checks that the written-slot index accounts for all keys of
+// the verified trie parts, if all parts have been verified. Snapshots without
+// an index, like the snapshots of the trie component, are not checked. The
+// verifier's mutex has to be held by the caller.
+func (v *vtSnapshotVerifier) checkCoverage() error {
+	if !v.hasSlots || v.slots == nil || len(v.partKeys) < v.numParts-1 {
+		return nil
+	}
+	partitioned := v.numParts-1 == trie.NumPartitions
+	numKeys := 0
+	for _, keys := range v.partKeys {
+		numKeys += len(keys)
+	}
+	err := checkWrittenSlotsCoverage(v.slots, numKeys, func(key trie.Key) bool {
+		part := 0
+		if partitioned {
+			part = int(key[0])
+		}
+		_, found := slices.BinarySearchFunc(v.partKeys[part], key, compareTrieKeys)
+		return found
+	})
+	if err != nil {
+		return fmt.Errorf("data verification failed: %w", err)
+	}
+	return nil
+}
+
+// verifyWrittenSlotsPart checks the part holding the written-slot index and
+// returns the decoded index. The index is not authenticated by any trusted
+// data, so it has no proof. Instead, it has to account for all keys of the
+// trie it is restored with, see checkWrittenSlotsCoverage.
+func verifyWrittenSlotsPart(proof, part []byte) (map[common.Address]map[common.Key]bool, error) {
+	if len(proof) != 0 {
+		return nil, fmt.Errorf("unexpected proof for unauthenticated written slots")
+	}
+	slots, err := decodeWrittenSlots(part)
+	if err != nil {
+		return nil, fmt.Errorf("failed to deserialize written slots: %w", err)
+	}
+	return slots, nil
+}
@@ -0,0 +1,577 @@
+package memory
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"hash/crc32"
+	"slices"
+	"sync"
+	"testing"
+
+	"github.com/QoraNet/qoraDB/go/backend"
+	"github.com/QoraNet/qoraDB/go/common"
+	"github.com/QoraNet/qoraDB/go/database/vt/commit"
+	"github.com/QoraNet/qoraDB/go/database/vt/memory/trie"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSnapshotMetadata_CanBeEncodedAndDecoded(t *testing.T) {
+	require := require.New(t)
+
+	data := encodeSnapshotMetadata([32]byte{1, 2, 3}, 7)
+	require.Len(data, snapshotMetadataSize)
+	require.True(bytes.HasPrefix(data, []byte(snapshotMetadataMagic)))
+
+	metadata, err := decodeSnapshotMetadata(data)
+	require.NoError(err)
+	require.Equal(snapshotMetadata{
+		version:    snapshotVersion,
+		commitment: [32]byte{1, 2, 3},
+		numParts:   7,
+	}, metadata)
+}
+
+func TestSnapshotMetadata_CorruptedMetadataIsRejected(t *testing.T) {
+	require := require.New(t)
+	data := encodeSnapshotMetadata([32]byte{1, 2, 3}, 1)
+
+	for i := range data {
+		corrupted := bytes.Clone(data)
+		corrupted[i]++
+		_, err := decodeSnapshotMetadata(corrupted)
+		require.Error(err, "byte %d", i)
+	}
+	for _, size := range []int{0, 4, 6, len(data) - 1} {
+		_, err := decodeSnapshotMetadata(data[:size])
+		require.Error(err, "size %d", size)
+	}
+}
+
+func TestSnapshotMetadata_UnsupportedVersionsAreRejected(t *testing.T) {
+	data := encodeSnapshotMetadata([32]byte{1}, 1)
+	binary.BigEndian.PutUint16(data[4:6], snapshotVersion+1)
+	_, err := decodeSnapshotMetadata(data)
+	require.ErrorContains(t, err, "unsupported snapshot version")
+}
+
+func TestSnapshotMetadata_LegacyMetadataIsAccepted(t *testing.T) {
+	require := require.New(t)
+
+	legacy := make([]byte, legacySnapshotMetadataSize)
+	copy(legacy, []byte{1, 2, 3})
+	binary.BigEndian.PutUint32(legacy[32:], 1)
+
+	metadata, err := decodeSnapshotMetadata(legacy)
+	require.NoError(err)
+	require.Equal(snapshotMetadata{commitment: [32]byte{1, 2, 3}, numParts: 1}, metadata)
+}
+
+func TestSnapshotPart_CanBeEncodedAndDecoded(t *testing.T) {
+	require := require.New(t)
+
+	original := &trie.Trie{}
+	for i := range 100 {
+		original.Set(trie.Key{byte(i * 7), 31: byte(i)}, trie.Value{byte(i)})
+	}
+	original.Set(trie.Key{1, 2, 3}, trie.Value{}) // explicitly set to zero
+
+	data := encodeSnapshotPart(original.Visit, nil, nil)
+	require.Len(data, getSnapshotPartSize(101, 0, 0))
+	require.True(bytes.HasPrefix(data, []byte(snapshotPartMagic)))
+
+	restored, err := decodeSnapshotPart(data)
+	require.NoError(err)
+	require.True(original.Commit().Equal(restored.Commit()))
+}
+
+func TestSnapshotPart_CorruptedPartsAreRejected(t *testing.T) {
+	require := require.New(t)
+
+	original := &trie.Trie{}
+	for i := range 10 {
+		original.Set(trie.Key{byte(i)}, trie.Value{byte(i)})
+	}
+	data := encodeSnapshotPart(original.Visit, nil, nil)
+
+	for _, i := range []int{0, 4, 7, snapshotPartHeaderSize, snapshotPartHeaderSize + 40, len(data) - 1} {
+		corrupted := bytes.Clone(data)
+		corrupted[i]++
+		_, err := decodeSnapshotPart(corrupted)
+		require.Error(err, "byte %d", i)
+	}
+	for _, size := range []int{0, 3, snapshotPartHeaderSize, len(data) - 1} {
+		_, err := decodeSnapshotPart(data[:size])
+		require.Error(err, "size %d", size)
+	}
+}
+
+func TestSnapshotPart_LegacyPartsAreAccepted(t *testing.T) {
+	require := require.New(t)
+
+	original := &trie.Trie{}
+	for i := range 10 {
+		original.Set(trie.Key{byte(i)}, trie.Value{byte(i)})
+	}
+
+	restored, err := decodeSnapshotPart(serializeTrie(original))
+	require.NoError(err)
+	require.True(original.Commit().Equal(restored.Commit()))
+}
+
+func TestSnapshotPart_UnsortedEntriesAreRejected(t *testing.T) {
+	require := require.New(t)
+
+	legacy := binary.BigEndian.AppendUint32(nil, 2)
+	legacy = append(legacy, make([]byte, 128)...)
+	legacy[4] = 2 // first key is larger than the second
+
+	_, err := decodeSnapshotPart(legacy)
+	require.ErrorContains(err, "order")
+}
+
+func TestSnapshot_PartsCoverPartitionsOfTrie(t *testing.T) {
+	require := require.New(t)
+
+	state := newState()
+	require.NoError(state.Apply(0, getRandomUpdate(t, 20)))
+	snapshot, err := state.CreateSnapshot()
+	require.NoError(err)
+	require.Equal(trie.NumPartitions+1, snapshot.GetNumParts())
+
+	total := 0
+	for i := range trie.NumPartitions {
+		part, err := snapshot.GetData().GetPartData(i)
+		require.NoError(err)
+		_, _, err = consumeSnapshotPart(part, func(key trie.Key, _ trie.Value) {
+			require.Equal(byte(i), key[0])
+			total++
+		})
+		require.NoError(err)
+	}
+	require.Equal(countEntries(state.trie.Visit), total)
+
+	_, err = snapshot.GetData().GetPartData(trie.NumPartitions + 1)
+	require.Error(err)
+	_, err = snapshot.GetData().GetProofData(-1)
+	require.Error(err)
+}
+
+func TestSnapshot_IsNotAffectedByLaterUpdates(t *testing.T) {
+	require := require.New(t)
+
+	state := newState()
+	require.NoError(state.Apply(0, getRandomUpdate(t, 5)))
+	want := getHash(t, state)
+	snapshot, err := state.CreateSnapshot()
+	require.NoError(err)
+	require.NoError(state.Apply(1, getRandomUpdate(t, 5)))
+
+	restored := newState()
+	require.NoError(restored.Restore(snapshot.GetData()))
+	require.Equal(want, getHash(t, restored))
+}
+
+func TestSnapshotVerifier_PartsCanBeVerifiedIndependentlyInParallel(t *testing.T) {
+	require := require.New(t)
+
+	state := newState()
+	require.NoError(state.Apply(0, getRandomUpdate(t, 20)))
+	snapshot, err := state.CreateSnapshot()
+	require.NoError(err)
+	metadata, err := snapshot.GetData().GetMetaData()
+	require.NoError(err)
+	verifier, err := newState().GetSnapshotVerifier(metadata)
+	require.NoError(err)
+
+	errs := make([]error, snapshot.GetNumParts())
+	var wg sync.WaitGroup
+	for i := range snapshot.GetNumParts() {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			proof, err := snapshot.GetData().GetProofData(i)
+			if err != nil {
+				errs[i] = err
+				return
+			}
+			part, err := snapshot.GetData().GetPartData(i)
+			if err != nil {
+				errs[i] = err
+				return
+			}
+			errs[i] = verifier.VerifyPart(i, proof, part)
+		}()
+	}
+	wg.Wait()
+	for i, err := range errs {
+		require.NoError(err, "part %d", i)
+	}
+}
+
+func TestSnapshotVerifier_TamperedPartsAndProofsAreRejected(t *testing.T) {
+	require := require.New(t)
+
+	state := newState()
+	require.NoError(state.Apply(0, getRandomUpdate(t, 20)))
+	snapshot, err := state.CreateSnapshot()
+	require.NoError(err)
+	metadata, err := snapshot.GetData().GetMetaData()
+	require.NoError(err)
+	verifier, err := newState().GetSnapshotVerifier(metadata)
+	require.NoError(err)
+
+	// Find two non-empty partitions.
+	var used []int
+	for i := range trie.NumPartitions {
+		if countEntries(getPartitionEntries(state.trie, byte(i))) > 0 {
+			used = append(used, i)
+		}
+	}
+	require.GreaterOrEqual(len(used), 2)
+	first, second := used[0], used[1]
+
+	proof, err := snapshot.GetData().GetProofData(first)
+	require.NoError(err)
+	part, err := snapshot.GetData().GetPartData(first)
+	require.NoError(err)
+	require.NoError(verifier.VerifyPart(first, proof, part))
+
+	// A part with a modified value is rejected, even with a valid checksum.
+	modified := &trie.Trie{}
+	state.trie.VisitPartition(byte(first), func(key trie.Key, value trie.Value) bool {
+		value[0]++
+		modified.Set(key, value)
+		return true
+	})
+	err = verifier.VerifyPart(first, proof, encodeSnapshotPart(getPartitionEntries(modified, byte(first)), nil, nil))
+	require.ErrorContains(err, "commitment mismatch")
+
+	// Parts and proofs can not be used for other partitions.
+	otherProof, err := snapshot.GetData().GetProofData(second)
+	require.NoError(err)
+	otherPart, err := snapshot.GetData().GetPartData(second)
+	require.NoError(err)
+	require.Error(verifier.VerifyPart(first, otherProof, otherPart))
+	require.Error(verifier.VerifyPart(first, proof, otherPart))
+	require.Error(verifier.VerifyPart(first, otherProof, part))
+
+	// Modified proofs are rejected.
+	corrupted := bytes.Clone(proof)
+	corrupted[len(corrupted)-1]++
+	require.Error(verifier.VerifyPart(first, corrupted, part))
+	require.Error(verifier.VerifyPart(first, proof[:len(proof)-1], part))
+
+	// The written-slot index is unauthenticated, so it has no proof and only
+	// its encoding is checked.
+	slotsProof, err := snapshot.GetData().GetProofData(writtenSlotsPart)
+	require.NoError(err)
+	require.Empty(slotsProof)
+	slots, err := snapshot.GetData().GetPartData(writtenSlotsPart)
+	require.NoError(err)
+	require.NoError(verifier.VerifyPart(writtenSlotsPart, slotsProof, slots))
+	corrupted = bytes.Clone(slots)
+	corrupted[len(corrupted)-1]++
+	require.ErrorContains(verifier.VerifyPart(writtenSlotsPart, slotsProof, corrupted), "checksum")
+	require.Error(verifier.VerifyPart(writtenSlotsPart, proof, slots))
+	require.Error(verifier.VerifyPart(writtenSlotsPart, proof, part))
+
+	require.Error(verifier.VerifyPart(writtenSlotsPart+1, proof, part))
+}
+
+func TestSnapshotVerifier_SinglePartSnapshotsAreSupported(t *testing.T) {
+	require := require.New(t)
+
+	original := &trie.Trie{}
+	for i := range 10 {
+		original.Set(trie.Key{byte(i)}, trie.Value{byte(i)})
+	}
+	commitment := original.Commit().Compress()
+
+	verifier, err := newState().GetSnapshotVerifier(encodeSnapshotMetadata(commitment, 1))
+	require.NoError(err)
+	require.NoError(verifier.VerifyPart(0, commitment[:], encodeSnapshotPart(original.Visit, nil, nil)))
+	require.NoError(verifier.VerifyPart(0, commitment[:], serializeTrie(original)))
+	require.Error(verifier.VerifyPart(1, commitment[:], encodeSnapshotPart(original.Visit, nil, nil)))
+
+	_, err = newState().GetSnapshotVerifier(encodeSnapshotMetadata(commitment, 3))
+	require.Error(err)
+}
+
+func TestSnapshotPart_OlderVersionsAreAccepted(t *testing.T) {
+	require := require.New(t)
+
+	original := &trie.Trie{}
+	for i := range 10 {
+		original.Set(trie.Key{byte(i)}, trie.Value{byte(i)})
+	}
+
+	// Version 2 parts lack the leaf depths section, version 1 parts also
+	// lack the commitments section. Both sections are empty here, so only
+	// their lengths need to be removed.
+	for version, omitted := range map[uint16]int{1: 8, 2: 4} {
+		data := encodeSnapshotPart(original.Visit, nil, nil)
+		data = bytes.Clone(data[:len(data)-snapshotChecksumSize-omitted])
+		binary.BigEndian.PutUint16(data[4:6], version)
+		data = binary.BigEndian.AppendUint32(data, crc32.Checksum(data, snapshotChecksumTable))
+
+		restored, err := decodeSnapshotPart(data)
+		require.NoError(err, "version %d", version)
+		require.True(original.Commit().Equal(restored.Commit()), "version %d", version)
+	}
+}
+
+func TestSnapshotPart_LeafDepthsAreIncluded(t *testing.T) {
+	require := require.New(t)
+
+	original := getTrieWithDeletedKeys()
+	depths := original.GetLeafDepths()
+	require.NotEmpty(depths)
+
+	data := encodeSnapshotPart(original.Visit, depths, nil)
+	require.Len(data, getSnapshotPartSize(countEntries(original.Visit), len(depths), 0))
+
+	got, _, err := consumeSnapshotPart(data, func(trie.Key, trie.Value) {})
+	require.NoError(err)
+	require.Equal(depths, got)
+
+	restored, err := decodeSnapshotPart(data)
+	require.NoError(err)
+	require.True(original.Commit().Equal(restored.Commit()))
+
+	// Without the leaf depths, the shape of the trie is not reproduced.
+	restored, err = decodeSnapshotPart(encodeSnapshotPart(original.Visit, nil, nil))
+	require.NoError(err)
+	require.False(original.Commit().Equal(restored.Commit()))
+}
+
+func TestSnapshotPart_InvalidLeafDepthsAreRejected(t *testing.T) {
+	require := require.New(t)
+
+	original := getTrieWithDeletedKeys()
+	depths := original.GetLeafDepths()
+	require.NotEmpty(depths)
+
+	missing := slices.Clone(depths)
+	missing[0].Stem[30]++
+	_, err := decodeSnapshotPart(encodeSnapshotPart(original.Visit, missing, nil))
+	require.ErrorContains(err, "leaf depths")
+
+	// More leaf depths than entries are rejected before they are read.
+	data := encodeSnapshotPart(original.Visit, nil, nil)
+	offset := snapshotPartHeaderSize + 64*countEntries(original.Visit)
+	binary.BigEndian.PutUint32(data[offset:], 1<<31)
+	data = binary.BigEndian.AppendUint32(data[:len(data)-snapshotChecksumSize], crc32.Checksum(data[:len(data)-snapshotChecksumSize], snapshotChecksumTable))
+	_, err = decodeSnapshotPart(data)
+	require.ErrorContains(err, "leaf depths")
+}
+
+func TestSnapshotPart_NodeCommitmentsAreIncluded(t *testing.T) {
+	require := require.New(t)
+
+	original := &trie.Trie{}
+	for i := range 10 {
+		original.Set(trie.Key{1, byte(i)}, trie.Value{byte(i)})
+	}
+	commitments := original.GetPartitionNodeCommitments(1)
+	require.NotEmpty(commitments)
+
+	data := encodeSnapshotPart(getPartitionEntries(original, 1), nil, commitments)
+	require.Len(data, getSnapshotPartSize(10, 0, len(commitments)))
+
+	_, got, err := consumeSnapshotPart(data, func(trie.Key, trie.Value) {})
+	require.NoError(err)
+	require.Len(got, len(commitments))
+	for i, commitment := range commitments {
+		require.Equal(commitment.Compress(), got[i])
+	}
+}
+
+func TestState_Restore_UsesNodeCommitmentsOfSnapshot(t *testing.T) {
+	require := require.New(t)
+
+	original := newState()
+	require.NoError(original.Apply(0, getRandomUpdate(t, 20)))
+	snapshot, err := original.CreateSnapshot()
+	require.NoError(err)
+
+	// Restored commitments are the basis of later updates.
+	update := getRandomUpdate(t, 5)
+	updated, err := Import(context.Background(), exportState(t, original))
+	require.NoError(err)
+	require.NoError(updated.Apply(1, update))
+
+	for _, verification := range []RestoreVerification{
+		{},
+		{TrustCommitments: true, SampleRate: 0},
+		{TrustCommitments: true, SampleRate: 0.5},
+		{TrustCommitments: true, SampleRate: 1},
+	} {
+		restored := newState()
+		restored.SetRestoreVerification(verification)
+		require.NoError(restored.Restore(snapshot.GetData()), "%+v", verification)
+		require.Equal(getHash(t, original), getHash(t, restored), "%+v", verification)
+
+		require.NoError(restored.Apply(1, update))
+		require.Equal(getHash(t, updated), getHash(t, restored), "%+v", verification)
+	}
+}
+
+func TestState_Restore_DetectsInvalidNodeCommitments(t *testing.T) {
+	require := require.New(t)
+
+	original := newState()
+	require.NoError(original.Apply(0, getRandomUpdate(t, 20)))
+	snapshot, err := original.CreateSnapshot()
+	require.NoError(err)
+	metadata, err := snapshot.GetData().GetMetaData()
+	require.NoError(err)
+
+	// Replace the commitment of the last node in the first non-empty part.
+	part := 0
+	for len(original.trie.GetPartitionNodeCommitments(byte(part))) == 0 {
+		part++
+	}
+	commitments := original.trie.GetPartitionNodeCommitments(byte(part))
+	commitments[len(commitments)-1] = commit.Identity()
+	tampered := &tamperedSnapshotData{
+		SnapshotData: snapshot.GetData(),
+		part:         part,
+		data:         encodeSnapshotPart(getPartitionEntries(original.trie, byte(part)), original.trie.GetPartitionLeafDepths(byte(part)), commitments),
+	}
+
+	restored := newState()
+	restored.SetRestoreVerification(RestoreVerification{TrustCommitments: true, SampleRate: 1})
+	require.Error(restored.Restore(tampered))
+
+	// Commitments are ignored unless they are trusted, which is the default.
+	restored = newState()
+	require.NoError(restored.Restore(tampered))
+	require.Equal(getHash(t, original), getHash(t, restored))
+
+	// Snapshot verifiers detect the invalid commitment.
+	verifier, err := newState().GetSnapshotVerifier(metadata)
+	require.NoError(err)
+	proof, err := snapshot.GetData().GetProofData(part)
+	require.NoError(err)
+	require.ErrorContains(verifier.VerifyPart(part, proof, tampered.data), "node commitment")
+}
+
+// tamperedSnapshotData replaces the data of a single part of a snapshot.
+type tamperedSnapshotData struct {
+	backend.SnapshotData
+	part int
+	data []byte
+}
+
+func (d *tamperedSnapshotData) GetPartData(partNumber int) ([]byte, error) {
+	if partNumber == d.part {
+		return d.data, nil
+	}
+	return d.SnapshotData.GetPartData(partNumber)
+}
+
+// exportState exports the given state into a buffer.
+func exportState(t *testing.T, state *State) *bytes.Buffer {
+	t.Helper()
+	var out bytes.Buffer
+	_, err := state.Export(context.Background(), &out)
+	require.NoError(t, err)
+	return &out
+}
+
+func TestState_Restore_ReproducesShapeOfTrieWithDeletedKeys(t *testing.T) {
+	require := require.New(t)
+
+	original := newState()
+	require.NoError(original.Apply(0, getRandomUpdate(t, 20)))
+	deleteSlotsSharingPrefixes(t, original)
+	require.NotEmpty(original.trie.GetLeafDepths())
+
+	snapshot, err := original.CreateSnapshot()
+	require.NoError(err)
+	metadata, err := snapshot.GetData().GetMetaData()
+	require.NoError(err)
+	verifier, err := original.GetSnapshotVerifier(metadata)
+	require.NoError(err)
+	for i := range snapshot.GetNumParts() {
+		proof, err := snapshot.GetData().GetProofData(i)
+		require.NoError(err)
+		part, err := snapshot.GetData().GetPartData(i)
+		require.NoError(err)
+		require.NoError(verifier.VerifyPart(i, proof, part), "part %d", i)
+	}
+
+	for _, verification := range []RestoreVerification{
+		{},
+		{TrustCommitments: true, SampleRate: 1},
+	} {
+		restored := newState()
+		restored.SetRestoreVerification(verification)
+		require.NoError(restored.Restore(snapshot.GetData()), "%+v", verification)
+		require.Equal(getHash(t, original), getHash(t, restored), "%+v", verification)
+		require.Equal(original.trie.GetLeafDepths(), restored.trie.GetLeafDepths())
+	}
+}
+
+// getTrieWithDeletedKeys returns a trie in which deleted keys left inner
+// nodes with a single leaf behind, such that its shape differs from the shape
+// of a trie built from its entries.
+func getTrieWithDeletedKeys() *trie.Trie {
+	res := &trie.Trie{}
+	for i := range 20 {
+		res.Set(trie.Key{byte(i % 3), byte(i), 31: byte(i)}, trie.Value{byte(i)})
+	}
+	deleteKeysSharingPrefixes(res)
+	return res
+}
+
+// deleteKeysSharingPrefixes inserts keys sharing prefixes of several bytes
+// into the given trie and deletes some of them again, leaving inner nodes
+// with a single leaf behind.
+func deleteKeysSharingPrefixes(t *trie.Trie) {
+	for _, prefix := range []byte{1, 200} {
+		t.Set(trie.Key{prefix, 100, 1, 31: 1}, trie.Value{1})
+		t.Set(trie.Key{prefix, 100, 2, 31: 1}, trie.Value{2})
+		t.Set(trie.Key{prefix, 100, 2, 3, 31: 1}, trie.Value{3})
+	}
+	t.Commit()
+	for _, prefix := range []byte{1, 200} {
+		t.Delete(trie.Key{prefix, 100, 2, 31: 1})
+		t.Delete(trie.Key{prefix, 100, 2, 3, 31: 1})
+	}
+}
+
+// deleteSlotsSharingPrefixes writes storage slots to the given state and
+// deletes the key of a slot whose stem shares its first two bytes with
+// exactly one other stem, leaving an inner node with a single leaf behind.
+// Unlike deleteKeysSharingPrefixes, only keys of accounts are used, such that
+// the written-slot index of the state still covers its trie.
+func deleteSlotsSharingPrefixes(t *testing.T, state *State) {
+	t.Helper()
+	address := common.Address{0xde, 0xad}
+	update := common.Update{}
+	for i := range 1024 {
+		update.Slots = append(update.Slots, common.SlotUpdate{
+			Account: address, Key: common.Key{1, 29: byte(i >> 8), 30: byte(i)}, Value: common.Value{1},
+		})
+	}
+	require.NoError(t, state.Apply(state.lastBlock+1, update))
+
+	stems := map[[2]byte][][31]byte{}
+	state.trie.Visit(func(key trie.Key, _ trie.Value) bool {
+		prefix, stem := [2]byte(key[:2]), [31]byte(key[:31])
+		if group := stems[prefix]; len(group) == 0 || group[len(group)-1] != stem {
+			stems[prefix] = append(group, stem)
+		}
+		return true
+	})
+	for _, slot := range update.Slots {
+		key := getStorageKey(slot.Account, slot.Key)
+		if len(stems[[2]byte(key[:2])]) == 2 {
+			state.trie.Delete(key)
+			return
+		}
+	}
+	require.Fail(t, "no slots sharing prefixes found")
+}
@@ -2,12 +2,14 @@ package memory
 
 import (
 	"bytes"
-	"context"
 	"encoding/binary"
+	"errors"
 	"fmt"
-	"io"
+	"maps"
+	"path/filepath"
+	"slices"
+	"sync"
 
-	"github.com/QoraNet/qoraDB/go/backend"
 	"github.com/QoraNet/qoraDB/go/common"
 	"github.com/QoraNet/qoraDB/go/common/amount"
 	"github.com/QoraNet/qoraDB/go/common/immutable"
@@ -21,259 +23,156 @@ import (
 // State is an in-memory implementation of a chain-state tracking account and
 // storage data using a Verkle Trie. It implements the state.State interface.
 type State struct {
-	trie           *trie.Trie
-	archive        *vtArchive          // Historical state storage
-	writtenSlots   map[common.Address]map[common.Key]bool // Track which storage slots have been written
-	archiveMaxSize int                 // Maximum blocks to keep in archive (0 = unlimited)
-}
-
-// vtSnapshot represents a snapshot of the Verkle Trie state
-type vtSnapshot struct {
-	commitment []byte // Verkle commitment as bytes
-	data       []byte // Serialized trie data
-}
-
-func (s *vtSnapshot) GetRootProof() backend.Proof {
-	return &vtProof{commitment: s.commitment}
-}
-
-func (s *vtSnapshot) GetNumParts() int {
-	// VT snapshot is stored as a single part
-	return 1
-}
-
-func (s *vtSnapshot) GetProof(partNumber int) (backend.Proof, error) {
-	if partNumber != 0 {
-		return nil, fmt.Errorf("invalid part number %d, VT has only 1 part", partNumber)
-	}
-	return &vtProof{commitment: s.commitment}, nil
-}
-
-func (s *vtSnapshot) GetPart(partNumber int) (backend.Part, error) {
-	if partNumber != 0 {
-		return nil, fmt.Errorf("invalid part number %d, VT has only 1 part", partNumber)
-	}
-	return &vtSnapshotPart{data: s.data}, nil
-}
-
-func (s *vtSnapshot) GetData() backend.SnapshotData {
-	return s
-}
-
-func (s *vtSnapshot) GetMetaData() ([]byte, error) {
-	// Metadata contains the commitment and number of parts
-	meta := make([]byte, 32+4)
-	copy(meta[0:32], s.commitment)
-	binary.BigEndian.PutUint32(meta[32:36], 1) // 1 part
-	return meta, nil
-}
+	trie          *trie.Trie
+	archive       *vtArchive                             // Historical state storage, nil if archiving is disabled
+	writtenSlots  map[common.Address]map[common.Key]bool // Track which storage slots have been written
+	touched       map[trie.Key]entry                     // State of keys modified since the last archived block before the modification
+	removedSlots  map[common.Address]map[common.Key]bool // Accounts and their slots dropped by deletions since the last archived block
+	addedSlots    map[common.Address]map[common.Key]bool // Accounts and slots tracked for the first time since the last archived block
+	sharedArchive bool                                   // Whether the archive is owned by another state
+	lastBlock     uint64                                 // The most recently applied block
+	hasLastBlock  bool                                   // Whether any block has been applied
 
-func (s *vtSnapshot) GetProofData(partNumber int) ([]byte, error) {
-	if partNumber != 0 {
-		return nil, fmt.Errorf("invalid part number %d, VT has only 1 part", partNumber)
-	}
-	return s.commitment, nil
-}
+	// The written-slot tracking is shared with archived states until it is
+	// modified, see ResolveArchiveState. Archived states track the slots
+	// removed after their block in additional indexes.
+	slotsShared  bool                                     // Whether writtenSlots has to be copied before being modified
+	laterRemoved []map[common.Address]map[common.Key]bool // Slots tracked in addition to writtenSlots
 
-func (s *vtSnapshot) GetPartData(partNumber int) ([]byte, error) {
-	if partNumber != 0 {
-		return nil, fmt.Errorf("invalid part number %d, VT has only 1 part", partNumber)
-	}
-	return s.data, nil
+	restoreVerification RestoreVerification // Verification of node commitments carried by restored snapshots
 }
 
-func (s *vtSnapshot) Release() error {
-	// In-memory snapshot, nothing to release
-	return nil
+// BlockOrderError is returned by Apply for blocks not succeeding the most
+// recently applied block. Block numbers passed to Apply must be strictly
+// increasing, but do not need to be contiguous.
+type BlockOrderError struct {
+	Block    uint64 // the rejected block
+	Previous uint64 // the most recently applied block
 }
 
-// vtSnapshotPart represents a part of the snapshot
-type vtSnapshotPart struct {
-	data []byte
+func (e *BlockOrderError) Error() string {
+	return fmt.Sprintf("block %d does not succeed the previously applied block %d", e.Block, e.Previous)
 }
 
-func (p *vtSnapshotPart) ToBytes() []byte {
-	return p.data
-}
-
-// vtProof represents a cryptographic proof of the Verkle Trie state
-type vtProof struct {
-	commitment []byte
-}
-
-func (p *vtProof) Equal(other backend.Proof) bool {
-	if otherVt, ok := other.(*vtProof); ok {
-		return bytes.Equal(p.commitment, otherVt.commitment)
+// NewState creates a new in-memory state instance archiving blocks according
+// to the DefaultArchivePolicy. Archiving is only disabled if state.NoArchive is
+// explicitly selected in the parameters. If a directory is given, archived
+// blocks are persisted in this directory, and the state is initialized with
+// the state of the last block archived in it.
+//
+// The parameters provide no settings for the retention of archived blocks, so
+// states retaining a different number of blocks, bounding the archive by a
+// memory budget, or archiving only every k-th block have to be created using
+// NewStateWithArchivePolicy.
+func NewState(params state.Parameters) (state.State, error) {
+	policy := DefaultArchivePolicy
+	if params.Archive == state.NoArchive {
+		policy.Disabled = true
 	}
-	return false
+	return NewStateWithArchivePolicy(params, policy)
 }
 
-func (p *vtProof) ToBytes() []byte {
-	return p.commitment
+// NewStateWithArchivePolicy creates a new in-memory state instance retaining
+// archived blocks according to the given policy. The archive settings of the
+// parameters are ignored.
+func NewStateWithArchivePolicy(params state.Parameters, policy ArchivePolicy) (state.State, error) {
+	return newStateWithArchivePolicy(params, policy)
 }
 
-// vtArchive stores historical state snapshots for each block
-type vtArchive struct {
-	snapshots map[uint64]*vtSnapshot // block number -> snapshot (in-memory cache)
-	maxBlock  uint64                 // highest block number stored
-	hasBlocks bool                   // whether any blocks have been archived
-	maxSize   int                    // maximum blocks to keep (0 = unlimited)
-	oldestBlock uint64               // oldest block in archive (for pruning)
-}
-
-func newVtArchive(maxSize int) *vtArchive {
-	return &vtArchive{
-		snapshots: make(map[uint64]*vtSnapshot),
-		maxBlock:  0,
-		hasBlocks: false,
-		maxSize:   maxSize,
-		oldestBlock: 0,
-	}
-}
-
-// addBlock stores a snapshot for a specific block with automatic pruning
-func (a *vtArchive) addBlock(block uint64, snapshot *vtSnapshot) {
-	a.snapshots[block] = snapshot
-
-	// Update max block
-	if !a.hasBlocks || block > a.maxBlock {
-		a.maxBlock = block
-		a.hasBlocks = true
-	}
-
-	// Update oldest block
-	if !a.hasBlocks || block < a.oldestBlock || a.oldestBlock == 0 {
-		a.oldestBlock = block
+func newStateWithArchivePolicy(params state.Parameters, policy ArchivePolicy) (*State, error) {
+	if policy.Disabled {
+		return newState(), nil
 	}
-
-	// Prune old blocks if we exceed maxSize
-	if a.maxSize > 0 && len(a.snapshots) > a.maxSize {
-		a.pruneOldest()
+	if params.Directory == "" {
+		return newStateWithArchive(policy), nil
 	}
-}
 
-// pruneOldest removes the oldest block from the archive
-func (a *vtArchive) pruneOldest() {
-	if len(a.snapshots) == 0 {
-		return
+	archive, err := newPersistentVtArchive(policy, filepath.Join(params.Directory, "archive"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to open archive: %w", err)
 	}
-
-	// Find and remove the oldest block
-	delete(a.snapshots, a.oldestBlock)
-
-	// Find the new oldest block
-	newOldest := a.maxBlock
-	for block := range a.snapshots {
-		if block < newOldest {
-			newOldest = block
+	live := &trie.Trie{}
+	writtenSlots := make(map[common.Address]map[common.Key]bool)
+	if height, found := archive.getBlockHeight(); found {
+		source, _ := archive.resolve(height)
+		live, err = archive.getTrie(source)
+		if err != nil {
+			return nil, errors.Join(fmt.Errorf("failed to restore state of block %d: %w", height, err), archive.close())
+		}
+		writtenSlots, err = archive.getWrittenSlots(source)
+		if err != nil {
+			return nil, errors.Join(fmt.Errorf("failed to restore written slots of block %d: %w", height, err), archive.close())
 		}
 	}
-	a.oldestBlock = newOldest
-}
-
-// getBlock retrieves a snapshot for a specific block
-func (a *vtArchive) getBlock(block uint64) (*vtSnapshot, bool) {
-	snapshot, exists := a.snapshots[block]
-	return snapshot, exists
-}
-
-// getBlockHeight returns the highest archived block number
-func (a *vtArchive) getBlockHeight() (uint64, bool) {
-	return a.maxBlock, a.hasBlocks
+	res := &State{
+		trie:                live,
+		archive:             archive,
+		writtenSlots:        writtenSlots,
+		restoreVerification: DefaultRestoreVerification,
+	}
+	res.lastBlock, res.hasLastBlock = archive.getBlockHeight()
+	return res, nil
 }
 
-// getMemorySize estimates the memory used by the archive
-func (a *vtArchive) getMemorySize() uint64 {
-	size := uint64(0)
-	for _, snapshot := range a.snapshots {
-		size += uint64(len(snapshot.commitment))
-		size += uint64(len(snapshot.data))
-		size += 16 // map overhead per entry
+// newState creates a new, empty in-memory state instance without an archive.
+func newState() *State {
+	return &State{
+		trie:                &trie.Trie{},
+		writtenSlots:        make(map[common.Address]map[common.Key]bool),
+		restoreVerification: DefaultRestoreVerification,
 	}
-	return size
 }
 
-// NewState creates a new, empty in-memory state instance.
-func NewState(_ state.Parameters) (state.State, error) {
-	return &State{
-		trie:           &trie.Trie{},
-		archive:        newVtArchive(1000), // Keep last 1000 blocks by default
-		writtenSlots:   make(map[common.Address]map[common.Key]bool),
-		archiveMaxSize: 1000,
-	}, nil
+// newStateWithArchive creates a new, empty in-memory state instance with an
+// in-memory archive retaining blocks according to the given policy.
+func newStateWithArchive(policy ArchivePolicy) *State {
+	res := newState()
+	res.archive = newVtArchive(policy)
+	return res
 }
 
-// newState creates a new, empty in-memory state instance.
-func newState() *State {
-	return &State{
-		trie:           &trie.Trie{},
-		archive:        newVtArchive(1000),
-		writtenSlots:   make(map[common.Address]map[common.Key]bool),
-		archiveMaxSize: 1000,
-	}
+func (s *State) getValue(key trie.Key) (trie.Value, error) {
+	return s.trie.Get(key), nil
 }
 
 func (s *State) Exists(address common.Address) (bool, error) {
-	key := getBasicDataKey(address)
-	value := s.trie.Get(key)
-	var empty [24]byte // nonce and balance are layed out in bytes 8-32
-	return !bytes.Equal(value[8:32], empty[:]), nil
-
+	return exists(s, address)
 }
 
 func (s *State) GetBalance(address common.Address) (amount.Amount, error) {
-	key := getBasicDataKey(address)
-	value := s.trie.Get(key)
-	return amount.NewFromBytes(value[16:32]...), nil
+	return getBalance(s, address)
 }
 
 func (s *State) GetNonce(address common.Address) (common.Nonce, error) {
-	key := getBasicDataKey(address)
-	value := s.trie.Get(key)
-	return common.Nonce(value[8:16]), nil
+	return getNonce(s, address)
 }
 
 func (s *State) GetStorage(address common.Address, key common.Key) (common.Value, error) {
-	return common.Value(s.trie.Get(getStorageKey(address, key))), nil
+	return getStorage(s, address, key)
 }
 
 func (s *State) GetCode(address common.Address) ([]byte, error) {
-	size, _ := s.GetCodeSize(address)
-	chunks := make([]chunk, 0, size)
-	for i := 0; i < size/31+1; i++ {
-		key := getCodeChunkKey(address, i)
-		value := s.trie.Get(key)
-		chunks = append(chunks, chunk(value))
-	}
-	return merge(chunks, size), nil
+	return getCode(s, address)
 }
 
 func (s *State) GetCodeSize(address common.Address) (int, error) {
-	key := getBasicDataKey(address)
-	value := s.trie.Get(key)
-	return int(binary.BigEndian.Uint32(value[4:8])), nil
+	return getCodeSize(s, address)
 }
 
 func (s *State) GetCodeHash(address common.Address) (common.Hash, error) {
-	key := getCodeHashKey(address)
-	value := s.trie.Get(key)
-	return common.Hash(value[:]), nil
+	return getCodeHash(s, address)
 }
 
 func (s *State) HasEmptyStorage(addr common.Address) (bool, error) {
-	// Check if we have tracked slots for this address
-	slots, exists := s.writtenSlots[addr]
-	if !exists || len(slots) == 0 {
-		// No slots written, storage is empty
-		return true, nil
-	}
-
-	// Check all tracked slots
-	for key := range slots {
-		value := s.trie.Get(getStorageKey(addr, key))
-		var zero [32]byte
-		if value != zero {
-			return false, nil // Found non-zero value
+	// Check all tracked slots, if no slots have been written, the storage is
+	// empty.
+	for _, index := range append([]map[common.Address]map[common.Key]bool{s.writtenSlots}, s.laterRemoved...) {
+		for key := range index[addr] {
+			value := s.trie.Get(getStorageKey(addr, key))
+			var zero [32]byte
+			if value != zero {
+				return false, nil // Found non-zero value
+			}
 		}
 	}
 
@@ -282,92 +181,283 @@ func (s *State) HasEmptyStorage(addr common.Address) (bool, error) {
 }
 
 func (s *State) Apply(block uint64, update common.Update) error {
+	// Archived states share the archive of the state they originate from,
+	// which must only be extended by that state.
+	if s.sharedArchive {
+		return fmt.Errorf("archived states can not be modified")
+	}
+	if s.hasLastBlock && block <= s.lastBlock {
+		return &BlockOrderError{Block: block, Previous: s.lastBlock}
+	}
+
+	// Deleted accounts are wiped before any other update is applied, such
+	// that accounts can be deleted and re-created within the same block.
+	for _, address := range update.DeletedAccounts {
+		s.deleteAccount(address)
+	}
 
 	// init potentially empty accounts with empty code hash,
 	for _, address := range update.CreatedAccounts {
+		s.trackAccount(address)
 		accountKey := getBasicDataKey(address)
 		value := s.trie.Get(accountKey)
 		var empty [28]byte
 		// empty accnout has empty code size, nonce, and balance
 		if bytes.Equal(value[4:32], empty[:]) {
 			codeHashKey := getCodeHashKey(address)
-			s.trie.Set(accountKey, value) // must be initialized to empty account
-			s.trie.Set(codeHashKey, trie.Value(types.EmptyCodeHash))
+			s.set(accountKey, value) // must be initialized to empty account
+			s.set(codeHashKey, trie.Value(types.EmptyCodeHash))
 		}
 	}
 
 	for _, update := range update.Nonces {
+		s.trackAccount(update.Account)
 		key := getBasicDataKey(update.Account)
 		value := s.trie.Get(key)
 		copy(value[8:16], update.Nonce[:])
-		s.trie.Set(key, value)
+		s.set(key, value)
 	}
 
 	for _, update := range update.Balances {
+		s.trackAccount(update.Account)
 		key := getBasicDataKey(update.Account)
 		value := s.trie.Get(key)
 		amount := update.Balance.Bytes32()
 		copy(value[16:32], amount[16:])
-		s.trie.Set(key, value)
+		s.set(key, value)
 	}
 
 	for _, update := range update.Slots {
 		key := getStorageKey(update.Account, update.Key)
-		s.trie.Set(key, trie.Value(update.Value))
+		s.set(key, trie.Value(update.Value))
 
 		// Track this slot as written
-		if s.writtenSlots[update.Account] == nil {
-			s.writtenSlots[update.Account] = make(map[common.Key]bool)
+		s.trackAccount(update.Account)
+		s.ownWrittenSlots()
+		if s.archive != nil && !s.writtenSlots[update.Account][update.Key] {
+			if s.addedSlots == nil {
+				s.addedSlots = make(map[common.Address]map[common.Key]bool)
+			}
+			if s.addedSlots[update.Account] == nil {
+				s.addedSlots[update.Account] = make(map[common.Key]bool)
+			}
+			s.addedSlots[update.Account][update.Key] = true
 		}
 		s.writtenSlots[update.Account][update.Key] = true
 	}
 
 	for _, update := range update.Codes {
+		s.trackAccount(update.Account)
+
 		// Store the code length.
 		key := getBasicDataKey(update.Account)
 		value := s.trie.Get(key)
 		size := len(update.Code)
 		binary.BigEndian.PutUint32(value[4:8], uint32(size))
-		s.trie.Set(key, value)
+		s.set(key, value)
 
 		// Store the code hash.
 		key = getCodeHashKey(update.Account)
 		hash := common.Keccak256(update.Code)
-		s.trie.Set(key, trie.Value(hash))
+		s.set(key, trie.Value(hash))
 
 		// Store the actual code.
 		chunks := splitCode(update.Code)
 		for i, chunk := range chunks {
 			key := getCodeChunkKey(update.Account, i)
-			s.trie.Set(key, trie.Value(chunk))
+			s.set(key, trie.Value(chunk))
 		}
 	}
 
-	// Archive the state after applying the block
-	if err := s.archiveCurrentState(block); err != nil {
+	// Archive the state after applying the block. The block is only
+	// considered applied if archiving succeeds.
+	if err := s.archiveChanges(block); err != nil {
 		return fmt.Errorf("failed to archive block %d: %w", block, err)
 	}
-
+	s.lastBlock, s.hasLastBlock = block, true
 	return nil
 }
 
-// archiveCurrentState creates a snapshot of the current state and stores it in the archive
-func (s *State) archiveCurrentState(block uint64) error {
-	// Create a snapshot of the current state
-	snapshot, err := s.CreateSnapshot()
-	if err != nil {
-		return fmt.Errorf("failed to create snapshot: %w", err)
+// trackAccount lists the given account in the written-slot tracking, if it is
+// not listed yet. All accounts with data in the trie are listed, even if no
+// slots have been written for them, such that snapshots of the tracking can be
+// checked to cover the trie, see checkWrittenSlotsCoverage.
+func (s *State) trackAccount(address common.Address) {
+	if _, found := s.writtenSlots[address]; found {
+		return
+	}
+	s.ownWrittenSlots()
+	s.writtenSlots[address] = make(map[common.Key]bool)
+	if s.archive != nil {
+		if s.addedSlots == nil {
+			s.addedSlots = make(map[common.Address]map[common.Key]bool)
+		}
+		if s.addedSlots[address] == nil {
+			s.addedSlots[address] = make(map[common.Key]bool)
+		}
+	}
+}
+
+// ownWrittenSlots copies the written-slot tracking if it is shared with
+// archived states, such that it can be modified without affecting them. It
+// has to be called before the tracking is modified.
+func (s *State) ownWrittenSlots() {
+	if s.slotsShared {
+		s.writtenSlots = unionWrittenSlots(s.writtenSlots)
+		s.slotsShared = false
+	}
+}
+
+// getWrittenSlots returns an index of all slots tracked by the state,
+// including the slots tracked by archived states in separate indexes. The
+// result must not be modified.
+func (s *State) getWrittenSlots() map[common.Address]map[common.Key]bool {
+	if len(s.laterRemoved) == 0 {
+		return s.writtenSlots
+	}
+	return unionWrittenSlots(slices.Concat([]map[common.Address]map[common.Key]bool{s.writtenSlots}, s.laterRemoved)...)
+}
+
+// setWrittenSlots replaces the written-slot tracking of the state by the
+// given index, which is exclusively owned by the state. Modifications of the
+// replaced tracking recorded for the archive are discarded.
+func (s *State) setWrittenSlots(slots map[common.Address]map[common.Key]bool) {
+	s.writtenSlots = slots
+	s.slotsShared = false
+	s.laterRemoved = nil
+	s.removedSlots = nil
+	s.addedSlots = nil
+}
+
+// deleteAccount removes all data of the given account from the trie. This
+// covers the basic data, the code hash, all code chunks, and all storage
+// slots that have been written for the account.
+func (s *State) deleteAccount(address common.Address) {
+	size, _ := s.GetCodeSize(address)
+	for i := range (size + 30) / 31 {
+		s.delete(getCodeChunkKey(address, i))
+	}
+	keys, tracked := s.writtenSlots[address]
+	for key := range keys {
+		s.delete(getStorageKey(address, key))
 	}
+	if tracked {
+		if s.archive != nil {
+			if s.removedSlots == nil {
+				s.removedSlots = make(map[common.Address]map[common.Key]bool)
+			}
+			if s.removedSlots[address] == nil {
+				s.removedSlots[address] = make(map[common.Key]bool)
+			}
+			maps.Copy(s.removedSlots[address], keys)
+		}
+		s.ownWrittenSlots()
+		delete(s.writtenSlots, address)
+	}
+	s.delete(getBasicDataKey(address))
+	s.delete(getCodeHashKey(address))
+}
+
+// set updates the value of the given key, recording the change for the
+// archive.
+func (s *State) set(key trie.Key, value trie.Value) {
+	s.recordChange(key)
+	s.trie.Set(key, value)
+}
+
+// delete removes the given key from the trie, recording the change for the
+// archive.
+func (s *State) delete(key trie.Key) {
+	s.recordChange(key)
+	s.trie.Delete(key)
+}
 
-	// Cast to vtSnapshot
-	vtSnap, ok := snapshot.(*vtSnapshot)
-	if !ok {
-		return fmt.Errorf("unexpected snapshot type")
+// recordChange retains the state of the given key before it is modified for
+// the first time in the current block. Changes are only recorded by the disk
+// archive, so they are not tracked unless the archive is persisted.
+func (s *State) recordChange(key trie.Key) {
+	if s.archive == nil || s.archive.disk == nil {
+		return
+	}
+	if _, found := s.touched[key]; found {
+		return
+	}
+	if s.touched == nil {
+		s.touched = make(map[trie.Key]entry)
 	}
+	value, used := s.trie.Lookup(key)
+	s.touched[key] = entry{value: value, used: used}
+}
+
+// archiveChanges stores the changes of the current block in the archive and
+// resets the change tracking for the next block. If the block is not archived
+// according to the archive's policy, changes are accumulated until the next
+// archived block. If archiving fails, the change tracking is retained.
+func (s *State) archiveChanges(block uint64) error {
+	if s.archive == nil || !s.archive.isArchived(block) {
+		return nil
+	}
+	changes := make([]change, 0, len(s.touched))
+	for key, before := range s.touched {
+		value, used := s.trie.Lookup(key)
+		after := entry{value: value, used: used}
+		if before == after {
+			continue // the key has been restored within the block
+		}
+		changes = append(changes, change{key: key, before: before, after: after})
+	}
+	slices.SortFunc(changes, func(a, b change) int {
+		return bytes.Compare(a.key[:], b.key[:])
+	})
+	slots := slotChanges{
+		added:   s.addedSlots,
+		removed: s.removedSlots,
+		tracked: s.writtenSlots,
+	}
+	if err := s.archive.addBlock(block, changes, slots, s.trie.Clone()); err != nil {
+		return err
+	}
+	s.touched = nil
+	s.removedSlots = nil
+	s.addedSlots = nil
+	return nil
+}
 
-	// Store in archive
-	s.archive.addBlock(block, vtSnap)
+// RevertTo resets the state to the state after the given archived block,
+// discarding all archived blocks after it. This way, blocks applied since can
+// be undone, e.g., in case of a chain reorganization. Blocks are resolved like
+// in GetArchiveState, and the root of the reverted state is verified against
+// the archived commitment. Subsequent updates need to continue with blocks
+// after the given block.
+func (s *State) RevertTo(block uint64) error {
+	if s.archive == nil {
+		return state.NoArchiveError
+	}
+	if s.sharedArchive {
+		return fmt.Errorf("archived states can not be reverted")
+	}
+	reverted, removed, err := s.archive.revert(block)
+	if err != nil {
+		return fmt.Errorf("failed to revert to block %d: %w", block, err)
+	}
 
+	// Slots written by discarded blocks remain tracked. Since tracked slots
+	// are only required to cover all slots present in the trie, this is
+	// sufficient to restore the tracking of the reverted block.
+	s.ownWrittenSlots()
+	for _, slots := range append(removed, s.removedSlots) {
+		for address, keys := range slots {
+			if s.writtenSlots[address] == nil {
+				s.writtenSlots[address] = make(map[common.Key]bool)
+			}
+			maps.Copy(s.writtenSlots[address], keys)
+		}
+	}
+	s.trie = reverted
+	s.touched = nil
+	s.removedSlots = nil
+	s.addedSlots = nil
+	s.lastBlock, s.hasLastBlock = block, true
 	return nil
 }
 
@@ -391,17 +481,21 @@ func (s *State) Check() error {
 }
 
 func (s *State) Flush() error {
-	// In-memory implementation - no disk persistence
-	// A file-based implementation would write trie data to disk here
-	// For now, this is a no-op as all data lives in RAM
-	return nil
+	// The live state is kept in memory only, yet archived blocks may be
+	// persisted on disk.
+	if s.archive == nil || s.sharedArchive {
+		return nil
+	}
+	return s.archive.flush()
 }
 
 func (s *State) Close() error {
-	// In-memory implementation - no cleanup needed
-	// A file-based implementation would close file handles here
-	// The trie will be garbage collected when no longer referenced
-	return nil
+	// The trie will be garbage collected when no longer referenced, while
+	// files of a persisted archive need to be closed.
+	if s.archive == nil || s.sharedArchive {
+		return nil
+	}
+	return s.archive.close()
 }
 
 func (s *State) GetMemoryFootprint() *common.MemoryFootprint {
@@ -412,12 +506,13 @@ func (s *State) GetMemoryFootprint() *common.MemoryFootprint {
 	trieSize := uint64(0)
 	// Note: For accurate trie size, we'd need to walk the trie
 	// For now, estimate based on serialization size
-	if data, err := s.serializeTrie(); err == nil {
-		trieSize = uint64(len(data))
-	}
+	trieSize = uint64(len(serializeTrie(s.trie)))
 
 	// Archive memory
-	archiveSize := s.archive.getMemorySize()
+	archiveSize := uint64(0)
+	if s.archive != nil {
+		archiveSize = s.archive.getMemorySize()
+	}
 
 	// Written slots tracking
 	slotsSize := uint64(0)
@@ -434,567 +529,307 @@ func (s *State) GetMemoryFootprint() *common.MemoryFootprint {
 	return mf
 }
 
+// GetArchiveState returns the state after the given block. Blocks that have
+// not been archived since they did not modify the state are resolved to the
+// closest archived block before. Blocks skipped by the interval of the
+// archive policy may have modified the state without being archived, so their
+// state is not available and an error is returned. ResolveArchiveState can be
+// used to obtain the state of the closest archived block instead.
 func (s *State) GetArchiveState(block uint64) (state.State, error) {
-	// Get the snapshot from the archive
-	snapshot, exists := s.archive.getBlock(block)
-	if !exists {
-		return nil, fmt.Errorf("no archived state for block %d", block)
-	}
-
-	// Create a new state and restore from the snapshot
-	archivedState := &State{
-		trie:           &trie.Trie{},
-		archive:        s.archive,          // Share the archive
-		writtenSlots:   make(map[common.Address]map[common.Key]bool), // Fresh tracking for archived state
-		archiveMaxSize: s.archiveMaxSize,
-	}
-
-	// Restore the archived state
-	if err := archivedState.Restore(snapshot); err != nil {
-		return nil, fmt.Errorf("failed to restore archived state for block %d: %w", block, err)
+	if s.archive != nil && !s.archive.isArchived(block) {
+		return nil, fmt.Errorf("state of block %d is not archived, only blocks divisible by %d are", block, s.archive.interval)
 	}
-
-	return archivedState, nil
+	res, _, err := s.ResolveArchiveState(block)
+	return res, err
 }
 
-func (s *State) GetArchiveBlockHeight() (height uint64, empty bool, err error) {
-	height, hasBlocks := s.archive.getBlockHeight()
-	if !hasBlocks {
-		return 0, true, nil
+// ResolveArchiveState returns the state of the closest archived block at or
+// before the given block together with the number of this block. Unlike
+// GetArchiveState, blocks skipped by the interval of the archive policy are
+// resolved as well, so the returned state is the state of the reported block,
+// which may differ from the state after the given block.
+func (s *State) ResolveArchiveState(block uint64) (state.State, uint64, error) {
+	if s.archive == nil {
+		return nil, 0, state.NoArchiveError
 	}
-	return height, false, nil
-}
-
-// accountInfo holds basic account data for witness proofs
-type accountInfo struct {
-	Balance  amount.Amount
-	Nonce    common.Nonce
-	CodeHash common.Hash
-}
-
-// getAccountInfo extracts account information from the trie
-func (s *State) getAccountInfo(address common.Address) (accountInfo, bool, error) {
-	key := getBasicDataKey(address)
-	value := s.trie.Get(key)
-
-	// Check if account exists (non-zero balance or nonce)
-	var empty [24]byte
-	exists := !bytes.Equal(value[8:32], empty[:])
-
-	balance, _ := s.GetBalance(address)
-	nonce, _ := s.GetNonce(address)
-	codeHash, _ := s.GetCodeHash(address)
-
-	return accountInfo{
-		Balance:  balance,
-		Nonce:    nonce,
-		CodeHash: codeHash,
-	}, exists, nil
-}
-
-func (s *State) CreateWitnessProof(address common.Address, keys ...common.Key) (witness.Proof, error) {
-	// Get current root hash
-	rootHash, err := s.GetHash()
-	if err != nil {
-		return nil, fmt.Errorf("failed to get root hash: %w", err)
-	}
-
-	// Collect account data
-	info, exists, err := s.getAccountInfo(address)
-	if err != nil {
-		return nil, fmt.Errorf("failed to get account info: %w", err)
-	}
-
-	var balance amount.Amount
-	var nonce common.Nonce
-	var codeHash common.Hash
-	if exists {
-		balance = info.Balance
-		nonce = info.Nonce
-		codeHash = info.CodeHash
-	}
-
-	// Collect storage values
-	storage := make(map[common.Key]common.Value)
-	for _, key := range keys {
-		value, err := s.GetStorage(address, key)
-		if err != nil {
-			return nil, fmt.Errorf("failed to get storage: %w", err)
-		}
-		storage[key] = value
-	}
-
-	return &vtWitnessProof{
-		rootHash: rootHash,
-		address:  address,
-		balance:  balance,
-		nonce:    nonce,
-		codeHash: codeHash,
-		storage:  storage,
-		exists:   exists,
-	}, nil
-}
-
-func (s *State) Export(ctx context.Context, out io.Writer) (common.Hash, error) {
-	// Export the state by creating a snapshot and writing it to the output
-
-	// Get the current root hash
-	rootHash, err := s.GetHash()
-	if err != nil {
-		return common.Hash{}, fmt.Errorf("failed to get root hash: %w", err)
+	source, found := s.archive.resolve(block)
+	if !found {
+		return nil, 0, fmt.Errorf("no archived state for block %d", block)
 	}
 
-	// Create a snapshot of the current state
-	snapshot, err := s.CreateSnapshot()
+	// Reconstruct the trie of the block from the archive
+	archivedTrie, err := s.archive.getTrie(source)
 	if err != nil {
-		return common.Hash{}, fmt.Errorf("failed to create snapshot: %w", err)
+		return nil, 0, fmt.Errorf("failed to restore archived state for block %d: %w", source, err)
 	}
 
-	// Get the snapshot data
-	snapshotData := snapshot.GetData()
-
-	// Write metadata (commitment + number of parts)
-	metadata, err := snapshotData.GetMetaData()
+	// The written-slot tracking of the archived state has to cover all slots
+	// present in its trie. Slots written since are tracked as well, which is
+	// harmless since their values in the archived trie are zero. Slots of
+	// accounts deleted since are recovered from the archive and tracked in
+	// separate indexes. Instead of copying the tracking of this state, it is
+	// shared until this state modifies it. Only slots removed since the last
+	// archived block are copied, since they are modified by later deletions.
+	removed, err := s.archive.getRemovedSlots(source)
 	if err != nil {
-		return common.Hash{}, fmt.Errorf("failed to get metadata: %w", err)
+		return nil, 0, fmt.Errorf("failed to restore written slots for block %d: %w", source, err)
 	}
-
-	// Write metadata length (4 bytes)
-	metaLen := make([]byte, 4)
-	binary.BigEndian.PutUint32(metaLen, uint32(len(metadata)))
-	if _, err := out.Write(metaLen); err != nil {
-		return common.Hash{}, fmt.Errorf("failed to write metadata length: %w", err)
+	laterRemoved := slices.Concat(removed, s.laterRemoved)
+	if len(s.removedSlots) > 0 {
+		laterRemoved = append(laterRemoved, unionWrittenSlots(s.removedSlots))
 	}
+	s.slotsShared = true
 
-	// Write metadata
-	if _, err := out.Write(metadata); err != nil {
-		return common.Hash{}, fmt.Errorf("failed to write metadata: %w", err)
-	}
-
-	// Write the snapshot part data
-	partData, err := snapshotData.GetPartData(0)
-	if err != nil {
-		return common.Hash{}, fmt.Errorf("failed to get part data: %w", err)
-	}
-
-	// Write part data length (4 bytes)
-	partLen := make([]byte, 4)
-	binary.BigEndian.PutUint32(partLen, uint32(len(partData)))
-	if _, err := out.Write(partLen); err != nil {
-		return common.Hash{}, fmt.Errorf("failed to write part data length: %w", err)
-	}
+	// Create a new state around the reconstructed trie
+	archivedState := &State{
+		trie:          archivedTrie,
+		archive:       s.archive, // Share the archive
+		writtenSlots:  s.writtenSlots,
+		slotsShared:   true,
+		laterRemoved:  laterRemoved,
+		sharedArchive: true,
+		lastBlock:     source,
+		hasLastBlock:  true,
 
-	// Write part data
-	if _, err := out.Write(partData); err != nil {
-		return common.Hash{}, fmt.Errorf("failed to write part data: %w", err)
+		restoreVerification: s.restoreVerification,
 	}
-
-	return rootHash, nil
+	return archivedState, source, nil
 }
 
-// Snapshot & Recovery
-func (s *State) GetProof() (backend.Proof, error) {
-	// Get the current Verkle commitment
-	commitment := s.trie.Commit()
-	commitmentBytes := commitment.Compress()
-	return &vtProof{commitment: commitmentBytes[:]}, nil
-}
-
-func (s *State) CreateSnapshot() (backend.Snapshot, error) {
-	// Get the cryptographic commitment for the snapshot
-	commitment := s.trie.Commit()
-	commitmentBytes := commitment.Compress()
-
-	// Serialize the trie state
-	// For in-memory VT, we serialize by collecting all key-value pairs
-	data, err := s.serializeTrie()
-	if err != nil {
-		return nil, fmt.Errorf("failed to serialize trie: %w", err)
+func (s *State) GetArchiveBlockHeight() (height uint64, empty bool, err error) {
+	if s.archive == nil {
+		return 0, false, state.NoArchiveError
 	}
-
-	return &vtSnapshot{
-		commitment: commitmentBytes[:],
-		data:       data,
-	}, nil
-}
-
-func (s *State) Restore(snapshotData backend.SnapshotData) error {
-	// Get metadata to verify structure
-	metadata, err := snapshotData.GetMetaData()
-	if err != nil {
-		return fmt.Errorf("failed to get metadata: %w", err)
+	height, hasBlocks := s.archive.getBlockHeight()
+	if !hasBlocks {
+		return 0, true, nil
 	}
+	return height, false, nil
+}
 
-	if len(metadata) < 32 {
-		return fmt.Errorf("invalid metadata length: expected at least 32, got %d", len(metadata))
+func (s *State) CreateWitnessProof(address common.Address, keys ...common.Key) (witness.Proof, error) {
+	// The proof covers the account's basic data and code hash as well as the
+	// requested storage slots.
+	storageKeys := make(map[common.Key]trie.Key, len(keys))
+	trieKeys := make([]trie.Key, 0, len(keys)+2)
+	trieKeys = append(trieKeys, getBasicDataKey(address), getCodeHashKey(address))
+	for _, key := range keys {
+		trieKey := getStorageKey(address, key)
+		storageKeys[key] = trieKey
+		trieKeys = append(trieKeys, trieKey)
 	}
 
-	expectedCommitment := metadata[0:32]
-
-	// Get the data
-	data, err := snapshotData.GetPartData(0)
+	proof, err := s.trie.CreateProof(trieKeys...)
 	if err != nil {
-		return fmt.Errorf("failed to get part data: %w", err)
-	}
-
-	// Deserialize and restore the trie state
-	if err := s.deserializeTrie(data); err != nil {
-		return fmt.Errorf("failed to deserialize trie: %w", err)
-	}
-
-	// Verify the restored state matches the snapshot commitment
-	restoredCommitment := s.trie.Commit().Compress()
-	if !bytes.Equal(restoredCommitment[:], expectedCommitment) {
-		return fmt.Errorf("commitment mismatch after restore")
+		return nil, fmt.Errorf("failed to create witness proof: %w", err)
 	}
-
-	return nil
+	return newWitnessProof(address, storageKeys, proof), nil
 }
 
-func (s *State) GetSnapshotVerifier(metadata []byte) (backend.SnapshotVerifier, error) {
-	// Parse the commitment from metadata
-	if len(metadata) < 32 {
-		return nil, fmt.Errorf("invalid metadata length: expected at least 32, got %d", len(metadata))
-	}
-
-	commitment := make([]byte, 32)
-	copy(commitment, metadata[0:32])
-
-	return &vtSnapshotVerifier{expectedCommitment: commitment}, nil
+// vtWitnessProof implements witness.Proof for Verkle Trie. It covers the
+// basic data and code hash of a single account and a selection of its storage
+// slots. Values are only reported after the proof has been verified against
+// the requested root.
+type vtWitnessProof struct {
+	address      common.Address
+	storageKeys  map[common.Key]trie.Key // covered storage slots and their trie keys
+	proof        *trie.Proof
+	verification *witnessVerification
 }
 
-// GetSnapshotableComponents returns nil as VT uses state-level snapshotting
-// rather than component-level snapshotting (when/if snapshot support is added)
-func (s *State) GetSnapshotableComponents() []backend.Snapshotable {
-	// VT currently doesn't support snapshots, but when it does,
-	// it will use the entire trie as a single snapshotable unit
-	return nil
+// witnessVerification caches the result of verifying a witness proof, which
+// is an expensive operation.
+type witnessVerification struct {
+	once  sync.Once
+	valid bool
+	err   error
 }
 
-// RunPostRestoreTasks performs any necessary cleanup after snapshot restoration
-func (s *State) RunPostRestoreTasks() error {
-	// Currently no post-restore tasks needed for in-memory VT
-	// Future: rebuild any caches or indices after restore
-	return nil
-}
-
-// serializeTrie converts the trie state to bytes for snapshotting
-// Format: [numEntries uint32][key1 32 bytes][value1 32 bytes][key2...]...
-func (s *State) serializeTrie() ([]byte, error) {
-	// Collect all key-value pairs from the trie
-	// This is a simplified implementation - a production version would use
-	// a more efficient format or store the trie structure directly
-	entries := make(map[trie.Key]trie.Value)
-
-	// Walk through all possible storage locations
-	// This is inefficient but works for the in-memory implementation
-	// A production version would track which keys have been set
-	for addrByte := 0; addrByte < 256; addrByte++ {
-		var addr common.Address
-		addr[0] = byte(addrByte)
-
-		// Check basic data
-		basicKey := getBasicDataKey(addr)
-		basicValue := s.trie.Get(basicKey)
-		var zero trie.Value
-		if basicValue != zero {
-			entries[basicKey] = basicValue
-		}
-
-		// Check code hash
-		codeHashKey := getCodeHashKey(addr)
-		codeHashValue := s.trie.Get(codeHashKey)
-		if codeHashValue != zero {
-			entries[codeHashKey] = codeHashValue
-		}
-
-		// Sample storage slots (first 256)
-		for slotByte := 0; slotByte < 256; slotByte++ {
-			var key common.Key
-			key[31] = byte(slotByte)
-			storageKey := getStorageKey(addr, key)
-			storageValue := s.trie.Get(storageKey)
-			if storageValue != zero {
-				entries[storageKey] = storageValue
-			}
-		}
-
-		// Sample code chunks (up to 1024 chunks = ~31KB per account)
-		for chunk := 0; chunk < 1024; chunk++ {
-			codeKey := getCodeChunkKey(addr, chunk)
-			codeValue := s.trie.Get(codeKey)
-			if codeValue != zero {
-				entries[codeKey] = codeValue
-			}
-		}
-	}
-
-	// Serialize to bytes
-	buf := make([]byte, 4+len(entries)*64)
-	binary.BigEndian.PutUint32(buf[0:4], uint32(len(entries)))
-
-	offset := 4
-	for k, v := range entries {
-		copy(buf[offset:offset+32], k[:])
-		copy(buf[offset+32:offset+64], v[:])
-		offset += 64
-	}
-
-	return buf[:offset], nil
-}
-
-// deserializeTrie restores the trie state from serialized bytes
-func (s *State) deserializeTrie(data []byte) error {
-	if len(data) < 4 {
-		return fmt.Errorf("invalid data: too short")
-	}
-
-	numEntries := binary.BigEndian.Uint32(data[0:4])
-	expectedLen := 4 + int(numEntries)*64
-	if len(data) != expectedLen {
-		return fmt.Errorf("invalid data length: expected %d, got %d", expectedLen, len(data))
-	}
-
-	// Reset the trie
-	s.trie = &trie.Trie{}
-
-	// Restore all entries
-	offset := 4
-	for i := uint32(0); i < numEntries; i++ {
-		var key trie.Key
-		var value trie.Value
-		copy(key[:], data[offset:offset+32])
-		copy(value[:], data[offset+32:offset+64])
-		s.trie.Set(key, value)
-		offset += 64
+func newWitnessProof(
+	address common.Address,
+	storageKeys map[common.Key]trie.Key,
+	proof *trie.Proof,
+) *vtWitnessProof {
+	return &vtWitnessProof{
+		address:      address,
+		storageKeys:  storageKeys,
+		proof:        proof,
+		verification: &witnessVerification{},
 	}
-
-	return nil
 }
 
-// vtSnapshotVerifier verifies that a snapshot matches an expected commitment
-type vtSnapshotVerifier struct {
-	expectedCommitment []byte
+// verify checks the opening of the proof against the root commitment the
+// proof has been created for.
+func (p *vtWitnessProof) verify() (bool, error) {
+	p.verification.once.Do(func() {
+		p.verification.valid, p.verification.err = p.proof.Verify(p.proof.Root())
+	})
+	return p.verification.valid, p.verification.err
 }
 
-func (v *vtSnapshotVerifier) VerifyRootProof(data backend.SnapshotData) (backend.Proof, error) {
-	// Get the proof from the snapshot data
-	proofBytes, err := data.GetProofData(0)
-	if err != nil {
-		return nil, fmt.Errorf("failed to get proof data: %w", err)
+// get fetches the value of the given trie key after verifying the proof for
+// the given root. The second result is false if the proof does not cover the
+// key or is not valid for the given root.
+func (p *vtWitnessProof) get(root common.Hash, address common.Address, key trie.Key) (trie.Value, bool, error) {
+	if address != p.address || common.Hash(p.proof.Root().Compress()) != root {
+		return trie.Value{}, false, nil
 	}
-
-	// Verify it matches expected commitment
-	if !bytes.Equal(proofBytes, v.expectedCommitment) {
-		return nil, fmt.Errorf("root proof verification failed: commitment mismatch")
+	if valid, err := p.verify(); err != nil || !valid {
+		return trie.Value{}, false, err
 	}
-
-	return &vtProof{commitment: proofBytes}, nil
+	value, covered := p.proof.Get(key)
+	return value, covered, nil
 }
 
-func (v *vtSnapshotVerifier) VerifyPart(partNumber int, proof, part []byte) error {
-	if partNumber != 0 {
-		return fmt.Errorf("invalid part number %d, VT has only 1 part", partNumber)
-	}
-
-	// Verify the proof matches expected commitment
-	if !bytes.Equal(proof, v.expectedCommitment) {
-		return fmt.Errorf("proof verification failed: commitment mismatch")
-	}
-
-	// Create a temporary state to deserialize and verify the part data
-	tempState := &State{trie: &trie.Trie{}}
-	if err := tempState.deserializeTrie(part); err != nil {
-		return fmt.Errorf("failed to deserialize data: %w", err)
-	}
-
-	// Verify the commitment matches
-	commitment := tempState.trie.Commit().Compress()
-	if !bytes.Equal(commitment[:], v.expectedCommitment) {
-		return fmt.Errorf("data verification failed: commitment mismatch")
+// getElements returns the commitments of all nodes covered by the given proof
+// in their compressed form.
+func getElements(proof *trie.Proof) []immutable.Bytes {
+	commitments := proof.Commitments()
+	res := make([]immutable.Bytes, 0, len(commitments))
+	for _, commitment := range commitments {
+		compressed := commitment.Compress()
+		res = append(res, immutable.NewBytes(compressed[:]))
 	}
-
-	return nil
-}
-
-// vtWitnessProof implements witness.Proof for Verkle Trie
-type vtWitnessProof struct {
-	rootHash common.Hash
-	address  common.Address
-	balance  amount.Amount
-	nonce    common.Nonce
-	codeHash common.Hash
-	storage  map[common.Key]common.Value
-	exists   bool
+	return res
 }
 
 func (p *vtWitnessProof) Extract(root common.Hash, address common.Address, keys ...common.Key) (witness.Proof, bool) {
-	// Check if root matches
-	if root != p.rootHash {
-		return nil, false
-	}
-
-	// Check if address matches
-	if address != p.address {
+	if address != p.address || common.Hash(p.proof.Root().Compress()) != root {
 		return nil, false
 	}
 
-	// Filter storage to only requested keys
-	filteredStorage := make(map[common.Key]common.Value)
-	allKeysPresent := true
+	storageKeys := make(map[common.Key]trie.Key, len(keys))
+	trieKeys := make([]trie.Key, 0, len(keys)+2)
+	trieKeys = append(trieKeys, getBasicDataKey(address), getCodeHashKey(address))
+	complete := true
 	for _, key := range keys {
-		if value, ok := p.storage[key]; ok {
-			filteredStorage[key] = value
-		} else {
-			allKeysPresent = false
+		trieKey, found := p.storageKeys[key]
+		if !found {
+			complete = false
+			continue
 		}
+		storageKeys[key] = trieKey
+		trieKeys = append(trieKeys, trieKey)
 	}
 
-	return &vtWitnessProof{
-		rootHash: p.rootHash,
-		address:  p.address,
-		balance:  p.balance,
-		nonce:    p.nonce,
-		codeHash: p.codeHash,
-		storage:  filteredStorage,
-		exists:   p.exists,
-	}, allKeysPresent
+	proof, _ := p.proof.Extract(trieKeys...)
+	return newWitnessProof(address, storageKeys, proof), complete
 }
 
 func (p *vtWitnessProof) IsValid() bool {
-	// Basic validation - check that the proof is self-consistent
-	return p.rootHash != (common.Hash{})
+	valid, err := p.verify()
+	return err == nil && valid
 }
 
 func (p *vtWitnessProof) GetElements() []immutable.Bytes {
-	// Serialize proof elements
-	elements := make([]immutable.Bytes, 0)
-
-	// Add account data
-	accountData := make([]byte, 32+8+32+32) // balance + nonce + codeHash + address
-	balanceBytes := p.balance.Bytes32()
-	copy(accountData[0:32], balanceBytes[:])
-	copy(accountData[32:40], p.nonce[:])
-	copy(accountData[40:72], p.codeHash[:])
-	copy(accountData[72:104], p.address[:])
-	elements = append(elements, immutable.NewBytes(accountData))
-
-	// Add storage elements
-	for key, value := range p.storage {
-		storageData := make([]byte, 64)
-		copy(storageData[0:32], key[:])
-		copy(storageData[32:64], value[:])
-		elements = append(elements, immutable.NewBytes(storageData))
-	}
-
-	return elements
+	return getElements(p.proof)
 }
 
 func (p *vtWitnessProof) GetAccountElements(root common.Hash, address common.Address) ([]immutable.Bytes, common.Hash, bool) {
-	if root != p.rootHash || address != p.address {
+	if address != p.address || common.Hash(p.proof.Root().Compress()) != root {
 		return nil, common.Hash{}, false
 	}
-
-	// Return account elements and storage root (for VT, we use the root hash)
-	accountData := make([]byte, 32+8+32)
-	balanceBytes := p.balance.Bytes32()
-	copy(accountData[0:32], balanceBytes[:])
-	copy(accountData[32:40], p.nonce[:])
-	copy(accountData[40:72], p.codeHash[:])
-
-	return []immutable.Bytes{immutable.NewBytes(accountData)}, p.rootHash, true
+	proof, complete := p.proof.Extract(getBasicDataKey(address), getCodeHashKey(address))
+	if !complete {
+		return nil, common.Hash{}, false
+	}
+	// Verkle tries have no per-account storage tries, so the root of the
+	// entire trie is reported as the storage root.
+	return getElements(proof), root, true
 }
 
 func (p *vtWitnessProof) GetStorageElements(root common.Hash, address common.Address, key common.Key) ([]immutable.Bytes, bool) {
-	if root != p.rootHash || address != p.address {
+	if address != p.address || common.Hash(p.proof.Root().Compress()) != root {
 		return nil, false
 	}
-
-	value, exists := p.storage[key]
-	if !exists {
+	trieKey, found := p.storageKeys[key]
+	if !found {
 		return nil, false
 	}
-
-	storageData := make([]byte, 64)
-	copy(storageData[0:32], key[:])
-	copy(storageData[32:64], value[:])
-
-	return []immutable.Bytes{immutable.NewBytes(storageData)}, true
+	proof, complete := p.proof.Extract(trieKey)
+	if !complete {
+		return nil, false
+	}
+	return getElements(proof), true
 }
 
 func (p *vtWitnessProof) GetBalance(root common.Hash, address common.Address) (amount.Amount, bool, error) {
-	if root != p.rootHash || address != p.address {
-		return amount.New(), false, nil
-	}
-	if !p.exists {
-		return amount.New(), false, nil
+	value, covered, err := p.get(root, address, getBasicDataKey(address))
+	if err != nil || !covered {
+		return amount.New(), false, err
 	}
-	return p.balance, true, nil
+	return amount.NewFromBytes(value[16:32]...), true, nil
 }
 
 func (p *vtWitnessProof) GetNonce(root common.Hash, address common.Address) (common.Nonce, bool, error) {
-	if root != p.rootHash || address != p.address {
-		return common.Nonce{}, false, nil
+	value, covered, err := p.get(root, address, getBasicDataKey(address))
+	if err != nil || !covered {
+		return common.Nonce{}, false, err
 	}
-	if !p.exists {
-		return common.Nonce{}, false, nil
-	}
-	return p.nonce, true, nil
+	return common.Nonce(value[8:16]), true, nil
 }
 
 func (p *vtWitnessProof) GetCodeHash(root common.Hash, address common.Address) (common.Hash, bool, error) {
-	if root != p.rootHash || address != p.address {
-		return common.Hash{}, false, nil
-	}
-	if !p.exists {
-		return common.Hash{}, false, nil
+	value, covered, err := p.get(root, address, getCodeHashKey(address))
+	if err != nil || !covered {
+		return common.Hash{}, false, err
 	}
-	return p.codeHash, true, nil
+	return common.Hash(value), true, nil
 }
 
 func (p *vtWitnessProof) GetState(root common.Hash, address common.Address, key common.Key) (common.Value, bool, error) {
-	if root != p.rootHash || address != p.address {
+	trieKey, found := p.storageKeys[key]
+	if !found {
 		return common.Value{}, false, nil
 	}
-
-	value, exists := p.storage[key]
-	return value, exists, nil
+	value, covered, err := p.get(root, address, trieKey)
+	if err != nil || !covered {
+		return common.Value{}, false, err
+	}
+	return common.Value(value), true, nil
 }
 
 func (p *vtWitnessProof) AllStatesZero(root common.Hash, address common.Address, from, to common.Key) (tribool.Tribool, error) {
-	if root != p.rootHash || address != p.address {
-		return tribool.Unknown(), nil
-	}
-
-	// Check all storage slots in the range
-	for key, value := range p.storage {
-		// Check if key is in range [from, to]
-		if bytes.Compare(key[:], from[:]) >= 0 && bytes.Compare(key[:], to[:]) <= 0 {
-			var zero common.Value
-			if value != zero {
-				return tribool.False(), nil
-			}
+	// Check all covered storage slots in the range [from, to]
+	for key, trieKey := range p.storageKeys {
+		if bytes.Compare(key[:], from[:]) < 0 || bytes.Compare(key[:], to[:]) > 0 {
+			continue
+		}
+		value, covered, err := p.get(root, address, trieKey)
+		if err != nil || !covered {
+			return tribool.Unknown(), err
+		}
+		if value != (trie.Value{}) {
+			return tribool.False(), nil
 		}
 	}
 
-	// All checked slots are zero, but we can't be sure about unchecked ones
-	return tribool.True(), nil
+	// Storage slots are spread across the trie, so only ranges consisting of
+	// a single covered slot can be proven to be zero.
+	if _, found := p.storageKeys[from]; found && from == to {
+		return tribool.True(), nil
+	}
+	return tribool.Unknown(), nil
 }
 
 func (p *vtWitnessProof) AllAddressesEmpty(root common.Hash, from, to common.Address) (tribool.Tribool, error) {
-	if root != p.rootHash {
+	// This proof only covers a single address.
+	if bytes.Compare(p.address[:], from[:]) < 0 || bytes.Compare(p.address[:], to[:]) > 0 {
 		return tribool.Unknown(), nil
 	}
 
-	// Check if our address is in the range
-	if bytes.Compare(p.address[:], from[:]) >= 0 && bytes.Compare(p.address[:], to[:]) <= 0 {
-		// Check if account is empty
-		var zeroHash common.Hash
-		if p.exists && (p.balance != amount.New() || p.nonce != (common.Nonce{}) || p.codeHash != zeroHash) {
-			return tribool.False(), nil
-		}
+	value, covered, err := p.get(root, p.address, getBasicDataKey(p.address))
+	if err != nil || !covered {
+		return tribool.Unknown(), err
 	}
 
-	// This proof only covers one address, so we can't be certain about others
+	// An account is empty if its code size, nonce, and balance are zero.
+	var empty [28]byte
+	if !bytes.Equal(value[4:32], empty[:]) {
+		return tribool.False(), nil
+	}
+	if from == to {
+		return tribool.True(), nil
+	}
 	return tribool.Unknown(), nil
 }
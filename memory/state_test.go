@@ -2,12 +2,15 @@ package memory
 
 import (
 	"bytes"
+	"context"
 	"crypto/rand"
+	"encoding/binary"
+	"reflect"
 	"testing"
 
-	"github.com/QoraNet/qoraDB/go/backend"
 	"github.com/QoraNet/qoraDB/go/common"
 	"github.com/QoraNet/qoraDB/go/common/amount"
+	"github.com/QoraNet/qoraDB/go/common/tribool"
 	"github.com/QoraNet/qoraDB/go/state"
 	geth_common "github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/core/types"
@@ -64,7 +67,7 @@ func TestState_CanStoreAndRestoreNonces(t *testing.T) {
 	require.Equal(common.ToNonce(42), nonce)
 
 	// Set another nonce
-	require.NoError(state.Apply(0, common.Update{
+	require.NoError(state.Apply(1, common.Update{
 		Nonces: []common.NonceUpdate{{
 			Account: address,
 			Nonce:   common.ToNonce(123),
@@ -103,7 +106,7 @@ func TestState_CanStoreAndRestoreBalances(t *testing.T) {
 	require.Equal(amount.New(42), balance)
 
 	// Set another balance
-	require.NoError(state.Apply(0, common.Update{
+	require.NoError(state.Apply(1, common.Update{
 		Balances: []common.BalanceUpdate{{
 			Account: address,
 			Balance: amount.New(123),
@@ -133,10 +136,12 @@ func TestState_CanStoreAndRestoreCodes(t *testing.T) {
 		"long":  {10_000: 1},
 	}
 
+	block := uint64(0)
 	for name, code := range tests {
 		t.Run(name, func(t *testing.T) {
 			// Set a code.
-			require.NoError(state.Apply(0, common.Update{
+			block++
+			require.NoError(state.Apply(block, common.Update{
 				Codes: []common.CodeUpdate{{
 					Account: address,
 					Code:    bytes.Clone(code),
@@ -161,10 +166,28 @@ func TestState_CanStoreAndRestoreCodes(t *testing.T) {
 	}
 }
 
-func TestState_HasEmptyStorage_ReturnsError(t *testing.T) {
+func TestState_HasEmptyStorage_ReflectsWrittenSlots(t *testing.T) {
+	require := require.New(t)
 	state := newState()
-	_, err := state.HasEmptyStorage(common.Address{1})
-	require.ErrorContains(t, err, "not supported by Verkle Tries")
+	address := common.Address{1}
+
+	empty, err := state.HasEmptyStorage(address)
+	require.NoError(err)
+	require.True(empty)
+
+	require.NoError(state.Apply(0, common.Update{
+		Slots: []common.SlotUpdate{{Account: address, Key: common.Key{1}, Value: common.Value{1}}},
+	}))
+	empty, err = state.HasEmptyStorage(address)
+	require.NoError(err)
+	require.False(empty)
+
+	require.NoError(state.Apply(1, common.Update{
+		DeletedAccounts: []common.Address{address},
+	}))
+	empty, err = state.HasEmptyStorage(address)
+	require.NoError(err)
+	require.True(empty)
 }
 
 func TestState_CanStoreAndRestoreCodesOfArbitraryLength(t *testing.T) {
@@ -179,7 +202,7 @@ func TestState_CanStoreAndRestoreCodesOfArbitraryLength(t *testing.T) {
 		code := random[:i]
 
 		// Set a code.
-		require.NoError(state.Apply(0, common.Update{
+		require.NoError(state.Apply(uint64(i), common.Update{
 			Codes: []common.CodeUpdate{{
 				Account: address,
 				Code:    bytes.Clone(code),
@@ -231,7 +254,7 @@ func TestState_CanStoreAndRestoreStorageSlots(t *testing.T) {
 	require.Equal(common.Value{1, 2, 3}, value)
 
 	// Set another value
-	require.NoError(state.Apply(0, common.Update{
+	require.NoError(state.Apply(1, common.Update{
 		Slots: []common.SlotUpdate{{
 			Account: address,
 			Key:     key,
@@ -282,39 +305,593 @@ func TestState_GetArchiveBlockHeight_ReturnsNoArchiveError(t *testing.T) {
 	require.ErrorIs(t, err, state.NoArchiveError)
 }
 
-func TestState_CreateWitnessProof_ReturnsNotSupportedError(t *testing.T) {
-	_, err := newState().CreateWitnessProof(common.Address{1}, common.Key{2})
-	require.ErrorContains(t, err, "witness proof not supported yet")
+func TestState_CreateWitnessProof_ProvesAccountAndStorageData(t *testing.T) {
+	require := require.New(t)
+	state := newState()
+	address := common.Address{1}
+	require.NoError(state.Apply(0, common.Update{
+		Balances: []common.BalanceUpdate{{Account: address, Balance: amount.New(12)}},
+		Nonces:   []common.NonceUpdate{{Account: address, Nonce: common.ToNonce(14)}},
+		Codes:    []common.CodeUpdate{{Account: address, Code: []byte{1, 2, 3}}},
+		Slots: []common.SlotUpdate{
+			{Account: address, Key: common.Key{1}, Value: common.Value{2}},
+			{Account: common.Address{2}, Key: common.Key{1}, Value: common.Value{3}},
+		},
+	}))
+	root, err := state.GetHash()
+	require.NoError(err)
+	wantCodeHash, err := state.GetCodeHash(address)
+	require.NoError(err)
+
+	proof, err := state.CreateWitnessProof(address, common.Key{1}, common.Key{2})
+	require.NoError(err)
+	require.True(proof.IsValid())
+	require.NotEmpty(proof.GetElements())
+
+	balance, complete, err := proof.GetBalance(root, address)
+	require.NoError(err)
+	require.True(complete)
+	require.Equal(amount.New(12), balance)
+
+	nonce, complete, err := proof.GetNonce(root, address)
+	require.NoError(err)
+	require.True(complete)
+	require.Equal(common.ToNonce(14), nonce)
+
+	codeHash, complete, err := proof.GetCodeHash(root, address)
+	require.NoError(err)
+	require.True(complete)
+	require.Equal(wantCodeHash, codeHash)
+
+	value, complete, err := proof.GetState(root, address, common.Key{1})
+	require.NoError(err)
+	require.True(complete)
+	require.Equal(common.Value{2}, value)
+
+	value, complete, err = proof.GetState(root, address, common.Key{2})
+	require.NoError(err)
+	require.True(complete)
+	require.Zero(value)
+
+	_, complete, err = proof.GetState(root, address, common.Key{3})
+	require.NoError(err)
+	require.False(complete)
+
+	zero, err := proof.AllStatesZero(root, address, common.Key{2}, common.Key{2})
+	require.NoError(err)
+	require.Equal(tribool.True(), zero)
+	zero, err = proof.AllStatesZero(root, address, common.Key{0}, common.Key{9})
+	require.NoError(err)
+	require.Equal(tribool.False(), zero)
+
+	empty, err := proof.AllAddressesEmpty(root, address, address)
+	require.NoError(err)
+	require.Equal(tribool.False(), empty)
 }
 
-func TestState_Export_PanicsAsNotImplemented(t *testing.T) {
+func TestState_CreateWitnessProof_ProvesAbsenceOfAccounts(t *testing.T) {
 	require := require.New(t)
 	state := newState()
-	require.Panics(
-		func() { state.Export(nil, nil) },
-		"Export should panic as it is not implemented",
-	)
+	require.NoError(state.Apply(0, getRandomUpdate(t, 3)))
+	root, err := state.GetHash()
+	require.NoError(err)
+
+	address := common.Address{1}
+	proof, err := state.CreateWitnessProof(address, common.Key{1})
+	require.NoError(err)
+	require.True(proof.IsValid())
+
+	balance, complete, err := proof.GetBalance(root, address)
+	require.NoError(err)
+	require.True(complete)
+	require.Equal(amount.New(), balance)
+
+	value, complete, err := proof.GetState(root, address, common.Key{1})
+	require.NoError(err)
+	require.True(complete)
+	require.Zero(value)
+
+	empty, err := proof.AllAddressesEmpty(root, address, address)
+	require.NoError(err)
+	require.Equal(tribool.True(), empty)
+}
+
+func TestState_CreateWitnessProof_DoesNotAnswerForOtherRootsOrAddresses(t *testing.T) {
+	require := require.New(t)
+	state := newState()
+	address := common.Address{1}
+	require.NoError(state.Apply(0, common.Update{
+		Balances: []common.BalanceUpdate{{Account: address, Balance: amount.New(12)}},
+	}))
+	root, err := state.GetHash()
+	require.NoError(err)
+
+	proof, err := state.CreateWitnessProof(address)
+	require.NoError(err)
+
+	_, complete, err := proof.GetBalance(common.Hash{1}, address)
+	require.NoError(err)
+	require.False(complete)
+
+	_, complete, err = proof.GetBalance(root, common.Address{2})
+	require.NoError(err)
+	require.False(complete)
+
+	_, complete = proof.Extract(common.Hash{1}, address)
+	require.False(complete)
+}
+
+func TestState_CreateWitnessProof_ExtractedProofsAreValid(t *testing.T) {
+	require := require.New(t)
+	state := newState()
+	address := common.Address{1}
+	require.NoError(state.Apply(0, common.Update{
+		Slots: []common.SlotUpdate{
+			{Account: address, Key: common.Key{1}, Value: common.Value{1}},
+			{Account: address, Key: common.Key{2}, Value: common.Value{2}},
+		},
+	}))
+	root, err := state.GetHash()
+	require.NoError(err)
+
+	proof, err := state.CreateWitnessProof(address, common.Key{1}, common.Key{2})
+	require.NoError(err)
+
+	extracted, complete := proof.Extract(root, address, common.Key{2})
+	require.True(complete)
+	require.True(extracted.IsValid())
+
+	value, complete, err := extracted.GetState(root, address, common.Key{2})
+	require.NoError(err)
+	require.True(complete)
+	require.Equal(common.Value{2}, value)
+
+	_, complete, err = extracted.GetState(root, address, common.Key{1})
+	require.NoError(err)
+	require.False(complete)
+
+	_, complete = proof.Extract(root, address, common.Key{3})
+	require.False(complete)
+}
+
+func TestState_Export_WritesSnapshotOfCurrentState(t *testing.T) {
+	require := require.New(t)
+	state := newState()
+	require.NoError(state.Apply(0, getRandomUpdate(t, 10)))
+
+	var out bytes.Buffer
+	hash, err := state.Export(context.Background(), &out)
+	require.NoError(err)
+
+	want, err := state.GetHash()
+	require.NoError(err)
+	require.Equal(want, hash)
+
+	// The export contains the snapshot metadata followed by the single part
+	// of entries and the written-slot index.
+	data := out.Bytes()
+	require.GreaterOrEqual(len(data), 4)
+	metaLen := int(binary.BigEndian.Uint32(data[0:4]))
+	require.GreaterOrEqual(len(data), 4+metaLen+4)
+	meta, err := decodeSnapshotMetadata(data[4 : 4+metaLen])
+	require.NoError(err)
+	require.Equal([32]byte(hash), meta.commitment)
+	partLen := int(binary.BigEndian.Uint32(data[4+metaLen:]))
+	require.GreaterOrEqual(len(data), 4+metaLen+4+partLen+4)
+	slotsLen := int(binary.BigEndian.Uint32(data[4+metaLen+4+partLen:]))
+	require.Equal(len(data), 4+metaLen+4+partLen+4+slotsLen)
+}
+
+func TestState_GetProof_ReturnsRootCommitment(t *testing.T) {
+	require := require.New(t)
+	state := newState()
+	require.NoError(state.Apply(0, getRandomUpdate(t, 5)))
+
+	proof, err := state.GetProof()
+	require.NoError(err)
+
+	hash, err := state.GetHash()
+	require.NoError(err)
+	require.Equal(hash[:], proof.ToBytes())
+}
+
+func TestState_CreateSnapshot_RestoreReproducesArbitraryState(t *testing.T) {
+	require := require.New(t)
+
+	update := getRandomUpdate(t, 20)
+	original := newState()
+	require.NoError(original.Apply(0, update))
+
+	snapshot, err := original.CreateSnapshot()
+	require.NoError(err)
+
+	restored := newState()
+	require.NoError(restored.Restore(snapshot.GetData()))
+
+	want, err := original.GetHash()
+	require.NoError(err)
+	have, err := restored.GetHash()
+	require.NoError(err)
+	require.Equal(want, have)
+
+	for _, change := range update.Balances {
+		balance, err := restored.GetBalance(change.Account)
+		require.NoError(err)
+		require.Equal(change.Balance, balance)
+	}
+	for _, change := range update.Nonces {
+		nonce, err := restored.GetNonce(change.Account)
+		require.NoError(err)
+		require.Equal(change.Nonce, nonce)
+	}
+	for _, change := range update.Codes {
+		code, err := restored.GetCode(change.Account)
+		require.NoError(err)
+		require.Equal(change.Code, code)
+	}
+	for _, change := range update.Slots {
+		value, err := restored.GetStorage(change.Account, change.Key)
+		require.NoError(err)
+		require.Equal(change.Value, value)
+	}
+}
+
+func TestState_Restore_RestoresWrittenSlots(t *testing.T) {
+	require := require.New(t)
+
+	original := newState()
+	address, other := common.Address{1}, common.Address{2}
+	require.NoError(original.Apply(0, common.Update{
+		Slots: []common.SlotUpdate{
+			{Account: address, Key: common.Key{1}, Value: common.Value{1}},
+			{Account: other, Key: common.Key{2}, Value: common.Value{2}},
+		},
+	}))
+
+	snapshot, err := original.CreateSnapshot()
+	require.NoError(err)
+	restored := newState()
+	require.NoError(restored.Restore(snapshot.GetData()))
+	require.NoError(restored.RunPostRestoreTasks())
+
+	empty, err := restored.HasEmptyStorage(address)
+	require.NoError(err)
+	require.False(empty)
+
+	// The storage of restored accounts is wiped when they are deleted.
+	require.NoError(restored.Apply(1, common.Update{
+		DeletedAccounts: []common.Address{address},
+	}))
+	require.NoError(original.Apply(1, common.Update{
+		DeletedAccounts: []common.Address{address},
+	}))
+	empty, err = restored.HasEmptyStorage(address)
+	require.NoError(err)
+	require.True(empty)
+	value, err := restored.GetStorage(address, common.Key{1})
+	require.NoError(err)
+	require.Equal(common.Value{}, value)
+	require.Equal(getHash(t, original), getHash(t, restored))
+
+	empty, err = restored.HasEmptyStorage(other)
+	require.NoError(err)
+	require.False(empty)
 }
 
-func TestState_GetProof_ReturnsNotSupportedError(t *testing.T) {
-	_, err := newState().GetProof()
-	require.ErrorIs(t, err, backend.ErrSnapshotNotSupported)
+func TestState_Restore_RejectsIncompleteWrittenSlots(t *testing.T) {
+	require := require.New(t)
+
+	original := newState()
+	require.NoError(original.Apply(0, getRandomUpdate(t, 5)))
+	snapshot, err := original.CreateSnapshot()
+	require.NoError(err)
+	metadata, err := snapshot.GetData().GetMetaData()
+	require.NoError(err)
+
+	// Leaving out a slot or an account of the index is detected.
+	var address common.Address
+	var key common.Key
+	for address = range original.writtenSlots {
+		for key = range original.writtenSlots[address] {
+			break
+		}
+		break
+	}
+	missingSlot := unionWrittenSlots(original.writtenSlots)
+	delete(missingSlot[address], key)
+	missingAccount := unionWrittenSlots(original.writtenSlots)
+	delete(missingAccount, address)
+
+	for _, slots := range []map[common.Address]map[common.Key]bool{missingSlot, missingAccount} {
+		tampered := &tamperedSnapshotData{
+			SnapshotData: snapshot.GetData(),
+			part:         writtenSlotsPart,
+			data:         encodeWrittenSlots(slots),
+		}
+		restored := newState()
+		require.ErrorContains(restored.Restore(tampered), "invalid written slots")
+		require.Equal(getHash(t, newState()), getHash(t, restored))
+
+		// Verifiers detect the incomplete index once all parts are verified.
+		verifier, err := newState().GetSnapshotVerifier(metadata)
+		require.NoError(err)
+		for i := range snapshot.GetNumParts() {
+			proof, err := tampered.GetProofData(i)
+			require.NoError(err)
+			part, err := tampered.GetPartData(i)
+			require.NoError(err)
+			err = verifier.VerifyPart(i, proof, part)
+			if i < snapshot.GetNumParts()-1 {
+				require.NoError(err, "part %d", i)
+			} else {
+				require.ErrorContains(err, "accounts for", "part %d", i)
+			}
+		}
+	}
 }
 
-func TestState_CreateSnapshot_ReturnsNotSupportedError(t *testing.T) {
-	_, err := newState().CreateSnapshot()
-	require.ErrorIs(t, err, backend.ErrSnapshotNotSupported)
+func TestState_RunPostRestoreTasks_DropsSlotsMissingInTrie(t *testing.T) {
+	require := require.New(t)
+
+	state := newState()
+	address := common.Address{1}
+	require.NoError(state.Apply(0, common.Update{
+		Slots: []common.SlotUpdate{{Account: address, Key: common.Key{1}, Value: common.Value{1}}},
+	}))
+	state.writtenSlots[address][common.Key{2}] = true
+	state.writtenSlots[common.Address{2}] = map[common.Key]bool{{3}: true}
+
+	require.NoError(state.RunPostRestoreTasks())
+	require.Equal(map[common.Address]map[common.Key]bool{
+		address: {{1}: true},
+	}, state.writtenSlots)
 }
 
-func TestState_Restore_ReturnsNotSupportedError(t *testing.T) {
-	var data backend.SnapshotData
-	err := newState().Restore(data)
-	require.ErrorIs(t, err, backend.ErrSnapshotNotSupported)
+func TestState_CreateSnapshot_IncludesSlotsExplicitlySetToZero(t *testing.T) {
+	require := require.New(t)
+
+	original := newState()
+	require.NoError(original.Apply(0, common.Update{
+		Slots: []common.SlotUpdate{
+			{Account: common.Address{1}, Key: common.Key{31: 1}, Value: common.Value{}},
+		},
+	}))
+	require.NotEqual(common.Hash(types.EmptyVerkleHash), getHash(t, original))
+
+	snapshot, err := original.CreateSnapshot()
+	require.NoError(err)
+
+	restored := newState()
+	require.NoError(restored.Restore(snapshot.GetData()))
+	require.Equal(getHash(t, original), getHash(t, restored))
 }
 
-func TestState_GetSnapshotVerifier_ReturnsNotSupportedError(t *testing.T) {
-	_, err := newState().GetSnapshotVerifier(nil)
-	require.ErrorIs(t, err, backend.ErrSnapshotNotSupported)
+func TestState_Restore_FailsOnCommitmentMismatch(t *testing.T) {
+	require := require.New(t)
+
+	original := newState()
+	require.NoError(original.Apply(0, getRandomUpdate(t, 2)))
+	snapshot, err := original.CreateSnapshot()
+	require.NoError(err)
+
+	data := snapshot.(*vtSnapshot)
+	corrupted := &vtSnapshot{
+		trie:       data.trie,
+		commitment: data.commitment,
+	}
+	corrupted.commitment[0]++
+
+	err = newState().Restore(corrupted)
+	require.ErrorContains(err, "commitment mismatch")
+}
+
+func TestState_GetSnapshotVerifier_AcceptsValidSnapshot(t *testing.T) {
+	require := require.New(t)
+
+	original := newState()
+	require.NoError(original.Apply(0, getRandomUpdate(t, 5)))
+	snapshot, err := original.CreateSnapshot()
+	require.NoError(err)
+
+	metadata, err := snapshot.GetData().GetMetaData()
+	require.NoError(err)
+
+	verifier, err := original.GetSnapshotVerifier(metadata)
+	require.NoError(err)
+
+	proof, err := verifier.VerifyRootProof(snapshot.GetData())
+	require.NoError(err)
+	require.True(proof.Equal(snapshot.GetRootProof()))
+
+	for i := range snapshot.GetNumParts() {
+		proof, err := snapshot.GetData().GetProofData(i)
+		require.NoError(err)
+		part, err := snapshot.GetData().GetPartData(i)
+		require.NoError(err)
+		require.NoError(verifier.VerifyPart(i, proof, part))
+	}
+}
+
+// getRandomUpdate produces an update touching the given number of randomly
+// chosen accounts, each with balance, nonce, code and storage spread over
+// the full key range.
+func getRandomUpdate(t *testing.T, numAccounts int) common.Update {
+	t.Helper()
+	update := common.Update{}
+	for i := range numAccounts {
+		var address common.Address
+		_, err := rand.Read(address[:])
+		require.NoError(t, err)
+
+		code := make([]byte, 100*i)
+		_, err = rand.Read(code)
+		require.NoError(t, err)
+
+		update.CreatedAccounts = append(update.CreatedAccounts, address)
+		update.Balances = append(update.Balances, common.BalanceUpdate{
+			Account: address, Balance: amount.New(uint64(i + 1)),
+		})
+		update.Nonces = append(update.Nonces, common.NonceUpdate{
+			Account: address, Nonce: common.ToNonce(uint64(i + 1)),
+		})
+		update.Codes = append(update.Codes, common.CodeUpdate{
+			Account: address, Code: code,
+		})
+		for range 3 {
+			var key common.Key
+			_, err := rand.Read(key[:])
+			require.NoError(t, err)
+			update.Slots = append(update.Slots, common.SlotUpdate{
+				Account: address, Key: key, Value: common.Value{byte(i), 31: 1},
+			})
+		}
+	}
+	return update
+}
+
+func getHash(t *testing.T, state *State) common.Hash {
+	t.Helper()
+	hash, err := state.GetHash()
+	require.NoError(t, err)
+	return hash
+}
+
+func TestState_DeleteAccount_WipesAllAccountData(t *testing.T) {
+	require := require.New(t)
+
+	address := common.Address{1}
+	headerSlot := common.Key{31: 1}
+	mainSlot := common.Key{1, 2, 3}
+	state := newState()
+	require.NoError(state.Apply(0, common.Update{
+		CreatedAccounts: []common.Address{address},
+		Balances:        []common.BalanceUpdate{{Account: address, Balance: amount.New(12)}},
+		Nonces:          []common.NonceUpdate{{Account: address, Nonce: common.ToNonce(14)}},
+		Codes:           []common.CodeUpdate{{Account: address, Code: []byte{10_000: 1}}},
+		Slots: []common.SlotUpdate{
+			{Account: address, Key: headerSlot, Value: common.Value{1}},
+			{Account: address, Key: mainSlot, Value: common.Value{2}},
+		},
+	}))
+
+	exists, err := state.Exists(address)
+	require.NoError(err)
+	require.True(exists)
+
+	require.NoError(state.Apply(1, common.Update{
+		DeletedAccounts: []common.Address{address},
+	}))
+
+	exists, err = state.Exists(address)
+	require.NoError(err)
+	require.False(exists)
+
+	balance, err := state.GetBalance(address)
+	require.NoError(err)
+	require.Equal(amount.New(), balance)
+
+	nonce, err := state.GetNonce(address)
+	require.NoError(err)
+	require.Equal(common.Nonce{}, nonce)
+
+	code, err := state.GetCode(address)
+	require.NoError(err)
+	require.Empty(code)
+
+	codeHash, err := state.GetCodeHash(address)
+	require.NoError(err)
+	require.Equal(common.Hash{}, codeHash)
+
+	for _, key := range []common.Key{headerSlot, mainSlot} {
+		value, err := state.GetStorage(address, key)
+		require.NoError(err)
+		require.Equal(common.Value{}, value)
+	}
+
+	empty, err := state.HasEmptyStorage(address)
+	require.NoError(err)
+	require.True(empty)
+
+	require.Equal(common.Hash(types.EmptyVerkleHash), getHash(t, state))
+}
+
+func TestState_DeleteAccount_CommitmentMatchesReferenceWithoutAccount(t *testing.T) {
+	require := require.New(t)
+
+	deleted := common.Address{1}
+	retained := common.Address{2}
+
+	createAccount := func(address common.Address) common.Update {
+		return common.Update{
+			CreatedAccounts: []common.Address{address},
+			Balances:        []common.BalanceUpdate{{Account: address, Balance: amount.New(1)}},
+			Nonces:          []common.NonceUpdate{{Account: address, Nonce: common.ToNonce(2)}},
+			Codes:           []common.CodeUpdate{{Account: address, Code: []byte{3 * 256 * 32: 1}}},
+			Slots: []common.SlotUpdate{
+				{Account: address, Key: common.Key{31: 3}, Value: common.Value{4}},
+				{Account: address, Key: common.Key{5}, Value: common.Value{6}},
+			},
+		}
+	}
+
+	state := newState()
+	require.NoError(state.Apply(0, createAccount(deleted)))
+	require.NoError(state.Apply(1, createAccount(retained)))
+	require.NoError(state.Apply(2, common.Update{
+		DeletedAccounts: []common.Address{deleted},
+	}))
+
+	reference, err := newRefState()
+	require.NoError(err)
+	require.NoError(reference.Apply(0, createAccount(retained)))
+	want, err := reference.GetHash()
+	require.NoError(err)
+
+	require.Equal(want, getHash(t, state))
+}
+
+func TestState_DeleteAccount_AccountCanBeRecreatedInSameBlock(t *testing.T) {
+	require := require.New(t)
+
+	address := common.Address{1}
+	state := newState()
+	require.NoError(state.Apply(0, common.Update{
+		Balances: []common.BalanceUpdate{{Account: address, Balance: amount.New(12)}},
+		Slots:    []common.SlotUpdate{{Account: address, Key: common.Key{1}, Value: common.Value{1}}},
+	}))
+
+	require.NoError(state.Apply(1, common.Update{
+		DeletedAccounts: []common.Address{address},
+		CreatedAccounts: []common.Address{address},
+		Nonces:          []common.NonceUpdate{{Account: address, Nonce: common.ToNonce(1)}},
+	}))
+
+	balance, err := state.GetBalance(address)
+	require.NoError(err)
+	require.Equal(amount.New(), balance)
+
+	nonce, err := state.GetNonce(address)
+	require.NoError(err)
+	require.Equal(common.ToNonce(1), nonce)
+
+	value, err := state.GetStorage(address, common.Key{1})
+	require.NoError(err)
+	require.Equal(common.Value{}, value)
+}
+
+func TestState_DeleteAccount_MissingAccountIsNoOp(t *testing.T) {
+	require := require.New(t)
+
+	state := newState()
+	require.NoError(state.Apply(0, common.Update{
+		Balances: []common.BalanceUpdate{{Account: common.Address{1}, Balance: amount.New(12)}},
+	}))
+	before := getHash(t, state)
+
+	require.NoError(state.Apply(1, common.Update{
+		DeletedAccounts: []common.Address{{2}},
+	}))
+	require.Equal(before, getHash(t, state))
 }
 
 // --- Tests comparing with Geth reference implementation ---
@@ -443,8 +1020,8 @@ func TestState_IncrementalStateUpdatesResultInSameCommitments(t *testing.T) {
 	reference, err := newRefState()
 	require.NoError(err)
 
-	for _, update := range updates {
-		state.Apply(0, update)
+	for i, update := range updates {
+		state.Apply(uint64(i), update)
 		hash, err := state.GetHash()
 		require.NoError(err)
 
@@ -549,7 +1126,7 @@ func TestState_Account_CodeHash_NotEmptied_When_Recreated(t *testing.T) {
 		CreatedAccounts: []common.Address{addr1},
 	}
 
-	require.NoError(state.Apply(0, update2))
+	require.NoError(state.Apply(1, update2))
 
 	codeHash, err = state.GetCodeHash(addr1)
 	require.NoError(err)
@@ -600,7 +1177,7 @@ func TestState_Account_Balance_NotEmptied_When_Recreated(t *testing.T) {
 		CreatedAccounts: []common.Address{addr1},
 	}
 
-	require.NoError(state.Apply(0, update2))
+	require.NoError(state.Apply(1, update2))
 
 	// The balance should remain the same
 	balance, err = state.GetBalance(addr1)
@@ -652,7 +1229,7 @@ func TestState_Account_Nonce_NotEmptied_When_Recreated(t *testing.T) {
 		CreatedAccounts: []common.Address{addr1},
 	}
 
-	require.NoError(state.Apply(0, update2))
+	require.NoError(state.Apply(1, update2))
 
 	// The nonce should remain the same
 	nonce, err = state.GetNonce(addr1)
@@ -669,6 +1246,227 @@ func TestState_Account_Nonce_NotEmptied_When_Recreated(t *testing.T) {
 	require.Equal(want, hash)
 }
 
+func TestState_RevertTo_RestoresStateOfArchivedBlock(t *testing.T) {
+	require := require.New(t)
+
+	state := newStateWithArchive(ArchivePolicy{})
+	address := common.Address{1}
+	key := common.Key{1}
+	require.NoError(state.Apply(1, common.Update{
+		Balances: []common.BalanceUpdate{{Account: address, Balance: amount.New(1)}},
+		Slots:    []common.SlotUpdate{{Account: address, Key: key, Value: common.Value{1}}},
+	}))
+	want, err := state.GetHash()
+	require.NoError(err)
+
+	require.NoError(state.Apply(2, common.Update{
+		DeletedAccounts: []common.Address{address},
+	}))
+	require.NoError(state.Apply(3, common.Update{
+		Balances: []common.BalanceUpdate{{Account: address, Balance: amount.New(3)}},
+	}))
+	empty, err := state.HasEmptyStorage(address)
+	require.NoError(err)
+	require.True(empty)
+
+	require.NoError(state.RevertTo(1))
+
+	hash, err := state.GetHash()
+	require.NoError(err)
+	require.Equal(want, hash)
+	balance, err := state.GetBalance(address)
+	require.NoError(err)
+	require.Equal(amount.New(1), balance)
+	value, err := state.GetStorage(address, key)
+	require.NoError(err)
+	require.Equal(common.Value{1}, value)
+	empty, err = state.HasEmptyStorage(address)
+	require.NoError(err)
+	require.False(empty)
+
+	// Blocks after the reverted block are discarded from the archive.
+	height, _, err := state.GetArchiveBlockHeight()
+	require.NoError(err)
+	require.Equal(uint64(1), height)
+	_, err = state.GetArchiveState(2)
+	require.Error(err)
+
+	// The state can be continued with new blocks, including deletions of the
+	// restored account.
+	require.NoError(state.Apply(2, common.Update{
+		DeletedAccounts: []common.Address{address},
+	}))
+	value, err = state.GetStorage(address, key)
+	require.NoError(err)
+	require.Equal(common.Value{}, value)
+	archived, err := state.GetArchiveState(1)
+	require.NoError(err)
+	hash, err = archived.GetHash()
+	require.NoError(err)
+	require.Equal(want, hash)
+}
+
+func TestState_GetArchiveState_ReportsStorageOfArchivedBlock(t *testing.T) {
+	require := require.New(t)
+
+	state := newStateWithArchive(ArchivePolicy{})
+	address := common.Address{1}
+	key := common.Key{1}
+	require.NoError(state.Apply(1, common.Update{
+		Slots: []common.SlotUpdate{{Account: address, Key: key, Value: common.Value{1}}},
+	}))
+	require.NoError(state.Apply(2, common.Update{
+		DeletedAccounts: []common.Address{address},
+	}))
+
+	// The slots of the account have been deleted after block 1, but are
+	// still part of the archived state.
+	archived, err := state.GetArchiveState(1)
+	require.NoError(err)
+	empty, err := archived.HasEmptyStorage(address)
+	require.NoError(err)
+	require.False(empty)
+
+	archived, err = state.GetArchiveState(2)
+	require.NoError(err)
+	empty, err = archived.HasEmptyStorage(address)
+	require.NoError(err)
+	require.True(empty)
+}
+
+func TestState_GetArchiveState_SharesWrittenSlotsUntilModified(t *testing.T) {
+	require := require.New(t)
+
+	state := newStateWithArchive(ArchivePolicy{})
+	address := common.Address{1}
+	require.NoError(state.Apply(1, common.Update{
+		Slots: []common.SlotUpdate{{Account: address, Key: common.Key{1}, Value: common.Value{1}}},
+	}))
+
+	archived, err := state.GetArchiveState(1)
+	require.NoError(err)
+	tracking := archived.(*State).writtenSlots
+	require.True(state.slotsShared)
+	require.Equal(reflect.ValueOf(state.writtenSlots).Pointer(), reflect.ValueOf(tracking).Pointer())
+
+	// Modifications of the live state copy the tracking first, such that
+	// the archived state is not affected.
+	require.NoError(state.Apply(2, common.Update{
+		DeletedAccounts: []common.Address{address},
+		Slots:           []common.SlotUpdate{{Account: common.Address{2}, Key: common.Key{2}, Value: common.Value{2}}},
+	}))
+	require.False(state.slotsShared)
+	require.Equal(map[common.Address]map[common.Key]bool{address: {{1}: true}}, tracking)
+	require.Equal(map[common.Address]map[common.Key]bool{{2}: {{2}: true}}, state.writtenSlots)
+
+	// Slots removed since are tracked separately by later archived states.
+	archived, err = state.GetArchiveState(1)
+	require.NoError(err)
+	require.Equal(map[common.Address]map[common.Key]bool{
+		address:           {{1}: true},
+		common.Address{2}: {{2}: true},
+	}, archived.(*State).getWrittenSlots())
+	empty, err := archived.HasEmptyStorage(address)
+	require.NoError(err)
+	require.False(empty)
+}
+
+func TestState_RevertTo_DiscardsPersistedBlocks(t *testing.T) {
+	require := require.New(t)
+	params := state.Parameters{Directory: t.TempDir()}
+
+	st, err := newStateWithArchivePolicy(params, DefaultArchivePolicy)
+	require.NoError(err)
+	hashes := map[uint64]common.Hash{}
+	for block := range uint64(5) {
+		require.NoError(st.Apply(block, common.Update{
+			Balances: []common.BalanceUpdate{{Account: common.Address{1}, Balance: amount.New(block + 1)}},
+		}))
+		hashes[block], _ = st.GetHash()
+	}
+	require.NoError(st.RevertTo(2))
+	require.NoError(st.Close())
+
+	st, err = newStateWithArchivePolicy(params, DefaultArchivePolicy)
+	require.NoError(err)
+	defer st.Close()
+	height, _, err := st.GetArchiveBlockHeight()
+	require.NoError(err)
+	require.Equal(uint64(2), height)
+	hash, err := st.GetHash()
+	require.NoError(err)
+	require.Equal(hashes[2], hash)
+	require.NoError(st.Apply(3, common.Update{}))
+}
+
+func TestState_RevertTo_FailsWithoutArchive(t *testing.T) {
+	require.ErrorIs(t, newState().RevertTo(0), state.NoArchiveError)
+}
+
+func TestState_RevertTo_FailsForUnknownBlocks(t *testing.T) {
+	state := newStateWithArchive(ArchivePolicy{})
+	require.NoError(t, state.Apply(1, common.Update{}))
+	require.Error(t, state.RevertTo(0))
+}
+
+func TestState_ArchivedStates_CanNotBeModified(t *testing.T) {
+	require := require.New(t)
+
+	state := newStateWithArchive(ArchivePolicy{})
+	address := common.Address{1}
+	require.NoError(state.Apply(1, common.Update{
+		Balances: []common.BalanceUpdate{{Account: address, Balance: amount.New(1)}},
+	}))
+	archived, err := state.GetArchiveState(1)
+	require.NoError(err)
+
+	require.ErrorContains(archived.Apply(2, common.Update{
+		Balances: []common.BalanceUpdate{{Account: address, Balance: amount.New(2)}},
+	}), "archived states can not be modified")
+	require.ErrorContains(archived.(*State).RevertTo(1), "archived states can not be reverted")
+
+	// Neither the archive nor the archived state are affected.
+	height, _, err := state.GetArchiveBlockHeight()
+	require.NoError(err)
+	require.Equal(uint64(1), height)
+	balance, err := archived.GetBalance(address)
+	require.NoError(err)
+	require.Equal(amount.New(1), balance)
+}
+
+func TestState_Apply_RequiresIncreasingBlockNumbers(t *testing.T) {
+	require := require.New(t)
+
+	state := newStateWithArchive(ArchivePolicy{})
+	address := common.Address{1}
+	require.NoError(state.Apply(5, common.Update{
+		Balances: []common.BalanceUpdate{{Account: address, Balance: amount.New(5)}},
+	}))
+	want, err := state.GetHash()
+	require.NoError(err)
+
+	for _, block := range []uint64{0, 4, 5} {
+		err := state.Apply(block, common.Update{
+			Balances: []common.BalanceUpdate{{Account: address, Balance: amount.New(block)}},
+		})
+		var orderErr *BlockOrderError
+		require.ErrorAs(err, &orderErr)
+		require.Equal(block, orderErr.Block)
+		require.Equal(uint64(5), orderErr.Previous)
+
+		// Rejected blocks do not modify the state.
+		hash, err := state.GetHash()
+		require.NoError(err)
+		require.Equal(want, hash)
+	}
+
+	// Gaps between blocks are allowed.
+	require.NoError(state.Apply(7, common.Update{}))
+	require.NoError(state.RevertTo(6))
+	require.ErrorAs(state.Apply(6, common.Update{}), new(*BlockOrderError))
+	require.NoError(state.Apply(7, common.Update{}))
+}
+
 // --- reference implementation from geth ---
 
 type refState struct {
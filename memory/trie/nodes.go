@@ -1,8 +1,9 @@
-
 package trie
 
 import (
 	"bytes"
+	"maps"
+	"sync"
 
 	"github.com/QoraNet/qoraDB/go/database/vt/commit"
 )
@@ -10,10 +11,25 @@ import (
 // ---- Nodes ----
 
 // node is an interface for trie nodes, which can be either inner or leaf nodes.
+//
+// Nodes may be shared by multiple versions of a trie. Each node is tagged with
+// the version of the trie that created it, and may only be modified in place
+// by operations on behalf of this version. Operations for other versions
+// modify a copy instead, which is returned as the replacement of the node.
 type node interface {
 	get(key Key, depth byte) Value
-	set(Key Key, depth byte, value Value) node
+	set(Key Key, depth byte, value Value, version uint64) node
 	commit() commit.Commitment
+
+	// delete removes the given key from the subtree rooted by this node. It
+	// returns the node replacing this node in its parent, which is nil if the
+	// subtree became empty, and whether the subtree was modified at all.
+	delete(key Key, depth byte, version uint64) (node, bool)
+
+	// visit calls the visitor for all used slots in the subtree rooted by
+	// this node in ascending key order. It returns false if the visitor
+	// requested to abort the iteration, true otherwise.
+	visit(visitor func(Key, Value) bool) bool
 }
 
 // ---- Inner nodes ----
@@ -27,6 +43,25 @@ type inner struct {
 	// commitmentClean flag is true.
 	commitment      commit.Commitment
 	commitmentClean bool
+
+	// The values of the children the cached commitment has been computed
+	// from, and a bitmap of the children modified since then. Modified
+	// children are integrated into the commitment through delta updates.
+	childValues [256]commit.Value
+	dirty       [256 / 8]byte
+
+	version uint64 // the version of the trie owning this node
+}
+
+// own returns a node equivalent to this node that may be modified on behalf of
+// the given trie version. The node is copied if it is owned by another version.
+func (i *inner) own(version uint64) *inner {
+	if i.version == version {
+		return i
+	}
+	res := *i
+	res.version = version
+	return &res
 }
 
 func (i *inner) get(key Key, depth byte) Value {
@@ -37,17 +72,47 @@ func (i *inner) get(key Key, depth byte) Value {
 	return next.get(key, depth+1)
 }
 
-func (i *inner) set(key Key, depth byte, value Value) node {
-	i.commitmentClean = false
+func (i *inner) set(key Key, depth byte, value Value, version uint64) node {
+	i = i.own(version)
 	pos := key[depth]
+	i.markDirty(pos)
 	next := i.children[pos]
 	if next == nil {
-		next = newLeaf(key)
+		leaf := newLeaf(key)
+		leaf.version = version
+		next = leaf
 	}
-	i.children[pos] = next.set(key, depth+1, value)
+	i.children[pos] = next.set(key, depth+1, value, version)
 	return i
 }
 
+func (i *inner) delete(key Key, depth byte, version uint64) (node, bool) {
+	pos := key[depth]
+	next := i.children[pos]
+	if next == nil {
+		return i, false
+	}
+	replacement, changed := next.delete(key, depth+1, version)
+	if !changed {
+		return i, false
+	}
+	i = i.own(version)
+	i.children[pos] = replacement
+	i.markDirty(pos)
+
+	// Inner nodes without children are removed. Like in go-verkle, inner
+	// nodes left with a single leaf are retained, such that the shape of the
+	// trie -- and thus its commitment -- depends on the keys deleted from
+	// it, not just on the keys it contains. See LeafDepth for how this shape
+	// is reproduced when rebuilding a trie from its entries.
+	for _, child := range i.children {
+		if child != nil {
+			return i, true
+		}
+	}
+	return nil, true
+}
+
 func (i *inner) commit() commit.Commitment {
 	if i.commitmentClean {
 		return i.commitment
@@ -61,16 +126,98 @@ func (i *inner) commit() commit.Commitment {
 	// For details, see
 	// https://blog.ethereum.org/2021/12/02/verkle-tree-structure#commitment-of-internal-nodes
 
-	// Recompute the commitment for this inner node.
+	// If there is no previous commitment, it is computed from scratch.
+	// Otherwise, only the modified children are updated.
+	if !i.commitment.IsValid() {
+		i.childValues = i.getValues()
+		i.commitment = commit.Commit(i.childValues)
+	} else {
+		for j, child := range i.children {
+			pos := byte(j)
+			if !i.isDirty(pos) {
+				continue
+			}
+			var value commit.Value
+			if child != nil {
+				value = child.commit().ToValue()
+			}
+			i.commitment = i.commitment.Update(pos, i.childValues[pos], value)
+			i.childValues[pos] = value
+		}
+	}
+	i.dirty = [256 / 8]byte{}
+	i.commitmentClean = true
+	return i.commitment
+}
+
+// commitChildren computes the commitments of all modified subtrees of this
+// node, such that a subsequent call to commit only needs to integrate the
+// cached child commitments. Subtrees are processed by additional goroutines
+// as long as a slot in the given worker pool is available, otherwise they are
+// processed by the current goroutine.
+func (i *inner) commitChildren(workers chan struct{}) {
+	if i.commitmentClean {
+		return
+	}
+	var wg sync.WaitGroup
+	for j, child := range i.children {
+		if child == nil || !i.isDirty(byte(j)) {
+			continue
+		}
+		select {
+		case workers <- struct{}{}:
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				defer func() { <-workers }()
+				commitSubtree(child, workers)
+			}()
+		default:
+			commitSubtree(child, workers)
+		}
+	}
+	wg.Wait()
+}
+
+// commitSubtree computes the commitment of the subtree rooted by the given
+// node, distributing the work on modified subtrees among the given workers.
+func commitSubtree(n node, workers chan struct{}) {
+	if inner, ok := n.(*inner); ok {
+		inner.commitChildren(workers)
+	}
+	n.commit()
+}
+
+// markDirty marks the child at the given position as modified, invalidating
+// the cached commitment of this node.
+func (i *inner) markDirty(pos byte) {
+	i.dirty[pos/8] |= 1 << (pos % 8)
+	i.commitmentClean = false
+}
+
+func (i *inner) isDirty(pos byte) bool {
+	return (i.dirty[pos/8] & (1 << (pos % 8))) != 0
+}
+
+// getValues returns the vector of values the commitment of this inner node is
+// computed from. Child commitments are computed if necessary.
+func (i *inner) getValues() [256]commit.Value {
 	children := [256]commit.Value{}
 	for j, child := range i.children {
 		if child != nil { // for empty children, the value to commit to is zero
 			children[j] = child.commit().ToValue()
 		}
 	}
-	i.commitment = commit.Commit(children)
-	i.commitmentClean = true
-	return i.commitment
+	return children
+}
+
+func (i *inner) visit(visitor func(Key, Value) bool) bool {
+	for _, child := range i.children {
+		if child != nil && !child.visit(visitor) {
+			return false
+		}
+	}
+	return true
 }
 
 // ---- Leaf nodes ----
@@ -83,12 +230,34 @@ type leaf struct {
 	values [256]Value    // The values stored in this leaf, indexed by the last byte of the key.
 	used   [256 / 8]byte // A bitmap indicating which suffixes (last byte of the key) are used.
 
-	// The cached commitment of this inner node. It is only valid if the
+	// The cached commitment of this leaf node. It is only valid if the
 	// commitmentClean flag is true.
 	commitment      commit.Commitment
 	commitmentClean bool
+
+	// The cached commitments C1 and C2 of the lower and upper half of the
+	// values. They are only up-to-date if the commitmentClean flag is true.
+	halves [2]commit.Commitment
+
+	// The state of the slots modified since the last commit, indexed by their
+	// suffix. It is used to update C1 and C2 instead of recomputing them.
+	previous map[byte]slot
+
+	version uint64 // the version of the trie owning this node
+}
+
+// slot is the state of a single slot of a leaf node.
+type slot struct {
+	value Value
+	used  bool
 }
 
+// maxSlotUpdates is the number of modified slots in one half of a leaf beyond
+// which the commitment of the half is recomputed instead of being updated.
+// Each slot update costs two scalar multiplications, while a recomputation is
+// a single multi-scalar multiplication over all 256 positions.
+const maxSlotUpdates = 64
+
 // newLeaf creates a new leaf node with the given key.
 func newLeaf(key Key) *leaf {
 	return &leaf{
@@ -96,6 +265,18 @@ func newLeaf(key Key) *leaf {
 	}
 }
 
+// own returns a node equivalent to this node that may be modified on behalf of
+// the given trie version. The node is copied if it is owned by another version.
+func (l *leaf) own(version uint64) *leaf {
+	if l.version == version {
+		return l
+	}
+	res := *l
+	res.previous = maps.Clone(l.previous)
+	res.version = version
+	return &res
+}
+
 func (l *leaf) get(key Key, _ byte) Value {
 	if !bytes.Equal(key[:31], l.stem[:]) {
 		return Value{}
@@ -103,19 +284,39 @@ func (l *leaf) get(key Key, _ byte) Value {
 	return l.values[key[31]]
 }
 
-func (l *leaf) set(key Key, depth byte, value Value) node {
+func (l *leaf) set(key Key, depth byte, value Value, version uint64) node {
 	if bytes.Equal(key[:31], l.stem[:]) {
+		l = l.own(version)
 		suffix := key[31]
+		l.markDirty(suffix)
 		l.values[suffix] = value
 		l.used[suffix/8] |= 1 << (suffix % 8)
-		l.commitmentClean = false
 		return l
 	}
 
-	// This leaf needs to be split
-	res := &inner{}
+	// This leaf needs to be split. The leaf itself is not modified, so it
+	// does not need to be owned by the given version.
+	res := &inner{version: version}
 	res.children[l.stem[depth]] = l
-	return res.set(key, depth, value)
+	res.markDirty(l.stem[depth])
+	return res.set(key, depth, value, version)
+}
+
+func (l *leaf) delete(key Key, _ byte, version uint64) (node, bool) {
+	suffix := key[31]
+	if !bytes.Equal(key[:31], l.stem[:]) || !l.isUsed(suffix) {
+		return l, false
+	}
+	l = l.own(version)
+	l.markDirty(suffix)
+	l.values[suffix] = Value{}
+	l.used[suffix/8] &^= 1 << (suffix % 8)
+
+	// Leaves without any used slots are removed from the trie.
+	if l.used == [256 / 8]byte{} {
+		return nil, true
+	}
+	return l, true
 }
 
 func (l *leaf) commit() commit.Commitment {
@@ -138,31 +339,130 @@ func (l *leaf) commit() commit.Commitment {
 	// For details on the commitment procedure, see
 	// https://blog.ethereum.org/2021/12/02/verkle-tree-structure#commitment-to-the-values-leaf-nodes
 
-	// Compute the commitment for this leaf node.
-	values := [2][256]commit.Value{}
-	for i, v := range l.values {
-		lower := commit.NewValueFromLittleEndianBytes(v[:16])
-		upper := commit.NewValueFromLittleEndianBytes(v[16:])
+	// If there is no previous commitment, it is computed from scratch.
+	// Otherwise, C1 and C2 are updated for the modified slots and the
+	// references to them are updated in the leaf commitment.
+	if !l.commitment.IsValid() {
+		values := l.getSubValues()
+		l.halves[0] = commit.Commit(values[0])
+		l.halves[1] = commit.Commit(values[1])
+		l.commitment = commit.Commit(l.getValues(l.halves[0], l.halves[1]))
+	} else {
+		previous := l.halves
+		l.updateHalves()
+		for j := range l.halves {
+			if !previous[j].Equal(l.halves[j]) {
+				l.commitment = l.commitment.Update(
+					byte(2+j),
+					previous[j].ToValue(),
+					l.halves[j].ToValue(),
+				)
+			}
+		}
+	}
+	l.previous = nil
+	l.commitmentClean = true
+	return l.commitment
+}
+
+// updateHalves brings the cached commitments C1 and C2 up-to-date with the
+// slots modified since the last commit.
+func (l *leaf) updateHalves() {
+	counts := [2]int{}
+	for suffix := range l.previous {
+		counts[suffix/128]++
+	}
 
-		if l.isUsed(byte(i)) {
-			lower.SetBit128()
+	var values *[2][256]commit.Value
+	for j, count := range counts {
+		if count > maxSlotUpdates {
+			if values == nil {
+				all := l.getSubValues()
+				values = &all
+			}
+			l.halves[j] = commit.Commit(values[j])
 		}
+	}
 
-		values[i/128][(2*i)%256] = lower
-		values[i/128][(2*i+1)%256] = upper
+	for suffix, before := range l.previous {
+		half := suffix / 128
+		if counts[half] > maxSlotUpdates {
+			continue
+		}
+		oldLower, oldUpper := splitValue(before.value, before.used)
+		newLower, newUpper := splitValue(l.values[suffix], l.isUsed(suffix))
+		pos := 2 * (suffix % 128)
+		l.halves[half] = l.halves[half].Update(pos, oldLower, newLower)
+		l.halves[half] = l.halves[half].Update(pos+1, oldUpper, newUpper)
 	}
+}
 
-	c1 := commit.Commit(values[0])
-	c2 := commit.Commit(values[1])
+// markDirty records the current state of the slot with the given suffix
+// before it is modified, invalidating the cached commitment of this leaf.
+// Only the state at the time of the last commit is retained.
+func (l *leaf) markDirty(suffix byte) {
+	l.commitmentClean = false
+	if !l.commitment.IsValid() {
+		return // the commitment is computed from scratch anyway
+	}
+	if _, found := l.previous[suffix]; found {
+		return
+	}
+	if l.previous == nil {
+		l.previous = map[byte]slot{}
+	}
+	l.previous[suffix] = slot{value: l.values[suffix], used: l.isUsed(suffix)}
+}
 
-	l.commitment = commit.Commit([256]commit.Value{
+// getValues returns the vector of values the commitment of this leaf node is
+// computed from, given the commitments C1 and C2 of its two halves.
+func (l *leaf) getValues(c1, c2 commit.Commitment) [256]commit.Value {
+	return [256]commit.Value{
 		commit.NewValue(1),
 		commit.NewValueFromLittleEndianBytes(l.stem[:]),
 		c1.ToValue(),
 		c2.ToValue(),
-	})
-	l.commitmentClean = true
-	return l.commitment
+	}
+}
+
+// getSubValues returns the vectors of values the commitments C1 and C2 of
+// this leaf node are computed from.
+func (l *leaf) getSubValues() [2][256]commit.Value {
+	values := [2][256]commit.Value{}
+	for i, v := range l.values {
+		lower, upper := splitValue(v, l.isUsed(byte(i)))
+		values[i/128][(2*i)%256] = lower
+		values[i/128][(2*i+1)%256] = upper
+	}
+	return values
+}
+
+// splitValue splits a value stored in a leaf into its lower and upper half as
+// they are committed to in C1 or C2. The lower half is marked by setting its
+// 128th bit if the slot holding the value is used.
+func splitValue(value Value, used bool) (lower, upper commit.Value) {
+	lower = commit.NewValueFromLittleEndianBytes(value[:16])
+	upper = commit.NewValueFromLittleEndianBytes(value[16:])
+	if used {
+		lower.SetBit128()
+	}
+	return lower, upper
+}
+
+func (l *leaf) visit(visitor func(Key, Value) bool) bool {
+	key := Key{}
+	copy(key[:31], l.stem[:])
+	for i := range l.values {
+		suffix := byte(i)
+		if !l.isUsed(suffix) {
+			continue
+		}
+		key[31] = suffix
+		if !visitor(key, l.values[suffix]) {
+			return false
+		}
+	}
+	return true
 }
 
 func (l *leaf) isUsed(suffix byte) bool {
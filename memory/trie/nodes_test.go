@@ -1,4 +1,3 @@
-
 package trie
 
 import (
@@ -21,8 +20,8 @@ func TestInnerNode_Get_ReturnsValueFromNextNode(t *testing.T) {
 	key2 := Key{1, 2, 4}
 
 	var root node = newLeaf(key1)
-	root = root.set(key1, 2, Value{42})
-	root = root.set(key2, 2, Value{84})
+	root = root.set(key1, 2, Value{42}, 0)
+	root = root.set(key2, 2, Value{84}, 0)
 
 	inner, ok := root.(*inner)
 	require.True(ok, "Root should be an inner node")
@@ -39,7 +38,7 @@ func TestInnerNode_Set_CreatesNewLeafIfThereIsNoNextNode(t *testing.T) {
 	innerNode := &inner{}
 	require.Nil(innerNode.children[key[2]])
 
-	res, ok := innerNode.set(key, 2, Value{42}).(*inner)
+	res, ok := innerNode.set(key, 2, Value{42}, 0).(*inner)
 	require.True(ok, "Setting a new key not result in a leaf node")
 	require.Equal(innerNode, res, "Setting a new key should not change the inner node")
 
@@ -54,7 +53,7 @@ func TestInnerNode_CommitCleanStateIsTracked(t *testing.T) {
 
 	// Setting a value should mark the commitment as dirty.
 	key := Key{1, 2, 3}
-	innerNode.set(key, 0, Value{42})
+	innerNode.set(key, 0, Value{42}, 0)
 	require.False(innerNode.commitmentClean)
 
 	// Committing should clean the state.
@@ -67,7 +66,7 @@ func TestInnerNode_CommitCleanStateIsTracked(t *testing.T) {
 	require.True(firstCommit.Equal(secondCommit))
 
 	// Setting another value should mark the commitment as dirty again.
-	innerNode.set(Key{1, 2, 4}, 0, Value{84})
+	innerNode.set(Key{1, 2, 4}, 0, Value{84}, 0)
 	require.False(innerNode.commitmentClean)
 }
 
@@ -79,8 +78,8 @@ func TestInnerNode_Commit_ComputesCommitmentFromChildren(t *testing.T) {
 	key2 := Key{1, 2, 4}
 
 	// Set two values in the inner node.
-	innerNode.set(key1, 2, Value{42})
-	innerNode.set(key2, 2, Value{84})
+	innerNode.set(key1, 2, Value{42}, 0)
+	innerNode.set(key2, 2, Value{84}, 0)
 
 	// Compute the commitment.
 	commitment := innerNode.commit()
@@ -97,6 +96,24 @@ func TestInnerNode_Commit_ComputesCommitmentFromChildren(t *testing.T) {
 	require.True(commitment.Equal(expectedCommitment))
 }
 
+func TestInnerNode_Commit_UpdatesMatchRecomputation(t *testing.T) {
+	require := require.New(t)
+
+	node := &inner{}
+	for i := range 10 {
+		node.set(Key{byte(i), 31: byte(i)}, 0, Value{byte(i)}, 0)
+	}
+	node.commit()
+
+	// Modify, add, and delete children of the committed node.
+	node.set(Key{1, 31: 1}, 0, Value{42}, 0)
+	node.set(Key{20, 31: 1}, 0, Value{42}, 0)
+	node.delete(Key{2, 31: 2}, 0, 0)
+
+	fresh := &inner{children: node.children}
+	require.True(node.commit().Equal(fresh.commit()))
+}
+
 func TestLeafNode_NewLeaf_ProducesEmptyLeafWithStem(t *testing.T) {
 	require := require.New(t)
 
@@ -124,7 +141,7 @@ func TestLeafNode_Get_ReturnsValueForMatchingStem(t *testing.T) {
 	require.Zero(leaf.get(key, 0), "Value for the key should be zero initially")
 
 	// Set a value for the key.
-	leaf.set(key, 0, Value{42})
+	leaf.set(key, 0, Value{42}, 0)
 
 	// Now retrieving the value should return the set value.
 	require.Equal(Value{42}, leaf.get(key, 0), "Value for the key should match the set value")
@@ -137,7 +154,7 @@ func TestLeafNode_Get_ReturnsZeroForNonMatchingStem(t *testing.T) {
 	key2 := Key{4, 5, 6}
 
 	leaf := newLeaf(key1)
-	leaf.set(key1, 0, Value{42})
+	leaf.set(key1, 0, Value{42}, 0)
 
 	require.Zero(leaf.get(key2, 0), "Value for non-matching key should be zero")
 }
@@ -149,10 +166,10 @@ func TestLeafNode_Set_SplitsLeafIfStemDoesNotMatch(t *testing.T) {
 	key2 := Key{1, 2, 4}
 
 	leafNode := newLeaf(key1)
-	leafNode.set(key1, 0, Value{42})
+	leafNode.set(key1, 0, Value{42}, 0)
 
 	// Setting a different key should split the leaf.
-	newNode := leafNode.set(key2, 2, Value{84})
+	newNode := leafNode.set(key2, 2, Value{84}, 0)
 
 	// The new node should be an inner node now.
 	innerNode, ok := newNode.(*inner)
@@ -182,7 +199,7 @@ func TestLeafNode_CanSetAndGetValues(t *testing.T) {
 
 	// Setting a value for key 1 makes the value retrievable and marks the
 	// suffix as used.
-	leaf.set(key1, 0, Value{10})
+	leaf.set(key1, 0, Value{10}, 0)
 
 	require.True(leaf.isUsed(key1[31]))
 	require.False(leaf.isUsed(key2[31]))
@@ -194,7 +211,7 @@ func TestLeafNode_CanSetAndGetValues(t *testing.T) {
 
 	// Setting the value for key 2 to zero does not change the value but marks
 	// the suffix as used.
-	leaf.set(key2, 0, Value{})
+	leaf.set(key2, 0, Value{}, 0)
 
 	require.True(leaf.isUsed(key1[31]))
 	require.True(leaf.isUsed(key2[31]))
@@ -205,7 +222,7 @@ func TestLeafNode_CanSetAndGetValues(t *testing.T) {
 	require.Zero(leaf.get(key3, 0))
 
 	// Resetting the value for key 1 to zero does not change the used bitmap.
-	leaf.set(key1, 0, Value{})
+	leaf.set(key1, 0, Value{}, 0)
 	require.True(leaf.isUsed(key1[31]))
 	require.True(leaf.isUsed(key2[31]))
 	require.False(leaf.isUsed(key3[31]))
@@ -225,8 +242,8 @@ func TestLeafNode_CanComputeCommitment(t *testing.T) {
 	val2 := Value{8: 2, 20: 20}
 
 	leaf := newLeaf(key1)
-	leaf.set(key1, 0, val1)
-	leaf.set(key2, 0, val2)
+	leaf.set(key1, 0, val1, 0)
+	leaf.set(key2, 0, val2, 0)
 
 	have := leaf.commit()
 
@@ -262,10 +279,10 @@ func TestLeafNode_CommitmentDirtyStateIsTracked(t *testing.T) {
 	leaf := newLeaf(key1)
 	require.False(leaf.commitmentClean)
 
-	leaf.set(key1, 0, Value{10})
+	leaf.set(key1, 0, Value{10}, 0)
 	require.False(leaf.commitmentClean)
 
-	leaf.set(key2, 0, Value{20})
+	leaf.set(key2, 0, Value{20}, 0)
 	require.False(leaf.commitmentClean)
 
 	first := leaf.commit()
@@ -275,7 +292,7 @@ func TestLeafNode_CommitmentDirtyStateIsTracked(t *testing.T) {
 	require.True(leaf.commitmentClean)
 	require.True(first.Equal(second))
 
-	leaf.set(key1, 0, Value{30})
+	leaf.set(key1, 0, Value{30}, 0)
 	require.False(leaf.commitmentClean)
 
 	third := leaf.commit()
@@ -283,3 +300,198 @@ func TestLeafNode_CommitmentDirtyStateIsTracked(t *testing.T) {
 
 	require.False(first.Equal(third))
 }
+
+func TestLeafNode_Commit_UpdatesMatchRecomputation(t *testing.T) {
+	require := require.New(t)
+
+	original := newLeaf(Key{})
+	for i := range 256 {
+		original.set(Key{31: byte(i)}, 0, Value{byte(i), 31: 1}, 0)
+	}
+	original.commit()
+
+	// Modify values in both halves and delete a value in the lower half.
+	original.set(Key{31: 3}, 0, Value{42}, 0)
+	original.set(Key{31: 200}, 0, Value{84}, 0)
+	original.delete(Key{31: 5}, 0, 0)
+
+	fresh := &leaf{stem: original.stem, values: original.values, used: original.used}
+	require.True(original.commit().Equal(fresh.commit()))
+}
+
+func TestLeafNode_Commit_TracksPreviousStateOfModifiedSlots(t *testing.T) {
+	require := require.New(t)
+
+	original := newLeaf(Key{})
+	original.set(Key{31: 1}, 0, Value{1}, 0)
+	require.Nil(original.previous, "uncommitted leaves should not track slots")
+	original.commit()
+
+	original.set(Key{31: 1}, 0, Value{2}, 0)
+	original.set(Key{31: 1}, 0, Value{3}, 0)
+	original.set(Key{31: 2}, 0, Value{4}, 0)
+	require.Equal(map[byte]slot{
+		1: {value: Value{1}, used: true},
+		2: {},
+	}, original.previous)
+
+	fresh := &leaf{stem: original.stem, values: original.values, used: original.used}
+	require.True(original.commit().Equal(fresh.commit()))
+	require.Nil(original.previous, "committing should reset the tracked slots")
+}
+
+func TestLeafNode_Commit_ManyModifiedSlotsMatchRecomputation(t *testing.T) {
+	require := require.New(t)
+
+	original := newLeaf(Key{})
+	original.set(Key{31: 200}, 0, Value{1}, 0)
+	original.commit()
+
+	// Exceed the update limit in the lower half only.
+	for i := range maxSlotUpdates + 1 {
+		original.set(Key{31: byte(i)}, 0, Value{byte(i), 31: 1}, 0)
+	}
+	original.set(Key{31: 201}, 0, Value{2}, 0)
+
+	fresh := &leaf{stem: original.stem, values: original.values, used: original.used}
+	require.True(original.commit().Equal(fresh.commit()))
+}
+
+func TestLeafNode_Visit_VisitsUsedSlotsInOrder(t *testing.T) {
+	require := require.New(t)
+
+	key1 := Key{1, 2, 3, 31: 200}
+	key2 := Key{1, 2, 3, 31: 7}
+	key3 := Key{1, 2, 3, 31: 42}
+
+	leaf := newLeaf(key1)
+	leaf.set(key1, 0, Value{1}, 0)
+	leaf.set(key2, 0, Value{2}, 0)
+	leaf.set(key3, 0, Value{}, 0) // < zero values are still used
+
+	var keys []Key
+	var values []Value
+	require.True(leaf.visit(func(key Key, value Value) bool {
+		keys = append(keys, key)
+		values = append(values, value)
+		return true
+	}))
+
+	require.Equal([]Key{key2, key3, key1}, keys)
+	require.Equal([]Value{{2}, {}, {1}}, values)
+}
+
+func TestInnerNode_Visit_StopsWhenVisitorReturnsFalse(t *testing.T) {
+	require := require.New(t)
+
+	innerNode := &inner{}
+	innerNode.set(Key{1}, 0, Value{1}, 0)
+	innerNode.set(Key{2}, 0, Value{2}, 0)
+	innerNode.set(Key{3}, 0, Value{3}, 0)
+
+	var keys []Key
+	require.False(innerNode.visit(func(key Key, _ Value) bool {
+		keys = append(keys, key)
+		return len(keys) < 2
+	}))
+	require.Equal([]Key{{1}, {2}}, keys)
+}
+
+func TestLeafNode_Delete_ClearsValueAndUsedFlag(t *testing.T) {
+	require := require.New(t)
+
+	key1 := Key{1, 2, 3, 31: 1}
+	key2 := Key{1, 2, 3, 31: 2}
+
+	leaf := newLeaf(key1)
+	leaf.set(key1, 0, Value{1}, 0)
+	leaf.set(key2, 0, Value{2}, 0)
+	leaf.commit()
+
+	replacement, changed := leaf.delete(key1, 0, 0)
+	require.True(changed)
+	require.Equal(leaf, replacement)
+	require.False(leaf.commitmentClean)
+
+	require.False(leaf.isUsed(key1[31]))
+	require.True(leaf.isUsed(key2[31]))
+	require.Zero(leaf.get(key1, 0))
+	require.Equal(Value{2}, leaf.get(key2, 0))
+}
+
+func TestLeafNode_Delete_IgnoresUnusedSlotsAndOtherStems(t *testing.T) {
+	require := require.New(t)
+
+	key := Key{1, 2, 3, 31: 1}
+	leaf := newLeaf(key)
+	leaf.set(key, 0, Value{1}, 0)
+	leaf.commit()
+
+	for _, other := range []Key{{1, 2, 3, 31: 2}, {1, 2, 4, 31: 1}} {
+		replacement, changed := leaf.delete(other, 0, 0)
+		require.False(changed)
+		require.Equal(leaf, replacement)
+		require.True(leaf.commitmentClean)
+		require.Equal(Value{1}, leaf.get(key, 0))
+	}
+}
+
+func TestLeafNode_Delete_RemovingLastValueRemovesLeaf(t *testing.T) {
+	require := require.New(t)
+
+	key := Key{1, 2, 3, 31: 1}
+	leaf := newLeaf(key)
+	leaf.set(key, 0, Value{}, 0)
+
+	replacement, changed := leaf.delete(key, 0, 0)
+	require.True(changed)
+	require.Nil(replacement)
+}
+
+func TestInnerNode_Delete_RetainsInnerNodeWithSingleLeaf(t *testing.T) {
+	require := require.New(t)
+
+	key1 := Key{1, 2, 3}
+	key2 := Key{1, 2, 4}
+
+	innerNode := &inner{}
+	innerNode.set(key1, 0, Value{1}, 0)
+	innerNode.set(key2, 0, Value{2}, 0)
+
+	// The two keys are split by an inner node at depth 2.
+	child, ok := innerNode.children[1].(*inner)
+	require.True(ok)
+
+	replacement, changed := child.delete(key2, 1, 0)
+	require.True(changed)
+	require.Equal(child, replacement, "inner node with a single leaf should be retained")
+	grandChild, ok := child.children[2].(*inner)
+	require.True(ok)
+	require.NotNil(grandChild.children[3])
+	require.Nil(grandChild.children[4])
+}
+
+func TestInnerNode_Delete_RemovesInnerNodeWithoutChildren(t *testing.T) {
+	require := require.New(t)
+
+	key := Key{1, 2, 3}
+	innerNode := &inner{}
+	innerNode.set(key, 0, Value{1}, 0)
+
+	replacement, changed := innerNode.delete(key, 0, 0)
+	require.True(changed)
+	require.Nil(replacement)
+}
+
+func TestInnerNode_Delete_MissingKeyDoesNotChangeNode(t *testing.T) {
+	require := require.New(t)
+
+	innerNode := &inner{}
+	innerNode.set(Key{1, 2, 3}, 0, Value{1}, 0)
+	innerNode.commit()
+
+	replacement, changed := innerNode.delete(Key{2}, 0, 0)
+	require.False(changed)
+	require.Equal(innerNode, replacement)
+	require.True(innerNode.commitmentClean)
+}
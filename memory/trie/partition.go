@@ -0,0 +1,290 @@
+package trie
+
+import (
+	"bytes"
+	"fmt"
+	"runtime"
+
+	"github.com/QoraNet/qoraDB/go/database/vt/commit"
+)
+
+// NumPartitions is the number of partitions the key space of a trie is split
+// into. Partition p covers all keys starting with the byte p, which are stored
+// in the subtree rooted by the child of the root node at position p. Thus, the
+// commitment of a partition can be proven against the root commitment of the
+// trie by a single opening, allowing partitions to be transferred and verified
+// independently of each other.
+const NumPartitions = 256
+
+// GetPartitionCommitment returns the commitment of the subtree covering all
+// keys starting with the given prefix byte. Empty partitions are represented
+// by the identity commitment.
+func (t *Trie) GetPartitionCommitment(prefix byte) commit.Commitment {
+	t.Commit()
+	root, ok := t.root.(*inner)
+	if !ok || root.children[prefix] == nil {
+		return commit.Identity()
+	}
+	return root.children[prefix].commit()
+}
+
+// OpenPartition creates an opening proving the commitment of the partition
+// with the given prefix byte, as reported by GetPartitionCommitment, to be at
+// the respective position of the trie's root commitment.
+func (t *Trie) OpenPartition(prefix byte) (commit.Opening, error) {
+	commitment := t.Commit()
+	var values [commit.VectorSize]commit.Value
+	if root, ok := t.root.(*inner); ok {
+		values = root.childValues // valid since the root has been committed
+	}
+	return commit.Open(commitment, values, prefix)
+}
+
+// VerifyPartition checks that the given opening proves the given partition
+// commitment to be at the position of the given prefix byte in a trie with
+// the given root commitment.
+func VerifyPartition(
+	root commit.Commitment,
+	prefix byte,
+	partition commit.Commitment,
+	opening commit.Opening,
+) (bool, error) {
+	// The identity commitment of empty partitions maps to the zero value,
+	// which is what the root commits to for empty children.
+	return opening.Verify(root, prefix, partition.ToValue())
+}
+
+// VisitPartition calls the given visitor for every key starting with the given
+// prefix byte that has been set in the trie, in ascending key order. Like for
+// Visit, the iteration stops early if the visitor returns false, and the trie
+// must not be modified by the visitor.
+func (t *Trie) VisitPartition(prefix byte, visitor func(key Key, value Value) bool) {
+	root, ok := t.root.(*inner)
+	if !ok || root.children[prefix] == nil {
+		return
+	}
+	root.children[prefix].visit(visitor)
+}
+
+// GetPartitionLeafDepths returns the depths of all leaves of the partition
+// with the given prefix byte that are placed deeper than required by their
+// stems, as described by GetLeafDepths.
+func (t *Trie) GetPartitionLeafDepths(prefix byte) []LeafDepth {
+	root, ok := t.root.(*inner)
+	if !ok {
+		return nil
+	}
+	partition, ok := root.children[prefix].(*inner)
+	if !ok {
+		return nil
+	}
+	return appendLeafDepths(nil, partition, 1)
+}
+
+// Partition is a subtree of a trie covering all keys starting with a given
+// prefix byte. It is built from the entries and leaf depths of the partition
+// alone and allows computing the partition's commitment without computing the
+// commitments of the root node or any other partition, such that the work
+// needed is proportional to the number of entries in the partition.
+type Partition struct {
+	prefix byte
+	root   node
+}
+
+// NewPartition creates an empty partition for keys with the given prefix byte.
+func NewPartition(prefix byte) *Partition {
+	return &Partition{prefix: prefix}
+}
+
+// Set associates the given key with the specified value in the partition. It
+// fails if the key does not belong to the partition.
+func (p *Partition) Set(key Key, value Value) error {
+	if key[0] != p.prefix {
+		return fmt.Errorf("key %x does not belong to partition %d", key, p.prefix)
+	}
+	if p.root == nil {
+		p.root = newLeaf(key)
+	}
+	// Partitions are never cloned, so all nodes are owned by version 0.
+	p.root = p.root.set(key, 1, value, 0)
+	return nil
+}
+
+// Commit returns the commitment of the partition, which equals the result of
+// GetPartitionCommitment for a trie containing the same entries and leaf
+// depths in the partition. Commitments of subtrees are computed in parallel, using up to
+// one goroutine per available CPU.
+func (p *Partition) Commit() commit.Commitment {
+	if p.root == nil {
+		return commit.Identity()
+	}
+	// The current goroutine is counted as one of the workers.
+	commitSubtree(p.root, make(chan struct{}, runtime.GOMAXPROCS(0)-1))
+	return p.root.commit()
+}
+
+// SetLeafDepths moves leaves of the partition down to the given depths, as
+// described by Trie.SetLeafDepths. It fails if any of the leaves does not
+// belong to the partition.
+func (p *Partition) SetLeafDepths(depths []LeafDepth) error {
+	for i, depth := range depths {
+		if depth.Stem[0] != p.prefix {
+			return fmt.Errorf("leaf with stem %x does not belong to partition %d", depth.Stem, p.prefix)
+		}
+		if i > 0 && bytes.Compare(depths[i-1].Stem[:], depth.Stem[:]) >= 0 {
+			return fmt.Errorf("leaf depth %d is not in increasing stem order", i)
+		}
+		if p.root == nil {
+			return fmt.Errorf("no leaf with stem %x", depth.Stem)
+		}
+		root, err := moveLeaf(p.root, 1, depth, 0)
+		if err != nil {
+			return err
+		}
+		p.root = root
+	}
+	return nil
+}
+
+// GetNodeCommitments returns the commitments of all nodes of the partition,
+// as described by Trie.GetPartitionNodeCommitments.
+func (p *Partition) GetNodeCommitments() []commit.Commitment {
+	if p.root == nil {
+		return nil
+	}
+	p.Commit()
+	return appendNodeCommitments(nil, p.root)
+}
+
+// GetPartitionNodeCommitments returns the commitments of all nodes of the
+// partition with the given prefix byte. Nodes are listed in pre-order, with
+// children in ascending order of their positions. Inner nodes contribute
+// their commitment, leaves their commitment followed by the commitments C1
+// and C2 of their two halves. Since the shape of a partition only depends on
+// its keys and the depths of its leaves, the list can be assigned to a
+// partition with the same entries and leaf depths in another trie through
+// SetPartitionNodeCommitments.
+func (t *Trie) GetPartitionNodeCommitments(prefix byte) []commit.Commitment {
+	t.Commit()
+	root, ok := t.root.(*inner)
+	if !ok || root.children[prefix] == nil {
+		return nil
+	}
+	return appendNodeCommitments(nil, root.children[prefix])
+}
+
+// SetPartitionNodeCommitments assigns the given commitments, listed in the
+// order produced by GetPartitionNodeCommitments, to the nodes of the partition
+// with the given prefix byte. The nodes are marked as committed, such that
+// their commitments are not recomputed by Commit anymore. The given check
+// function is called once per node and decides whether the assigned
+// commitment of the node is verified by recomputing it from the node's values
+// and the assigned commitments of its children. Commitments that are not
+// verified are trusted, so this is intended for restoring tries from sources
+// that have been verified otherwise.
+//
+// The nodes of the partition must be exclusively owned by this trie, which
+// is the case for partitions built through Set since the trie was last
+// cloned. If an error is reported, the commitments of the partition are left
+// in an inconsistent state and the trie should be discarded.
+func (t *Trie) SetPartitionNodeCommitments(
+	prefix byte,
+	commitments []commit.Commitment,
+	check func() bool,
+) error {
+	var partition node
+	if root, ok := t.root.(*inner); ok {
+		partition = root.children[prefix]
+	}
+	if partition == nil {
+		if len(commitments) != 0 {
+			return fmt.Errorf("got %d commitments for empty partition %d", len(commitments), prefix)
+		}
+		return nil
+	}
+	rest, err := assignNodeCommitments(partition, commitments, t.version.Load(), check)
+	if err != nil {
+		return fmt.Errorf("failed to assign commitments of partition %d: %w", prefix, err)
+	}
+	if len(rest) != 0 {
+		return fmt.Errorf("got %d surplus commitments for partition %d", len(rest), prefix)
+	}
+	return nil
+}
+
+// appendNodeCommitments appends the commitments of all nodes of the subtree
+// rooted by the given node in the order documented by
+// GetPartitionNodeCommitments. All nodes must have been committed.
+func appendNodeCommitments(res []commit.Commitment, n node) []commit.Commitment {
+	switch n := n.(type) {
+	case *inner:
+		res = append(res, n.commitment)
+		for _, child := range n.children {
+			if child != nil {
+				res = appendNodeCommitments(res, child)
+			}
+		}
+	case *leaf:
+		res = append(res, n.commitment, n.halves[0], n.halves[1])
+	}
+	return res
+}
+
+// assignNodeCommitments assigns the leading commitments of the given list to
+// the nodes of the subtree rooted by the given node, which must be owned by
+// the given version. It returns the remaining commitments.
+func assignNodeCommitments(
+	n node,
+	commitments []commit.Commitment,
+	version uint64,
+	check func() bool,
+) ([]commit.Commitment, error) {
+	switch n := n.(type) {
+	case *inner:
+		if n.version != version {
+			return nil, fmt.Errorf("inner node is shared with other versions")
+		}
+		if len(commitments) < 1 {
+			return nil, fmt.Errorf("missing commitment of inner node")
+		}
+		n.commitment, commitments = commitments[0], commitments[1:]
+		for j, child := range n.children {
+			if child == nil {
+				n.childValues[j] = commit.Value{}
+				continue
+			}
+			var err error
+			commitments, err = assignNodeCommitments(child, commitments, version, check)
+			if err != nil {
+				return nil, err
+			}
+			n.childValues[j] = child.commit().ToValue() // the child is committed by now
+		}
+		n.dirty = [256 / 8]byte{}
+		n.commitmentClean = true
+		if check() && !commit.Commit(n.childValues).Equal(n.commitment) {
+			return nil, fmt.Errorf("invalid commitment of inner node")
+		}
+	case *leaf:
+		if n.version != version {
+			return nil, fmt.Errorf("leaf node is shared with other versions")
+		}
+		if len(commitments) < 3 {
+			return nil, fmt.Errorf("missing commitments of leaf node")
+		}
+		n.commitment = commitments[0]
+		n.halves = [2]commit.Commitment{commitments[1], commitments[2]}
+		commitments = commitments[3:]
+		n.previous = nil
+		n.commitmentClean = true
+		if check() {
+			values := n.getSubValues()
+			if !commit.Commit(values[0]).Equal(n.halves[0]) ||
+				!commit.Commit(values[1]).Equal(n.halves[1]) ||
+				!commit.Commit(n.getValues(n.halves[0], n.halves[1])).Equal(n.commitment) {
+				return nil, fmt.Errorf("invalid commitment of leaf with stem %x", n.stem)
+			}
+		}
+	}
+	return commitments, nil
+}
@@ -0,0 +1,242 @@
+package trie
+
+import (
+	"testing"
+
+	"github.com/QoraNet/qoraDB/go/database/vt/commit"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTrie_PartitionCommitmentsAreProvenByRootCommitment(t *testing.T) {
+	require := require.New(t)
+
+	trie := &Trie{}
+	trie.Set(Key{1, 2}, Value{1})
+	trie.Set(Key{1, 3}, Value{2})
+	trie.Set(Key{2}, Value{3}) // a partition consisting of a single leaf
+	root := trie.Commit()
+
+	for _, prefix := range []byte{0, 1, 2, 255} {
+		partition := trie.GetPartitionCommitment(prefix)
+		opening, err := trie.OpenPartition(prefix)
+		require.NoError(err)
+
+		ok, err := VerifyPartition(root, prefix, partition, opening)
+		require.NoError(err)
+		require.True(ok, "prefix %d", prefix)
+
+		// The opening does not prove other positions or commitments.
+		ok, _ = VerifyPartition(root, prefix+1, partition, opening)
+		require.False(ok, "prefix %d", prefix)
+		ok, _ = VerifyPartition(root, prefix, commit.Commit([commit.VectorSize]commit.Value{commit.NewValue(1)}), opening)
+		require.False(ok, "prefix %d", prefix)
+	}
+
+	require.True(trie.GetPartitionCommitment(0).Equal(commit.Identity()))
+	require.False(trie.GetPartitionCommitment(1).Equal(commit.Identity()))
+}
+
+func TestTrie_PartitionCommitmentOnlyDependsOnEntriesOfPartition(t *testing.T) {
+	require := require.New(t)
+
+	full := &Trie{}
+	for i := range 50 {
+		full.Set(Key{byte(i % 3), byte(i), 31: byte(i)}, Value{byte(i)})
+	}
+
+	for prefix := range byte(3) {
+		partition := &Trie{}
+		full.VisitPartition(prefix, func(key Key, value Value) bool {
+			partition.Set(key, value)
+			return true
+		})
+		require.True(full.GetPartitionCommitment(prefix).Equal(partition.GetPartitionCommitment(prefix)))
+	}
+}
+
+func TestTrie_VisitPartition_VisitsOnlyKeysWithPrefix(t *testing.T) {
+	require := require.New(t)
+
+	trie := &Trie{}
+	trie.Set(Key{1, 2}, Value{1})
+	trie.Set(Key{1, 1}, Value{2})
+	trie.Set(Key{2}, Value{3})
+
+	var keys []Key
+	trie.VisitPartition(1, func(key Key, _ Value) bool {
+		keys = append(keys, key)
+		return true
+	})
+	require.Equal([]Key{{1, 1}, {1, 2}}, keys)
+
+	keys = nil
+	trie.VisitPartition(3, func(key Key, _ Value) bool {
+		keys = append(keys, key)
+		return true
+	})
+	require.Empty(keys)
+}
+
+func TestPartition_CommitmentMatchesPartitionOfTrie(t *testing.T) {
+	require := require.New(t)
+
+	trie := &Trie{}
+	for i := range 100 {
+		trie.Set(Key{byte(i % 4), byte(i), 31: byte(i)}, Value{byte(i)})
+	}
+	trie.Set(Key{4, 1}, Value{})    // a single key explicitly set to zero
+	trie.Set(Key{1, 2, 3}, Value{}) // a zero value next to other values
+
+	for prefix := range byte(6) {
+		partition := NewPartition(prefix)
+		trie.VisitPartition(prefix, func(key Key, value Value) bool {
+			require.NoError(partition.Set(key, value))
+			return true
+		})
+		require.True(trie.GetPartitionCommitment(prefix).Equal(partition.Commit()), "prefix %d", prefix)
+	}
+}
+
+func TestPartition_KeysOfOtherPartitionsAreRejected(t *testing.T) {
+	require := require.New(t)
+
+	partition := NewPartition(1)
+	require.NoError(partition.Set(Key{1, 2}, Value{1}))
+	require.Error(partition.Set(Key{2, 1}, Value{1}))
+
+	trie := &Trie{}
+	trie.Set(Key{1, 2}, Value{1})
+	require.True(trie.GetPartitionCommitment(1).Equal(partition.Commit()))
+}
+
+func TestTrie_PartitionNodeCommitmentsCanBeTransferredToOtherTries(t *testing.T) {
+	require := require.New(t)
+
+	source := &Trie{}
+	for i := range 100 {
+		source.Set(Key{byte(i % 3), byte(i % 7), 31: byte(i)}, Value{byte(i)})
+	}
+	want := source.Commit()
+
+	target := &Trie{}
+	source.Visit(func(key Key, value Value) bool {
+		target.Set(key, value)
+		return true
+	})
+	for prefix := range byte(4) {
+		commitments := source.GetPartitionNodeCommitments(prefix)
+		require.NoError(target.SetPartitionNodeCommitments(prefix, commitments, func() bool { return true }))
+	}
+	require.True(want.Equal(target.Commit()))
+
+	// Assigned commitments are the basis of later updates.
+	source.Set(Key{1, 2, 31: 3}, Value{42})
+	target.Set(Key{1, 2, 31: 3}, Value{42})
+	require.True(source.Commit().Equal(target.Commit()))
+}
+
+func TestTrie_SetPartitionNodeCommitments_DetectsInvalidCommitments(t *testing.T) {
+	require := require.New(t)
+
+	source := &Trie{}
+	for i := range 10 {
+		source.Set(Key{1, byte(i)}, Value{byte(i)})
+	}
+	commitments := source.GetPartitionNodeCommitments(1)
+	build := func() *Trie {
+		res := &Trie{}
+		source.Visit(func(key Key, value Value) bool {
+			res.Set(key, value)
+			return true
+		})
+		return res
+	}
+	always := func() bool { return true }
+
+	require.Error(build().SetPartitionNodeCommitments(1, commitments[1:], always))
+	require.Error(build().SetPartitionNodeCommitments(1, append(commitments, commit.Identity()), always))
+	require.Error(build().SetPartitionNodeCommitments(2, commitments, always))
+
+	for i := range commitments {
+		modified := append([]commit.Commitment(nil), commitments...)
+		modified[i] = commit.Identity()
+		require.Error(build().SetPartitionNodeCommitments(1, modified, always), "commitment %d", i)
+	}
+
+	// Nodes shared with other tries can not be modified.
+	shared := build()
+	shared.Clone()
+	require.Error(shared.SetPartitionNodeCommitments(1, commitments, always))
+}
+
+func TestPartition_NodeCommitmentsMatchPartitionOfTrie(t *testing.T) {
+	require := require.New(t)
+
+	trie := &Trie{}
+	for i := range 20 {
+		trie.Set(Key{5, byte(i % 4), 31: byte(i)}, Value{byte(i)})
+	}
+
+	partition := NewPartition(5)
+	trie.VisitPartition(5, func(key Key, value Value) bool {
+		require.NoError(partition.Set(key, value))
+		return true
+	})
+	want := trie.GetPartitionNodeCommitments(5)
+	got := partition.GetNodeCommitments()
+	require.Equal(len(want), len(got))
+	for i := range want {
+		require.True(want[i].Equal(got[i]), "commitment %d", i)
+	}
+	require.Empty(NewPartition(1).GetNodeCommitments())
+}
+
+func TestPartition_LeafDepthsReproducePartitionOfTrieWithDeletedKeys(t *testing.T) {
+	require := require.New(t)
+
+	trie := &Trie{}
+	for i := range 40 {
+		trie.Set(Key{byte(i % 2), byte(i % 5), byte(i), 31: byte(i)}, Value{byte(i)})
+	}
+	for prefix := range byte(2) {
+		trie.Set(Key{prefix, 7, 1}, Value{1})
+		trie.Set(Key{prefix, 7, 2}, Value{2})
+	}
+	trie.Set(Key{2, 1}, Value{1})
+	trie.Set(Key{2, 2}, Value{2})
+	trie.Commit()
+
+	// Deleting keys leaves single leaves below inner nodes at depth 2 and, for
+	// the last partition, below the partition's root.
+	for prefix := range byte(2) {
+		trie.Delete(Key{prefix, 7, 2})
+	}
+	trie.Delete(Key{2, 2})
+
+	for prefix := range byte(3) {
+		depths := trie.GetPartitionLeafDepths(prefix)
+		require.NotEmpty(depths, "prefix %d", prefix)
+
+		partition := NewPartition(prefix)
+		trie.VisitPartition(prefix, func(key Key, value Value) bool {
+			require.NoError(partition.Set(key, value))
+			return true
+		})
+		require.NoError(partition.SetLeafDepths(depths))
+		require.True(trie.GetPartitionCommitment(prefix).Equal(partition.Commit()), "prefix %d", prefix)
+
+		want := trie.GetPartitionNodeCommitments(prefix)
+		got := partition.GetNodeCommitments()
+		require.Equal(len(want), len(got), "prefix %d", prefix)
+	}
+}
+
+func TestPartition_SetLeafDepths_RejectsLeavesOfOtherPartitions(t *testing.T) {
+	require := require.New(t)
+
+	partition := NewPartition(1)
+	require.NoError(partition.Set(Key{1, 2}, Value{1}))
+	require.Error(partition.SetLeafDepths([]LeafDepth{{Stem: [31]byte{2}, Depth: 2}}))
+	require.Error(partition.SetLeafDepths([]LeafDepth{{Stem: [31]byte{1, 3}, Depth: 2}}))
+	require.NoError(partition.SetLeafDepths([]LeafDepth{{Stem: [31]byte{1, 2}, Depth: 2}}))
+}
@@ -0,0 +1,346 @@
+package trie
+
+import (
+	"bytes"
+	"slices"
+
+	"github.com/QoraNet/qoraDB/go/database/vt/commit"
+)
+
+// Proof is a cryptographic proof for the values associated with a set of keys
+// in a trie with a given root commitment. For each key, it contains the
+// commitments of the nodes on the path from the root towards the key, which
+// are linked by claims stating that each of those nodes is referenced by its
+// parent. If the path ends in a leaf, the claims also cover the leaf's stem
+// and the value stored for the key. Proofs thus cover present as well as
+// absent keys.
+//
+// All claims of a proof are proven by a single multi-opening, such that the
+// size of the proof and the time needed for verifying it are dominated by a
+// single opening, independently of the number of keys and the depth of their
+// paths. When verifying the proof, the claims of each path are derived from
+// the path itself and checked to be among the proven claims, such that the
+// paths can not be altered without invalidating the proof.
+type Proof struct {
+	root    commit.Commitment
+	paths   map[Key]path
+	claims  []commit.Claim      // all claims proven by the opening, in the order of its queries
+	opening commit.MultiOpening // proves all claims, unset if there are none
+}
+
+// path summarizes the nodes visited when looking up a single key in the trie.
+type path struct {
+	inner []commit.Commitment // commitments of inner nodes, starting at the root
+	leaf  *leafProof          // the leaf at the end of the path, nil if none
+}
+
+// leafProof summarizes the leaf at the end of a path in the trie.
+type leafProof struct {
+	stem       [31]byte
+	commitment commit.Commitment
+	// The following fields are only set if the stem matches the key's stem.
+	half  commit.Commitment // C1 or C2, whichever covers the key's suffix
+	value Value
+	used  bool
+}
+
+// claim states that a commitment has a given value at a given position.
+type claim struct {
+	claimTarget
+	value commit.Value
+}
+
+// claimTarget identifies a position in a committed vector.
+type claimTarget struct {
+	commitment [32]byte // in compressed form
+	position   byte
+}
+
+// CreateProof creates a proof for the values associated with the given keys.
+// The resulting proof is valid for the current commitment of the trie.
+func (t *Trie) CreateProof(keys ...Key) (*Proof, error) {
+	var root node = t.root
+	if root == nil {
+		root = &inner{}
+	}
+
+	proof := &Proof{
+		root:  root.commit(),
+		paths: map[Key]path{},
+	}
+	vectors := map[[32]byte][256]commit.Value{}
+	covered := map[claimTarget]bool{}
+	queries := []commit.Query{}
+	for _, key := range keys {
+		if _, found := proof.paths[key]; found {
+			continue
+		}
+		path := getPath(root, key, vectors)
+		proof.paths[key] = path
+		for _, claim := range getClaims(key, path) {
+			if covered[claim.claimTarget] {
+				continue
+			}
+			commitment, found := path.getCommitment(claim.commitment)
+			if !found {
+				continue // can not happen for claims derived from the path
+			}
+			covered[claim.claimTarget] = true
+			queries = append(queries, commit.Query{
+				Commitment: commitment,
+				Values:     vectors[claim.commitment],
+				Position:   claim.position,
+			})
+			proof.claims = append(proof.claims, commit.Claim{
+				Commitment: commitment,
+				Position:   claim.position,
+				Value:      claim.value,
+			})
+		}
+	}
+	if len(queries) == 0 {
+		return proof, nil
+	}
+	opening, err := commit.OpenMulti(queries...)
+	if err != nil {
+		return nil, err
+	}
+	proof.opening = opening
+	return proof, nil
+}
+
+// getPath collects the nodes on the path from the given root towards the
+// given key. The vectors committed to by the visited nodes are recorded in the
+// given map, indexed by the compressed form of their commitments.
+func getPath(root node, key Key, vectors map[[32]byte][256]commit.Value) path {
+	res := path{}
+	next := root
+	for depth := 0; next != nil; depth++ {
+		switch n := next.(type) {
+		case *inner:
+			commitment := n.commit() // also updates the cached child values
+			res.inner = append(res.inner, commitment)
+			vectors[commitment.Compress()] = n.childValues
+			next = n.children[key[depth]]
+		case *leaf:
+			proof := &leafProof{
+				stem:       n.stem,
+				commitment: n.commit(), // also updates the cached halves
+			}
+			halves := n.getSubValues()
+			vectors[proof.commitment.Compress()] = n.getValues(n.halves[0], n.halves[1])
+			if bytes.Equal(key[:31], n.stem[:]) {
+				suffix := key[31]
+				proof.half = n.halves[suffix/128]
+				proof.value = n.values[suffix]
+				proof.used = n.isUsed(suffix)
+				vectors[proof.half.Compress()] = halves[suffix/128]
+			}
+			res.leaf = proof
+			next = nil
+		}
+	}
+	return res
+}
+
+// getCommitment looks up a commitment on this path by its compressed form.
+func (p *path) getCommitment(compressed [32]byte) (commit.Commitment, bool) {
+	candidates := slices.Clone(p.inner)
+	if p.leaf != nil {
+		candidates = append(candidates, p.leaf.commitment)
+		if p.leaf.half.IsValid() {
+			candidates = append(candidates, p.leaf.half)
+		}
+	}
+	for _, candidate := range candidates {
+		if candidate.Compress() == compressed {
+			return candidate, true
+		}
+	}
+	return commit.Commitment{}, false
+}
+
+// isWellFormed checks structural properties of a path that are not covered by
+// the commitments, namely that it starts at an inner node, is not longer than
+// a key, and only ends in a leaf whose stem is consistent with the traversed
+// positions.
+func (p *path) isWellFormed(key Key) bool {
+	if len(p.inner) == 0 || len(p.inner) > 31 {
+		return false
+	}
+	for _, commitment := range p.inner {
+		if !commitment.IsValid() {
+			return false
+		}
+	}
+	if p.leaf == nil {
+		return true
+	}
+	if !p.leaf.commitment.IsValid() {
+		return false
+	}
+	depth := len(p.inner)
+	if !bytes.Equal(p.leaf.stem[:depth], key[:depth]) {
+		return false
+	}
+	if bytes.Equal(p.leaf.stem[:], key[:31]) && !p.leaf.half.IsValid() {
+		return false
+	}
+	return true
+}
+
+// getClaims derives the claims to be proven for the given key and path. The
+// claims link the commitments along the path from the root to the end of the
+// path and, if the path ends in the key's leaf, to the key's value.
+func getClaims(key Key, path path) []claim {
+	res := []claim{}
+	add := func(commitment commit.Commitment, position byte, value commit.Value) {
+		res = append(res, claim{
+			claimTarget: claimTarget{
+				commitment: commitment.Compress(),
+				position:   position,
+			},
+			value: value,
+		})
+	}
+
+	// Each inner node references the next node on the path, the last one
+	// either references the leaf or has an empty slot at the key's position.
+	for i, commitment := range path.inner {
+		var next commit.Value
+		if i+1 < len(path.inner) {
+			next = path.inner[i+1].ToValue()
+		} else if path.leaf != nil {
+			next = path.leaf.commitment.ToValue()
+		}
+		add(commitment, key[i], next)
+	}
+	if path.leaf == nil {
+		return res
+	}
+
+	// The leaf commitment covers the marker and the stem. If the stem
+	// differs from the key's stem, the key is not present in the trie.
+	leaf := path.leaf
+	add(leaf.commitment, 0, commit.NewValue(1))
+	add(leaf.commitment, 1, commit.NewValueFromLittleEndianBytes(leaf.stem[:]))
+	if !bytes.Equal(key[:31], leaf.stem[:]) {
+		return res
+	}
+
+	// For a matching stem, the value is proven through C1 or C2.
+	suffix := key[31]
+	lower, upper := splitValue(leaf.value, leaf.used)
+	add(leaf.commitment, 2+suffix/128, leaf.half.ToValue())
+	add(leaf.half, 2*(suffix%128), lower)
+	add(leaf.half, 2*(suffix%128)+1, upper)
+	return res
+}
+
+// Root returns the root commitment this proof has been created for.
+func (p *Proof) Root() commit.Commitment {
+	return p.root
+}
+
+// Get returns the value proven for the given key. The second result is false
+// if the key is not covered by this proof. Keys proven to be absent are
+// reported with the zero value.
+func (p *Proof) Get(key Key) (Value, bool) {
+	path, found := p.paths[key]
+	if !found {
+		return Value{}, false
+	}
+	leaf := path.leaf
+	if leaf == nil || !leaf.used || !bytes.Equal(key[:31], leaf.stem[:]) {
+		return Value{}, true
+	}
+	return leaf.value, true
+}
+
+// Verify checks that this proof is a valid proof for a trie with the given
+// root commitment. All values reported by Get may only be trusted if this
+// check succeeds.
+func (p *Proof) Verify(root commit.Commitment) (bool, error) {
+	if !p.root.Equal(root) {
+		return false, nil
+	}
+
+	// Each claim derived from the paths has to be among the proven claims.
+	proven := make(map[claimTarget]commit.Value, len(p.claims))
+	for _, claim := range p.claims {
+		target := claimTarget{commitment: claim.Commitment.Compress(), position: claim.Position}
+		if value, found := proven[target]; found && value != claim.Value {
+			return false, nil
+		}
+		proven[target] = claim.Value
+	}
+	for key, path := range p.paths {
+		if !path.isWellFormed(key) || !path.inner[0].Equal(p.root) {
+			return false, nil
+		}
+		for _, claim := range getClaims(key, path) {
+			if value, found := proven[claim.claimTarget]; !found || value != claim.value {
+				return false, nil
+			}
+		}
+	}
+
+	// Every path contributes at least one claim, so there is nothing to
+	// verify if there are no claims.
+	if len(p.claims) == 0 {
+		return true, nil
+	}
+	return p.opening.Verify(p.claims...)
+}
+
+// Extract creates a proof covering only the given keys. The second result is
+// false if some of the keys are not covered by this proof. Since the claims
+// of all keys are proven by a single opening, the extracted proof retains the
+// claims and the opening of this proof.
+func (p *Proof) Extract(keys ...Key) (*Proof, bool) {
+	res := &Proof{
+		root:    p.root,
+		paths:   map[Key]path{},
+		claims:  p.claims,
+		opening: p.opening,
+	}
+	complete := true
+	for _, key := range keys {
+		path, found := p.paths[key]
+		if !found {
+			complete = false
+			continue
+		}
+		res.paths[key] = path
+	}
+	return res, complete
+}
+
+// Commitments returns the commitments of all nodes covered by this proof,
+// ordered by their compressed form.
+func (p *Proof) Commitments() []commit.Commitment {
+	unique := map[[32]byte]commit.Commitment{}
+	for _, path := range p.paths {
+		for _, commitment := range path.inner {
+			unique[commitment.Compress()] = commitment
+		}
+		if leaf := path.leaf; leaf != nil {
+			unique[leaf.commitment.Compress()] = leaf.commitment
+			if leaf.half.IsValid() {
+				unique[leaf.half.Compress()] = leaf.half
+			}
+		}
+	}
+	keys := make([][32]byte, 0, len(unique))
+	for key := range unique {
+		keys = append(keys, key)
+	}
+	slices.SortFunc(keys, func(a, b [32]byte) int {
+		return bytes.Compare(a[:], b[:])
+	})
+	res := make([]commit.Commitment, 0, len(keys))
+	for _, key := range keys {
+		res = append(res, unique[key])
+	}
+	return res
+}
@@ -0,0 +1,261 @@
+package trie
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/QoraNet/qoraDB/go/database/vt/commit"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProof_CanProvePresentValues(t *testing.T) {
+	require := require.New(t)
+
+	trie := &Trie{}
+	trie.Set(Key{1}, Value{1})
+	trie.Set(Key{2}, Value{2})
+	trie.Set(Key{1, 31: 200}, Value{3})
+	trie.Set(Key{1, 2, 3}, Value{4})
+
+	keys := []Key{{1}, {2}, {1, 31: 200}, {1, 2, 3}}
+	proof, err := trie.CreateProof(keys...)
+	require.NoError(err)
+
+	ok, err := proof.Verify(trie.Commit())
+	require.NoError(err)
+	require.True(ok)
+
+	for _, key := range keys {
+		value, covered := proof.Get(key)
+		require.True(covered)
+		require.Equal(trie.Get(key), value)
+	}
+}
+
+func TestProof_CanProveAbsentValues(t *testing.T) {
+	require := require.New(t)
+
+	trie := &Trie{}
+	trie.Set(Key{1}, Value{1})
+	trie.Set(Key{1, 2}, Value{2})
+
+	keys := []Key{
+		{2},          // < empty slot in the root node
+		{1, 3},       // < leaf with a different stem
+		{1, 31: 100}, // < unused suffix in a leaf with the same stem
+	}
+	proof, err := trie.CreateProof(keys...)
+	require.NoError(err)
+
+	ok, err := proof.Verify(trie.Commit())
+	require.NoError(err)
+	require.True(ok)
+
+	for _, key := range keys {
+		value, covered := proof.Get(key)
+		require.True(covered)
+		require.Zero(value)
+	}
+}
+
+func TestProof_CanProveAbsenceInEmptyTrie(t *testing.T) {
+	require := require.New(t)
+
+	trie := &Trie{}
+	proof, err := trie.CreateProof(Key{1})
+	require.NoError(err)
+
+	ok, err := proof.Verify(commit.Identity())
+	require.NoError(err)
+	require.True(ok)
+
+	value, covered := proof.Get(Key{1})
+	require.True(covered)
+	require.Zero(value)
+}
+
+func TestProof_KeysNotIncludedAreNotCovered(t *testing.T) {
+	require := require.New(t)
+
+	trie := &Trie{}
+	trie.Set(Key{1}, Value{1})
+	proof, err := trie.CreateProof(Key{1})
+	require.NoError(err)
+
+	_, covered := proof.Get(Key{2})
+	require.False(covered)
+}
+
+func TestProof_VerificationFailsForDifferentRoot(t *testing.T) {
+	require := require.New(t)
+
+	trie := &Trie{}
+	trie.Set(Key{1}, Value{1})
+	proof, err := trie.CreateProof(Key{1})
+	require.NoError(err)
+
+	trie.Set(Key{1}, Value{2})
+	ok, err := proof.Verify(trie.Commit())
+	require.NoError(err)
+	require.False(ok)
+}
+
+func TestProof_VerificationDetectsManipulatedValues(t *testing.T) {
+	require := require.New(t)
+
+	trie := &Trie{}
+	trie.Set(Key{1}, Value{1})
+	trie.Set(Key{2}, Value{2})
+	proof, err := trie.CreateProof(Key{1}, Key{2}, Key{3})
+	require.NoError(err)
+
+	manipulations := map[string]func(p *path){
+		"value": func(p *path) {
+			p.leaf.value = Value{3}
+		},
+		"used": func(p *path) {
+			p.leaf.used = !p.leaf.used
+		},
+		"stem": func(p *path) {
+			p.leaf.stem[30]++
+		},
+		"missing leaf": func(p *path) {
+			p.leaf = nil
+		},
+	}
+
+	for name, manipulate := range manipulations {
+		t.Run(name, func(t *testing.T) {
+			manipulated, _ := proof.Extract(Key{1}, Key{2}, Key{3})
+			path := manipulated.paths[Key{1}]
+			leaf := *path.leaf
+			path.leaf = &leaf
+			manipulate(&path)
+			manipulated.paths[Key{1}] = path
+
+			ok, err := manipulated.Verify(trie.Commit())
+			require.NoError(err)
+			require.False(ok)
+		})
+	}
+}
+
+func TestProof_Extract_ProducesVerifiableSubProof(t *testing.T) {
+	require := require.New(t)
+
+	trie := &Trie{}
+	trie.Set(Key{1}, Value{1})
+	trie.Set(Key{2}, Value{2})
+	trie.Set(Key{3}, Value{3})
+	proof, err := trie.CreateProof(Key{1}, Key{2}, Key{3})
+	require.NoError(err)
+
+	sub, complete := proof.Extract(Key{1}, Key{3})
+	require.True(complete)
+	require.Len(sub.paths, 2)
+
+	ok, err := sub.Verify(trie.Commit())
+	require.NoError(err)
+	require.True(ok)
+
+	_, covered := sub.Get(Key{2})
+	require.False(covered)
+	value, covered := sub.Get(Key{3})
+	require.True(covered)
+	require.Equal(Value{3}, value)
+
+	_, complete = proof.Extract(Key{1}, Key{4})
+	require.False(complete)
+}
+
+func TestProof_CreateProof_ProvesAllClaimsWithSingleOpening(t *testing.T) {
+	require := require.New(t)
+
+	trie := &Trie{}
+	for i := range 16 {
+		trie.Set(Key{byte(i)}, Value{byte(i + 1)})
+	}
+	keys := []Key{}
+	for i := range 20 {
+		keys = append(keys, Key{byte(i)})
+	}
+	proof, err := trie.CreateProof(keys...)
+	require.NoError(err)
+
+	// Claims shared by multiple paths, like those of the root, are only
+	// included once.
+	unique := map[claimTarget]bool{}
+	for key, path := range proof.paths {
+		for _, claim := range getClaims(key, path) {
+			unique[claim.claimTarget] = true
+		}
+	}
+	require.Len(proof.claims, len(unique))
+
+	ok, err := proof.Verify(trie.Commit())
+	require.NoError(err)
+	require.True(ok)
+}
+
+func TestProof_Verify_DetectsManipulatedClaims(t *testing.T) {
+	require := require.New(t)
+
+	trie := &Trie{}
+	trie.Set(Key{1}, Value{1})
+	trie.Set(Key{2}, Value{2})
+	proof, err := trie.CreateProof(Key{1}, Key{2})
+	require.NoError(err)
+
+	manipulations := map[string]func(claims []commit.Claim) []commit.Claim{
+		"modified value": func(claims []commit.Claim) []commit.Claim {
+			claims[len(claims)-1].Value = commit.NewValue(42)
+			return claims
+		},
+		"missing claim": func(claims []commit.Claim) []commit.Claim {
+			return claims[:len(claims)-1]
+		},
+		"swapped claims": func(claims []commit.Claim) []commit.Claim {
+			claims[0], claims[1] = claims[1], claims[0]
+			return claims
+		},
+	}
+
+	for name, manipulate := range manipulations {
+		t.Run(name, func(t *testing.T) {
+			manipulated := *proof
+			manipulated.claims = manipulate(slices.Clone(proof.claims))
+
+			ok, err := manipulated.Verify(trie.Commit())
+			require.NoError(err)
+			require.False(ok)
+		})
+	}
+}
+
+func TestProof_Verify_EmptyProofIsValid(t *testing.T) {
+	require := require.New(t)
+
+	trie := &Trie{}
+	trie.Set(Key{1}, Value{1})
+	proof, err := trie.CreateProof()
+	require.NoError(err)
+
+	ok, err := proof.Verify(trie.Commit())
+	require.NoError(err)
+	require.True(ok)
+}
+
+func TestProof_Commitments_ContainsAllNodesOnPaths(t *testing.T) {
+	require := require.New(t)
+
+	trie := &Trie{}
+	trie.Set(Key{1}, Value{1})
+	trie.Set(Key{2}, Value{2})
+	proof, err := trie.CreateProof(Key{1})
+	require.NoError(err)
+
+	// root, leaf, and C1 of the leaf
+	commitments := proof.Commitments()
+	require.Len(commitments, 3)
+	require.Contains(commitments, trie.Commit())
+}
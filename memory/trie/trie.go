@@ -1,7 +1,11 @@
-
 package trie
 
 import (
+	"bytes"
+	"fmt"
+	"runtime"
+	"sync/atomic"
+
 	"github.com/QoraNet/qoraDB/go/database/vt/commit"
 )
 
@@ -22,8 +26,78 @@ type Value [32]byte
 //
 // For an overview of the Verkle trie structure, see
 // https://blog.ethereum.org/2021/12/02/verkle-tree-structure
+//
+// Tries support cheap copies through Clone. Copies share all nodes until they
+// are modified, at which point the nodes on the path to the modified key are
+// copied. Thus, retaining copies of a trie costs memory proportional to the
+// number of modifications applied since, rather than to the size of the trie.
 type Trie struct {
-	root node
+	root        node
+	parallelism int           // maximum number of goroutines used by Commit, 0 for default
+	version     atomic.Uint64 // nodes tagged with this version are exclusively owned by this trie
+}
+
+// versionCounter is the source of unique trie versions assigned by Clone.
+// Version 0 is used by tries that have never been cloned.
+var versionCounter atomic.Uint64
+
+// Clone creates an independent copy of this trie in constant time. Nodes are
+// shared between the original and the copy until they are modified through
+// either of them. Both tries may be used concurrently, as long as each of
+// them is used by a single goroutine at a time.
+func (t *Trie) Clone() *Trie {
+	// Commitments are computed before nodes become shared, such that shared
+	// nodes are never modified -- not even by lazily computing commitments.
+	t.Commit()
+	res := &Trie{root: t.root, parallelism: t.parallelism}
+	res.version.Store(versionCounter.Add(1))
+	t.version.Store(versionCounter.Add(1))
+	return res
+}
+
+// CountNodesNotSharedWith returns the number of inner nodes and leaves of this
+// trie which are not shared with the given trie, e.g. a version of the trie
+// cloned before. These nodes have been copied or created since, and are only
+// retained in memory by this trie. If the other trie is nil, all nodes are
+// counted.
+func (t *Trie) CountNodesNotSharedWith(other *Trie) (innerNodes, leafNodes int) {
+	var otherRoot node
+	if other != nil {
+		otherRoot = other.root
+	}
+	return countNodesNotSharedWith(t.root, otherRoot)
+}
+
+// countNodesNotSharedWith counts the nodes of the subtree rooted by n which
+// are not shared with the subtree rooted by other at the same position.
+func countNodesNotSharedWith(n, other node) (innerNodes, leafNodes int) {
+	if n == nil || n == other {
+		return 0, 0
+	}
+	cur, ok := n.(*inner)
+	if !ok {
+		return 0, 1
+	}
+	otherInner, _ := other.(*inner)
+	innerNodes = 1
+	for pos := range cur.children {
+		var otherChild node
+		if otherInner != nil {
+			otherChild = otherInner.children[pos]
+		}
+		i, l := countNodesNotSharedWith(cur.children[pos], otherChild)
+		innerNodes += i
+		leafNodes += l
+	}
+	return innerNodes, leafNodes
+}
+
+// SetParallelism sets the maximum number of goroutines used for computing
+// commitments of modified subtrees in Commit. A value of 1 disables parallel
+// processing. Values smaller than 1 reset the parallelism to the default,
+// which is the number of available CPUs.
+func (t *Trie) SetParallelism(parallelism int) {
+	t.parallelism = max(parallelism, 0)
 }
 
 // Get retrieves the value associated with the given key from the trie. All keys
@@ -35,19 +109,205 @@ func (t *Trie) Get(key Key) Value {
 	return t.root.get(key, 0)
 }
 
+// Lookup retrieves the value associated with the given key from the trie. The
+// second result reports whether the key is used, which is the case for keys
+// that have been set -- including keys explicitly set to the zero value -- and
+// not deleted since.
+func (t *Trie) Lookup(key Key) (Value, bool) {
+	next := t.root
+	for depth := 0; next != nil; depth++ {
+		switch n := next.(type) {
+		case *inner:
+			next = n.children[key[depth]]
+		case *leaf:
+			if !bytes.Equal(key[:31], n.stem[:]) {
+				return Value{}, false
+			}
+			suffix := key[31]
+			return n.values[suffix], n.isUsed(suffix)
+		}
+	}
+	return Value{}, false
+}
+
 // Set associates the given key with the specified value in the trie. If the key
 // already exists, its value will be updated.
 func (t *Trie) Set(key Key, value Value) {
+	version := t.version.Load()
 	if t.root == nil {
-		t.root = &inner{}
+		t.root = &inner{version: version}
+	}
+	t.root = t.root.set(key, 0, value, version)
+}
+
+// Delete removes the given key from the trie. Unlike setting a key to the
+// zero value, which still marks the key as used, deleted keys do not
+// contribute to the trie's commitment anymore. Leaves without remaining
+// values and inner nodes without remaining children are removed. Like in
+// go-verkle, inner nodes left with a single leaf are retained, so the
+// commitment matches the commitment of a go-verkle trie subjected to the
+// same operations, but generally not the commitment of a trie in which the
+// key was never set. Deleting a key that is not present in the trie is a
+// no-op.
+func (t *Trie) Delete(key Key) {
+	if _, used := t.Lookup(key); !used {
+		return
+	}
+	// The root is always an inner node. It is modified in place and only
+	// replaced if it is left without children.
+	version := t.version.Load()
+	root := t.root.(*inner).own(version)
+	if replacement, _ := root.delete(key, 0, version); replacement == nil {
+		t.root = nil
+	} else {
+		t.root = root
 	}
-	t.root = t.root.set(key, 0, value)
 }
 
 // Commit returns the cryptographic commitment of the current state of the trie.
+// Commitments of modified subtrees are computed in parallel, using up to the
+// configured number of goroutines. The result does not depend on the degree
+// of parallelism.
 func (t *Trie) Commit() commit.Commitment {
 	if t.root == nil {
 		return commit.Identity()
 	}
+	parallelism := t.parallelism
+	if parallelism == 0 {
+		parallelism = runtime.GOMAXPROCS(0)
+	}
+	if root, ok := t.root.(*inner); ok && parallelism > 1 {
+		// The current goroutine is counted as one of the workers.
+		root.commitChildren(make(chan struct{}, parallelism-1))
+	}
 	return t.root.commit()
 }
+
+// Visit calls the given visitor for every key that has been set in the trie,
+// in ascending key order. Keys that have been explicitly set to the zero value
+// are included, since they contribute to the trie's commitment. The iteration
+// stops early if the visitor returns false.
+//
+// The trie must not be modified by the visitor.
+func (t *Trie) Visit(visitor func(key Key, value Value) bool) {
+	if t.root == nil {
+		return
+	}
+	t.root.visit(visitor)
+}
+
+// LeafDepth records the depth of a leaf placed deeper in the trie than
+// required to distinguish its stem from the stems of all other leaves. Such
+// leaves are the result of deleting keys, since inner nodes left with a
+// single leaf are retained. The depth of a leaf is the number of inner nodes
+// on the path from the root to the leaf.
+//
+// A trie built by setting its entries has the minimal shape required by its
+// keys. The shape of any other trie with the same entries is described by
+// the list of its deeper leaves reported by GetLeafDepths, which can be
+// applied to the freshly built trie through SetLeafDepths to reproduce the
+// trie's shape and commitment.
+type LeafDepth struct {
+	Stem  [31]byte
+	Depth byte
+}
+
+// GetLeafDepths returns the depths of all leaves placed deeper than required
+// by their stems, in ascending order of their stems.
+func (t *Trie) GetLeafDepths() []LeafDepth {
+	root, ok := t.root.(*inner)
+	if !ok {
+		return nil
+	}
+	return appendLeafDepths(nil, root, 0)
+}
+
+// SetLeafDepths moves the leaves with the given stems down to the given
+// depths by inserting inner nodes above them, such that a trie built from
+// entries alone reproduces the shape described by the result of
+// GetLeafDepths of the original trie. The depths have to be listed in
+// strictly ascending order of their stems, and each leaf has to be moved
+// deeper than its current position. If an error is reported, the trie is
+// left with the depths listed before the offending one.
+func (t *Trie) SetLeafDepths(depths []LeafDepth) error {
+	version := t.version.Load()
+	for i, depth := range depths {
+		if i > 0 && bytes.Compare(depths[i-1].Stem[:], depth.Stem[:]) >= 0 {
+			return fmt.Errorf("leaf depth %d is not in increasing stem order", i)
+		}
+		if t.root == nil {
+			return fmt.Errorf("no leaf with stem %x", depth.Stem)
+		}
+		root, err := moveLeaf(t.root, 0, depth, version)
+		if err != nil {
+			return err
+		}
+		t.root = root
+	}
+	return nil
+}
+
+// appendLeafDepths appends the depths of all leaves below the given inner
+// node at the given depth that are placed deeper than required by their
+// stems. Those are the leaves being the only child of an inner node other
+// than the root, since inner nodes required by the stems of the trie have at
+// least two children.
+func appendLeafDepths(res []LeafDepth, n *inner, depth byte) []LeafDepth {
+	children := 0
+	for _, child := range n.children {
+		if child != nil {
+			children++
+		}
+	}
+	for _, child := range n.children {
+		switch child := child.(type) {
+		case *inner:
+			res = appendLeafDepths(res, child, depth+1)
+		case *leaf:
+			if depth > 0 && children == 1 {
+				res = append(res, LeafDepth{Stem: child.stem, Depth: depth + 1})
+			}
+		}
+	}
+	return res
+}
+
+// moveLeaf moves the leaf with the given stem in the subtree rooted by the
+// given node at the given depth down to the given target depth. It returns
+// the node replacing the given node in its parent.
+func moveLeaf(n node, depth byte, target LeafDepth, version uint64) (node, error) {
+	switch n := n.(type) {
+	case *inner:
+		pos := target.Stem[depth]
+		next := n.children[pos]
+		if next == nil {
+			return nil, fmt.Errorf("no leaf with stem %x", target.Stem)
+		}
+		replacement, err := moveLeaf(next, depth+1, target, version)
+		if err != nil {
+			return nil, err
+		}
+		n = n.own(version)
+		n.children[pos] = replacement
+		n.markDirty(pos)
+		return n, nil
+	case *leaf:
+		if n.stem != target.Stem {
+			return nil, fmt.Errorf("no leaf with stem %x", target.Stem)
+		}
+		if target.Depth <= depth || int(target.Depth) > len(target.Stem) {
+			return nil, fmt.Errorf("invalid depth %d for leaf with stem %x at depth %d", target.Depth, target.Stem, depth)
+		}
+		// The leaf itself is not modified, so it does not need to be owned
+		// by the given version.
+		var res node = n
+		for d := int(target.Depth) - 1; d >= int(depth); d-- {
+			parent := &inner{version: version}
+			parent.children[target.Stem[d]] = res
+			parent.markDirty(target.Stem[d])
+			res = parent
+		}
+		return res, nil
+	}
+	return nil, fmt.Errorf("no leaf with stem %x", target.Stem)
+}
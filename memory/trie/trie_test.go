@@ -1,10 +1,10 @@
-
 package trie
 
 import (
 	"testing"
 
 	"github.com/QoraNet/qoraDB/go/database/vt/commit"
+	"github.com/ethereum/go-verkle"
 	"github.com/stretchr/testify/require"
 )
 
@@ -93,6 +93,32 @@ func TestTrie_ManyValuesCanBeSetAndRetrieved(t *testing.T) {
 	}
 }
 
+func TestTrie_Lookup_ReportsWhetherKeysAreUsed(t *testing.T) {
+	require := require.New(t)
+
+	trie := &Trie{}
+	trie.Set(Key{1, 31: 1}, Value{1})
+	trie.Set(Key{1, 31: 2}, Value{})
+	trie.Set(Key{2, 31: 1}, Value{2})
+	trie.Delete(Key{2, 31: 1})
+
+	tests := map[Key]struct {
+		value Value
+		used  bool
+	}{
+		{1, 31: 1}: {Value{1}, true},
+		{1, 31: 2}: {Value{}, true},
+		{1, 31: 3}: {Value{}, false},
+		{2, 31: 1}: {Value{}, false},
+		{3}:        {Value{}, false},
+	}
+	for key, want := range tests {
+		value, used := trie.Lookup(key)
+		require.Equal(want.value, value, "key %x", key)
+		require.Equal(want.used, used, "key %x", key)
+	}
+}
+
 func TestTrie_SettingASingleValueProducesAnInnerNode(t *testing.T) {
 	require := require.New(t)
 
@@ -127,3 +153,415 @@ func TestTrie_CommitmentOfNonEmptyTrieIsRootNodeCommitment(t *testing.T) {
 	want := trie.root.commit()
 	require.True(have.Equal(want), "Commitment should match the root's commitment")
 }
+
+func TestTrie_Commit_ParallelismDoesNotAffectCommitment(t *testing.T) {
+	require := require.New(t)
+
+	tries := map[int]*Trie{}
+	for _, parallelism := range []int{1, 2, 4, 16} {
+		trie := &Trie{}
+		trie.SetParallelism(parallelism)
+		tries[parallelism] = trie
+	}
+
+	for round := range 3 {
+		for i := range 1000 {
+			key := Key{byte(i), byte(i >> 8), byte(round), 31: byte(i)}
+			for _, trie := range tries {
+				trie.Set(key, Value{byte(round), byte(i)})
+			}
+		}
+		want := tries[1].Commit()
+		for parallelism, trie := range tries {
+			require.True(want.Equal(trie.Commit()), "parallelism %d, round %d", parallelism, round)
+		}
+	}
+}
+
+func TestTrie_Clone_CopiesAreIndependent(t *testing.T) {
+	require := require.New(t)
+
+	original := &Trie{}
+	for i := range 100 {
+		original.Set(Key{byte(i), 31: byte(i)}, Value{byte(i + 1)})
+	}
+	want := original.Commit()
+
+	clone := original.Clone()
+	require.True(want.Equal(clone.Commit()))
+
+	clone.Set(Key{1, 31: 1}, Value{42})
+	clone.Set(Key{200}, Value{43})
+	clone.Delete(Key{2, 31: 2})
+
+	require.Equal(Value{2}, original.Get(Key{1, 31: 1}))
+	require.Equal(Value{}, original.Get(Key{200}))
+	require.Equal(Value{3}, original.Get(Key{2, 31: 2}))
+	require.True(want.Equal(original.Commit()))
+
+	require.Equal(Value{42}, clone.Get(Key{1, 31: 1}))
+	require.Equal(Value{43}, clone.Get(Key{200}))
+	require.Equal(Value{}, clone.Get(Key{2, 31: 2}))
+	require.False(want.Equal(clone.Commit()))
+}
+
+func TestTrie_Clone_OriginalCanBeModifiedWithoutAffectingCopies(t *testing.T) {
+	require := require.New(t)
+
+	original := &Trie{}
+	original.Set(Key{1}, Value{1})
+	original.Set(Key{1, 31: 1}, Value{2})
+
+	copies := []*Trie{}
+	commitments := []commit.Commitment{}
+	for i := range 10 {
+		copies = append(copies, original.Clone())
+		commitments = append(commitments, original.Commit())
+		original.Set(Key{1}, Value{byte(i + 2)})
+		original.Set(Key{byte(i + 2)}, Value{1})
+	}
+
+	for i, clone := range copies {
+		require.Equal(Value{byte(i + 1)}, clone.Get(Key{1}))
+		require.True(commitments[i].Equal(clone.Commit()), "copy %d", i)
+	}
+
+	// The commitment of a modified trie matches the one of a fresh trie.
+	fresh := &Trie{}
+	fresh.Set(Key{1}, Value{11})
+	fresh.Set(Key{1, 31: 1}, Value{2})
+	for i := range 10 {
+		fresh.Set(Key{byte(i + 2)}, Value{1})
+	}
+	require.True(fresh.Commit().Equal(original.Commit()))
+}
+
+func TestTrie_CountNodesNotSharedWith_CountsNodesModifiedSinceClone(t *testing.T) {
+	require := require.New(t)
+
+	original := &Trie{}
+	innerNodes, leafNodes := original.CountNodesNotSharedWith(nil)
+	require.Zero(innerNodes)
+	require.Zero(leafNodes)
+
+	// Keys {1, 2} and {1, 3} share the first inner node below the root.
+	original.Set(Key{1, 2}, Value{1})
+	original.Set(Key{1, 3}, Value{1})
+	for i := range 10 {
+		original.Set(Key{byte(i + 2)}, Value{1})
+	}
+	innerNodes, leafNodes = original.CountNodesNotSharedWith(nil)
+	require.Equal(2, innerNodes)
+	require.Equal(12, leafNodes)
+
+	clone := original.Clone()
+	innerNodes, leafNodes = clone.CountNodesNotSharedWith(original)
+	require.Zero(innerNodes)
+	require.Zero(leafNodes)
+
+	// Modifying a leaf copies the leaf and the inner nodes on its path.
+	clone.Set(Key{1, 2, 31: 1}, Value{2})
+	innerNodes, leafNodes = clone.CountNodesNotSharedWith(original)
+	require.Equal(2, innerNodes)
+	require.Equal(1, leafNodes)
+
+	// Nodes modified through the other trie are no longer shared either.
+	clone.Set(Key{5}, Value{2})
+	original.Set(Key{6}, Value{2})
+	innerNodes, leafNodes = clone.CountNodesNotSharedWith(original)
+	require.Equal(2, innerNodes)
+	require.Equal(3, leafNodes)
+}
+
+func TestTrie_Visit_EmptyTrieHasNoEntries(t *testing.T) {
+	trie := &Trie{}
+	trie.Visit(func(Key, Value) bool {
+		t.Fatal("visitor should not be called for an empty trie")
+		return true
+	})
+}
+
+func TestTrie_Visit_EnumeratesAllSetKeysInOrder(t *testing.T) {
+	require := require.New(t)
+
+	keys := []Key{
+		{0, 31: 1},
+		{0, 31: 2},
+		{1, 2, 3, 31: 4},
+		{1, 2, 4, 31: 4},
+		{255, 31: 255},
+	}
+
+	trie := &Trie{}
+	for i := len(keys) - 1; i >= 0; i-- {
+		trie.Set(keys[i], Value{byte(i)})
+	}
+
+	var got []Key
+	trie.Visit(func(key Key, value Value) bool {
+		require.Equal(trie.Get(key), value)
+		got = append(got, key)
+		return true
+	})
+	require.Equal(keys, got)
+}
+
+func TestTrie_Visit_ProducesEntriesReproducingTheCommitment(t *testing.T) {
+	require := require.New(t)
+
+	original := &Trie{}
+	for i := range 500 {
+		key := Key{byte(i), byte(i >> 3), byte(i * 7), 31: byte(i * 13)}
+		value := Value{}
+		if i%5 != 0 { // < some keys are explicitly set to zero
+			value = Value{byte(i), 31: 1}
+		}
+		original.Set(key, value)
+	}
+
+	restored := &Trie{}
+	original.Visit(func(key Key, value Value) bool {
+		restored.Set(key, value)
+		return true
+	})
+
+	want := original.Commit()
+	have := restored.Commit()
+	require.True(want.Equal(have), "restored trie should have the same commitment")
+}
+
+func TestTrie_Delete_RemovesValues(t *testing.T) {
+	require := require.New(t)
+
+	trie := &Trie{}
+	trie.Set(Key{1}, Value{1})
+	trie.Set(Key{2}, Value{2})
+
+	trie.Delete(Key{1})
+	require.Zero(trie.Get(Key{1}))
+	require.Equal(Value{2}, trie.Get(Key{2}))
+
+	var keys []Key
+	trie.Visit(func(key Key, _ Value) bool {
+		keys = append(keys, key)
+		return true
+	})
+	require.Equal([]Key{{2}}, keys)
+}
+
+func TestTrie_Delete_DeletingMissingKeysIsNoOp(t *testing.T) {
+	require := require.New(t)
+
+	trie := &Trie{}
+	trie.Delete(Key{1})
+	require.True(trie.Commit().Equal(commit.Identity()))
+
+	trie.Set(Key{1}, Value{1})
+	before := trie.Commit()
+	trie.Delete(Key{2})
+	trie.Delete(Key{1, 31: 1})
+	require.True(before.Equal(trie.Commit()))
+}
+
+func TestTrie_Delete_DeletingAllKeysProducesEmptyCommitment(t *testing.T) {
+	require := require.New(t)
+
+	trie := &Trie{}
+	keys := []Key{{1}, {1, 31: 1}, {1, 2}, {2}}
+	for _, key := range keys {
+		trie.Set(key, Value{1})
+	}
+	trie.Commit()
+
+	for _, key := range keys {
+		trie.Delete(key)
+	}
+	require.True(trie.Commit().Equal(commit.Identity()))
+}
+
+func TestTrie_Delete_CommitmentsMatchGoVerkleAfterManyDeletions(t *testing.T) {
+	require := require.New(t)
+
+	// Keys share prefixes of various lengths, such that deletions leave
+	// inner nodes with single leaves behind.
+	toKey := func(i int) Key {
+		return Key{byte(i % 7), byte(i % 3), byte(i), 31: byte(i % 5)}
+	}
+
+	const N = 200
+	trie := &Trie{}
+	reference := verkle.New()
+	for i := range N {
+		key, value := toKey(i), Value{byte(i), 1}
+		trie.Set(key, value)
+		require.NoError(reference.Insert(key[:], value[:], nil))
+	}
+	require.Equal(reference.Commit().Bytes(), trie.Commit().Compress())
+
+	for i := range N {
+		if i%3 != 0 {
+			continue
+		}
+		key := toKey(i)
+		trie.Delete(key)
+		_, err := reference.Delete(key[:], nil)
+		require.NoError(err)
+	}
+
+	for i := range N {
+		want, err := reference.Get(toKey(i)[:], nil)
+		require.NoError(err)
+		if i%3 == 0 {
+			require.Nil(want)
+		}
+		got, used := trie.Lookup(toKey(i))
+		require.Equal(want != nil, used)
+		if used {
+			require.Equal(want, got[:])
+		}
+	}
+	require.Equal(reference.Commit().Bytes(), trie.Commit().Compress())
+}
+
+func TestTrie_Delete_CommitmentsMatchGoVerkle(t *testing.T) {
+	tests := map[string]struct {
+		set    []Key
+		delete []Key
+	}{
+		"single value of leaf": {
+			set:    []Key{{1, 31: 1}, {1, 31: 2}},
+			delete: []Key{{1, 31: 1}},
+		},
+		"all values in lower half of leaf": {
+			set:    []Key{{1, 31: 1}, {1, 31: 200}},
+			delete: []Key{{1, 31: 1}},
+		},
+		"all values in upper half of leaf": {
+			set:    []Key{{1, 31: 1}, {1, 31: 200}},
+			delete: []Key{{1, 31: 200}},
+		},
+		"entire leaf": {
+			set:    []Key{{1, 31: 1}, {2, 31: 1}},
+			delete: []Key{{1, 31: 1}},
+		},
+		"all leaves": {
+			set:    []Key{{1, 31: 1}, {2, 31: 1}},
+			delete: []Key{{1, 31: 1}, {2, 31: 1}},
+		},
+		"missing key": {
+			set:    []Key{{1, 31: 1}},
+			delete: []Key{{1, 31: 2}, {2}},
+		},
+		"leaf sharing a prefix with another leaf": {
+			set:    []Key{{1, 1, 31: 1}, {1, 2, 31: 1}},
+			delete: []Key{{1, 1, 31: 1}},
+		},
+		"leaves sharing a prefix with multiple leaves": {
+			set:    []Key{{1, 1, 1, 31: 1}, {1, 1, 2, 31: 1}, {1, 2, 31: 1}},
+			delete: []Key{{1, 1, 1, 31: 1}, {1, 2, 31: 1}},
+		},
+		"all leaves sharing a prefix": {
+			set:    []Key{{1, 1, 1, 31: 1}, {1, 1, 2, 31: 1}, {2, 31: 1}},
+			delete: []Key{{1, 1, 1, 31: 1}, {1, 1, 2, 31: 1}},
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			require := require.New(t)
+
+			trie := &Trie{}
+			reference := verkle.New()
+			for i, key := range test.set {
+				value := Value{byte(i + 1)}
+				trie.Set(key, value)
+				require.NoError(reference.Insert(key[:], value[:], nil))
+			}
+			trie.Commit()
+			reference.Commit()
+
+			for _, key := range test.delete {
+				trie.Delete(key)
+				_, err := reference.Delete(key[:], nil)
+				require.NoError(err)
+			}
+
+			want := reference.Commit().Bytes()
+			have := trie.Commit().Compress()
+			require.Equal(want, have)
+		})
+	}
+}
+
+func TestTrie_Delete_RetainsInnerNodesWithSingleLeaf(t *testing.T) {
+	require := require.New(t)
+
+	keys := []Key{{1, 1, 31: 1}, {1, 2, 31: 1}}
+	trie := &Trie{}
+	for _, key := range keys {
+		trie.Set(key, Value{1})
+	}
+	trie.Delete(keys[0])
+
+	// The inner node at depth 1 is retained, so the remaining leaf is not
+	// moved up and the commitment differs from a trie built from scratch.
+	fresh := &Trie{}
+	fresh.Set(keys[1], Value{1})
+	require.False(fresh.Commit().Equal(trie.Commit()))
+	require.Equal([]LeafDepth{{Stem: [31]byte(keys[1][:31]), Depth: 2}}, trie.GetLeafDepths())
+	require.Empty(fresh.GetLeafDepths())
+}
+
+func TestTrie_SetLeafDepths_ReproducesShapeOfTrieWithDeletedKeys(t *testing.T) {
+	require := require.New(t)
+
+	toKey := func(i int) Key {
+		return Key{byte(i % 5), byte(i % 3), byte(i % 11), byte(i), 31: byte(i % 7)}
+	}
+	original := &Trie{}
+	for i := range 250 {
+		original.Set(toKey(i), Value{byte(i), 1})
+	}
+	original.Commit()
+	for i := range 250 {
+		if i%4 != 0 {
+			original.Delete(toKey(i))
+		}
+	}
+	depths := original.GetLeafDepths()
+	require.NotEmpty(depths)
+
+	restored := &Trie{}
+	original.Visit(func(key Key, value Value) bool {
+		restored.Set(key, value)
+		return true
+	})
+	require.False(original.Commit().Equal(restored.Commit()))
+
+	require.NoError(restored.SetLeafDepths(depths))
+	require.True(original.Commit().Equal(restored.Commit()))
+	require.Equal(depths, restored.GetLeafDepths())
+}
+
+func TestTrie_SetLeafDepths_RejectsInvalidDepths(t *testing.T) {
+	stem := func(key Key) [31]byte {
+		return [31]byte(key[:31])
+	}
+	tests := map[string][]LeafDepth{
+		"missing leaf":          {{Stem: stem(Key{3}), Depth: 2}},
+		"other leaf on path":    {{Stem: stem(Key{1, 2, 4}), Depth: 4}},
+		"depth not increased":   {{Stem: stem(Key{1, 2, 3}), Depth: 2}},
+		"depth beyond stem":     {{Stem: stem(Key{2}), Depth: 32}},
+		"duplicate leaf":        {{Stem: stem(Key{2}), Depth: 2}, {Stem: stem(Key{2}), Depth: 3}},
+		"decreasing stem order": {{Stem: stem(Key{2}), Depth: 2}, {Stem: stem(Key{1, 2, 3}), Depth: 4}},
+	}
+	for name, depths := range tests {
+		t.Run(name, func(t *testing.T) {
+			trie := &Trie{}
+			trie.Set(Key{1, 2, 3}, Value{1})
+			trie.Set(Key{1, 3}, Value{2})
+			trie.Set(Key{2}, Value{3})
+			require.Error(t, trie.SetLeafDepths(depths))
+		})
+	}
+}
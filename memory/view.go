@@ -0,0 +1,134 @@
+package memory
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+
+	"github.com/QoraNet/qoraDB/go/common"
+	"github.com/QoraNet/qoraDB/go/common/amount"
+	"github.com/QoraNet/qoraDB/go/database/vt/memory/trie"
+	"github.com/QoraNet/qoraDB/go/state"
+)
+
+// valueSource is a source of trie values the account and storage data of a
+// state is decoded from. It is implemented by the live state as well as by
+// views on archived blocks.
+type valueSource interface {
+	getValue(key trie.Key) (trie.Value, error)
+}
+
+// ArchiveView provides read access to the state of an archived block. Unlike
+// states obtained through GetArchiveState, a view does not create a copy of
+// the trie of the block. Instead, every query is answered directly from the
+// archive, which makes views suitable for individual lookups. Views remain
+// valid until the block is pruned from the archive.
+type ArchiveView struct {
+	archive *vtArchive
+	block   uint64
+}
+
+// GetArchiveView returns a view on the state after the given block. Like for
+// ResolveArchiveState, the block is resolved to the closest archived block at
+// or before the given block, which is reported by the view's GetBlock.
+func (s *State) GetArchiveView(block uint64) (*ArchiveView, error) {
+	if s.archive == nil {
+		return nil, state.NoArchiveError
+	}
+	source, found := s.archive.resolve(block)
+	if !found {
+		return nil, fmt.Errorf("no archived state for block %d", block)
+	}
+	return &ArchiveView{archive: s.archive, block: source}, nil
+}
+
+// GetBlock returns the number of the archived block the view is based on.
+func (v *ArchiveView) GetBlock() uint64 {
+	return v.block
+}
+
+func (v *ArchiveView) getValue(key trie.Key) (trie.Value, error) {
+	return v.archive.getValue(v.block, key)
+}
+
+func (v *ArchiveView) Exists(address common.Address) (bool, error) {
+	return exists(v, address)
+}
+
+func (v *ArchiveView) GetBalance(address common.Address) (amount.Amount, error) {
+	return getBalance(v, address)
+}
+
+func (v *ArchiveView) GetNonce(address common.Address) (common.Nonce, error) {
+	return getNonce(v, address)
+}
+
+func (v *ArchiveView) GetStorage(address common.Address, key common.Key) (common.Value, error) {
+	return getStorage(v, address, key)
+}
+
+func (v *ArchiveView) GetCode(address common.Address) ([]byte, error) {
+	return getCode(v, address)
+}
+
+func (v *ArchiveView) GetCodeSize(address common.Address) (int, error) {
+	return getCodeSize(v, address)
+}
+
+func (v *ArchiveView) GetCodeHash(address common.Address) (common.Hash, error) {
+	return getCodeHash(v, address)
+}
+
+func (v *ArchiveView) GetHash() (common.Hash, error) {
+	commitment, err := v.archive.getCommitment(v.block)
+	return common.Hash(commitment), err
+}
+
+// --- Decoding of account and storage data ---
+
+func exists(source valueSource, address common.Address) (bool, error) {
+	value, err := source.getValue(getBasicDataKey(address))
+	var empty [24]byte // nonce and balance are layed out in bytes 8-32
+	return !bytes.Equal(value[8:32], empty[:]), err
+}
+
+func getBalance(source valueSource, address common.Address) (amount.Amount, error) {
+	value, err := source.getValue(getBasicDataKey(address))
+	return amount.NewFromBytes(value[16:32]...), err
+}
+
+func getNonce(source valueSource, address common.Address) (common.Nonce, error) {
+	value, err := source.getValue(getBasicDataKey(address))
+	return common.Nonce(value[8:16]), err
+}
+
+func getStorage(source valueSource, address common.Address, key common.Key) (common.Value, error) {
+	value, err := source.getValue(getStorageKey(address, key))
+	return common.Value(value), err
+}
+
+func getCode(source valueSource, address common.Address) ([]byte, error) {
+	size, err := getCodeSize(source, address)
+	if err != nil {
+		return nil, err
+	}
+	chunks := make([]chunk, 0, size/31+1)
+	for i := 0; i < size/31+1; i++ {
+		value, err := source.getValue(getCodeChunkKey(address, i))
+		if err != nil {
+			return nil, err
+		}
+		chunks = append(chunks, chunk(value))
+	}
+	return merge(chunks, size), nil
+}
+
+func getCodeSize(source valueSource, address common.Address) (int, error) {
+	value, err := source.getValue(getBasicDataKey(address))
+	return int(binary.BigEndian.Uint32(value[4:8])), err
+}
+
+func getCodeHash(source valueSource, address common.Address) (common.Hash, error) {
+	value, err := source.getValue(getCodeHashKey(address))
+	return common.Hash(value[:]), err
+}